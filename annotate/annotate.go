@@ -0,0 +1,274 @@
+// Package annotate は、期間や条件に一致する複数のデータポイントに対して、
+// コメントと表示/非表示状態をまとめて設定する機能を提供します。
+//
+// [ambidata.Sender.SetCmnt] と [ambidata.Sender.SetHide] は1回の呼び出しで
+// 1つの時刻のデータポイントのみを対象とするため、本パッケージは対象のデータポイントを
+// [ambidata.Fetcher.FetchPeriodAll] で取得し、一定の間隔を空けて1つずつ呼び出します。
+// 既に目的の状態であるデータポイントは呼び出しを省略するため、
+// 中断した場合は同じ引数で再度実行することで続きから再開できます。
+//
+// 使用例:
+//
+//	res, err := annotate.Run(ctx, f, s, annotate.Action{Hide: ambidata.Just(true)}, &annotate.Options{
+//		Start: start,
+//		End:   end,
+//		Match: annotate.OutOfRange(ambidata.FieldD1, -40, 85),
+//	})
+package annotate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/migrate"
+)
+
+// DefaultInterval は [Options.Interval] のデフォルト値です。
+const DefaultInterval = time.Second
+
+// ErrVerify は設定後の照合で、目的の状態になっていないデータポイントが見つかった場合のエラーです。
+var ErrVerify = errors.New("annotate: verification failed")
+
+// Action はデータポイントに設定する内容です。
+// OK が false の項目は変更しません。
+type Action struct {
+	Cmnt ambidata.Maybe[string] // コメント
+	Hide ambidata.Maybe[bool]   // 非表示フラグ
+}
+
+// apply は data に a を適用した結果を返します。
+func (a *Action) apply(data ambidata.Data) ambidata.Data {
+	if a.Cmnt.OK {
+		data.Cmnt = a.Cmnt.V
+	}
+	if a.Hide.OK {
+		data.Hide = a.Hide.V
+	}
+	return data
+}
+
+// Predicate はデータポイントが対象となる場合に true を返す関数です。
+type Predicate func(data *ambidata.Data) bool
+
+// OutOfRange はデータ番号 f の値が lo 未満または hi を超えるデータポイントに一致する [Predicate] を返します。
+// 下限または上限を設けない場合は、 [math.Inf] を指定してください。
+// f の値が存在しないデータポイントには一致しません。
+func OutOfRange(f ambidata.Field, lo float64, hi float64) Predicate {
+	return func(data *ambidata.Data) bool {
+		v := data.Field(f)
+		return v.OK && (v.V < lo || v.V > hi)
+	}
+}
+
+// Options は一括設定に関する設定です。
+// ゼロ値の Options 構造体は、チャネルの全てのデータポイントを対象とする有効な構成となります。
+type Options struct {
+	// Start と End は対象とする期間です。
+	// Start がゼロ値の場合は最も古いデータから、 End がゼロ値の場合は最新のデータまでを対象とします。
+	Start time.Time
+	End   time.Time
+
+	// Match は対象とするデータポイントの条件です。
+	// nil の場合は、期間内の全てのデータポイントを対象とします。
+	Match Predicate
+
+	// Interval は [ambidata.Sender.SetCmnt] および [ambidata.Sender.SetHide] の呼び出し間隔です。
+	// 0 以下の場合は、 [DefaultInterval] が使用されます。
+	Interval time.Duration
+
+	// DryRun が true の場合、 [Run] は対象のデータポイントを決定するだけで、設定を行いません。
+	DryRun bool
+
+	// NoVerify が true の場合、 [Run] は設定後の照合を行いません。
+	NoVerify bool
+
+	// OnProgress は進捗が更新されるたびに呼び出される関数です。
+	// nil の場合は、何もしません。
+	OnProgress func(p Progress)
+
+	// Now は現在時刻を返す関数です。 End がゼロ値の場合の期間の決定に使用します。
+	// nil の場合は、 [time.Now] が使用されます。
+	Now func() time.Time
+}
+
+// Progress は一括設定の進捗です。
+type Progress struct {
+	Total   int // 対象のデータポイントの数
+	Done    int // 処理済みのデータポイントの数 (Skipped を含む)
+	Skipped int // 既に目的の状態であったため、呼び出しを省略したデータポイントの数
+}
+
+// Result は一括設定の結果です。
+type Result struct {
+	Targets      []ambidata.Data       // 対象のデータポイント (設定前の内容)
+	Progress     *Progress             // 進捗 (DryRun の場合は nil)
+	Verification *migrate.Verification // 照合結果 (DryRun または NoVerify の場合は nil)
+}
+
+// Run は f のチャネルから opt に一致するデータポイントを取得し、 s で act の内容を設定します。
+// opt が nil の場合は、デフォルトの設定が使用されます。
+//
+// 設定後は f でデータを再取得し、全ての対象が目的の状態になっていることを照合します。
+// 一致しない場合は [ErrVerify] を返します。
+// エラーが発生した場合も、その時点までの結果を返します。
+func Run(ctx context.Context, f *ambidata.Fetcher, s *ambidata.Sender, act Action, opt *Options) (*Result, error) {
+	if opt == nil {
+		opt = &Options{}
+	}
+
+	targets, err := Find(ctx, f, opt)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{Targets: targets}
+	if opt.DryRun {
+		return res, nil
+	}
+
+	res.Progress, err = Apply(ctx, s, targets, act, opt)
+	if err != nil {
+		return res, err
+	}
+	if opt.NoVerify {
+		return res, nil
+	}
+
+	res.Verification, err = Verify(ctx, f, targets, act)
+	if err != nil {
+		return res, err
+	}
+	if !res.Verification.OK() {
+		return res, fmt.Errorf("%w: %s", ErrVerify, res.Verification)
+	}
+	return res, nil
+}
+
+// Find は f のチャネルから opt の期間と条件に一致するデータポイントを取得します。
+// データポイントは古いものから順に並びます。
+func Find(ctx context.Context, f *ambidata.Fetcher, opt *Options) ([]ambidata.Data, error) {
+	if opt == nil {
+		opt = &Options{}
+	}
+	start := opt.Start
+	if start.IsZero() {
+		start = time.Unix(0, 0)
+	}
+	end := opt.End
+	if end.IsZero() {
+		now := time.Now()
+		if opt.Now != nil {
+			now = opt.Now()
+		}
+		end = now.Add(24 * time.Hour)
+	}
+
+	fetched, err := f.FetchPeriodAll(ctx, start, end)
+	if err != nil {
+		return nil, err
+	}
+	arr := []ambidata.Data{}
+	for i := len(fetched) - 1; i >= 0; i-- {
+		if opt.Match == nil || opt.Match(&fetched[i]) {
+			arr = append(arr, fetched[i])
+		}
+	}
+	return arr, nil
+}
+
+// Apply は targets の各データポイントに s で act の内容を設定します。
+// opt は Interval と OnProgress のみを参照します。
+//
+// 既に目的の状態であるデータポイントは、呼び出しを省略します。
+// エラーが発生した場合や ctx がキャンセルされた場合は、その時点の進捗とエラーを返します。
+func Apply(ctx context.Context, s *ambidata.Sender, targets []ambidata.Data, act Action, opt *Options) (*Progress, error) {
+	return ApplyFunc(ctx, s, targets, func(*ambidata.Data) Action { return act }, opt)
+}
+
+// ApplyFunc は [Apply] と同様ですが、データポイントごとに fn が返す内容を設定します。
+func ApplyFunc(ctx context.Context, s *ambidata.Sender, targets []ambidata.Data, fn func(data *ambidata.Data) Action, opt *Options) (*Progress, error) {
+	if opt == nil {
+		opt = &Options{}
+	}
+	interval := opt.Interval
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+
+	p := &Progress{Total: len(targets)}
+	var last time.Time
+	call := func(fn func() error) error {
+		if !last.IsZero() {
+			err := sleep(ctx, time.Until(last.Add(interval)))
+			if err != nil {
+				return err
+			}
+		}
+		err := fn()
+		last = time.Now()
+		return err
+	}
+
+	for i := range targets {
+		data := &targets[i]
+		act := fn(data)
+		called := false
+		if act.Cmnt.OK && data.Cmnt != act.Cmnt.V {
+			err := call(func() error { return s.SetCmnt(ctx, data.Created, act.Cmnt.V) })
+			if err != nil {
+				return p, fmt.Errorf("annotate: %s: %w", data.Created.Format(time.RFC3339Nano), err)
+			}
+			called = true
+		}
+		if act.Hide.OK && data.Hide != act.Hide.V {
+			err := call(func() error { return s.SetHide(ctx, data.Created, act.Hide.V) })
+			if err != nil {
+				return p, fmt.Errorf("annotate: %s: %w", data.Created.Format(time.RFC3339Nano), err)
+			}
+			called = true
+		}
+
+		p.Done++
+		if !called {
+			p.Skipped++
+		}
+		if opt.OnProgress != nil {
+			opt.OnProgress(*p)
+		}
+	}
+	return p, nil
+}
+
+// Verify は f でデータを再取得し、 targets の各データポイントが act を適用した状態になっていることを確認します。
+// 照合は [migrate.Verify] により行い、コメントと表示/非表示状態以外の内容も比較します。
+func Verify(ctx context.Context, f *ambidata.Fetcher, targets []ambidata.Data, act Action) (*migrate.Verification, error) {
+	return VerifyFunc(ctx, f, targets, func(*ambidata.Data) Action { return act })
+}
+
+// VerifyFunc は [Verify] と同様ですが、データポイントごとに fn が返す内容を適用した状態と照合します。
+func VerifyFunc(ctx context.Context, f *ambidata.Fetcher, targets []ambidata.Data, fn func(data *ambidata.Data) Action) (*migrate.Verification, error) {
+	want := slices.Clone(targets)
+	for i := range want {
+		act := fn(&targets[i])
+		want[i] = act.apply(want[i])
+	}
+	return migrate.Verify(ctx, f, want)
+}
+
+// sleep は d の間待機します。
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,173 @@
+package annotate
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/internal/ambimock"
+	"github.com/google/go-cmp/cmp"
+)
+
+var t0 = time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+
+func point(sec int, v float64) ambidata.Data {
+	return ambidata.Data{Created: t0.Add(time.Duration(sec) * time.Second), D1: ambidata.Just(v)}
+}
+
+func newServer(t *testing.T, data ...ambidata.Data) *ambimock.Server {
+	srv := ambimock.New(t)
+	srv.AddChannel(&ambimock.Channel{
+		Info:     ambidata.ChannelInfo{Ch: "1"},
+		ReadKey:  "rk",
+		WriteKey: "wk",
+		Data:     data,
+	})
+	return srv
+}
+
+func countPuts(srv *ambimock.Server) int {
+	n := 0
+	for _, req := range srv.Requests() {
+		if req.Method == http.MethodPut {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	srv := newServer(t,
+		point(0, 20),
+		point(1, 999),
+		point(2, 21),
+		point(3, -100),
+		point(3600, 999),
+	)
+
+	act := Action{Cmnt: ambidata.Just("sensor error"), Hide: ambidata.Just(true)}
+	var progress []Progress
+	opt := &Options{
+		Start:      t0,
+		End:        t0.Add(time.Minute),
+		Match:      OutOfRange(ambidata.FieldD1, -40, 85),
+		Interval:   time.Millisecond,
+		OnProgress: func(p Progress) { progress = append(progress, p) },
+	}
+	res, err := Run(ctx, srv.Fetcher("1"), srv.Sender("1"), act, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff([]ambidata.Data{point(1, 999), point(3, -100)}, res.Targets); diff != "" {
+		t.Errorf("Targets: mismatch (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]Progress{{Total: 2, Done: 1}, {Total: 2, Done: 2}}, progress); diff != "" {
+		t.Errorf("OnProgress: mismatch (-want, +got):\n%s", diff)
+	}
+	if !res.Verification.OK() || res.Verification.Checked != 2 {
+		t.Errorf("Verification: unexpected result %s", res.Verification)
+	}
+
+	want := []ambidata.Data{
+		point(0, 20),
+		act.apply(point(1, 999)),
+		point(2, 21),
+		act.apply(point(3, -100)),
+		point(3600, 999),
+	}
+	if diff := cmp.Diff(want, srv.Data("1")); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+	if n := countPuts(srv); n != 4 {
+		t.Errorf("expected 4 PUT requests, got %d", n)
+	}
+
+	// 再実行では、既に目的の状態であるため呼び出しを省略する
+	res, err = Run(ctx, srv.Fetcher("1"), srv.Sender("1"), act, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(&Progress{Total: 2, Done: 2, Skipped: 2}, res.Progress); diff != "" {
+		t.Errorf("rerun: mismatch (-want, +got):\n%s", diff)
+	}
+	if n := countPuts(srv); n != 4 {
+		t.Errorf("rerun: expected 4 PUT requests, got %d", n)
+	}
+}
+
+func TestRunDryRun(t *testing.T) {
+	srv := newServer(t, point(0, 1), point(1, 2))
+
+	res, err := Run(context.Background(), srv.Fetcher("1"), srv.Sender("1"), Action{Hide: ambidata.Just(true)}, &Options{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]ambidata.Data{point(0, 1), point(1, 2)}, res.Targets); diff != "" {
+		t.Errorf("Targets: mismatch (-want, +got):\n%s", diff)
+	}
+	if res.Progress != nil || res.Verification != nil {
+		t.Errorf("expected no progress and verification, got %v, %v", res.Progress, res.Verification)
+	}
+	if n := countPuts(srv); n != 0 {
+		t.Errorf("expected 0 PUT requests, got %d", n)
+	}
+}
+
+func TestApplyError(t *testing.T) {
+	srv := newServer(t, point(0, 1), point(1, 2), point(2, 3))
+	var n atomic.Int32
+	srv.Hook = func(r *http.Request) int {
+		if r.Method == http.MethodPut && n.Add(1) == 2 {
+			return http.StatusInternalServerError
+		}
+		return 0
+	}
+
+	targets := []ambidata.Data{point(0, 1), point(1, 2), point(2, 3)}
+	p, err := Apply(context.Background(), srv.Sender("1"), targets, Action{Hide: ambidata.Just(true)}, &Options{Interval: time.Millisecond})
+	var sc *ambidata.StatusCodeError
+	if !errors.As(err, &sc) {
+		t.Errorf("expected StatusCodeError, got %v", err)
+	}
+	if diff := cmp.Diff(&Progress{Total: 3, Done: 1}, p); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	srv := newServer(t, point(0, 1), point(1, 2))
+
+	act := Action{Cmnt: ambidata.Just("c")}
+	v, err := Verify(context.Background(), srv.Fetcher("1"), []ambidata.Data{point(0, 1), point(1, 2)}, act)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]time.Time{point(0, 1).Created, point(1, 2).Created}, v.Changed); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestOutOfRange(t *testing.T) {
+	tests := []struct {
+		data ambidata.Data
+		want bool
+	}{
+		{ambidata.Data{D1: ambidata.Just(-1.0)}, true},
+		{ambidata.Data{D1: ambidata.Just(0.0)}, false},
+		{ambidata.Data{D1: ambidata.Just(math.MaxFloat64)}, false},
+		{ambidata.Data{D2: ambidata.Just(-1.0)}, false},
+	}
+	match := OutOfRange(ambidata.FieldD1, 0, math.Inf(1))
+	for _, tt := range tests {
+		if got := match(&tt.data); got != tt.want {
+			t.Errorf("%v: expected %t, got %t", tt.data.D1, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+// Package archive は、チャネルの全データをファイルに書き出すバックアップ機能、
+// バックアップを作成してからデータを削除する安全な削除機能、
+// およびアーカイブからデータを復元する機能を提供します。
+//
+// [ambidata.Manager.DeleteData] はチャネルの全データを削除し、削除したデータは復元できません。
+// [Delete] は以下の手順を全て完了した場合にのみデータを削除します。
+//
+//  1. 確認用の文字列 ([ConfirmToken]) がチャネルIDと一致することを確認する
+//  2. [ambidata.Fetcher] でチャネルの全データを取得する
+//  3. 取得したデータの件数と最新のデータを、チャネル情報およびサーバー上の件数と照合する
+//  4. データをファイルに書き出し、読み戻して内容を確認する
+//  5. バックアップ中に新しいデータが送信されていないことを確認する
+//
+// アーカイブは [dataio] パッケージの形式 (デフォルトは NDJSON) で、古いデータから順に書き出されます。
+// [ReadFile] で読み込んだアーカイブは、 [Restore] で別のチャネルや削除後のチャネルに復元できます。
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/dataio"
+)
+
+// DefaultFormat は [Options.Format] のデフォルト値です。
+const DefaultFormat = dataio.FormatNDJSON
+
+var (
+	// ErrConfirm は確認用の文字列がチャネルと一致しない場合のエラーです。
+	ErrConfirm = errors.New("archive: confirmation does not match the channel")
+
+	// ErrVerify は取得したデータまたは書き出したアーカイブの照合に失敗した場合のエラーです。
+	ErrVerify = errors.New("archive: verification failed")
+)
+
+// Options はバックアップに関する設定です。
+// ゼロ値の Options 構造体は、デフォルトの設定を表す有効な構成となります。
+type Options struct {
+	// Dir はアーカイブを書き出すディレクトリです。
+	// 空文字列の場合は、カレントディレクトリが使用されます。
+	Dir string
+
+	// Format はアーカイブの形式です。
+	// 空文字列の場合は、 [DefaultFormat] が使用されます。
+	Format dataio.Format
+
+	// Now は現在時刻を返す関数です。
+	// nil の場合は、 [time.Now] が使用されます。
+	Now func() time.Time
+}
+
+// Result はバックアップの結果です。
+type Result struct {
+	Ch       string    // チャネルID
+	Path     string    // アーカイブのパス
+	Count    int       // アーカイブに書き出したデータポイントの数
+	LastPost time.Time // バックアップ時点のデータの最終送信日時
+}
+
+// ConfirmToken はチャネル ch のデータを [Delete] で削除する際に指定する確認用の文字列を返します。
+// 確認用の文字列は "delete-" にチャネルIDを続けたものです。
+func ConfirmToken(ch string) string {
+	return "delete-" + ch
+}
+
+// Backup は f のチャネルの全データを取得して照合し、アーカイブとして書き出します。
+// opt が nil の場合は、デフォルトの設定が使用されます。
+//
+// アーカイブのファイル名は "<チャネルID>-<UTC の日時>.<形式>" です。
+// ファイルは一時ファイルに書き出した後に名前を変更するため、書き出しに失敗した場合に
+// 不完全なアーカイブが残ることはありません。
+func Backup(ctx context.Context, f *ambidata.Fetcher, opt *Options) (*Result, error) {
+	if opt == nil {
+		opt = &Options{}
+	}
+	format := opt.Format
+	if format == "" {
+		format = DefaultFormat
+	}
+	now := time.Now()
+	if opt.Now != nil {
+		now = opt.Now()
+	}
+
+	info, err := f.GetChannel(ctx)
+	if err != nil {
+		return nil, err
+	}
+	arr, err := fetchAll(ctx, f, &info, now)
+	if err != nil {
+		return nil, err
+	}
+	err = verify(ctx, f, &info, arr)
+	if err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("%s-%s.%s", f.Ch, now.UTC().Format("20060102T150405Z"), format)
+	path := filepath.Join(opt.Dir, name)
+	err = writeFile(path, format, arr)
+	if err != nil {
+		return nil, err
+	}
+	err = verifyFile(path, format, arr)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Result{
+		Ch:       f.Ch,
+		Path:     path,
+		Count:    len(arr),
+		LastPost: info.LastPost,
+	}
+	return r, nil
+}
+
+// Delete は f のチャネルのバックアップを [Backup] で作成した後、m でチャネルの全データを削除します。
+// opt が nil の場合は、デフォルトの設定が使用されます。
+//
+// confirm には [ConfirmToken] が返す文字列を指定する必要があります。
+// 一致しない場合は何もせずに [ErrConfirm] を返します。
+//
+// バックアップの作成中にチャネルのデータの最終送信日時が変化した場合は、
+// 新しいデータがバックアップに含まれていない可能性があるため、削除せずに [ErrVerify] を返します。
+// ただし、最後の確認から削除までの間に送信されたデータは、バックアップされずに削除されます。
+func Delete(ctx context.Context, m *ambidata.Manager, f *ambidata.Fetcher, confirm string, opt *Options) (*Result, error) {
+	if confirm != ConfirmToken(f.Ch) {
+		return nil, fmt.Errorf("%w: got %q for channel %s", ErrConfirm, confirm, f.Ch)
+	}
+
+	r, err := Backup(ctx, f, opt)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.GetChannel(ctx)
+	if err != nil {
+		return r, err
+	}
+	if !info.LastPost.Equal(r.LastPost) {
+		return r, fmt.Errorf("%w: new data was posted during the backup (last post %s, was %s)", ErrVerify, info.LastPost.Format(time.RFC3339Nano), r.LastPost.Format(time.RFC3339Nano))
+	}
+
+	err = m.DeleteData(ctx, f.Ch)
+	if err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+// fetchAll はチャネルの全データを古いものから順に取得します。
+// 未来の時刻のデータを含めるため、取得する期間の終了時刻は現在時刻または最終送信日時の1日後とします。
+func fetchAll(ctx context.Context, f *ambidata.Fetcher, info *ambidata.ChannelInfo, now time.Time) ([]ambidata.Data, error) {
+	end := now
+	if info.LastPost.After(end) {
+		end = info.LastPost
+	}
+	end = end.Add(24 * time.Hour)
+
+	arr, err := f.FetchPeriodAll(ctx, time.Unix(0, 0), end)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(arr)-1; i < j; i, j = i+1, j-1 {
+		arr[i], arr[j] = arr[j], arr[i]
+	}
+	return arr, nil
+}
+
+// verify は取得したデータ arr がチャネルの全データであることを確認します。
+//
+// Ambient API はチャネルのデータ数を返さないため、以下の方法で照合します。
+//
+//   - 最後に送信されたデータ ([ambidata.ChannelInfo.LastData]) が arr に含まれること
+//   - 新しい方から len(arr) 件を読み飛ばした先にデータが存在しないこと
+//   - 新しい方から len(arr)-1 件を読み飛ばした先のデータが arr の最も古いデータと一致すること
+func verify(ctx context.Context, f *ambidata.Fetcher, info *ambidata.ChannelInfo, arr []ambidata.Data) error {
+	if len(arr) <= 0 {
+		if !info.LastPost.IsZero() {
+			return fmt.Errorf("%w: channel has data posted at %s, but none was fetched", ErrVerify, info.LastPost.Format(time.RFC3339Nano))
+		}
+		return nil
+	}
+
+	if last := info.LastData.Created; !last.IsZero() && !containsCreated(arr, last) {
+		return fmt.Errorf("%w: last data at %s was not fetched", ErrVerify, last.Format(time.RFC3339Nano))
+	}
+
+	rest, err := f.FetchRange(ctx, 1, len(arr))
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return fmt.Errorf("%w: channel has more than %d data points", ErrVerify, len(arr))
+	}
+	oldest, err := f.FetchRange(ctx, 1, len(arr)-1)
+	if err != nil {
+		return err
+	}
+	if len(oldest) != 1 || !oldest[0].Created.Equal(arr[0].Created) {
+		return fmt.Errorf("%w: channel has fewer than %d data points", ErrVerify, len(arr))
+	}
+	return nil
+}
+
+func containsCreated(arr []ambidata.Data, t time.Time) bool {
+	for i := len(arr) - 1; i >= 0; i-- {
+		if arr[i].Created.Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeFile(path string, format dataio.Format, arr []ambidata.Data) (err error) {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
+
+	w, err := dataio.NewWriter(file, format)
+	if err != nil {
+		return err
+	}
+	err = dataio.WriteAll(w, arr)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if err != nil {
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// verifyFile は書き出したアーカイブを読み戻し、データポイントの数と時刻が arr と一致することを確認します。
+func verifyFile(path string, format dataio.Format, arr []ambidata.Data) error {
+	got, err := ReadFile(path, format)
+	if err != nil {
+		return err
+	}
+	if len(got) != len(arr) {
+		return fmt.Errorf("%w: %s: expected %d data points, got %d", ErrVerify, path, len(arr), len(got))
+	}
+	for i := range arr {
+		if !got[i].Created.Equal(arr[i].Created) {
+			return fmt.Errorf("%w: %s: data point %d: expected created %s, got %s", ErrVerify, path, i, arr[i].Created.Format(time.RFC3339Nano), got[i].Created.Format(time.RFC3339Nano))
+		}
+	}
+	return nil
+}
+
+// ReadFile は path のアーカイブを読み込みます。
+// format が空文字列の場合は、ファイルの拡張子から形式を判定します。
+func ReadFile(path string, format dataio.Format) ([]ambidata.Data, error) {
+	if format == "" {
+		format = dataio.Format(filepath.Ext(path))
+		if format != "" {
+			format = format[1:]
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r, err := dataio.NewReader(file, format)
+	if err != nil {
+		return nil, err
+	}
+	arr, err := dataio.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("archive: %s: %w", path, err)
+	}
+	return arr, nil
+}
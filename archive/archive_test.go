@@ -0,0 +1,177 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/dataio"
+	"github.com/gcrtnst/ambidata/internal/ambimock"
+	"github.com/google/go-cmp/cmp"
+)
+
+var now = time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+
+func newChannel(n int) *ambimock.Channel {
+	c := &ambimock.Channel{
+		Info:     ambidata.ChannelInfo{Ch: "1"},
+		UserKey:  "uk",
+		ReadKey:  "rk",
+		WriteKey: "wk",
+	}
+	for i := range n {
+		c.Data = append(c.Data, ambidata.Data{
+			Created: now.Add(time.Duration(i-n) * time.Second),
+			D1:      ambidata.Just(float64(i)),
+		})
+	}
+	c.Data[0].Cmnt = "first"
+	c.Data[0].Hide = true
+	c.Data[1].Loc = ambidata.Just(ambidata.Location{Lat: 35, Lng: 139})
+	return c
+}
+
+func TestBackup(t *testing.T) {
+	for _, format := range []dataio.Format{dataio.FormatNDJSON, dataio.FormatCSV, dataio.FormatJSON} {
+		s := ambimock.New(t)
+		s.AddChannel(newChannel(3500))
+		dir := t.TempDir()
+
+		r, err := Backup(context.Background(), s.Fetcher("1"), &Options{Dir: dir, Format: format, Now: func() time.Time { return now }})
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+
+		wantPath := filepath.Join(dir, "1-20060102T150405Z."+string(format))
+		if r.Path != wantPath {
+			t.Errorf("%s: Path: expected %q, got %q", format, wantPath, r.Path)
+		}
+		if r.Count != 3500 {
+			t.Errorf("%s: Count: expected 3500, got %d", format, r.Count)
+		}
+		if want := now.Add(-time.Second); !r.LastPost.Equal(want) {
+			t.Errorf("%s: LastPost: expected %v, got %v", format, want, r.LastPost)
+		}
+
+		got, err := ReadFile(r.Path, "")
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if diff := cmp.Diff(s.Data("1"), got); diff != "" {
+			t.Errorf("%s: mismatch (-want, +got):\n%s", format, diff)
+		}
+
+		entries, _ := os.ReadDir(dir)
+		if len(entries) != 1 {
+			t.Errorf("%s: expected 1 file in the directory, got %d", format, len(entries))
+		}
+	}
+}
+
+func TestBackupEmpty(t *testing.T) {
+	s := ambimock.New(t)
+	s.AddChannel(&ambimock.Channel{Info: ambidata.ChannelInfo{Ch: "1"}, ReadKey: "rk"})
+
+	r, err := Backup(context.Background(), s.Fetcher("1"), &Options{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Count != 0 {
+		t.Errorf("Count: expected 0, got %d", r.Count)
+	}
+}
+
+func TestBackupErrVerify(t *testing.T) {
+	s := ambimock.New(t)
+	c := newChannel(10)
+	c.Data[0].Created = time.Date(1969, 12, 31, 0, 0, 0, 0, time.UTC) // 取得する期間の外
+	s.AddChannel(c)
+	dir := t.TempDir()
+
+	_, err := Backup(context.Background(), s.Fetcher("1"), &Options{Dir: dir})
+	if !errors.Is(err, ErrVerify) {
+		t.Errorf("expected ErrVerify, got %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("expected no file in the directory, got %d", len(entries))
+	}
+}
+
+func TestDelete(t *testing.T) {
+	s := ambimock.New(t)
+	s.AddChannel(newChannel(10))
+	want := s.Data("1")
+
+	r, err := Delete(context.Background(), s.Manager("uk"), s.Fetcher("1"), "delete-1", &Options{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.Data("1")); n != 0 {
+		t.Errorf("expected all data to be deleted, %d data points remain", n)
+	}
+	got, err := ReadFile(r.Path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestDeleteErrConfirm(t *testing.T) {
+	tests := []string{"", "1", "delete-2", "delete-1 "}
+	for _, tt := range tests {
+		s := ambimock.New(t)
+		s.AddChannel(newChannel(10))
+
+		_, err := Delete(context.Background(), s.Manager("uk"), s.Fetcher("1"), tt, &Options{Dir: t.TempDir()})
+		if !errors.Is(err, ErrConfirm) {
+			t.Errorf("%q: expected ErrConfirm, got %v", tt, err)
+		}
+		if n := len(s.Requests()); n != 0 {
+			t.Errorf("%q: expected no request, got %d", tt, n)
+		}
+	}
+}
+
+func TestDeleteModified(t *testing.T) {
+	s := ambimock.New(t)
+	s.AddChannel(newChannel(10))
+
+	// バックアップの照合中に新しいデータが送信される
+	var posted atomic.Bool
+	s.Hook = func(r *http.Request) int {
+		if r.URL.Query().Has("skip") && !posted.Swap(true) {
+			c := newChannel(10)
+			c.Data = append(c.Data, ambidata.Data{Created: now, D1: ambidata.Just(10.0)})
+			s.AddChannel(c)
+		}
+		return 0
+	}
+
+	_, err := Delete(context.Background(), s.Manager("uk"), s.Fetcher("1"), "delete-1", &Options{Dir: t.TempDir()})
+	if !errors.Is(err, ErrVerify) {
+		t.Errorf("expected ErrVerify, got %v", err)
+	}
+	for _, req := range s.Requests() {
+		if req.Method == http.MethodDelete {
+			t.Errorf("unexpected DELETE request")
+		}
+	}
+	if n := len(s.Data("1")); n != 11 {
+		t.Errorf("expected 11 data points to remain, got %d", n)
+	}
+}
+
+func TestConfirmToken(t *testing.T) {
+	if got := ConfirmToken("83601"); got != "delete-83601" {
+		t.Errorf("expected %q, got %q", "delete-83601", got)
+	}
+}
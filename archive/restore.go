@@ -0,0 +1,351 @@
+package archive
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+)
+
+const (
+	// DefaultBatchSize は [RestoreOptions.BatchSize] のデフォルト値です。
+	// [ambidata.Sender.SendBulk] のリクエストボディのサイズ制限に達しない個数としています。
+	DefaultBatchSize = 250
+
+	// DefaultAnnotateInterval は [RestoreOptions.AnnotateInterval] のデフォルト値です。
+	DefaultAnnotateInterval = time.Second
+
+	// QuotaPeriod は [ambidata.MaxDataPerDay] の制限が適用される期間です。
+	//
+	// 推測に基づく情報: 制限がどの時点で解除されるかは明らかではありません。
+	// 本パッケージでは、期間内で最初に送信した時刻から 24 時間が経過するまで待機します。
+	QuotaPeriod = 24 * time.Hour
+)
+
+// ErrProgressMismatch は進捗ファイルが復元するチャネルやデータと一致しない場合のエラーです。
+var ErrProgressMismatch = errors.New("archive: progress file does not match the restore")
+
+// RestoreOptions はデータの復元に関する設定です。
+// ゼロ値の RestoreOptions 構造体は、デフォルトの設定を表す有効な構成となります。
+type RestoreOptions struct {
+	// BatchSize は1回の [ambidata.Sender.SendBulk] で送信するデータポイントの最大数です。
+	// 0 以下の場合は、 [DefaultBatchSize] が使用されます。
+	BatchSize int
+
+	// Interval は [ambidata.Sender.SendBulk] の送信間隔です。
+	// 0 以下の場合は、 [ambidata.MinSendInterval] が使用されます。
+	Interval time.Duration
+
+	// AnnotateInterval は [ambidata.Sender.SetCmnt] および [ambidata.Sender.SetHide] の呼び出し間隔です。
+	// 0 以下の場合は、 [DefaultAnnotateInterval] が使用されます。
+	AnnotateInterval time.Duration
+
+	// DailyLimit は [QuotaPeriod] あたりに送信するデータポイントの最大数です。
+	// 上限に達した場合は、期間が終わるまで待機してから送信を再開します。
+	// 復元先のチャネルに他のデバイスも送信している場合は、その分を差し引いた値を指定してください。
+	// 0 以下の場合は、 [ambidata.MaxDataPerDay] が使用されます。
+	DailyLimit int
+
+	// ProgressFile は進捗を保存するファイルのパスです。
+	// ファイルが存在する場合は、保存された進捗から復元を再開します。
+	// 全ての処理が完了した場合、ファイルは削除されます。
+	// 空文字列の場合は、進捗を保存しません。
+	ProgressFile string
+
+	// OnProgress は進捗が更新されるたびに呼び出される関数です。
+	// nil の場合は、何もしません。
+	OnProgress func(p Progress)
+
+	// Now は現在時刻を返す関数です。
+	// nil の場合は、 [time.Now] が使用されます。
+	Now func() time.Time
+}
+
+// Progress はデータの復元の進捗です。
+type Progress struct {
+	Ch        string    `json:"ch"`        // 復元先のチャネルID
+	Digest    string    `json:"digest"`    // 復元するデータの時刻から計算したハッシュ値
+	Total     int       `json:"total"`     // 復元するデータポイントの数
+	Sent      int       `json:"sent"`      // 送信済みのデータポイントの数
+	Annotated int       `json:"annotated"` // コメントと表示/非表示状態を設定済みのデータポイントの数
+	DayStart  time.Time `json:"dayStart"`  // 現在の制限期間で最初に送信した時刻
+	DaySent   int       `json:"daySent"`   // 現在の制限期間に送信したデータポイントの数
+	Last      time.Time `json:"last"`      // 直前にリクエストを送信した時刻
+}
+
+// Done は全ての処理が完了した場合に true を返します。
+func (p *Progress) Done() bool {
+	return p.Sent >= p.Total && p.Annotated >= p.Total
+}
+
+// sleep は d の間待機します。テストで置き換えられます。
+var sleep = func(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// Restore は arr のデータポイントを s のチャネルに送信し、データを復元します。
+// opt が nil の場合は、デフォルトの設定が使用されます。
+//
+// データポイントは [RestoreOptions.BatchSize] 個ずつ [ambidata.Sender.SendBulk] で送信します。
+// 送信間隔と一日あたりのデータ数の制限を守るため、必要に応じて待機します。
+// データ数が多い場合、復元には複数日かかることがあります。
+//
+// [ambidata.Sender.SendBulk] は [ambidata.Data.Hide] を送信しないため、全てのデータポイントを送信した後に、
+// コメントがあるデータポイントには [ambidata.Sender.SetCmnt] を、
+// 非表示のデータポイントには [ambidata.Sender.SetHide] を呼び出します。
+//
+// 途中でエラーが発生した場合や ctx がキャンセルされた場合は、その時点の進捗とエラーを返します。
+// [RestoreOptions.ProgressFile] を指定していれば、同じ引数で再度呼び出すことで続きから再開できます。
+// 進捗ファイルが別のチャネルやデータのものである場合は [ErrProgressMismatch] を返します。
+func Restore(ctx context.Context, s *ambidata.Sender, arr []ambidata.Data, opt *RestoreOptions) (*Progress, error) {
+	if opt == nil {
+		opt = &RestoreOptions{}
+	}
+	r := &restorer{s: s, arr: arr, opt: opt, now: time.Now}
+	if opt.Now != nil {
+		r.now = opt.Now
+	}
+
+	for i := range arr {
+		if arr[i].Created.IsZero() {
+			return nil, fmt.Errorf("archive: data point %d has no created time", i)
+		}
+	}
+
+	p := Progress{Ch: s.Ch, Digest: digest(arr), Total: len(arr)}
+	if opt.ProgressFile != "" {
+		saved, err := loadProgress(opt.ProgressFile)
+		switch {
+		case err == nil:
+			if saved.Ch != p.Ch || saved.Digest != p.Digest || saved.Total != p.Total {
+				return nil, fmt.Errorf("%w: %s", ErrProgressMismatch, opt.ProgressFile)
+			}
+			p = *saved
+		case errors.Is(err, os.ErrNotExist):
+		default:
+			return nil, err
+		}
+	}
+	r.p = p
+	// 再開した場合も、前回の直前のリクエストから送信間隔を空ける
+	r.last = p.Last
+
+	err := r.send(ctx)
+	if err == nil {
+		err = r.annotate(ctx)
+	}
+	if err != nil {
+		// 失敗したリクエストも送信間隔の起点とするため、その時刻を保存する
+		if !r.p.Last.Equal(r.last) {
+			r.p.Last = r.last
+			if opt.ProgressFile != "" {
+				saveProgress(opt.ProgressFile, &r.p)
+			}
+		}
+		return &r.p, err
+	}
+	if opt.ProgressFile != "" {
+		err = os.Remove(opt.ProgressFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return &r.p, err
+		}
+	}
+	return &r.p, nil
+}
+
+type restorer struct {
+	s   *ambidata.Sender
+	arr []ambidata.Data
+	opt *RestoreOptions
+	now func() time.Time
+	p   Progress
+	// last は直前にリクエストを送信した時刻です。
+	last time.Time
+}
+
+func (r *restorer) send(ctx context.Context) error {
+	size := r.opt.BatchSize
+	if size <= 0 {
+		size = DefaultBatchSize
+	}
+	interval := r.opt.Interval
+	if interval <= 0 {
+		interval = ambidata.MinSendInterval
+	}
+	limit := r.opt.DailyLimit
+	if limit <= 0 {
+		limit = ambidata.MaxDataPerDay
+	}
+
+	for r.p.Sent < len(r.arr) {
+		if !r.p.DayStart.IsZero() && !r.now().Before(r.p.DayStart.Add(QuotaPeriod)) {
+			r.p.DayStart = time.Time{}
+			r.p.DaySent = 0
+		}
+		if r.p.DaySent >= limit {
+			err := sleep(ctx, r.p.DayStart.Add(QuotaPeriod).Sub(r.now()))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err := r.wait(ctx, interval)
+		if err != nil {
+			return err
+		}
+
+		n := min(size, len(r.arr)-r.p.Sent, limit-r.p.DaySent)
+		err = r.s.SendBulk(ctx, r.arr[r.p.Sent:r.p.Sent+n])
+		r.last = r.now()
+		if err != nil {
+			return err
+		}
+
+		if r.p.DayStart.IsZero() {
+			r.p.DayStart = r.last
+		}
+		r.p.Sent += n
+		r.p.DaySent += n
+		err = r.update()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *restorer) annotate(ctx context.Context) error {
+	interval := r.opt.AnnotateInterval
+	if interval <= 0 {
+		interval = DefaultAnnotateInterval
+	}
+
+	for r.p.Annotated < len(r.arr) {
+		data := &r.arr[r.p.Annotated]
+		if data.Cmnt != "" {
+			err := r.wait(ctx, interval)
+			if err != nil {
+				return err
+			}
+			err = r.s.SetCmnt(ctx, data.Created, data.Cmnt)
+			r.last = r.now()
+			if err != nil {
+				return err
+			}
+		}
+		if data.Hide {
+			err := r.wait(ctx, interval)
+			if err != nil {
+				return err
+			}
+			err = r.s.SetHide(ctx, data.Created, true)
+			r.last = r.now()
+			if err != nil {
+				return err
+			}
+		}
+
+		r.p.Annotated++
+		if data.Cmnt != "" || data.Hide || r.p.Annotated == len(r.arr) {
+			err := r.update()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// wait は直前のリクエストから interval が経過するまで待機します。
+func (r *restorer) wait(ctx context.Context, interval time.Duration) error {
+	if r.last.IsZero() {
+		return ctx.Err()
+	}
+	return sleep(ctx, r.last.Add(interval).Sub(r.now()))
+}
+
+// update は進捗を保存し、 [RestoreOptions.OnProgress] を呼び出します。
+func (r *restorer) update() error {
+	r.p.Last = r.last
+	if r.opt.ProgressFile != "" {
+		err := saveProgress(r.opt.ProgressFile, &r.p)
+		if err != nil {
+			return err
+		}
+	}
+	if r.opt.OnProgress != nil {
+		r.opt.OnProgress(r.p)
+	}
+	return nil
+}
+
+// digest はデータポイントの時刻の並びから、進捗ファイルとの照合に使用するハッシュ値を計算します。
+func digest(arr []ambidata.Data) string {
+	h := sha256.New()
+	var b [8]byte
+	for i := range arr {
+		binary.BigEndian.PutUint64(b[:], uint64(arr[i].Created.UnixMilli()))
+		h.Write(b[:])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func loadProgress(path string) (*Progress, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p Progress
+	err = json.Unmarshal(b, &p)
+	if err != nil {
+		return nil, fmt.Errorf("archive: %s: %w", path, err)
+	}
+	return &p, nil
+}
+
+func saveProgress(path string, p *Progress) (err error) {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
+
+	_, err = file.Write(b)
+	if err != nil {
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
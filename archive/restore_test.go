@@ -0,0 +1,193 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/internal/ambimock"
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeClock は sleep を置き換え、待機した時間だけ進む時計です。
+type fakeClock struct {
+	t      time.Time
+	sleeps []time.Duration
+}
+
+func useFakeClock(t *testing.T) *fakeClock {
+	c := &fakeClock{t: now}
+	orig := sleep
+	sleep = func(ctx context.Context, d time.Duration) error {
+		if d > 0 {
+			c.t = c.t.Add(d)
+			c.sleeps = append(c.sleeps, d)
+		}
+		return ctx.Err()
+	}
+	t.Cleanup(func() { sleep = orig })
+	return c
+}
+
+func (c *fakeClock) Now() time.Time { return c.t }
+
+func newRestoreTarget(t *testing.T) *ambimock.Server {
+	s := ambimock.New(t)
+	s.AddChannel(&ambimock.Channel{Info: ambidata.ChannelInfo{Ch: "2"}, ReadKey: "rk", WriteKey: "wk"})
+	return s
+}
+
+func bulkSizes(s *ambimock.Server) []int {
+	sizes := []int{}
+	for _, req := range s.Requests() {
+		if req.Method == http.MethodPost {
+			var n int
+			for _, b := range req.Body {
+				if b == '{' {
+					n++
+				}
+			}
+			sizes = append(sizes, n-1)
+		}
+	}
+	return sizes
+}
+
+func countMethod(s *ambimock.Server, method string) int {
+	n := 0
+	for _, req := range s.Requests() {
+		if req.Method == method {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRestore(t *testing.T) {
+	clock := useFakeClock(t)
+	s := newRestoreTarget(t)
+	arr := newChannel(600).Data
+	arr[300].Cmnt = "middle"
+	arr[300].Hide = true
+
+	var updates int
+	p, err := Restore(context.Background(), s.Sender("2"), arr, &RestoreOptions{
+		Now:        clock.Now,
+		OnProgress: func(Progress) { updates++ },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Done() {
+		t.Errorf("expected progress to be done, got %+v", p)
+	}
+
+	if diff := cmp.Diff(arr, s.Data("2")); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]int{250, 250, 100}, bulkSizes(s)); diff != "" {
+		t.Errorf("SendBulk: mismatch (-want, +got):\n%s", diff)
+	}
+	if n := countMethod(s, http.MethodPut); n != 4 {
+		t.Errorf("expected 4 PUT requests, got %d", n)
+	}
+	wantSleeps := []time.Duration{5 * time.Second, 5 * time.Second, time.Second, time.Second, time.Second, time.Second}
+	if diff := cmp.Diff(wantSleeps, clock.sleeps); diff != "" {
+		t.Errorf("sleeps: mismatch (-want, +got):\n%s", diff)
+	}
+	if updates != 6 {
+		t.Errorf("OnProgress: expected 6 calls, got %d", updates)
+	}
+}
+
+func TestRestoreDailyLimit(t *testing.T) {
+	clock := useFakeClock(t)
+	s := newRestoreTarget(t)
+	arr := newChannel(700).Data
+
+	_, err := Restore(context.Background(), s.Sender("2"), arr, &RestoreOptions{
+		DailyLimit: 300,
+		Now:        clock.Now,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]int{250, 50, 250, 50, 100}, bulkSizes(s)); diff != "" {
+		t.Errorf("SendBulk: mismatch (-want, +got):\n%s", diff)
+	}
+	wantSleeps := []time.Duration{5 * time.Second, QuotaPeriod - 5*time.Second, 5 * time.Second, QuotaPeriod - 5*time.Second, time.Second, time.Second}
+	if diff := cmp.Diff(wantSleeps, clock.sleeps); diff != "" {
+		t.Errorf("sleeps: mismatch (-want, +got):\n%s", diff)
+	}
+	if n := len(s.Data("2")); n != 700 {
+		t.Errorf("expected 700 data points, got %d", n)
+	}
+}
+
+func TestRestoreResume(t *testing.T) {
+	clock := useFakeClock(t)
+	s := newRestoreTarget(t)
+	arr := newChannel(600).Data
+	path := filepath.Join(t.TempDir(), "progress.json")
+	opt := &RestoreOptions{ProgressFile: path, Now: clock.Now}
+
+	var posts atomic.Int32
+	s.Hook = func(r *http.Request) int {
+		if r.Method == http.MethodPost && posts.Add(1) == 2 {
+			return http.StatusInternalServerError
+		}
+		return 0
+	}
+	p, err := Restore(context.Background(), s.Sender("2"), arr, opt)
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	if p.Sent != 250 {
+		t.Errorf("Sent: expected 250, got %d", p.Sent)
+	}
+	saved, err := loadProgress(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(p, saved); diff != "" {
+		t.Errorf("progress file: mismatch (-want, +got):\n%s", diff)
+	}
+
+	_, err = Restore(context.Background(), s.Sender("2"), arr[:599], opt)
+	if !errors.Is(err, ErrProgressMismatch) {
+		t.Errorf("different data: expected ErrProgressMismatch, got %v", err)
+	}
+
+	// 再開後の最初の送信も、失敗したリクエストから送信間隔を空ける
+	clock.sleeps = nil
+	_, err = Restore(context.Background(), s.Sender("2"), arr, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]time.Duration{5 * time.Second, 5 * time.Second, time.Second, time.Second}, clock.sleeps); diff != "" {
+		t.Errorf("sleeps: mismatch (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(arr, s.Data("2")); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected progress file to be removed, got %v", err)
+	}
+}
+
+func TestRestoreErrNoCreated(t *testing.T) {
+	s := newRestoreTarget(t)
+	_, err := Restore(context.Background(), s.Sender("2"), []ambidata.Data{{D1: ambidata.Just(1.0)}}, nil)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+	if n := len(s.Requests()); n != 0 {
+		t.Errorf("expected no request, got %d", n)
+	}
+}
@@ -0,0 +1,302 @@
+// Package async は、データポイントをバッファに蓄積し、送信間隔の制限を守りながら
+// 非同期にまとめて送信する [Sender] を提供します。
+//
+// センサーを送信間隔の制限 ([ambidata.MinSendInterval]) より短い周期でサンプリングする場合に、
+// 呼び出し側は [Sender.Submit] でデータポイントを渡すだけで済みます。
+// バッファが満杯になった場合の動作は [Policy] で選択できます。
+// バッファと送信の処理は、各種ブリッジと共通の internal/batch パッケージにより行います。
+//
+// 使用例:
+//
+//	s := async.New(ambidata.NewSender(ch, writeKey))
+//	defer s.Close(context.Background())
+//	for range time.Tick(time.Second) {
+//		err := s.Submit(ctx, ambidata.Data{Created: time.Now(), D1: ambidata.Just(read())})
+//		// ...
+//	}
+package async
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/internal/batch"
+)
+
+const (
+	// DefaultBufferSize は [Sender.BufferSize] のデフォルト値です。
+	DefaultBufferSize = 1000
+
+	// DefaultMaxBatch は [Sender.MaxBatch] のデフォルト値です。
+	DefaultMaxBatch = batch.DefaultMaxBatch
+)
+
+var (
+	// ErrClosed は [Sender.Close] の後に [Sender.Submit] が呼び出された場合のエラーです。
+	ErrClosed = errors.New("async: sender is closed")
+
+	// ErrDropped は [DropNewest] によりデータポイントが破棄された場合に [Sender.Submit] が返すエラーです。
+	ErrDropped = errors.New("async: buffer is full; data point was dropped")
+)
+
+// Policy はバッファが満杯の場合の動作です。
+type Policy int
+
+const (
+	// DropOldest はバッファの最も古いデータポイントを破棄して、新しいデータポイントを追加します。
+	DropOldest Policy = iota
+
+	// DropNewest は新しいデータポイントを破棄します。 [Sender.Submit] は [ErrDropped] を返します。
+	DropNewest
+
+	// Block はバッファに空きができるまで [Sender.Submit] の呼び出しをブロックします。
+	Block
+
+	// Aggregate は新しいデータポイントをバッファの最も新しいデータポイントに統合します。
+	// データ1～8の値は統合したデータポイントの平均値となり、時刻、位置情報、コメントは
+	// 新しいデータポイントのもので上書きされます (コメントは空でない場合のみ) 。
+	Aggregate
+)
+
+// Stats は [Sender] の統計情報です。
+type Stats struct {
+	Depth      int    // バッファにある未送信のデータポイントの数 (送信中のものを除く)
+	Submitted  uint64 // Submit に渡されたデータポイントの数
+	Sent       uint64 // 送信に成功したデータポイントの数
+	Dropped    uint64 // バッファが満杯のために破棄したデータポイントの数
+	Aggregated uint64 // バッファが満杯のために統合したデータポイントの数
+	Failed     uint64 // 再試行しても解決しない送信エラーにより破棄したデータポイントの数
+}
+
+// Sender はデータポイントをバッファに蓄積し、非同期にまとめて送信します。
+//
+// Sender のメソッドは複数の goroutine から同時に呼び出すことができます。
+// フィールドは最初の [Sender.Submit] の呼び出しより前に設定してください。
+type Sender struct {
+	// Sender はデータポイントを送信する [ambidata.Sender] です。
+	Sender *ambidata.Sender
+
+	// Interval は送信間隔です。
+	// 0 以下の場合は、 [ambidata.MinSendInterval] が使用されます。
+	Interval time.Duration
+
+	// BufferSize はバッファに保持する最大のデータポイント数です。
+	// 送信中のデータポイントはバッファから取り出されているため含みません。
+	// 0 以下の場合は、 [DefaultBufferSize] が使用されます。
+	BufferSize int
+
+	// MaxBatch は1回の送信に含める最大のデータポイント数です。
+	// 0 以下の場合は、 [DefaultMaxBatch] が使用されます。
+	MaxBatch int
+
+	// Policy はバッファが満杯の場合の動作です。
+	Policy Policy
+
+	// OnError は送信エラーが発生した場合に呼び出されます。
+	// 再試行しても解決しないエラーの場合、送信しようとしたデータポイントは破棄されます。
+	// nil の場合は、エラーは無視されます。
+	OnError func(err error)
+
+	mu      sync.Mutex
+	batcher *batch.Batcher
+	stats   Stats
+	closed  bool
+	space   chan struct{}             // 送信によりバッファに空きができたときに close される
+	n       [len(ambidata.Fields)]int // バッファの最も新しいデータポイントに統合したデータポイントの数
+}
+
+// errFull はバッファが満杯であることを表す内部のエラーです。
+var errFull = errors.New("async: buffer is full")
+
+// New は s で送信する新しい [Sender] を作成します。
+func New(s *ambidata.Sender) *Sender {
+	return &Sender{Sender: s}
+}
+
+// Submit はデータポイントをバッファに追加します。
+// データポイントは追加された順序で送信されます。
+//
+// バッファが満杯の場合の動作は [Sender.Policy] に従います。
+// [Block] の場合、ctx が終了するとデータポイントを追加せずに ctx.Err() を返します。
+func (s *Sender) Submit(ctx context.Context, data ambidata.Data) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	s.start()
+	s.stats.Submitted++
+
+	for {
+		space := s.space
+		err := s.batcher.Update(s.Sender, func(pending []ambidata.Data) ([]ambidata.Data, error) {
+			return s.push(pending, &data)
+		})
+		if !errors.Is(err, errFull) {
+			return err
+		}
+
+		// Block
+		s.mu.Unlock()
+		select {
+		case <-space:
+		case <-ctx.Done():
+			s.mu.Lock()
+			return ctx.Err()
+		}
+		s.mu.Lock()
+		if s.closed {
+			return ErrClosed
+		}
+	}
+}
+
+// push は Policy に従って pending に data を追加した結果を返します。
+// s.mu をロックした状態で呼び出してください。
+func (s *Sender) push(pending []ambidata.Data, data *ambidata.Data) ([]ambidata.Data, error) {
+	for len(pending) >= s.bufferSize() {
+		switch s.Policy {
+		case DropNewest:
+			s.stats.Dropped++
+			return nil, ErrDropped
+		case Block:
+			return nil, errFull
+		case Aggregate:
+			if len(pending) > 0 {
+				s.aggregate(&pending[len(pending)-1], data)
+				s.stats.Aggregated++
+				return pending, nil
+			}
+		}
+		// DropOldest
+		pending = pending[1:]
+		s.stats.Dropped++
+	}
+
+	for i, f := range ambidata.Fields {
+		s.n[i] = 0
+		if data.Field(f).OK {
+			s.n[i] = 1
+		}
+	}
+	return append(pending, *data), nil
+}
+
+// Stats は統計情報を返します。
+func (s *Sender) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.stats
+	if s.batcher != nil {
+		st.Depth = s.batcher.Queued(s.Sender.Ch)
+	}
+	return st
+}
+
+// Close は新たなデータポイントの追加を停止し、バッファに残っているデータポイントを送信します。
+// 全てのデータポイントの送信が完了するか、ctx が終了するまで待機します。
+// ctx が終了した場合、未送信のデータポイントは破棄され、その数を含むエラーを返します。
+func (s *Sender) Close(ctx context.Context) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	b := s.batcher
+	if b != nil {
+		close(s.space) // ブロックしている Submit を解放する
+	}
+	s.mu.Unlock()
+	if b == nil {
+		return nil
+	}
+
+	err := b.Close(ctx)
+	var ue *batch.UnsentError
+	if !errors.As(err, &ue) {
+		return err
+	}
+	n := 0
+	for _, arr := range ue.Unsent {
+		n += len(arr)
+	}
+	return fmt.Errorf("async: %w (%d data points unsent)", ue.Err, n)
+}
+
+// start は送信に使用する [batch.Batcher] を作成します。
+// s.mu をロックした状態で呼び出してください。
+func (s *Sender) start() {
+	if s.batcher != nil {
+		return
+	}
+	s.space = make(chan struct{})
+	s.batcher = &batch.Batcher{
+		Interval: s.Interval,
+		MaxBatch: s.MaxBatch,
+		FIFO:     true,
+		OnError:  s.onError,
+		OnSend:   s.onSend,
+	}
+}
+
+func (s *Sender) onError(ch string, err error) {
+	if s.OnError != nil {
+		s.OnError(err)
+	}
+}
+
+func (s *Sender) onSend(ch string, arr []ambidata.Data, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case err == nil:
+		s.stats.Sent += uint64(len(arr))
+	case !batch.Retryable(err):
+		s.stats.Failed += uint64(len(arr))
+	}
+
+	// ブロックしている Submit にバッファの空きを通知する
+	if !s.closed {
+		close(s.space)
+		s.space = make(chan struct{})
+	}
+}
+
+func (s *Sender) bufferSize() int {
+	if s.BufferSize <= 0 {
+		return DefaultBufferSize
+	}
+	return s.BufferSize
+}
+
+// aggregate は data をバッファの最も新しいデータポイント dst に統合します。
+// s.mu をロックした状態で呼び出してください。
+func (s *Sender) aggregate(dst *ambidata.Data, data *ambidata.Data) {
+	for i, f := range ambidata.Fields {
+		v := data.Field(f)
+		if !v.OK {
+			continue
+		}
+		cur := dst.Field(f)
+		if !cur.OK {
+			dst.SetField(f, v)
+			s.n[i] = 1
+			continue
+		}
+		s.n[i]++
+		cur.V += (v.V - cur.V) / float64(s.n[i])
+		dst.SetField(f, cur)
+	}
+	dst.Created = data.Created
+	if data.Loc.OK {
+		dst.Loc = data.Loc
+	}
+	if data.Cmnt != "" {
+		dst.Cmnt = data.Cmnt
+	}
+}
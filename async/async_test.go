@@ -0,0 +1,243 @@
+package async
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/internal/ambimock"
+	"github.com/google/go-cmp/cmp"
+)
+
+var t0 = time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+
+func point(i int) ambidata.Data {
+	return ambidata.Data{Created: t0.Add(time.Duration(i) * time.Second), D1: ambidata.Just(float64(i))}
+}
+
+// sentValues は送信されたデータポイントの D1 の値を送信順に返します。
+func sentValues(t *testing.T, srv *ambimock.Server) []float64 {
+	ret := []float64{}
+	for _, req := range srv.Requests() {
+		if req.Method != http.MethodPost {
+			continue
+		}
+		var j struct {
+			Data []struct {
+				D1 float64 `json:"d1"`
+			} `json:"data"`
+		}
+		err := json.Unmarshal(req.Body, &j)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range j.Data {
+			ret = append(ret, d.D1)
+		}
+	}
+	return ret
+}
+
+// newBlocked は最初の送信をブロックするサーバーと Sender を作成し、
+// 最初のデータポイント (値 0) が送信中になるまで待機します。
+// 戻り値の関数を呼び出すと、ブロックを解除します。
+func newBlocked(t *testing.T, s *Sender) (*ambimock.Server, func()) {
+	srv := ambimock.New(t)
+	srv.AddChannel(&ambimock.Channel{Info: ambidata.ChannelInfo{Ch: "1"}, ReadKey: "rk", WriteKey: "wk"})
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	var first atomic.Bool
+	srv.Hook = func(r *http.Request) int {
+		if !first.Swap(true) {
+			close(entered)
+			<-release
+		}
+		return 0
+	}
+
+	s.Sender = srv.Sender("1")
+	s.Interval = time.Millisecond
+	err := s.Submit(context.Background(), point(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-entered
+	return srv, func() { close(release) }
+}
+
+func TestSender(t *testing.T) {
+	srv := ambimock.New(t)
+	srv.AddChannel(&ambimock.Channel{Info: ambidata.ChannelInfo{Ch: "1"}, ReadKey: "rk", WriteKey: "wk"})
+	s := New(srv.Sender("1"))
+	s.Interval = 10 * time.Millisecond
+
+	want := []float64{}
+	for i := range 20 {
+		err := s.Submit(context.Background(), point(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, float64(i))
+		time.Sleep(time.Millisecond)
+	}
+	err := s.Close(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(want, sentValues(t, srv)); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(Stats{Submitted: 20, Sent: 20}, s.Stats()); diff != "" {
+		t.Errorf("Stats: mismatch (-want, +got):\n%s", diff)
+	}
+	if n := len(srv.Requests()); n >= 20 {
+		t.Errorf("expected data points to be coalesced, got %d requests", n)
+	}
+}
+
+func TestSenderPolicy(t *testing.T) {
+	tests := []struct {
+		policy    Policy
+		wantErrs  []error
+		wantSent  []float64
+		wantStats Stats
+	}{
+		{
+			policy:    DropOldest,
+			wantErrs:  []error{nil, nil, nil, nil, nil},
+			wantSent:  []float64{0, 3, 4, 5},
+			wantStats: Stats{Submitted: 6, Sent: 4, Dropped: 2},
+		},
+		{
+			policy:    DropNewest,
+			wantErrs:  []error{nil, nil, nil, ErrDropped, ErrDropped},
+			wantSent:  []float64{0, 1, 2, 3},
+			wantStats: Stats{Submitted: 6, Sent: 4, Dropped: 2},
+		},
+		{
+			policy:    Aggregate,
+			wantErrs:  []error{nil, nil, nil, nil, nil},
+			wantSent:  []float64{0, 1, 2, 4},
+			wantStats: Stats{Submitted: 6, Sent: 4, Aggregated: 2},
+		},
+	}
+
+	for _, tt := range tests {
+		s := &Sender{BufferSize: 3, Policy: tt.policy}
+		srv, release := newBlocked(t, s)
+
+		var errs []error
+		for i := 1; i <= 5; i++ {
+			errs = append(errs, s.Submit(context.Background(), point(i)))
+		}
+		if diff := cmp.Diff(tt.wantErrs, errs, cmp.Comparer(func(a, b error) bool { return errors.Is(a, b) })); diff != "" {
+			t.Errorf("policy %d: errors: mismatch (-want, +got):\n%s", tt.policy, diff)
+		}
+		if depth := s.Stats().Depth; depth != 3 {
+			t.Errorf("policy %d: Depth: expected 3, got %d", tt.policy, depth)
+		}
+
+		release()
+		err := s.Close(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(tt.wantSent, sentValues(t, srv)); diff != "" {
+			t.Errorf("policy %d: sent: mismatch (-want, +got):\n%s", tt.policy, diff)
+		}
+		if diff := cmp.Diff(tt.wantStats, s.Stats()); diff != "" {
+			t.Errorf("policy %d: Stats: mismatch (-want, +got):\n%s", tt.policy, diff)
+		}
+	}
+}
+
+func TestSenderAggregate(t *testing.T) {
+	s := &Sender{BufferSize: 1, Policy: Aggregate}
+	srv, release := newBlocked(t, s)
+
+	s.Submit(context.Background(), ambidata.Data{Created: t0, D1: ambidata.Just(1.0)})
+	s.Submit(context.Background(), ambidata.Data{Created: t0.Add(time.Second), D1: ambidata.Just(2.0), D2: ambidata.Just(5.0), Cmnt: "c"})
+	s.Submit(context.Background(), ambidata.Data{Created: t0.Add(2 * time.Second), D1: ambidata.Just(6.0)})
+	release()
+	err := s.Close(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := ambidata.Data{Created: t0.Add(2 * time.Second), D1: ambidata.Just(3.0), D2: ambidata.Just(5.0), Cmnt: "c"}
+	got := srv.Data("1")
+	if len(got) != 2 {
+		t.Fatalf("expected 2 data points, got %d", len(got))
+	}
+	if diff := cmp.Diff(want, got[1]); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestSenderBlock(t *testing.T) {
+	s := &Sender{BufferSize: 1, Policy: Block}
+	srv, release := newBlocked(t, s)
+
+	err := s.Submit(context.Background(), point(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = s.Submit(ctx, point(2))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- s.Submit(context.Background(), point(3))
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("expected Submit to block, got %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	release()
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Close(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]float64{0, 1, 3}, sentValues(t, srv)); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestSenderClose(t *testing.T) {
+	s := &Sender{}
+	_, release := newBlocked(t, s)
+	defer release()
+
+	s.Submit(context.Background(), point(1))
+	s.Submit(context.Background(), point(2))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := s.Close(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	err = s.Submit(context.Background(), point(3))
+	if !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
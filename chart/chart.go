@@ -0,0 +1,348 @@
+// Package chart は、チャネルのデータを折れ線グラフとして描画する機能を提供します。
+//
+// グラフは SVG 形式 ([RenderSVG]) または PNG 形式 ([RenderPNG]) で出力できます。
+// 各データフィールドの線には、チャネル情報で設定されたデータ名と色 ([ambidata.FieldColor]) が使用されます。
+// 値が無いデータポイント ([ambidata.Maybe] の OK が false) の箇所では線が途切れます。
+package chart
+
+import (
+	"image/color"
+	"math"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+)
+
+// Options 構造体で値を設定しなかった場合に使用されるデフォルト値。
+const (
+	DefaultWidth  = 800 // [Options.Width] のデフォルト値
+	DefaultHeight = 400 // [Options.Height] のデフォルト値
+)
+
+// Options はグラフの描画設定を保持する構造体です。
+//
+// ゼロ値の Options 構造体は、デフォルトの設定を使用する有効な構成となります。
+type Options struct {
+	// Width と Height は画像の幅と高さをピクセル単位で指定します。
+	// 0 以下の場合は、 [DefaultWidth] と [DefaultHeight] が使用されます。
+	Width  int
+	Height int
+
+	// Title はグラフのタイトルを指定します。
+	// 空文字列の場合は、 [ambidata.ChannelInfo.ChName] が使用されます。
+	Title string
+
+	// Fields は描画するデータフィールドを指定します。
+	// nil の場合は、データ名が設定されているか値が存在するフィールドを全て描画します。
+	Fields []ambidata.Field
+
+	// Location は時間軸の目盛りを表示するタイムゾーンを指定します。
+	// nil の場合は、 [time.Local] が使用されます。
+	Location *time.Location
+
+	// TimeFormat は時間軸の目盛りの書式を [time.Time.Format] の形式で指定します。
+	// 空文字列の場合は、表示する期間に応じて自動的に選択されます。
+	TimeFormat string
+
+	// ShowHidden が true の場合、非表示フラグ ([ambidata.Data.Hide]) が設定された
+	// データポイントも描画します。
+	ShowHidden bool
+}
+
+var (
+	colorBackground = color.RGBA{0xFF, 0xFF, 0xFF, 0xFF}
+	colorAxis       = color.RGBA{0x33, 0x33, 0x33, 0xFF}
+	colorGrid       = color.RGBA{0xDD, 0xDD, 0xDD, 0xFF}
+	colorText       = color.RGBA{0x33, 0x33, 0x33, 0xFF}
+)
+
+const (
+	marginLeft   = 64
+	marginRight  = 16
+	marginTop    = 32
+	marginBottom = 48
+	legendHeight = 16
+)
+
+// series は1つのデータフィールドの描画内容を表します。
+type series struct {
+	Name     string
+	Color    color.RGBA
+	Segments [][]point // 値が連続している区間ごとの点列
+}
+
+type point struct {
+	T time.Time
+	V float64
+}
+
+// layout は描画に必要な計算済みの情報を保持します。
+type layout struct {
+	Width, Height int
+	Title         string
+	Series        []series
+
+	// プロット領域 (ピクセル座標)
+	X0, Y0, X1, Y1 float64
+
+	TMin, TMax time.Time
+	VMin, VMax float64
+
+	XTicks []tick
+	YTicks []tick
+}
+
+type tick struct {
+	Pos   float64 // ピクセル座標
+	Label string
+}
+
+func newLayout(info *ambidata.ChannelInfo, arr []ambidata.Data, opt *Options) *layout {
+	if opt == nil {
+		opt = &Options{}
+	}
+	loc := opt.Location
+	if loc == nil {
+		loc = time.Local
+	}
+
+	l := &layout{
+		Width:  opt.Width,
+		Height: opt.Height,
+		Title:  opt.Title,
+	}
+	if l.Width <= 0 {
+		l.Width = DefaultWidth
+	}
+	if l.Height <= 0 {
+		l.Height = DefaultHeight
+	}
+	if l.Title == "" {
+		l.Title = info.ChName
+	}
+
+	// Fetcher から取得したデータは新しい順に並んでいるため、時刻順に並べ替える
+	sorted := slices.Clone(arr)
+	slices.SortStableFunc(sorted, func(a, b ambidata.Data) int {
+		return a.Created.Compare(b.Created)
+	})
+	if !opt.ShowHidden {
+		sorted = slices.DeleteFunc(sorted, func(d ambidata.Data) bool { return d.Hide })
+	}
+
+	fields := opt.Fields
+	if fields == nil {
+		for _, f := range ambidata.Fields {
+			if info.Field(f).Name != "" || hasValue(sorted, f) {
+				fields = append(fields, f)
+			}
+		}
+	}
+
+	first := true
+	for _, f := range fields {
+		s := newSeries(info, sorted, f)
+		for _, seg := range s.Segments {
+			for _, p := range seg {
+				if first {
+					l.TMin, l.TMax = p.T, p.T
+					l.VMin, l.VMax = p.V, p.V
+					first = false
+					continue
+				}
+				if p.T.Before(l.TMin) {
+					l.TMin = p.T
+				}
+				if p.T.After(l.TMax) {
+					l.TMax = p.T
+				}
+				l.VMin = math.Min(l.VMin, p.V)
+				l.VMax = math.Max(l.VMax, p.V)
+			}
+		}
+		l.Series = append(l.Series, s)
+	}
+	if first && len(sorted) > 0 {
+		l.TMin = sorted[0].Created
+		l.TMax = sorted[len(sorted)-1].Created
+	}
+	if !l.TMax.After(l.TMin) {
+		l.TMin = l.TMin.Add(-30 * time.Minute)
+		l.TMax = l.TMax.Add(30 * time.Minute)
+	}
+
+	l.X0 = marginLeft
+	l.Y0 = marginTop
+	l.X1 = float64(l.Width - marginRight)
+	l.Y1 = float64(l.Height - marginBottom - legendHeight)
+	if l.X1 <= l.X0 {
+		l.X1 = l.X0 + 1
+	}
+	if l.Y1 <= l.Y0 {
+		l.Y1 = l.Y0 + 1
+	}
+
+	var step float64
+	l.VMin, l.VMax, step = niceRange(l.VMin, l.VMax, 5)
+	// 値の絶対値が大きいと v += step で値が変化しない場合があるため、目盛りの数を先に求める
+	n := int(math.Round((l.VMax - l.VMin) / step))
+	for i := 0; i <= n; i++ {
+		v := l.VMin + float64(i)*step
+		l.YTicks = append(l.YTicks, tick{
+			Pos:   l.y(v),
+			Label: strconv.FormatFloat(v, 'f', decimals(step), 64),
+		})
+	}
+
+	tstep := timeStep(l.TMax.Sub(l.TMin), 6)
+	format := opt.TimeFormat
+	if format == "" {
+		format = timeFormat(tstep, l.TMin.In(loc), l.TMax.In(loc))
+	}
+	for _, t := range timeTicks(l.TMin, l.TMax, tstep, loc) {
+		l.XTicks = append(l.XTicks, tick{
+			Pos:   l.x(t),
+			Label: t.In(loc).Format(format),
+		})
+	}
+	return l
+}
+
+func newSeries(info *ambidata.ChannelInfo, arr []ambidata.Data, f ambidata.Field) series {
+	fi := info.Field(f)
+	s := series{Name: fi.Name, Color: fieldColor(fi.Color, f)}
+	if s.Name == "" {
+		s.Name = f.String()
+	}
+
+	var seg []point
+	for i := range arr {
+		v := arr[i].Field(f)
+		if !v.OK || math.IsNaN(v.V) || math.IsInf(v.V, 0) {
+			if len(seg) > 0 {
+				s.Segments = append(s.Segments, seg)
+				seg = nil
+			}
+			continue
+		}
+		seg = append(seg, point{T: arr[i].Created, V: v.V})
+	}
+	if len(seg) > 0 {
+		s.Segments = append(s.Segments, seg)
+	}
+	return s
+}
+
+func hasValue(arr []ambidata.Data, f ambidata.Field) bool {
+	for i := range arr {
+		if arr[i].Field(f).OK {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldColor は色IDを RGBA 値に変換します。
+// 色IDが無効な場合は、Ambient と同じくフィールド番号に対応する色を使用します。
+func fieldColor(c ambidata.FieldColor, f ambidata.Field) color.RGBA {
+	if rgba, ok := c.ToRGBA(); ok {
+		return rgba
+	}
+	rgba, _ := ambidata.FieldColor(strconv.Itoa(int(f))).ToRGBA()
+	return rgba
+}
+
+func (l *layout) x(t time.Time) float64 {
+	r := float64(t.Sub(l.TMin)) / float64(l.TMax.Sub(l.TMin))
+	return l.X0 + r*(l.X1-l.X0)
+}
+
+func (l *layout) y(v float64) float64 {
+	r := (v - l.VMin) / (l.VMax - l.VMin)
+	return l.Y1 - r*(l.Y1-l.Y0)
+}
+
+// niceRange は [lo, hi] を含み、目盛りの間隔がきりの良い値になるような範囲を返します。
+func niceRange(lo, hi float64, n int) (nlo, nhi, step float64) {
+	if hi <= lo {
+		d := math.Max(math.Abs(lo)*0.1, 1)
+		lo -= d
+		hi += d
+	}
+	step = niceNum((hi - lo) / float64(n-1))
+	nlo = math.Floor(lo/step) * step
+	nhi = math.Ceil(hi/step) * step
+	return nlo, nhi, step
+}
+
+func niceNum(x float64) float64 {
+	exp := math.Floor(math.Log10(x))
+	frac := x / math.Pow(10, exp)
+	var nice float64
+	switch {
+	case frac <= 1:
+		nice = 1
+	case frac <= 2:
+		nice = 2
+	case frac <= 5:
+		nice = 5
+	default:
+		nice = 10
+	}
+	return nice * math.Pow(10, exp)
+}
+
+func decimals(step float64) int {
+	d := -int(math.Floor(math.Log10(step)))
+	return max(d, 0)
+}
+
+var timeSteps = []time.Duration{
+	time.Second, 2 * time.Second, 5 * time.Second, 10 * time.Second, 15 * time.Second, 30 * time.Second,
+	time.Minute, 2 * time.Minute, 5 * time.Minute, 10 * time.Minute, 15 * time.Minute, 30 * time.Minute,
+	time.Hour, 2 * time.Hour, 3 * time.Hour, 6 * time.Hour, 12 * time.Hour,
+	24 * time.Hour, 2 * 24 * time.Hour, 7 * 24 * time.Hour, 14 * 24 * time.Hour, 28 * 24 * time.Hour,
+}
+
+func timeStep(span time.Duration, n int) time.Duration {
+	for _, s := range timeSteps {
+		if span/s <= time.Duration(n) {
+			return s
+		}
+	}
+	return timeSteps[len(timeSteps)-1]
+}
+
+// timeTicks は tmin から tmax までの間で、タイムゾーン loc においてきりの良い時刻を返します。
+func timeTicks(tmin, tmax time.Time, step time.Duration, loc *time.Location) []time.Time {
+	lt := tmin.In(loc)
+	t := time.Date(lt.Year(), lt.Month(), lt.Day(), 0, 0, 0, 0, loc)
+	if step < 24*time.Hour {
+		n := lt.Sub(t) / step
+		t = t.Add(n * step)
+	}
+
+	var ticks []time.Time
+	for ; !t.After(tmax); t = t.Add(step) {
+		if !t.Before(tmin) {
+			ticks = append(ticks, t)
+		}
+	}
+	return ticks
+}
+
+func timeFormat(step time.Duration, tmin, tmax time.Time) string {
+	sameDay := tmin.Year() == tmax.Year() && tmin.YearDay() == tmax.YearDay()
+	switch {
+	case step < time.Minute:
+		return "15:04:05"
+	case step < 24*time.Hour && sameDay:
+		return "15:04"
+	case step < 24*time.Hour:
+		return "01/02 15:04"
+	default:
+		return "2006/01/02"
+	}
+}
@@ -0,0 +1,181 @@
+package chart
+
+import (
+	"bytes"
+	"encoding/xml"
+	"image/png"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/google/go-cmp/cmp"
+)
+
+var testInfo = ambidata.ChannelInfo{
+	ChName: "room",
+	D1:     ambidata.FieldInfo{Name: "temp", Color: ambidata.FieldColorRed},
+	D2:     ambidata.FieldInfo{Name: "humi", Color: ""},
+}
+
+func testData() []ambidata.Data {
+	base := time.Date(2006, 1, 2, 15, 0, 0, 0, time.UTC)
+	return []ambidata.Data{
+		{Created: base.Add(40 * time.Minute), D1: ambidata.Just(24.0), D2: ambidata.Just(50.0)},
+		{Created: base.Add(30 * time.Minute), D1: ambidata.Just(23.0)},
+		{Created: base.Add(20 * time.Minute), D2: ambidata.Just(52.0)},
+		{Created: base.Add(10 * time.Minute), D1: ambidata.Just(21.0), D2: ambidata.Just(55.0)},
+		{Created: base, D1: ambidata.Just(20.0), D2: ambidata.Just(60.0)},
+	}
+}
+
+func TestNewLayoutSeries(t *testing.T) {
+	base := time.Date(2006, 1, 2, 15, 0, 0, 0, time.UTC)
+	l := newLayout(&testInfo, testData(), nil)
+
+	if len(l.Series) != 2 {
+		t.Fatalf("series: expected 2, got %d", len(l.Series))
+	}
+
+	d1 := l.Series[0]
+	if d1.Name != "temp" {
+		t.Errorf("d1: name: expected %#v, got %#v", "temp", d1.Name)
+	}
+	if want, _ := ambidata.FieldColorRed.ToRGBA(); d1.Color != want {
+		t.Errorf("d1: color: expected %#v, got %#v", want, d1.Color)
+	}
+	wantSeg := [][]point{
+		{{T: base, V: 20}, {T: base.Add(10 * time.Minute), V: 21}},
+		{{T: base.Add(30 * time.Minute), V: 23}, {T: base.Add(40 * time.Minute), V: 24}},
+	}
+	if diff := cmp.Diff(wantSeg, d1.Segments); diff != "" {
+		t.Errorf("d1: segments: mismatch (-want, +got)\n%s", diff)
+	}
+
+	d2 := l.Series[1]
+	if want, _ := ambidata.FieldColorRed.ToRGBA(); d2.Color != want {
+		// 色が未設定の場合はフィールド番号に対応する色 (d2 は赤) になる
+		t.Errorf("d2: color: expected %#v, got %#v", want, d2.Color)
+	}
+	if len(d2.Segments) != 2 || len(d2.Segments[0]) != 3 || len(d2.Segments[1]) != 1 {
+		t.Errorf("d2: segments: expected segments of 3 and 1 points, got %#v", d2.Segments)
+	}
+}
+
+func TestNewLayoutHidden(t *testing.T) {
+	arr := testData()
+	arr[0].Hide = true
+
+	l := newLayout(&testInfo, arr, &Options{Fields: []ambidata.Field{ambidata.FieldD1}})
+	if n := len(l.Series[0].Segments[1]); n != 1 {
+		t.Errorf("hidden: expected 1 point, got %d", n)
+	}
+
+	l = newLayout(&testInfo, arr, &Options{Fields: []ambidata.Field{ambidata.FieldD1}, ShowHidden: true})
+	if n := len(l.Series[0].Segments[1]); n != 2 {
+		t.Errorf("show hidden: expected 2 points, got %d", n)
+	}
+}
+
+func TestNewLayoutTimeTicks(t *testing.T) {
+	jst := time.FixedZone("JST", 9*60*60)
+	l := newLayout(&testInfo, testData(), &Options{Location: jst})
+
+	var got []string
+	for _, tk := range l.XTicks {
+		got = append(got, tk.Label)
+	}
+	want := []string{"00:00", "00:10", "00:20", "00:30", "00:40"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want, +got)\n%s", diff)
+	}
+}
+
+func TestNewLayoutTimeFormat(t *testing.T) {
+	l := newLayout(&testInfo, testData(), &Options{Location: time.UTC, TimeFormat: "15h04"})
+	if got := l.XTicks[0].Label; got != "15h00" {
+		t.Errorf("expected %#v, got %#v", "15h00", got)
+	}
+}
+
+func TestNewLayoutEmpty(t *testing.T) {
+	l := newLayout(&testInfo, nil, nil)
+	if !l.TMax.After(l.TMin) {
+		t.Errorf("time range: expected non-empty, got %s - %s", l.TMin, l.TMax)
+	}
+	if !(l.VMax > l.VMin) {
+		t.Errorf("value range: expected non-empty, got %v - %v", l.VMin, l.VMax)
+	}
+}
+
+func TestNewLayoutLargeValues(t *testing.T) {
+	// 1e17 付近では浮動小数点数の間隔が目盛りの間隔より大きくなる
+	base := time.Date(2006, 1, 2, 15, 0, 0, 0, time.UTC)
+	arr := []ambidata.Data{
+		{Created: base, D1: ambidata.Just(1e17)},
+		{Created: base.Add(time.Minute), D1: ambidata.Just(1e17 + 16)},
+	}
+
+	l := newLayout(&testInfo, arr, nil)
+	if n := len(l.YTicks); n < 2 || n > 10 {
+		t.Errorf("y ticks: expected 2 to 10 ticks, got %d", n)
+	}
+}
+
+func TestRenderSVG(t *testing.T) {
+	info := testInfo
+	info.ChName = "a<b"
+
+	var buf bytes.Buffer
+	if err := RenderSVG(&buf, &info, testData(), nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	s := buf.String()
+	d := xml.NewDecoder(&buf)
+	for {
+		_, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("xml: %v", err)
+		}
+	}
+
+	for _, want := range []string{"a&lt;b", "temp", "humi", "#dc3912"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("expected to contain %#v", want)
+		}
+	}
+}
+
+func TestRenderPNG(t *testing.T) {
+	var buf bytes.Buffer
+	opt := &Options{Width: 320, Height: 240}
+	if err := RenderPNG(&buf, &testInfo, testData(), opt); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatalf("png: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 320 || b.Dy() != 240 {
+		t.Errorf("size: expected 320x240, got %dx%d", b.Dx(), b.Dy())
+	}
+
+	want, _ := ambidata.FieldColorRed.ToRGBA()
+	found := false
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y && !found; y++ {
+		for x := b.Min.X; x < b.Max.X && !found; x++ {
+			r, g, bl, _ := img.At(x, y).RGBA()
+			found = uint8(r>>8) == want.R && uint8(g>>8) == want.G && uint8(bl>>8) == want.B
+		}
+	}
+	if !found {
+		t.Errorf("expected to contain a pixel of field color %#v", want)
+	}
+}
@@ -0,0 +1,110 @@
+package chart
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+
+	"github.com/gcrtnst/ambidata"
+)
+
+// RenderPNG はチャネル情報 info とデータ arr から折れ線グラフを描画し、PNG 形式で w に書き込みます。
+// arr の並び順は問いません。
+// opt が nil の場合は、デフォルトの設定が使用されます。
+//
+// PNG 出力では簡易的なビットマップフォントを使用するため、英数字と一部の記号以外の文字は
+// '?' として描画されます。
+func RenderPNG(w io.Writer, info *ambidata.ChannelInfo, arr []ambidata.Data, opt *Options) error {
+	img := Draw(info, arr, opt)
+	return png.Encode(w, img)
+}
+
+// Draw はチャネル情報 info とデータ arr から折れ線グラフを描画し、画像として返します。
+// 描画内容は [RenderPNG] と同じです。
+func Draw(info *ambidata.ChannelInfo, arr []ambidata.Data, opt *Options) *image.RGBA {
+	l := newLayout(info, arr, opt)
+	img := image.NewRGBA(image.Rect(0, 0, l.Width, l.Height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(colorBackground), image.Point{}, draw.Src)
+
+	if l.Title != "" {
+		drawText(img, marginLeft, marginTop-12-glyphHeight, l.Title, colorText)
+	}
+
+	for _, t := range l.YTicks {
+		y := int(math.Round(t.Pos))
+		drawLine(img, l.X0, t.Pos, l.X1, t.Pos, colorGrid, 1)
+		drawText(img, int(l.X0)-6-textWidth(t.Label), y-glyphHeight/2, t.Label, colorText)
+	}
+	for _, t := range l.XTicks {
+		x := int(math.Round(t.Pos))
+		drawLine(img, t.Pos, l.Y0, t.Pos, l.Y1, colorGrid, 1)
+		drawText(img, x-textWidth(t.Label)/2, int(l.Y1)+8, t.Label, colorText)
+	}
+	drawLine(img, l.X0, l.Y0, l.X0, l.Y1, colorAxis, 1)
+	drawLine(img, l.X0, l.Y1, l.X1, l.Y1, colorAxis, 1)
+
+	for _, s := range l.Series {
+		for _, seg := range s.Segments {
+			if len(seg) == 1 {
+				fillRect(img, int(l.x(seg[0].T))-1, int(l.y(seg[0].V))-1, 3, 3, s.Color)
+				continue
+			}
+			for i := 1; i < len(seg); i++ {
+				drawLine(img, l.x(seg[i-1].T), l.y(seg[i-1].V), l.x(seg[i].T), l.y(seg[i].V), s.Color, 2)
+			}
+		}
+	}
+
+	x := int(l.X0)
+	y := l.Height - legendHeight - glyphHeight + 1
+	for _, s := range l.Series {
+		fillRect(img, x, y-1, 9, 9, s.Color)
+		drawText(img, x+14, y, s.Name, colorText)
+		x += 14 + textWidth(s.Name) + 16
+	}
+	return img
+}
+
+// drawLine は (x0, y0) から (x1, y1) まで太さ width の線を描画します。
+func drawLine(img *image.RGBA, x0, y0, x1, y1 float64, c color.RGBA, width int) {
+	dx := x1 - x0
+	dy := y1 - y0
+	n := int(math.Ceil(math.Max(math.Abs(dx), math.Abs(dy))))
+	if n == 0 {
+		n = 1
+	}
+	off := (width - 1) / 2
+	for i := 0; i <= n; i++ {
+		r := float64(i) / float64(n)
+		x := int(math.Round(x0+dx*r)) - off
+		y := int(math.Round(y0+dy*r)) - off
+		fillRect(img, x, y, width, width, c)
+	}
+}
+
+func fillRect(img *image.RGBA, x, y, w, h int, c color.RGBA) {
+	r := image.Rect(x, y, x+w, y+h).Intersect(img.Bounds())
+	for py := r.Min.Y; py < r.Max.Y; py++ {
+		for px := r.Min.X; px < r.Max.X; px++ {
+			img.SetRGBA(px, py, c)
+		}
+	}
+}
+
+// drawText は左上を (x, y) として文字列 s を描画します。
+func drawText(img *image.RGBA, x, y int, s string, c color.RGBA) {
+	for _, r := range s {
+		g := glyph(r)
+		for gy, row := range g {
+			for gx := 0; gx < glyphWidth; gx++ {
+				if row[gx] == '#' {
+					fillRect(img, x+gx, y+gy, 1, 1, c)
+				}
+			}
+		}
+		x += glyphAdvance
+	}
+}
@@ -0,0 +1,74 @@
+package chart
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"image/color"
+	"io"
+	"strings"
+
+	"github.com/gcrtnst/ambidata"
+)
+
+// RenderSVG はチャネル情報 info とデータ arr から折れ線グラフを描画し、SVG 形式で w に書き込みます。
+// arr の並び順は問いません。
+// opt が nil の場合は、デフォルトの設定が使用されます。
+func RenderSVG(w io.Writer, info *ambidata.ChannelInfo, arr []ambidata.Data, opt *Options) error {
+	l := newLayout(info, arr, opt)
+	b := bufio.NewWriter(w)
+
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="11">`+"\n", l.Width, l.Height, l.Width, l.Height)
+	fmt.Fprintf(b, `<rect width="100%%" height="100%%" fill="%s"/>`+"\n", hex(colorBackground))
+
+	if l.Title != "" {
+		fmt.Fprintf(b, `<text x="%d" y="%d" font-size="14" fill="%s">%s</text>`+"\n", marginLeft, marginTop-12, hex(colorText), escape(l.Title))
+	}
+
+	for _, t := range l.YTicks {
+		fmt.Fprintf(b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="%s"/>`+"\n", l.X0, t.Pos, l.X1, t.Pos, hex(colorGrid))
+		fmt.Fprintf(b, `<text x="%.1f" y="%.1f" text-anchor="end" dominant-baseline="middle" fill="%s">%s</text>`+"\n", l.X0-6, t.Pos, hex(colorText), escape(t.Label))
+	}
+	for _, t := range l.XTicks {
+		fmt.Fprintf(b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="%s"/>`+"\n", t.Pos, l.Y0, t.Pos, l.Y1, hex(colorGrid))
+		fmt.Fprintf(b, `<text x="%.1f" y="%.1f" text-anchor="middle" fill="%s">%s</text>`+"\n", t.Pos, l.Y1+16, hex(colorText), escape(t.Label))
+	}
+	fmt.Fprintf(b, `<polyline points="%.1f,%.1f %.1f,%.1f %.1f,%.1f" fill="none" stroke="%s"/>`+"\n", l.X0, l.Y0, l.X0, l.Y1, l.X1, l.Y1, hex(colorAxis))
+
+	for _, s := range l.Series {
+		fmt.Fprintf(b, `<g stroke="%s" fill="%s">`+"\n", hex(s.Color), hex(s.Color))
+		for _, seg := range s.Segments {
+			if len(seg) == 1 {
+				fmt.Fprintf(b, `<circle cx="%.1f" cy="%.1f" r="2"/>`+"\n", l.x(seg[0].T), l.y(seg[0].V))
+				continue
+			}
+			pts := make([]string, len(seg))
+			for i, p := range seg {
+				pts[i] = fmt.Sprintf("%.1f,%.1f", l.x(p.T), l.y(p.V))
+			}
+			fmt.Fprintf(b, `<polyline points="%s" fill="none" stroke-width="1.5"/>`+"\n", strings.Join(pts, " "))
+		}
+		fmt.Fprintf(b, "</g>\n")
+	}
+
+	x := l.X0
+	y := float64(l.Height - legendHeight)
+	for _, s := range l.Series {
+		fmt.Fprintf(b, `<rect x="%.1f" y="%.1f" width="10" height="10" fill="%s"/>`+"\n", x, y-9, hex(s.Color))
+		fmt.Fprintf(b, `<text x="%.1f" y="%.1f" fill="%s">%s</text>`+"\n", x+14, y, hex(colorText), escape(s.Name))
+		x += 14 + float64(7*len([]rune(s.Name))) + 16
+	}
+
+	fmt.Fprintf(b, "</svg>\n")
+	return b.Flush()
+}
+
+func hex(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+func escape(s string) string {
+	b := &strings.Builder{}
+	_ = xml.EscapeText(b, []byte(s))
+	return b.String()
+}
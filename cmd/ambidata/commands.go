@@ -0,0 +1,997 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/annotate"
+	"github.com/gcrtnst/ambidata/archive"
+	"github.com/gcrtnst/ambidata/dataio"
+	"github.com/gcrtnst/ambidata/diff"
+	"github.com/gcrtnst/ambidata/migrate"
+	"github.com/gcrtnst/ambidata/outlier"
+	"github.com/gcrtnst/ambidata/report"
+)
+
+func runChannels(ctx context.Context, e *Env, args []string) error {
+	pos, err := parseArgs(e.Flags, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) > 0 {
+		return usageErrorf("unexpected arguments: %q", pos)
+	}
+
+	m, err := e.manager()
+	if err != nil {
+		return err
+	}
+	arr, err := m.GetChannelList(ctx)
+	if err != nil {
+		return err
+	}
+	return writeChannels(e.Stdout, e.Common.Format, arr)
+}
+
+func runDevChannel(ctx context.Context, e *Env, args []string) error {
+	var lv1 bool
+	e.Flags.BoolVar(&lv1, "lv1", false, "get only the channel ID and write key")
+	pos, err := parseArgs(e.Flags, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) != 1 {
+		return usageErrorf("expected exactly one device key")
+	}
+	devKey := pos[0]
+
+	m, err := e.manager()
+	if err != nil {
+		return err
+	}
+
+	var ca ambidata.ChannelAccess
+	if lv1 {
+		ca1, err := m.GetDeviceChannelLv1(ctx, devKey)
+		if err != nil {
+			return err
+		}
+		ca.Ch = ca1.Ch
+		ca.WriteKey = ca1.WriteKey
+	} else {
+		ca, err = m.GetDeviceChannel(ctx, devKey)
+		if err != nil {
+			return err
+		}
+	}
+	return writeChannel(e.Stdout, e.Common.Format, &ca)
+}
+
+func runInfo(ctx context.Context, e *Env, args []string) error {
+	pos, err := parseArgs(e.Flags, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) > 0 {
+		return usageErrorf("unexpected arguments: %q", pos)
+	}
+
+	f, err := e.fetcher()
+	if err != nil {
+		return err
+	}
+	info, err := f.GetChannel(ctx)
+	if err != nil {
+		return err
+	}
+	return writeChannel(e.Stdout, e.Common.Format, &ambidata.ChannelAccess{ChannelInfo: info})
+}
+
+func runFetch(ctx context.Context, e *Env, args []string) error {
+	var n, skip int
+	var start, end string
+	e.Flags.IntVar(&n, "n", 10, "number of data points to fetch")
+	e.Flags.IntVar(&skip, "skip", 0, "number of latest data points to skip")
+	e.Flags.StringVar(&start, "start", "", "start of the period (RFC 3339, \"now\" or relative such as \"-24h\")")
+	e.Flags.StringVar(&end, "end", "", "end of the period (default now)")
+	pos, err := parseArgs(e.Flags, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) > 0 {
+		return usageErrorf("unexpected arguments: %q", pos)
+	}
+	if start != "" || end != "" {
+		var conflict string
+		e.Flags.Visit(func(f *flag.Flag) {
+			if f.Name == "n" || f.Name == "skip" {
+				conflict = f.Name
+			}
+		})
+		if conflict != "" {
+			return usageErrorf("-%s cannot be used with -start or -end", conflict)
+		}
+	}
+
+	f, err := e.fetcher()
+	if err != nil {
+		return err
+	}
+
+	var arr []ambidata.Data
+	if start != "" || end != "" {
+		now := time.Now()
+		if start == "" {
+			return usageErrorf("-start is required when -end is specified")
+		}
+		stt, err := parseTime(start, now)
+		if err != nil {
+			return &UsageError{Msg: err.Error()}
+		}
+		et := now
+		if end != "" {
+			et, err = parseTime(end, now)
+			if err != nil {
+				return &UsageError{Msg: err.Error()}
+			}
+		}
+		arr, err = f.FetchPeriod(ctx, stt, et)
+		if err != nil {
+			return err
+		}
+	} else {
+		arr, err = f.FetchRange(ctx, n, skip)
+		if err != nil {
+			return err
+		}
+	}
+
+	var info *ambidata.ChannelInfo
+	if e.Common.Format == "table" {
+		ci, err := f.GetChannel(ctx)
+		if err != nil {
+			return err
+		}
+		info = &ci
+	}
+	return writeData(e.Stdout, e.Common.Format, info, arr)
+}
+
+func runSend(ctx context.Context, e *Env, args []string) error {
+	var lat, lng, cmnt, created string
+	e.Flags.StringVar(&lat, "lat", "", "latitude")
+	e.Flags.StringVar(&lng, "lng", "", "longitude")
+	e.Flags.StringVar(&cmnt, "cmnt", "", "comment")
+	e.Flags.StringVar(&created, "created", "", "creation time (default: set by the server)")
+	pos, err := parseArgs(e.Flags, args)
+	if err != nil {
+		return err
+	}
+
+	var data ambidata.Data
+	for _, arg := range pos {
+		k, v, ok := strings.Cut(arg, "=")
+		if !ok {
+			return usageErrorf("invalid argument %q: expected dN=VALUE", arg)
+		}
+		f, err := ambidata.ParseField(k)
+		if err != nil {
+			return usageErrorf("invalid argument %q: unknown field %q", arg, k)
+		}
+		x, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return usageErrorf("invalid argument %q: %s", arg, err.Error())
+		}
+		data.SetField(f, ambidata.Just(x))
+	}
+
+	if (lat == "") != (lng == "") {
+		return usageErrorf("-lat and -lng must be specified together")
+	}
+	if lat != "" {
+		var loc ambidata.Location
+		loc.Lat, err = strconv.ParseFloat(lat, 64)
+		if err != nil {
+			return usageErrorf("invalid -lat: %s", err.Error())
+		}
+		loc.Lng, err = strconv.ParseFloat(lng, 64)
+		if err != nil {
+			return usageErrorf("invalid -lng: %s", err.Error())
+		}
+		data.Loc = ambidata.Just(loc)
+	}
+	data.Cmnt = cmnt
+	if created != "" {
+		data.Created, err = parseTime(created, time.Now())
+		if err != nil {
+			return &UsageError{Msg: err.Error()}
+		}
+	}
+
+	s, err := e.sender()
+	if err != nil {
+		return err
+	}
+	return s.Send(ctx, data)
+}
+
+func runSendBulk(ctx context.Context, e *Env, args []string) error {
+	var in, inFormat string
+	var chunk int
+	var interval time.Duration
+	e.Flags.StringVar(&in, "in", "-", "input file (\"-\" for stdin)")
+	e.Flags.StringVar(&inFormat, "in-format", "", "input format: json, ndjson or csv (default: by file extension, or json)")
+	e.Flags.IntVar(&chunk, "chunk", 250, "maximum number of data points per request")
+	e.Flags.DurationVar(&interval, "interval", 5*time.Second, "interval between requests")
+	pos, err := parseArgs(e.Flags, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) > 0 {
+		return usageErrorf("unexpected arguments: %q", pos)
+	}
+	if chunk <= 0 {
+		return usageErrorf("-chunk must be positive")
+	}
+
+	if inFormat == "" {
+		inFormat = strings.TrimPrefix(filepath.Ext(in), ".")
+		if inFormat != "csv" && inFormat != "ndjson" {
+			inFormat = "json"
+		}
+	}
+
+	var r io.Reader = e.Stdin
+	if in != "-" {
+		file, err := os.Open(in)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	dr, err := dataio.NewReader(r, dataio.Format(inFormat))
+	if err != nil {
+		return usageErrorf("unknown input format %q", inFormat)
+	}
+	arr, err := dataio.ReadAll(dr)
+	if err != nil {
+		return err
+	}
+
+	s, err := e.sender()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(arr); i += chunk {
+		if i > 0 {
+			t := time.NewTimer(interval)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return fmt.Errorf("%w (%d of %d data points sent)", ctx.Err(), i, len(arr))
+			case <-t.C:
+			}
+		}
+
+		end := min(i+chunk, len(arr))
+		err := s.SendBulk(ctx, arr[i:end])
+		if err != nil {
+			return fmt.Errorf("%w (%d of %d data points sent)", err, i, len(arr))
+		}
+	}
+	return nil
+}
+
+func runSetCmnt(ctx context.Context, e *Env, args []string) error {
+	var created string
+	e.Flags.StringVar(&created, "created", "", "creation time of the data point (required)")
+	pos, err := parseArgs(e.Flags, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) != 1 {
+		return usageErrorf("expected exactly one comment")
+	}
+	t, err := requireTime("created", created)
+	if err != nil {
+		return err
+	}
+
+	s, err := e.sender()
+	if err != nil {
+		return err
+	}
+	return s.SetCmnt(ctx, t, pos[0])
+}
+
+func runSetHide(ctx context.Context, e *Env, args []string) error {
+	var created string
+	var hide bool
+	e.Flags.StringVar(&created, "created", "", "creation time of the data point (required)")
+	e.Flags.BoolVar(&hide, "hide", true, "hide flag")
+	pos, err := parseArgs(e.Flags, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) > 0 {
+		return usageErrorf("unexpected arguments: %q", pos)
+	}
+	t, err := requireTime("created", created)
+	if err != nil {
+		return err
+	}
+
+	s, err := e.sender()
+	if err != nil {
+		return err
+	}
+	return s.SetHide(ctx, t, hide)
+}
+
+func runAnnotate(ctx context.Context, e *Env, args []string) error {
+	var start, end, cmnt, hide, outOfRange string
+	var opt annotate.Options
+	e.Flags.StringVar(&start, "start", "", "start of the period (RFC 3339, \"now\" or relative such as \"-24h\")")
+	e.Flags.StringVar(&end, "end", "", "end of the period (default: all data)")
+	e.Flags.StringVar(&cmnt, "cmnt", "", "comment to set (use -cmnt \"\" to clear comments)")
+	e.Flags.StringVar(&hide, "hide", "", "hide flag to set: true or false")
+	e.Flags.StringVar(&outOfRange, "out-of-range", "", "only data points with values out of range, such as \"d1=-40:85,d2=0:\"")
+	e.Flags.BoolVar(&opt.DryRun, "dry-run", false, "show what would be changed without changing")
+	e.Flags.BoolVar(&opt.NoVerify, "no-verify", false, "do not verify the data points after changing")
+	e.Flags.DurationVar(&opt.Interval, "interval", annotate.DefaultInterval, "interval between requests")
+	pos, err := parseArgs(e.Flags, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) > 0 {
+		return usageErrorf("unexpected arguments: %q", pos)
+	}
+
+	var act annotate.Action
+	e.Flags.Visit(func(f *flag.Flag) {
+		if f.Name == "cmnt" {
+			act.Cmnt = ambidata.Just(cmnt)
+		}
+	})
+	if hide != "" {
+		v, err := strconv.ParseBool(hide)
+		if err != nil {
+			return usageErrorf("invalid -hide %q", hide)
+		}
+		act.Hide = ambidata.Just(v)
+	}
+	if !act.Cmnt.OK && !act.Hide.OK {
+		return usageErrorf("-cmnt or -hide is required")
+	}
+
+	now := time.Now()
+	if start != "" {
+		opt.Start, err = parseTime(start, now)
+		if err != nil {
+			return &UsageError{Msg: err.Error()}
+		}
+	}
+	if end != "" {
+		opt.End, err = parseTime(end, now)
+		if err != nil {
+			return &UsageError{Msg: err.Error()}
+		}
+	}
+	if outOfRange != "" {
+		opt.Match, err = parseOutOfRange(outOfRange)
+		if err != nil {
+			return err
+		}
+	}
+
+	cr, err := e.Common.Credentials()
+	if err != nil {
+		return err
+	}
+	f, err := cr.Fetcher()
+	if err != nil {
+		return err
+	}
+	var s *ambidata.Sender
+	if !opt.DryRun {
+		s, err = cr.Sender()
+		if err != nil {
+			return err
+		}
+		opt.OnProgress = func(p annotate.Progress) {
+			fmt.Fprintf(e.Stderr, "annotated %d/%d (%d unchanged)\n", p.Done, p.Total, p.Skipped)
+		}
+	}
+
+	res, err := annotate.Run(ctx, f, s, act, &opt)
+	if res != nil {
+		if opt.DryRun {
+			fmt.Fprintf(e.Stdout, "would annotate %d data points in channel %s\n", len(res.Targets), f.Ch)
+			for i := range res.Targets {
+				fmt.Fprintln(e.Stdout, formatTime(res.Targets[i].Created))
+			}
+		} else if res.Verification != nil {
+			fmt.Fprintf(e.Stdout, "verification: %s\n", res.Verification)
+		}
+	}
+	return err
+}
+
+// parseOutOfRange は "d1=-40:85,d2=0:" の形式の文字列を解析し、
+// いずれかのフィールドの値が範囲外であるデータポイントに一致する条件を返します。
+// 下限または上限を省略した場合は、その方向の制限を設けません。
+func parseOutOfRange(s string) (annotate.Predicate, error) {
+	var preds []annotate.Predicate
+	for item := range strings.SplitSeq(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(item), "=")
+		f, errField := ambidata.ParseField(k)
+		lo, hi, okRange := strings.Cut(v, ":")
+		if !ok || errField != nil || !okRange {
+			return nil, usageErrorf("invalid -out-of-range %q", item)
+		}
+		bounds := [2]float64{math.Inf(-1), math.Inf(1)}
+		for i, b := range [2]string{lo, hi} {
+			if b == "" {
+				continue
+			}
+			x, err := strconv.ParseFloat(b, 64)
+			if err != nil {
+				return nil, usageErrorf("invalid -out-of-range %q", item)
+			}
+			bounds[i] = x
+		}
+		preds = append(preds, annotate.OutOfRange(f, bounds[0], bounds[1]))
+	}
+	return func(data *ambidata.Data) bool {
+		return slices.ContainsFunc(preds, func(p annotate.Predicate) bool { return p(data) })
+	}, nil
+}
+
+func runOutliers(ctx context.Context, e *Env, args []string) error {
+	var start, end, zscore, mad, rate, bounds string
+	var apply bool
+	var opt annotate.Options
+	e.Flags.StringVar(&start, "start", "", "start of the period (RFC 3339, \"now\" or relative such as \"-24h\")")
+	e.Flags.StringVar(&end, "end", "", "end of the period (default: all data)")
+	e.Flags.StringVar(&zscore, "zscore", "", "fields to check by z-score with optional thresholds, such as \"d1,d2=4\"")
+	e.Flags.StringVar(&mad, "mad", "", "fields to check by median absolute deviation with optional thresholds, such as \"d1,d2=5\"")
+	e.Flags.StringVar(&rate, "rate", "", "maximum rate of change per field, such as \"d1=10/1m\" (default unit: 1s)")
+	e.Flags.StringVar(&bounds, "bounds", "", "valid range per field, such as \"d1=-40:85,d2=0:\"")
+	e.Flags.BoolVar(&apply, "apply", false, "hide the outliers and set the reasons as comments (default: report only)")
+	e.Flags.BoolVar(&opt.NoVerify, "no-verify", false, "do not verify the data points after changing")
+	e.Flags.DurationVar(&opt.Interval, "interval", annotate.DefaultInterval, "interval between requests")
+	pos, err := parseArgs(e.Flags, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) > 0 {
+		return usageErrorf("unexpected arguments: %q", pos)
+	}
+
+	var rules []outlier.Rule
+	for _, spec := range []struct {
+		name  string
+		value string
+		parse func(v string) (outlier.Detector, error)
+	}{
+		{"zscore", zscore, func(v string) (outlier.Detector, error) {
+			var d outlier.ZScore
+			if v == "" {
+				return d, nil
+			}
+			var err error
+			d.Threshold, err = strconv.ParseFloat(v, 64)
+			return d, err
+		}},
+		{"mad", mad, func(v string) (outlier.Detector, error) {
+			var d outlier.MAD
+			if v == "" {
+				return d, nil
+			}
+			var err error
+			d.Threshold, err = strconv.ParseFloat(v, 64)
+			return d, err
+		}},
+		{"rate", rate, func(v string) (outlier.Detector, error) {
+			var d outlier.RateOfChange
+			x, per, ok := strings.Cut(v, "/")
+			var err error
+			d.Max, err = strconv.ParseFloat(x, 64)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				d.Per, err = time.ParseDuration(per)
+			}
+			return d, err
+		}},
+		{"bounds", bounds, func(v string) (outlier.Detector, error) {
+			lo, hi, ok := strings.Cut(v, ":")
+			if !ok {
+				return nil, errors.New("missing \":\"")
+			}
+			d := outlier.Bounds{Min: math.Inf(-1), Max: math.Inf(1)}
+			var err error
+			if lo != "" {
+				d.Min, err = strconv.ParseFloat(lo, 64)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if hi != "" {
+				d.Max, err = strconv.ParseFloat(hi, 64)
+			}
+			return d, err
+		}},
+	} {
+		if spec.value == "" {
+			continue
+		}
+		for item := range strings.SplitSeq(spec.value, ",") {
+			k, v, _ := strings.Cut(strings.TrimSpace(item), "=")
+			f, errField := ambidata.ParseField(k)
+			d, errParse := spec.parse(v)
+			if errField != nil || errParse != nil {
+				return usageErrorf("invalid -%s %q", spec.name, item)
+			}
+			rules = append(rules, outlier.Rule{Field: f, Detector: d})
+		}
+	}
+	if len(rules) <= 0 {
+		return usageErrorf("at least one of -zscore, -mad, -rate or -bounds is required")
+	}
+
+	now := time.Now()
+	if start != "" {
+		opt.Start, err = parseTime(start, now)
+		if err != nil {
+			return &UsageError{Msg: err.Error()}
+		}
+	}
+	if end != "" {
+		opt.End, err = parseTime(end, now)
+		if err != nil {
+			return &UsageError{Msg: err.Error()}
+		}
+	}
+
+	cr, err := e.Common.Credentials()
+	if err != nil {
+		return err
+	}
+	f, err := cr.Fetcher()
+	if err != nil {
+		return err
+	}
+	var s *ambidata.Sender
+	if apply {
+		s, err = cr.Sender()
+		if err != nil {
+			return err
+		}
+	}
+
+	arr, err := annotate.Find(ctx, f, &opt)
+	if err != nil {
+		return err
+	}
+	suspects := outlier.Detect(arr, rules)
+	err = outlier.WriteText(e.Stdout, suspects)
+	if err != nil || !apply {
+		return err
+	}
+
+	opt.OnProgress = func(p annotate.Progress) {
+		fmt.Fprintf(e.Stderr, "hid %d/%d (%d unchanged)\n", p.Done, p.Total, p.Skipped)
+	}
+	res, err := outlier.Apply(ctx, f, s, arr, suspects, &opt)
+	if res != nil && res.Verification != nil {
+		fmt.Fprintf(e.Stdout, "verification: %s\n", res.Verification)
+	}
+	return err
+}
+
+func runDeleteData(ctx context.Context, e *Env, args []string) error {
+	var confirm, dir, format string
+	e.Flags.StringVar(&confirm, "confirm", "", "confirmation: \"delete-\" followed by the channel ID")
+	e.Flags.StringVar(&dir, "backup-dir", ".", "directory to write the backup archive to")
+	e.Flags.StringVar(&format, "backup-format", string(archive.DefaultFormat), "backup archive format: ndjson, json or csv")
+	pos, err := parseArgs(e.Flags, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) > 0 {
+		return usageErrorf("unexpected arguments: %q", pos)
+	}
+
+	cr, err := e.Common.Credentials()
+	if err != nil {
+		return err
+	}
+	if cr.Ch == "" {
+		return usageErrorf("channel ID is required")
+	}
+	if confirm == "" {
+		return usageErrorf("deleting all data in channel %s cannot be undone; specify -confirm %s to confirm", cr.Ch, archive.ConfirmToken(cr.Ch))
+	}
+	if confirm != archive.ConfirmToken(cr.Ch) {
+		return usageErrorf("confirmation %q does not match channel %s", confirm, cr.Ch)
+	}
+	if _, err := dataio.NewWriter(io.Discard, dataio.Format(format)); err != nil {
+		return usageErrorf("unknown backup format %q", format)
+	}
+
+	m, err := cr.Manager()
+	if err != nil {
+		return err
+	}
+	f, err := cr.Fetcher()
+	if err != nil {
+		return err
+	}
+	r, err := archive.Delete(ctx, m, f, confirm, &archive.Options{Dir: dir, Format: dataio.Format(format)})
+	if r != nil {
+		fmt.Fprintf(e.Stderr, "backed up %d data points to %s\n", r.Count, r.Path)
+	}
+	return err
+}
+
+func runRestore(ctx context.Context, e *Env, args []string) error {
+	var inFormat, progress string
+	var opt archive.RestoreOptions
+	e.Flags.StringVar(&inFormat, "in-format", "", "archive format: json, ndjson or csv (default: by file extension)")
+	e.Flags.StringVar(&progress, "progress", "", "progress file to resume from (default: FILE.progress)")
+	e.Flags.IntVar(&opt.BatchSize, "chunk", archive.DefaultBatchSize, "maximum number of data points per request")
+	e.Flags.DurationVar(&opt.Interval, "interval", ambidata.MinSendInterval, "interval between requests")
+	e.Flags.DurationVar(&opt.AnnotateInterval, "annotate-interval", archive.DefaultAnnotateInterval, "interval between comment and hide requests")
+	e.Flags.IntVar(&opt.DailyLimit, "daily-limit", ambidata.MaxDataPerDay, "maximum number of data points to send per day")
+	pos, err := parseArgs(e.Flags, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) != 1 {
+		return usageErrorf("expected exactly one archive file")
+	}
+	if opt.BatchSize <= 0 {
+		return usageErrorf("-chunk must be positive")
+	}
+	path := pos[0]
+	opt.ProgressFile = progress
+	if opt.ProgressFile == "" {
+		opt.ProgressFile = path + ".progress"
+	}
+
+	arr, err := archive.ReadFile(path, dataio.Format(inFormat))
+	if err != nil {
+		return err
+	}
+	s, err := e.sender()
+	if err != nil {
+		return err
+	}
+
+	opt.OnProgress = func(p archive.Progress) {
+		fmt.Fprintf(e.Stderr, "sent %d/%d, annotated %d/%d\n", p.Sent, p.Total, p.Annotated, p.Total)
+	}
+	p, err := archive.Restore(ctx, s, arr, &opt)
+	if err != nil && p != nil && opt.ProgressFile != "" {
+		return fmt.Errorf("%w (progress saved to %s; run the same command again to resume)", err, opt.ProgressFile)
+	}
+	return err
+}
+
+func runCopy(ctx context.Context, e *Env, args []string) error {
+	var from, fromReadKey, start, end, fields, hidden string
+	var noVerify bool
+	var opt migrate.Options
+	e.Flags.StringVar(&from, "from", "", "source channel name or ID")
+	e.Flags.StringVar(&fromReadKey, "from-read-key", "", "source read key")
+	e.Flags.StringVar(&start, "start", "", "start of the period to copy (RFC 3339, \"now\" or relative such as \"-24h\")")
+	e.Flags.StringVar(&end, "end", "", "end of the period to copy (default: all data)")
+	e.Flags.StringVar(&fields, "fields", "", "field mapping from source to destination, such as \"d3=d1,d1=d2\" (default: same fields)")
+	e.Flags.StringVar(&hidden, "hidden", "keep", "hidden data points: keep, skip or only")
+	e.Flags.BoolVar(&opt.DryRun, "dry-run", false, "show what would be copied without sending")
+	e.Flags.BoolVar(&noVerify, "no-verify", false, "do not verify the destination after copying")
+	e.Flags.StringVar(&opt.Restore.ProgressFile, "progress", "", "progress file to resume from")
+	e.Flags.IntVar(&opt.Restore.BatchSize, "chunk", archive.DefaultBatchSize, "maximum number of data points per request")
+	e.Flags.DurationVar(&opt.Restore.Interval, "interval", ambidata.MinSendInterval, "interval between requests")
+	e.Flags.DurationVar(&opt.Restore.AnnotateInterval, "annotate-interval", archive.DefaultAnnotateInterval, "interval between comment and hide requests")
+	e.Flags.IntVar(&opt.Restore.DailyLimit, "daily-limit", ambidata.MaxDataPerDay, "maximum number of data points to send per day")
+	pos, err := parseArgs(e.Flags, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) > 0 {
+		return usageErrorf("unexpected arguments: %q", pos)
+	}
+	if from == "" {
+		return usageErrorf("-from is required")
+	}
+
+	now := time.Now()
+	if start != "" {
+		opt.Start, err = parseTime(start, now)
+		if err != nil {
+			return &UsageError{Msg: err.Error()}
+		}
+	}
+	if end != "" {
+		opt.End, err = parseTime(end, now)
+		if err != nil {
+			return &UsageError{Msg: err.Error()}
+		}
+	}
+	if fields != "" {
+		opt.Fields, err = migrate.ParseFields(fields)
+		if err != nil {
+			return &UsageError{Msg: err.Error()}
+		}
+	}
+	opt.Hidden, err = migrate.ParseHiddenFilter(hidden)
+	if err != nil {
+		return &UsageError{Msg: err.Error()}
+	}
+
+	srcFlags := *e.Common
+	srcFlags.Ch = from
+	srcFlags.ReadKey = fromReadKey
+	srcCr, err := srcFlags.Credentials()
+	if err != nil {
+		return err
+	}
+	src, err := srcCr.Fetcher()
+	if err != nil {
+		return fmt.Errorf("source: %w", err)
+	}
+	cr, err := e.Common.Credentials()
+	if err != nil {
+		return err
+	}
+	var dst *ambidata.Sender
+	var dstFetcher *ambidata.Fetcher
+	if !opt.DryRun {
+		dst, err = cr.Sender()
+		if err != nil {
+			return fmt.Errorf("destination: %w", err)
+		}
+		if !noVerify {
+			dstFetcher, err = cr.Fetcher()
+			if err != nil {
+				return fmt.Errorf("destination: %w", err)
+			}
+		}
+	}
+
+	if !opt.DryRun {
+		opt.Restore.OnProgress = func(p archive.Progress) {
+			fmt.Fprintf(e.Stderr, "sent %d/%d, annotated %d/%d\n", p.Sent, p.Total, p.Annotated, p.Total)
+		}
+	}
+	res, err := migrate.Copy(ctx, src, dst, dstFetcher, &opt)
+	if res != nil {
+		if opt.DryRun {
+			fmt.Fprintf(e.Stdout, "would copy %d data points from channel %s to channel %s\n", len(res.Data), src.Ch, cr.Ch)
+			if n := len(res.Data); n > 0 {
+				fmt.Fprintf(e.Stdout, "period: %s to %s\n", formatTime(res.Data[0].Created), formatTime(res.Data[n-1].Created))
+			}
+		} else if res.Verification != nil {
+			fmt.Fprintf(e.Stdout, "verification: %s\n", res.Verification)
+		}
+	}
+	return err
+}
+
+func runDiff(ctx context.Context, e *Env, args []string) error {
+	var start, end, fieldTol, ignore string
+	var opt diff.Options
+	e.Flags.StringVar(&start, "start", "", "start of the period to compare (RFC 3339, \"now\" or relative such as \"-24h\")")
+	e.Flags.StringVar(&end, "end", "", "end of the period to compare (default: all data)")
+	e.Flags.Float64Var(&opt.Tolerance, "tolerance", 0, "tolerance for field values")
+	e.Flags.StringVar(&fieldTol, "field-tolerance", "", "per-field tolerance, such as \"d1=0.1,d2=0.5\"")
+	e.Flags.Float64Var(&opt.LocTolerance, "loc-tolerance", 0, "tolerance for latitude and longitude in degrees")
+	e.Flags.StringVar(&ignore, "ignore", "", "comma-separated items not to compare: loc, cmnt, hide")
+	pos, err := parseArgs(e.Flags, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) != 2 {
+		return usageErrorf("expected exactly two channels or files to compare")
+	}
+
+	now := time.Now()
+	var stt, et time.Time
+	if start != "" {
+		stt, err = parseTime(start, now)
+		if err != nil {
+			return &UsageError{Msg: err.Error()}
+		}
+	}
+	if end != "" {
+		et, err = parseTime(end, now)
+		if err != nil {
+			return &UsageError{Msg: err.Error()}
+		}
+	}
+	if fieldTol != "" {
+		opt.FieldTolerance = map[ambidata.Field]float64{}
+		for item := range strings.SplitSeq(fieldTol, ",") {
+			k, v, ok := strings.Cut(strings.TrimSpace(item), "=")
+			f, errField := ambidata.ParseField(k)
+			tol, errTol := strconv.ParseFloat(v, 64)
+			if !ok || errField != nil || errTol != nil {
+				return usageErrorf("invalid -field-tolerance %q", item)
+			}
+			opt.FieldTolerance[f] = tol
+		}
+	}
+	if ignore != "" {
+		for item := range strings.SplitSeq(ignore, ",") {
+			switch strings.TrimSpace(item) {
+			case diff.ItemLoc:
+				opt.IgnoreLoc = true
+			case diff.ItemCmnt:
+				opt.IgnoreCmnt = true
+			case diff.ItemHide:
+				opt.IgnoreHide = true
+			default:
+				return usageErrorf("invalid -ignore item %q", item)
+			}
+		}
+	}
+
+	var write func(*diff.Result, io.Writer) error
+	switch e.Common.Format {
+	case "table":
+		write = (*diff.Result).WriteText
+	case "json":
+		write = (*diff.Result).WriteJSON
+	default:
+		return usageErrorf("unknown format %q; diff supports table and json", e.Common.Format)
+	}
+
+	var sides [2][]ambidata.Data
+	for i, arg := range pos {
+		sides[i], err = e.loadData(ctx, arg, stt, et, now)
+		if err != nil {
+			return &ExitError{Code: 2, Err: fmt.Errorf("%s: %w", arg, err)}
+		}
+	}
+
+	r := diff.Compare(sides[0], sides[1], &opt)
+	err = write(r, e.Stdout)
+	if err != nil {
+		return &ExitError{Code: 2, Err: err}
+	}
+	if !r.Equal() {
+		return &ExitError{Code: 1}
+	}
+	return nil
+}
+
+// loadData は "ch:NAME" または "ch:ID:READKEY" 形式のチャネル、またはアーカイブのファイルから、
+// 期間内のデータを読み込みます。
+func (e *Env) loadData(ctx context.Context, arg string, start time.Time, end time.Time, now time.Time) ([]ambidata.Data, error) {
+	spec, ok := strings.CutPrefix(arg, "ch:")
+	if !ok {
+		arr, err := archive.ReadFile(arg, "")
+		if err != nil {
+			return nil, err
+		}
+		return slices.DeleteFunc(arr, func(d ambidata.Data) bool {
+			return (!start.IsZero() && d.Created.Before(start)) || (!end.IsZero() && d.Created.After(end))
+		}), nil
+	}
+
+	flags := *e.Common
+	flags.Ch, flags.ReadKey, _ = strings.Cut(spec, ":")
+	cr, err := flags.Credentials()
+	if err != nil {
+		return nil, err
+	}
+	f, err := cr.Fetcher()
+	if err != nil {
+		return nil, err
+	}
+	if start.IsZero() {
+		start = time.Unix(0, 0)
+	}
+	if end.IsZero() {
+		end = now.Add(24 * time.Hour)
+	}
+	return f.FetchPeriodAll(ctx, start, end)
+}
+
+func runReport(ctx context.Context, e *Env, args []string) error {
+	var opt report.Options
+	var noLoc, fail bool
+	e.Flags.DurationVar(&opt.StaleAfter, "stale", report.DefaultStaleAfter, "report channels with no post for this duration")
+	e.Flags.Float64Var(&opt.QuotaRatio, "quota", report.DefaultQuotaRatio, "report channels whose data per day exceeds this ratio of the daily limit")
+	e.Flags.BoolVar(&noLoc, "no-location", false, "do not report channels without a location")
+	e.Flags.BoolVar(&fail, "fail", false, "exit with status 1 if any issue is found")
+	pos, err := parseArgs(e.Flags, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) > 0 {
+		return usageErrorf("unexpected arguments: %q", pos)
+	}
+	opt.IgnoreLocation = noLoc
+
+	var write func(*report.Report, io.Writer) error
+	switch e.Common.Format {
+	case "table":
+		write = (*report.Report).WriteTable
+	case "json":
+		write = (*report.Report).WriteJSON
+	case "markdown":
+		write = (*report.Report).WriteMarkdown
+	default:
+		return usageErrorf("unknown format %q; report supports table, json and markdown", e.Common.Format)
+	}
+
+	m, err := e.manager()
+	if err != nil {
+		return err
+	}
+	r, err := report.Generate(ctx, m, &opt)
+	if err != nil {
+		return err
+	}
+	err = write(r, e.Stdout)
+	if err != nil {
+		return err
+	}
+	if fail && r.HasIssues() {
+		return errors.New("issues found")
+	}
+	return nil
+}
+
+func requireTime(name string, s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, usageErrorf("-%s is required", name)
+	}
+	t, err := parseTime(s, time.Now())
+	if err != nil {
+		return time.Time{}, &UsageError{Msg: err.Error()}
+	}
+	return t, nil
+}
+
+func (e *Env) fetcher() (*ambidata.Fetcher, error) {
+	cr, err := e.Common.Credentials()
+	if err != nil {
+		return nil, err
+	}
+	return cr.Fetcher()
+}
+
+func (e *Env) sender() (*ambidata.Sender, error) {
+	cr, err := e.Common.Credentials()
+	if err != nil {
+		return nil, err
+	}
+	return cr.Sender()
+}
+
+func (e *Env) manager() (*ambidata.Manager, error) {
+	cr, err := e.Common.Credentials()
+	if err != nil {
+		return nil, err
+	}
+	return cr.Manager()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/config"
+)
+
+// CommonFlags は全てのサブコマンドで共通のフラグです。
+type CommonFlags struct {
+	Profile  string
+	Config   string
+	Ch       string
+	ReadKey  string
+	WriteKey string
+	UserKey  string
+	Scheme   string
+	Host     string
+	Format   string
+}
+
+func registerCommonFlags(fs *flag.FlagSet) *CommonFlags {
+	c := &CommonFlags{}
+	fs.StringVar(&c.Profile, "profile", "", "profile name (env AMBIDATA_PROFILE)")
+	fs.StringVar(&c.Config, "config", "", "config file (env AMBIDATA_CONFIG, default $XDG_CONFIG_HOME/ambidata/config.json)")
+	fs.StringVar(&c.Ch, "ch", "", "channel name or ID (env AMBIDATA_CH)")
+	fs.StringVar(&c.ReadKey, "read-key", "", "read key (env AMBIDATA_READKEY)")
+	fs.StringVar(&c.WriteKey, "write-key", "", "write key (env AMBIDATA_WRITEKEY)")
+	fs.StringVar(&c.UserKey, "user-key", "", "user key (env AMBIDATA_USERKEY)")
+	fs.StringVar(&c.Scheme, "scheme", "", "request scheme (env AMBIDATA_SCHEME)")
+	fs.StringVar(&c.Host, "host", "", "request host (env AMBIDATA_HOST)")
+	fs.StringVar(&c.Format, "format", "table", "output format: table, json, ndjson or csv")
+	return c
+}
+
+// Credentials はコマンドの実行に使用する認証情報と接続先です。
+type Credentials struct {
+	Ch       string
+	ReadKey  string
+	WriteKey string
+	UserKey  string
+	Scheme   string
+	Host     string
+}
+
+// Credentials はフラグ、環境変数、設定ファイルの順に認証情報を解決します。
+// 環境変数のリードキーとライトキーは、デフォルトのチャネルか、設定ファイルに無いチャネルにのみ適用します。
+func (c *CommonFlags) Credentials() (*Credentials, error) {
+	p, err := config.Open(c.Config, c.Profile)
+	if err != nil {
+		return nil, err
+	}
+
+	// 環境変数のキーはデフォルトチャネルの情報のため、設定ファイルの他のチャネルには適用しない
+	var ch config.Channel
+	if found, err := p.Channel(c.Ch); err == nil {
+		ch = *found
+		if c.Ch != "" && isDefaultChannel(p, found) {
+			def, err := p.Channel("")
+			if err == nil {
+				ch = *def
+			}
+		}
+	} else if c.Ch != "" {
+		ch.Ch = c.Ch
+		ch.ReadKey = os.Getenv("AMBIDATA_READKEY")
+		ch.WriteKey = os.Getenv("AMBIDATA_WRITEKEY")
+	}
+
+	cr := &Credentials{
+		Ch:       ch.Ch,
+		ReadKey:  firstNonEmpty(c.ReadKey, ch.ReadKey),
+		WriteKey: firstNonEmpty(c.WriteKey, ch.WriteKey),
+		UserKey:  firstNonEmpty(c.UserKey, p.UserKey),
+		Scheme:   firstNonEmpty(c.Scheme, p.Config.Scheme),
+		Host:     firstNonEmpty(c.Host, p.Config.Host),
+	}
+	return cr, nil
+}
+
+// isDefaultChannel は設定ファイルのチャネル c がデフォルトのチャネルかどうかを返します。
+// 環境変数 AMBIDATA_CH が設定されている場合は、そのチャネルをデフォルトのチャネルとします。
+func isDefaultChannel(p *config.Profile, c *config.Channel) bool {
+	name := firstNonEmpty(os.Getenv("AMBIDATA_CH"), p.DefaultChannel)
+	if name == "" {
+		return len(p.Channels) == 1
+	}
+	def, err := p.Channel(name)
+	return err == nil && def == c
+}
+
+func (cr *Credentials) Config() *ambidata.Config {
+	if cr.Scheme == "" && cr.Host == "" {
+		return nil
+	}
+	return &ambidata.Config{Scheme: cr.Scheme, Host: cr.Host}
+}
+
+func (cr *Credentials) Fetcher() (*ambidata.Fetcher, error) {
+	if cr.Ch == "" || cr.ReadKey == "" {
+		return nil, errors.New("channel ID and read key are required")
+	}
+	f := ambidata.NewFetcher(cr.Ch, cr.ReadKey)
+	f.Config = cr.Config()
+	return f, nil
+}
+
+func (cr *Credentials) Sender() (*ambidata.Sender, error) {
+	if cr.Ch == "" || cr.WriteKey == "" {
+		return nil, errors.New("channel ID and write key are required")
+	}
+	s := ambidata.NewSender(cr.Ch, cr.WriteKey)
+	s.Config = cr.Config()
+	return s, nil
+}
+
+func (cr *Credentials) Manager() (*ambidata.Manager, error) {
+	if cr.UserKey == "" {
+		return nil, errors.New("user key is required")
+	}
+	m := ambidata.NewManager(cr.UserKey)
+	m.Config = cr.Config()
+	return m, nil
+}
+
+func firstNonEmpty(s ...string) string {
+	for _, v := range s {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,209 @@
+// ambidata は、Ambient のデータやチャネルを操作するコマンドラインツールです。
+//
+// 使い方:
+//
+//	ambidata <command> [flags] [args]
+//
+// コマンド:
+//
+//	channels     ユーザーが所有するチャネルの一覧を表示する
+//	devchannel   デバイスキーに関連付けられたチャネルを表示する
+//	info         チャネルの詳細情報を表示する
+//	fetch        データを取得する
+//	send         データポイントを1件送信する
+//	send-bulk    ファイルから複数のデータポイントを送信する
+//	set-cmnt     データポイントにコメントを設定する
+//	set-hide     データポイントの表示/非表示を設定する
+//	annotate     期間や条件に一致するデータポイントのコメントと表示/非表示をまとめて設定する
+//	outliers     外れ値を検出し、必要に応じて非表示にする
+//	delete-data  チャネルの全データをバックアップしてから削除する
+//	copy         別のチャネルからデータをコピーする
+//	restore      アーカイブからチャネルにデータを復元する
+//	diff         2つのチャネルまたはファイルのデータを比較する
+//	report       チャネルの一覧を点検し、問題のあるチャネルを報告する
+//
+// diff コマンドは、データが一致する場合は 0、異なる場合は 1、エラーの場合は 2 の終了コードで終了します。
+//
+// 認証情報は、フラグ、環境変数、設定ファイル (config パッケージを参照) の順に参照されます。
+// 詳細は "ambidata <command> -h" を参照してください。
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+)
+
+const Name = "ambidata"
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	code := Run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr)
+	stop()
+	os.Exit(code)
+}
+
+// Command はサブコマンドの定義です。
+type Command struct {
+	Name  string
+	Usage string // 引数の書式
+	Short string // 短い説明
+	Run   func(ctx context.Context, e *Env, args []string) error
+}
+
+// Env はサブコマンドの実行環境です。
+type Env struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	Flags  *flag.FlagSet
+	Common *CommonFlags
+}
+
+var Commands = []*Command{
+	{"channels", "", "list channels owned by the user", runChannels},
+	{"devchannel", "DEVKEY", "show the channel associated with a device key", runDevChannel},
+	{"info", "", "show channel information", runInfo},
+	{"fetch", "", "fetch data points", runFetch},
+	{"send", "[dN=VALUE ...]", "send a data point", runSend},
+	{"send-bulk", "", "send data points read from a file", runSendBulk},
+	{"set-cmnt", "CMNT", "set a comment on a data point", runSetCmnt},
+	{"set-hide", "", "set the hide flag of a data point", runSetHide},
+	{"annotate", "", "set comments or hide flags of data points in a period", runAnnotate},
+	{"outliers", "", "detect outliers and optionally hide them", runOutliers},
+	{"delete-data", "", "back up and delete all data in a channel", runDeleteData},
+	{"copy", "", "copy data points from another channel", runCopy},
+	{"restore", "FILE", "restore data points from an archive", runRestore},
+	{"diff", "A B", "compare data points; A and B are ch:NAME, ch:ID:READKEY or an archive file", runDiff},
+	{"report", "", "report channel health issues", runReport},
+}
+
+// UsageError はコマンドライン引数の誤りを表すエラーです。
+type UsageError struct {
+	Msg string
+}
+
+func (err *UsageError) Error() string {
+	return err.Msg
+}
+
+func usageErrorf(format string, args ...any) error {
+	return &UsageError{Msg: fmt.Sprintf(format, args...)}
+}
+
+// ExitError は終了コードを指定するエラーです。
+// Err が nil の場合は、メッセージを出力せずに終了します。
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (err *ExitError) Error() string {
+	if err.Err == nil {
+		return fmt.Sprintf("exit status %d", err.Code)
+	}
+	return err.Err.Error()
+}
+
+func (err *ExitError) Unwrap() error {
+	return err.Err
+}
+
+// Run はコマンドを実行し、終了コードを返します。
+// 成功時は 0、実行時のエラーは 1、引数の誤りは 2 を返します。
+// ただし、コマンドが [ExitError] を返した場合は、その終了コードを返します。
+func Run(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	if len(args) < 1 || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" || args[0] == "help" {
+		usage(stderr)
+		if len(args) < 1 {
+			return 2
+		}
+		return 0
+	}
+
+	var cmd *Command
+	for _, c := range Commands {
+		if c.Name == args[0] {
+			cmd = c
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(stderr, "%s: unknown command %q\n", Name, args[0])
+		usage(stderr)
+		return 2
+	}
+
+	fs := flag.NewFlagSet(Name+" "+cmd.Name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "usage: %s %s [flags] %s\n\n%s\n\nflags:\n", Name, cmd.Name, cmd.Usage, cmd.Short)
+		fs.PrintDefaults()
+	}
+
+	e := &Env{
+		Stdin:  stdin,
+		Stdout: stdout,
+		Stderr: stderr,
+		Flags:  fs,
+		Common: registerCommonFlags(fs),
+	}
+
+	err := cmd.Run(ctx, e, args[1:])
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if usageErr := (*UsageError)(nil); errors.As(err, &usageErr) {
+		fmt.Fprintf(stderr, "%s %s: %s\n", Name, cmd.Name, err.Error())
+		fs.Usage()
+		return 2
+	}
+	if exitErr := (*ExitError)(nil); errors.As(err, &exitErr) {
+		if exitErr.Err != nil {
+			fmt.Fprintf(stderr, "%s %s: %s\n", Name, cmd.Name, exitErr.Err.Error())
+		}
+		return exitErr.Code
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "%s %s: %s\n", Name, cmd.Name, err.Error())
+		return 1
+	}
+	return 0
+}
+
+// parseArgs はフラグと位置引数が混在した引数を解析し、位置引数を返します。
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var pos []string
+	for {
+		err := fs.Parse(args)
+		if err == flag.ErrHelp {
+			return nil, err
+		}
+		if err != nil {
+			return nil, &UsageError{Msg: err.Error()}
+		}
+		args = fs.Args()
+		if len(args) <= 0 {
+			return pos, nil
+		}
+		if args[0] == "--" {
+			return append(pos, args[1:]...), nil
+		}
+		pos = append(pos, args[0])
+		args = args[1:]
+	}
+}
+
+func usage(w io.Writer) {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "usage: %s <command> [flags] [args]\n\ncommands:\n", Name)
+	for _, c := range Commands {
+		fmt.Fprintf(b, "  %-12s %s\n", c.Name, c.Short)
+	}
+	fmt.Fprintf(b, "\nRun '%s <command> -h' for details.\n", Name)
+	io.WriteString(w, b.String())
+}
@@ -0,0 +1,588 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/internal/ambimock"
+	"github.com/google/go-cmp/cmp"
+)
+
+type testServer struct {
+	*httptest.Server
+	Host string
+	Reqs []*http.Request
+	Body [][]byte
+}
+
+func newTestServer(t *testing.T) *testServer {
+	ts := &testServer{}
+	mux := http.NewServeMux()
+	mux.Handle("/", http.NotFoundHandler())
+	mux.HandleFunc("GET /api/v2/channels/{$}", func(w http.ResponseWriter, r *http.Request) {
+		ts.record(r)
+		w.Write([]byte(`[{"ch":"83601","chName":"room","d1":{"name":"temp","color":"2"}}]`))
+	})
+	mux.HandleFunc("GET /api/v2/channels/83601/{$}", func(w http.ResponseWriter, r *http.Request) {
+		ts.record(r)
+		w.Write([]byte(`{"ch":"83601","chName":"room","d1":{"name":"temp","color":"2"}}`))
+	})
+	mux.HandleFunc("GET /api/v2/channels/83601/data", func(w http.ResponseWriter, r *http.Request) {
+		ts.record(r)
+		w.Write([]byte(`[{"d1":2,"created":"2006-01-02T15:01:00.000Z"},{"d1":1,"cmnt":"c","created":"2006-01-02T15:00:00.000Z"}]`))
+	})
+	mux.HandleFunc("POST /api/v2/channels/83601/data", func(w http.ResponseWriter, r *http.Request) {
+		ts.record(r)
+	})
+	mux.HandleFunc("POST /api/v2/channels/83601/dataarray", func(w http.ResponseWriter, r *http.Request) {
+		ts.record(r)
+	})
+	mux.HandleFunc("PUT /api/v2/channels/83601/data", func(w http.ResponseWriter, r *http.Request) {
+		ts.record(r)
+	})
+	mux.HandleFunc("DELETE /api/v2/channels/83601/data", func(w http.ResponseWriter, r *http.Request) {
+		ts.record(r)
+	})
+
+	ts.Server = httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	u, _ := url.Parse(ts.URL)
+	ts.Host = u.Host
+
+	t.Setenv("AMBIDATA_SCHEME", "http")
+	t.Setenv("AMBIDATA_HOST", ts.Host)
+	t.Setenv("AMBIDATA_CH", "")
+	t.Setenv("AMBIDATA_READKEY", "")
+	t.Setenv("AMBIDATA_WRITEKEY", "")
+	t.Setenv("AMBIDATA_USERKEY", "")
+	t.Setenv("AMBIDATA_PROFILE", "")
+	t.Setenv("AMBIDATA_CONFIG", "")
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	return ts
+}
+
+func (ts *testServer) record(r *http.Request) {
+	b, _ := io.ReadAll(r.Body)
+	ts.Reqs = append(ts.Reqs, r)
+	ts.Body = append(ts.Body, b)
+}
+
+func run(t *testing.T, stdin string, args ...string) (code int, stdout string, stderr string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var o, e bytes.Buffer
+	code = Run(ctx, args, strings.NewReader(stdin), &o, &e)
+	return code, o.String(), e.String()
+}
+
+func TestRunChannelsNDJSON(t *testing.T) {
+	newTestServer(t)
+	t.Setenv("AMBIDATA_USERKEY", "uk")
+
+	code, stdout, stderr := run(t, "", "channels", "-format", "ndjson")
+	if code != 0 {
+		t.Fatalf("exit code: expected 0, got %d: %s", code, stderr)
+	}
+
+	want := `{"ch":"83601","chName":"room","dataperday":0,"fields":{"d1":{"name":"temp","color":"2"}}}` + "\n"
+	if stdout != want {
+		t.Errorf("stdout: expected %#v, got %#v", want, stdout)
+	}
+}
+
+func TestRunSend(t *testing.T) {
+	ts := newTestServer(t)
+
+	code, _, stderr := run(t, "", "send", "-ch", "83601", "-write-key", "wk", "d1=1.5", "-cmnt", "hello", "d3=-2", "-lat", "35", "-lng", "139")
+	if code != 0 {
+		t.Fatalf("exit code: expected 0, got %d: %s", code, stderr)
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal(ts.Body[0], &got); err != nil {
+		t.Fatalf("body: %v", err)
+	}
+	want := map[string]any{"writeKey": "wk", "d1": 1.5, "d3": -2.0, "lat": 35.0, "lng": 139.0, "cmnt": "hello"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("body: mismatch (-want, +got)\n%s", diff)
+	}
+}
+
+func TestRunSendErrUsage(t *testing.T) {
+	newTestServer(t)
+
+	for _, args := range [][]string{
+		{"send", "-ch", "83601", "-write-key", "wk", "d9=1"},
+		{"send", "-ch", "83601", "-write-key", "wk", "d1"},
+		{"send", "-ch", "83601", "-write-key", "wk", "-lat", "1"},
+	} {
+		if code, _, _ := run(t, "", args...); code != 2 {
+			t.Errorf("%q: exit code: expected 2, got %d", args, code)
+		}
+	}
+}
+
+func TestRunFetchJSON(t *testing.T) {
+	ts := newTestServer(t)
+	t.Setenv("AMBIDATA_CH", "83601")
+	t.Setenv("AMBIDATA_READKEY", "rk")
+
+	code, stdout, stderr := run(t, "", "fetch", "-n", "2", "-format", "ndjson")
+	if code != 0 {
+		t.Fatalf("exit code: expected 0, got %d: %s", code, stderr)
+	}
+
+	want := `{"created":"2006-01-02T15:01:00Z","d1":2}` + "\n" + `{"created":"2006-01-02T15:00:00Z","d1":1,"cmnt":"c"}` + "\n"
+	if stdout != want {
+		t.Errorf("stdout: expected %#v, got %#v", want, stdout)
+	}
+	if q := ts.Reqs[0].URL.Query(); q.Get("n") != "2" || q.Get("readKey") != "rk" {
+		t.Errorf("query: unexpected %v", q)
+	}
+}
+
+func TestRunFetchEnvKey(t *testing.T) {
+	ts := newTestServer(t)
+	t.Setenv("AMBIDATA_READKEY", "rk")
+
+	code, _, stderr := run(t, "", "fetch", "-ch", "83601", "-n", "1")
+	if code != 0 {
+		t.Fatalf("exit code: expected 0, got %d: %s", code, stderr)
+	}
+	if q := ts.Reqs[0].URL.Query(); q.Get("readKey") != "rk" {
+		t.Errorf("query: unexpected %v", q)
+	}
+}
+
+func TestRunFetchPeriod(t *testing.T) {
+	ts := newTestServer(t)
+
+	code, _, stderr := run(t, "", "fetch", "-ch", "83601", "-read-key", "rk", "-start", "2006-01-02T00:00:00Z", "-end", "2006-01-03T00:00:00Z", "-format", "csv")
+	if code != 0 {
+		t.Fatalf("exit code: expected 0, got %d: %s", code, stderr)
+	}
+	q := ts.Reqs[0].URL.Query()
+	if got := q.Get("start"); got != "2006-01-02T00:00:00Z" {
+		t.Errorf("start: expected %#v, got %#v", "2006-01-02T00:00:00Z", got)
+	}
+	if got := q.Get("end"); got != "2006-01-03T00:00:00Z" {
+		t.Errorf("end: expected %#v, got %#v", "2006-01-03T00:00:00Z", got)
+	}
+
+	for _, args := range [][]string{
+		{"fetch", "-ch", "83601", "-read-key", "rk", "-start", "-24h", "-n", "5"},
+		{"fetch", "-ch", "83601", "-read-key", "rk", "-end", "now", "-skip", "1"},
+	} {
+		if code, _, _ := run(t, "", args...); code != 2 {
+			t.Errorf("%q: exit code: expected 2, got %d", args, code)
+		}
+	}
+	if len(ts.Reqs) != 1 {
+		t.Errorf("requests: expected 1, got %d", len(ts.Reqs))
+	}
+}
+
+func TestRunSendBulk(t *testing.T) {
+	ts := newTestServer(t)
+
+	const in = "created,d1\n2006-01-02T15:00:00Z,1\n2006-01-02T15:01:00Z,2\n2006-01-02T15:02:00Z,3\n"
+	code, _, stderr := run(t, in, "send-bulk", "-ch", "83601", "-write-key", "wk", "-in-format", "csv", "-chunk", "2", "-interval", "1ms")
+	if code != 0 {
+		t.Fatalf("exit code: expected 0, got %d: %s", code, stderr)
+	}
+	if len(ts.Body) != 2 {
+		t.Fatalf("requests: expected 2, got %d", len(ts.Body))
+	}
+
+	var got struct {
+		Data []map[string]any `json:"data"`
+	}
+	if err := json.Unmarshal(ts.Body[1], &got); err != nil {
+		t.Fatalf("body: %v", err)
+	}
+	want := []map[string]any{{"created": "2006-01-02T15:02:00Z", "d1": 3.0}}
+	if diff := cmp.Diff(want, got.Data); diff != "" {
+		t.Errorf("body: mismatch (-want, +got)\n%s", diff)
+	}
+}
+
+func TestRunSetHide(t *testing.T) {
+	ts := newTestServer(t)
+
+	code, _, stderr := run(t, "", "set-hide", "-ch", "83601", "-write-key", "wk", "-created", "2006-01-02T15:00:00Z", "-hide=false")
+	if code != 0 {
+		t.Fatalf("exit code: expected 0, got %d: %s", code, stderr)
+	}
+	const want = `{"writeKey":"wk","created":"2006-01-02T15:00:00Z","hide":false}`
+	if got := string(ts.Body[0]); got != want {
+		t.Errorf("body: expected %#v, got %#v", want, got)
+	}
+}
+
+func TestRunAnnotate(t *testing.T) {
+	newTestServer(t)
+	s := ambimock.New(t)
+	s.AddChannel(&ambimock.Channel{
+		Info:     ambidata.ChannelInfo{Ch: "83601"},
+		ReadKey:  "rk",
+		WriteKey: "wk",
+		Data: []ambidata.Data{
+			{Created: time.Date(2006, 1, 2, 15, 0, 0, 0, time.UTC), D1: ambidata.Just(20.0)},
+			{Created: time.Date(2006, 1, 2, 15, 1, 0, 0, time.UTC), D1: ambidata.Just(999.0)},
+		},
+	})
+	t.Setenv("AMBIDATA_HOST", strings.TrimPrefix(s.URL, "http://"))
+	args := []string{"annotate", "-ch", "83601", "-read-key", "rk", "-write-key", "wk", "-out-of-range", "d1=-40:85", "-hide", "true", "-cmnt", "out of range", "-interval", "1ms"}
+
+	code, stdout, stderr := run(t, "", append(args, "-dry-run")...)
+	if code != 0 {
+		t.Fatalf("-dry-run: exit code: expected 0, got %d: %s", code, stderr)
+	}
+	if !strings.Contains(stdout, "would annotate 1 data points") || !strings.Contains(stdout, "2006-01-02T15:01:00Z") {
+		t.Errorf("-dry-run: unexpected output: %s", stdout)
+	}
+
+	code, stdout, stderr = run(t, "", args...)
+	if code != 0 {
+		t.Fatalf("exit code: expected 0, got %d: %s", code, stderr)
+	}
+	if !strings.Contains(stdout, "1 checked, 0 missing, 0 changed") {
+		t.Errorf("unexpected output: %s", stdout)
+	}
+	want := []ambidata.Data{
+		{Created: time.Date(2006, 1, 2, 15, 0, 0, 0, time.UTC), D1: ambidata.Just(20.0)},
+		{Created: time.Date(2006, 1, 2, 15, 1, 0, 0, time.UTC), D1: ambidata.Just(999.0), Cmnt: "out of range", Hide: true},
+	}
+	if diff := cmp.Diff(want, s.Data("83601")); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+
+	code, _, _ = run(t, "", "annotate", "-ch", "83601", "-read-key", "rk", "-write-key", "wk")
+	if code != 2 {
+		t.Errorf("without -cmnt and -hide: exit code: expected 2, got %d", code)
+	}
+}
+
+func TestRunOutliers(t *testing.T) {
+	newTestServer(t)
+	s := ambimock.New(t)
+	s.AddChannel(&ambimock.Channel{
+		Info:     ambidata.ChannelInfo{Ch: "83601"},
+		ReadKey:  "rk",
+		WriteKey: "wk",
+		Data: []ambidata.Data{
+			{Created: time.Date(2006, 1, 2, 15, 0, 0, 0, time.UTC), D1: ambidata.Just(20.0)},
+			{Created: time.Date(2006, 1, 2, 15, 1, 0, 0, time.UTC), D1: ambidata.Just(999.0)},
+			{Created: time.Date(2006, 1, 2, 15, 2, 0, 0, time.UTC), D1: ambidata.Just(21.0)},
+		},
+	})
+	t.Setenv("AMBIDATA_HOST", strings.TrimPrefix(s.URL, "http://"))
+	args := []string{"outliers", "-ch", "83601", "-read-key", "rk", "-write-key", "wk", "-bounds", "d1=-40:85", "-rate", "d1=100/1m", "-interval", "1ms"}
+
+	code, stdout, stderr := run(t, "", args...)
+	if code != 0 {
+		t.Fatalf("exit code: expected 0, got %d: %s", code, stderr)
+	}
+	if !strings.Contains(stdout, "2 suspect values in 1 data points") {
+		t.Errorf("unexpected output: %s", stdout)
+	}
+	if s.Data("83601")[1].Hide {
+		t.Fatalf("expected data not to be changed without -apply")
+	}
+
+	code, stdout, stderr = run(t, "", append(args, "-apply")...)
+	if code != 0 {
+		t.Fatalf("-apply: exit code: expected 0, got %d: %s", code, stderr)
+	}
+	if !strings.Contains(stdout, "1 checked, 0 missing, 0 changed") {
+		t.Errorf("-apply: unexpected output: %s", stdout)
+	}
+	got := s.Data("83601")[1]
+	if !got.Hide || !strings.HasPrefix(got.Cmnt, "outlier: d1 change") {
+		t.Errorf("-apply: unexpected data point: %+v", got)
+	}
+
+	code, _, _ = run(t, "", "outliers", "-ch", "83601", "-read-key", "rk", "-rate", "d1=x")
+	if code != 2 {
+		t.Errorf("invalid -rate: exit code: expected 2, got %d", code)
+	}
+}
+
+func TestRunDeleteData(t *testing.T) {
+	newTestServer(t)
+	s := ambimock.New(t)
+	s.AddChannel(&ambimock.Channel{
+		Info:    ambidata.ChannelInfo{Ch: "83601"},
+		UserKey: "uk",
+		ReadKey: "rk",
+		Data: []ambidata.Data{
+			{Created: time.Date(2006, 1, 2, 15, 0, 0, 0, time.UTC), D1: ambidata.Just(1.0)},
+			{Created: time.Date(2006, 1, 2, 15, 1, 0, 0, time.UTC), D1: ambidata.Just(2.0)},
+		},
+	})
+	t.Setenv("AMBIDATA_HOST", strings.TrimPrefix(s.URL, "http://"))
+	dir := t.TempDir()
+	args := []string{"delete-data", "-ch", "83601", "-read-key", "rk", "-user-key", "uk", "-backup-dir", dir}
+
+	for _, confirm := range [][]string{nil, {"-confirm", "delete-83602"}, {"-confirm", "yes"}} {
+		code, _, _ := run(t, "", append(args, confirm...)...)
+		if code != 2 {
+			t.Errorf("%q: exit code: expected 2, got %d", confirm, code)
+		}
+	}
+	if n := len(s.Requests()); n != 0 {
+		t.Fatalf("without confirmation: expected no request, got %d", n)
+	}
+
+	code, _, stderr := run(t, "", append(args, "-confirm", "delete-83601")...)
+	if code != 0 {
+		t.Fatalf("with -confirm: exit code: expected 0, got %d: %s", code, stderr)
+	}
+	if n := len(s.Data("83601")); n != 0 {
+		t.Errorf("expected all data to be deleted, %d data points remain", n)
+	}
+	paths, _ := filepath.Glob(filepath.Join(dir, "83601-*.ndjson"))
+	if len(paths) != 1 {
+		t.Fatalf("expected 1 backup archive, got %q", paths)
+	}
+	b, _ := os.ReadFile(paths[0])
+	if n := strings.Count(string(b), "\n"); n != 2 {
+		t.Errorf("expected 2 data points in the backup archive, got %d", n)
+	}
+}
+
+func TestRunRestore(t *testing.T) {
+	newTestServer(t)
+	s := ambimock.New(t)
+	s.AddChannel(&ambimock.Channel{Info: ambidata.ChannelInfo{Ch: "83601"}, WriteKey: "wk"})
+	t.Setenv("AMBIDATA_HOST", strings.TrimPrefix(s.URL, "http://"))
+
+	path := filepath.Join(t.TempDir(), "83601.ndjson")
+	in := `{"created":"2006-01-02T15:00:00Z","d1":1,"hide":true}
+{"created":"2006-01-02T15:01:00Z","d1":2,"cmnt":"c"}
+{"created":"2006-01-02T15:02:00Z","d1":3}
+`
+	err := os.WriteFile(path, []byte(in), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, _, stderr := run(t, "", "restore", "-ch", "83601", "-write-key", "wk", "-chunk", "2", "-interval", "1ms", "-annotate-interval", "1ms", path)
+	if code != 0 {
+		t.Fatalf("exit code: expected 0, got %d: %s", code, stderr)
+	}
+	want := []ambidata.Data{
+		{Created: time.Date(2006, 1, 2, 15, 0, 0, 0, time.UTC), D1: ambidata.Just(1.0), Hide: true},
+		{Created: time.Date(2006, 1, 2, 15, 1, 0, 0, time.UTC), D1: ambidata.Just(2.0), Cmnt: "c"},
+		{Created: time.Date(2006, 1, 2, 15, 2, 0, 0, time.UTC), D1: ambidata.Just(3.0)},
+	}
+	if diff := cmp.Diff(want, s.Data("83601")); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+	if _, err := os.Stat(path + ".progress"); !os.IsNotExist(err) {
+		t.Errorf("expected progress file to be removed, got %v", err)
+	}
+}
+
+func TestRunCopy(t *testing.T) {
+	newTestServer(t)
+	s := ambimock.New(t)
+	s.AddChannel(&ambimock.Channel{
+		Info:    ambidata.ChannelInfo{Ch: "83600"},
+		ReadKey: "rk0",
+		Data: []ambidata.Data{
+			{Created: time.Date(2006, 1, 2, 15, 0, 0, 0, time.UTC), D3: ambidata.Just(1.0), Hide: true},
+			{Created: time.Date(2006, 1, 2, 15, 1, 0, 0, time.UTC), D3: ambidata.Just(2.0), Cmnt: "c"},
+		},
+	})
+	s.AddChannel(&ambimock.Channel{Info: ambidata.ChannelInfo{Ch: "83601"}, ReadKey: "rk", WriteKey: "wk"})
+	t.Setenv("AMBIDATA_HOST", strings.TrimPrefix(s.URL, "http://"))
+	args := []string{"copy", "-from", "83600", "-from-read-key", "rk0", "-ch", "83601", "-read-key", "rk", "-write-key", "wk", "-fields", "d3=d1", "-interval", "1ms", "-annotate-interval", "1ms"}
+
+	code, stdout, stderr := run(t, "", append(args, "-dry-run")...)
+	if code != 0 {
+		t.Fatalf("-dry-run: exit code: expected 0, got %d: %s", code, stderr)
+	}
+	if !strings.Contains(stdout, "would copy 2 data points") {
+		t.Errorf("-dry-run: unexpected output: %s", stdout)
+	}
+	if n := len(s.Data("83601")); n != 0 {
+		t.Fatalf("-dry-run: expected no data to be copied, got %d", n)
+	}
+
+	code, stdout, stderr = run(t, "", args...)
+	if code != 0 {
+		t.Fatalf("exit code: expected 0, got %d: %s", code, stderr)
+	}
+	if !strings.Contains(stdout, "2 checked, 0 missing, 0 changed") {
+		t.Errorf("unexpected output: %s", stdout)
+	}
+	want := []ambidata.Data{
+		{Created: time.Date(2006, 1, 2, 15, 0, 0, 0, time.UTC), D1: ambidata.Just(1.0), Hide: true},
+		{Created: time.Date(2006, 1, 2, 15, 1, 0, 0, time.UTC), D1: ambidata.Just(2.0), Cmnt: "c"},
+	}
+	if diff := cmp.Diff(want, s.Data("83601")); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestRunDiff(t *testing.T) {
+	newTestServer(t)
+	s := ambimock.New(t)
+	data := []ambidata.Data{
+		{Created: time.Date(2006, 1, 2, 15, 0, 0, 0, time.UTC), D1: ambidata.Just(1.0), Hide: true},
+		{Created: time.Date(2006, 1, 2, 15, 1, 0, 0, time.UTC), D1: ambidata.Just(2.0), Cmnt: "c"},
+	}
+	s.AddChannel(&ambimock.Channel{Info: ambidata.ChannelInfo{Ch: "83601"}, ReadKey: "rk", Data: data})
+	t.Setenv("AMBIDATA_HOST", strings.TrimPrefix(s.URL, "http://"))
+
+	dir := t.TempDir()
+	same := filepath.Join(dir, "same.ndjson")
+	os.WriteFile(same, []byte(`{"created":"2006-01-02T15:00:00Z","d1":1,"hide":true}
+{"created":"2006-01-02T15:01:00Z","d1":2,"cmnt":"c"}
+`), 0o600)
+	changed := filepath.Join(dir, "changed.csv")
+	os.WriteFile(changed, []byte(`created,d1,cmnt,hide
+2006-01-02T15:00:00Z,1.05,,true
+2006-01-02T15:01:00Z,2,,false
+`), 0o600)
+
+	code, _, stderr := run(t, "", "diff", "ch:83601:rk", same)
+	if code != 0 {
+		t.Errorf("same: exit code: expected 0, got %d: %s", code, stderr)
+	}
+
+	code, stdout, _ := run(t, "", "diff", "-format", "json", "-tolerance", "0.1", "ch:83601:rk", changed)
+	if code != 1 {
+		t.Errorf("changed: exit code: expected 1, got %d", code)
+	}
+	var r struct {
+		Summary struct {
+			Equal   bool
+			Changed int
+			Items   map[string]int
+		}
+	}
+	err := json.Unmarshal([]byte(stdout), &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Summary.Equal || r.Summary.Changed != 1 || r.Summary.Items["cmnt"] != 1 || len(r.Summary.Items) != 1 {
+		t.Errorf("changed: unexpected summary: %s", stdout)
+	}
+
+	code, _, _ = run(t, "", "diff", "-ignore", "cmnt", "-field-tolerance", "d1=0.1", "ch:83601:rk", changed)
+	if code != 0 {
+		t.Errorf("ignore: exit code: expected 0, got %d", code)
+	}
+
+	code, _, _ = run(t, "", "diff", "ch:83601:wrong", same)
+	if code != 2 {
+		t.Errorf("error: exit code: expected 2, got %d", code)
+	}
+}
+
+func TestRunReport(t *testing.T) {
+	ts := newTestServer(t)
+
+	code, stdout, stderr := run(t, "", "report", "-user-key", "uk", "-format", "json")
+	if code != 0 {
+		t.Fatalf("exit code: expected 0, got %d: %s", code, stderr)
+	}
+	if got := ts.Reqs[0].URL.Query().Get("userKey"); got != "uk" {
+		t.Errorf("userKey: expected %#v, got %#v", "uk", got)
+	}
+	var r struct {
+		Channels []struct {
+			Ch     string
+			Issues []struct{ Kind string }
+		}
+	}
+	err := json.Unmarshal([]byte(stdout), &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Channels) != 1 || r.Channels[0].Ch != "83601" || len(r.Channels[0].Issues) != 2 {
+		t.Errorf("unexpected report: %s", stdout)
+	}
+
+	code, _, _ = run(t, "", "report", "-user-key", "uk", "-fail")
+	if code != 1 {
+		t.Errorf("-fail: exit code: expected 1, got %d", code)
+	}
+
+	code, _, _ = run(t, "", "report", "-user-key", "uk", "-format", "csv")
+	if code != 2 {
+		t.Errorf("-format csv: exit code: expected 2, got %d", code)
+	}
+}
+
+func TestRunProfile(t *testing.T) {
+	ts := newTestServer(t)
+
+	dir := filepath.Join(os.Getenv("XDG_CONFIG_HOME"), "ambidata")
+	os.MkdirAll(dir, 0o700)
+	os.WriteFile(filepath.Join(dir, "config.json"), []byte(`{"profiles":{"default":{"channels":{"room":{"ch":"83601","writeKey":"default"}}},"other":{"channels":{"room":{"ch":"83601","writeKey":"other"},"spare":{"ch":"83601","writeKey":"spare"}},"defaultChannel":"room"}}}`), 0o600)
+
+	tt := []struct {
+		name  string
+		envCh string
+		env   string
+		args  []string
+		want  string
+	}{
+		{name: "Default", args: nil, want: "default"},
+		{name: "Flag", args: []string{"-profile", "other"}, want: "other"},
+		{name: "ChannelName", args: []string{"-profile", "other", "-ch", "spare"}, want: "spare"},
+		{name: "KeyFlag", args: []string{"-profile", "other", "-write-key", "flag"}, want: "flag"},
+		{name: "Env", env: "env", args: []string{"-profile", "other"}, want: "env"},
+		{name: "EnvChannelName", env: "env", args: []string{"-profile", "other", "-ch", "spare"}, want: "spare"},
+		{name: "EnvDefaultChannelName", env: "env", args: []string{"-profile", "other", "-ch", "room"}, want: "env"},
+		{name: "EnvChOtherChannel", envCh: "room", env: "env", args: []string{"-profile", "other", "-ch", "spare"}, want: "spare"},
+		{name: "EnvChSameChannel", envCh: "spare", env: "env", args: []string{"-profile", "other", "-ch", "spare"}, want: "env"},
+	}
+
+	for _, tc := range tt {
+		t.Setenv("AMBIDATA_CH", tc.envCh)
+		t.Setenv("AMBIDATA_WRITEKEY", tc.env)
+		ts.Body = nil
+
+		args := append([]string{"send", "d1=1"}, tc.args...)
+		code, _, stderr := run(t, "", args...)
+		if code != 0 {
+			t.Errorf("%s: exit code: expected 0, got %d: %s", tc.name, code, stderr)
+			continue
+		}
+
+		var got struct {
+			WriteKey string `json:"writeKey"`
+		}
+		json.Unmarshal(ts.Body[0], &got)
+		if got.WriteKey != tc.want {
+			t.Errorf("%s: writeKey: expected %#v, got %#v", tc.name, tc.want, got.WriteKey)
+		}
+	}
+
+	if code, _, _ := run(t, "", "send", "d1=1", "-profile", "missing"); code != 1 {
+		t.Errorf("missing profile: exit code: expected 1, got %d", code)
+	}
+}
+
+func TestRunUnknownCommand(t *testing.T) {
+	if code, _, _ := run(t, "", "unknown"); code != 2 {
+		t.Errorf("exit code: expected 2, got %d", code)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/dataio"
+	"github.com/gcrtnst/ambidata/termview"
+)
+
+type jsonChannel struct {
+	Ch         string                   `json:"ch"`
+	User       string                   `json:"user,omitempty"`
+	ChName     string                   `json:"chName"`
+	ChDesc     string                   `json:"chDesc,omitempty"`
+	Created    time.Time                `json:"created,omitzero"`
+	Modified   time.Time                `json:"modified,omitzero"`
+	LastPost   time.Time                `json:"lastpost,omitzero"`
+	DataPerDay int                      `json:"dataperday"`
+	Fields     map[string]jsonFieldInfo `json:"fields,omitempty"`
+	Lat        *float64                 `json:"lat,omitempty"`
+	Lng        *float64                 `json:"lng,omitempty"`
+	PhotoID    string                   `json:"photoid,omitempty"`
+	DevKeys    []string                 `json:"devkeys,omitempty"`
+	Bd         string                   `json:"bd,omitempty"`
+	LastData   json.RawMessage          `json:"lastdata,omitempty"`
+	ReadKey    string                   `json:"readKey,omitempty"`
+	WriteKey   string                   `json:"writeKey,omitempty"`
+}
+
+type jsonFieldInfo struct {
+	Name  string `json:"name"`
+	Color string `json:"color,omitempty"`
+}
+
+func toJSONChannel(ca *ambidata.ChannelAccess) (*jsonChannel, error) {
+	c := &ca.ChannelInfo
+	j := &jsonChannel{
+		Ch:         c.Ch,
+		User:       c.User,
+		ChName:     c.ChName,
+		ChDesc:     c.ChDesc,
+		Created:    c.Created,
+		Modified:   c.Modified,
+		LastPost:   c.LastPost,
+		DataPerDay: c.DataPerDay,
+		Fields:     map[string]jsonFieldInfo{},
+		PhotoID:    c.PhotoID,
+		DevKeys:    c.DevKeys,
+		Bd:         c.Bd,
+		ReadKey:    ca.ReadKey,
+		WriteKey:   ca.WriteKey,
+	}
+	for _, f := range ambidata.Fields {
+		fi := c.Field(f)
+		if fi.Name != "" || fi.Color != "" {
+			j.Fields[f.String()] = jsonFieldInfo{Name: fi.Name, Color: string(fi.Color)}
+		}
+	}
+	if c.Loc.OK {
+		j.Lat = &c.Loc.V.Lat
+		j.Lng = &c.Loc.V.Lng
+	}
+	if c.LastData.ID != "" {
+		b, err := dataio.Marshal(c.LastData.Data)
+		if err != nil {
+			return nil, err
+		}
+		j.LastData = b
+	}
+	return j, nil
+}
+
+var channelColumns = []string{"ch", "chName", "lastpost", "dataperday", "readKey", "writeKey"}
+
+func channelRow(ca *ambidata.ChannelAccess) []string {
+	return []string{
+		ca.Ch,
+		ca.ChName,
+		formatTime(ca.LastPost),
+		strconv.Itoa(ca.DataPerDay),
+		ca.ReadKey,
+		ca.WriteKey,
+	}
+}
+
+// writeChannels はチャネルの一覧を format 形式で書き込みます。
+func writeChannels(w io.Writer, format string, arr []ambidata.ChannelAccess) error {
+	switch format {
+	case "json", "ndjson":
+		l := make([]*jsonChannel, len(arr))
+		for i := range arr {
+			j, err := toJSONChannel(&arr[i])
+			if err != nil {
+				return err
+			}
+			l[i] = j
+		}
+		if format == "json" {
+			return writeJSON(w, format, l)
+		}
+		for _, j := range l {
+			if err := writeJSON(w, format, j); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "csv":
+		c := csv.NewWriter(w)
+		c.Write(channelColumns)
+		for i := range arr {
+			c.Write(channelRow(&arr[i]))
+		}
+		c.Flush()
+		return c.Error()
+
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "CH\tNAME\tLAST POST\tDATA/DAY")
+		for i := range arr {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\n", arr[i].Ch, arr[i].ChName, formatTime(arr[i].LastPost), arr[i].DataPerDay)
+		}
+		return tw.Flush()
+
+	default:
+		return usageErrorf("unknown format %q", format)
+	}
+}
+
+// writeChannel は単一のチャネルを format 形式で書き込みます。
+func writeChannel(w io.Writer, format string, ca *ambidata.ChannelAccess) error {
+	switch format {
+	case "json", "ndjson":
+		j, err := toJSONChannel(ca)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, format, j)
+
+	case "csv":
+		c := csv.NewWriter(w)
+		c.Write(channelColumns)
+		c.Write(channelRow(ca))
+		c.Flush()
+		return c.Error()
+
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "ch\t%s\n", ca.Ch)
+		fmt.Fprintf(tw, "chName\t%s\n", ca.ChName)
+		if ca.ChDesc != "" {
+			fmt.Fprintf(tw, "chDesc\t%s\n", ca.ChDesc)
+		}
+		fmt.Fprintf(tw, "lastpost\t%s\n", formatTime(ca.LastPost))
+		fmt.Fprintf(tw, "dataperday\t%d\n", ca.DataPerDay)
+		for _, f := range ambidata.Fields {
+			if fi := ca.Field(f); fi.Name != "" {
+				fmt.Fprintf(tw, "%s\t%s\n", f, fi.Name)
+			}
+		}
+		if ca.Loc.OK {
+			fmt.Fprintf(tw, "loc\t%g, %g\n", ca.Loc.V.Lat, ca.Loc.V.Lng)
+		}
+		if ca.ReadKey != "" {
+			fmt.Fprintf(tw, "readKey\t%s\n", ca.ReadKey)
+		}
+		if ca.WriteKey != "" {
+			fmt.Fprintf(tw, "writeKey\t%s\n", ca.WriteKey)
+		}
+		return tw.Flush()
+
+	default:
+		return usageErrorf("unknown format %q", format)
+	}
+}
+
+// writeData はデータポイントを format 形式で書き込みます。
+// table 形式の場合、info が nil でなければ列見出しにデータ名を使用します。
+func writeData(w io.Writer, format string, info *ambidata.ChannelInfo, arr []ambidata.Data) error {
+	if format == "table" {
+		if info == nil {
+			info = &ambidata.ChannelInfo{}
+		}
+		return termview.WriteTable(w, info, arr, nil)
+	}
+
+	dw, err := dataio.NewWriter(w, dataio.Format(format))
+	if err != nil {
+		return usageErrorf("unknown format %q", format)
+	}
+	return dataio.WriteAll(dw, arr)
+}
+
+func writeJSON(w io.Writer, format string, v any) error {
+	e := json.NewEncoder(w)
+	if format == "json" {
+		e.SetIndent("", "  ")
+	}
+	return e.Encode(v)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
+
+// parseTime は時刻を表す文字列を解析します。
+// RFC 3339 形式の時刻、"now"、または現在時刻からの相対時間 (例: "-24h") を受け付けます。
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if s == "now" {
+		return now, nil
+	}
+	if len(s) > 0 && (s[0] == '-' || s[0] == '+') {
+		d, err := time.ParseDuration(s)
+		if err == nil {
+			return now.Add(d), nil
+		}
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: expected RFC 3339, \"now\" or a relative duration such as \"-24h\"", s)
+	}
+	return t, nil
+}
@@ -0,0 +1,326 @@
+// Package config は、認証情報のプロファイルを設定ファイルから読み込む機能を提供します。
+//
+// 設定ファイルは JSON 形式で、デフォルトでは $XDG_CONFIG_HOME/ambidata/config.json
+// ([os.UserConfigDir] 配下の ambidata/config.json) に配置します。
+//
+//	{
+//	  "scheme": "https",
+//	  "host": "ambidata.io",
+//	  "profiles": {
+//	    "default": {
+//	      "userKey": "0123456789abcdef",
+//	      "defaultChannel": "room",
+//	      "channels": {
+//	        "room":    {"ch": "12345", "readKey": "0123456789abcdef", "writeKey": "0123456789abcdef"},
+//	        "outdoor": {"ch": "12346", "readKey": "0123456789abcdef", "writeKey": "0123456789abcdef"}
+//	      }
+//	    }
+//	  }
+//	}
+//
+// 設定ファイルには秘密情報が含まれるため、その他のユーザーが読み取り可能なファイルは
+// 読み込みを拒否します ([PermissionError])。
+//
+// 設定ファイルの内容は、以下の環境変数で上書きできます。
+//
+//   - AMBIDATA_CONFIG: 設定ファイルのパス
+//   - AMBIDATA_PROFILE: 使用するプロファイル名
+//   - AMBIDATA_SCHEME, AMBIDATA_HOST: 接続先
+//   - AMBIDATA_USERKEY: ユーザーキー
+//   - AMBIDATA_CH, AMBIDATA_READKEY, AMBIDATA_WRITEKEY: デフォルトチャネルの情報
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+
+	"github.com/gcrtnst/ambidata"
+)
+
+// DefaultProfile はプロファイル名が指定されなかった場合に使用されるプロファイル名です。
+const DefaultProfile = "default"
+
+// File は設定ファイルの内容を表す構造体です。
+type File struct {
+	Scheme   string              `json:"scheme,omitempty"`   // リクエストのスキーム
+	Host     string              `json:"host,omitempty"`     // リクエストのホスト名
+	Profiles map[string]*Profile `json:"profiles,omitempty"` // プロファイル名をキーとするプロファイル
+}
+
+// Profile は1つのアカウントに対応する認証情報の組です。
+type Profile struct {
+	UserKey        string              `json:"userKey,omitempty"`        // ユーザーキー
+	DefaultChannel string              `json:"defaultChannel,omitempty"` // デフォルトのチャネル名
+	Channels       map[string]*Channel `json:"channels,omitempty"`       // チャネル名をキーとするチャネル
+
+	// Config は HTTP 通信の設定を保持します。
+	// [File.Profile] が返す Profile では、このプロファイルの全てのクライアントで共有されます。
+	Config *ambidata.Config `json:"-"`
+
+	override *Channel // 環境変数で指定されたデフォルトチャネル
+}
+
+// Channel はチャネルへのアクセス情報です。
+type Channel struct {
+	Ch       string `json:"ch"`                 // チャネルID
+	ReadKey  string `json:"readKey,omitempty"`  // リードキー
+	WriteKey string `json:"writeKey,omitempty"` // ライトキー
+}
+
+// PermissionError は設定ファイルのパーミッションが安全でない場合のエラーです。
+type PermissionError struct {
+	Path string
+	Mode fs.FileMode
+}
+
+func (err *PermissionError) Error() string {
+	return fmt.Sprintf("config: %s: permissions %#o are too open; the file must not be readable by others (e.g. chmod 600)", err.Path, err.Mode.Perm())
+}
+
+// DefaultPath は設定ファイルのパスを返します。
+// 環境変数 AMBIDATA_CONFIG が設定されている場合はその値を、
+// そうでない場合は [os.UserConfigDir] 配下の ambidata/config.json を返します。
+func DefaultPath() (string, error) {
+	if p := os.Getenv("AMBIDATA_CONFIG"); p != "" {
+		return p, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "ambidata", "config.json"), nil
+}
+
+// Load は path の設定ファイルを読み込みます。
+// その他のユーザーが読み取り可能なファイルの場合は [*PermissionError] を返します。
+func Load(path string) (*File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	st, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if runtime.GOOS != "windows" && st.Mode().Perm()&0o004 != 0 {
+		return nil, &PermissionError{Path: path, Mode: st.Mode()}
+	}
+
+	f, err := Parse(file)
+	if err != nil {
+		return nil, fmt.Errorf("config: %s: %w", path, err)
+	}
+	return f, nil
+}
+
+// Parse は r から設定ファイルの内容を読み込みます。
+// パーミッションの確認は行いません。
+func Parse(r io.Reader) (*File, error) {
+	d := json.NewDecoder(r)
+	d.DisallowUnknownFields()
+
+	var f File
+	err := d.Decode(&f)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// Open は設定ファイルを読み込み、プロファイルを環境変数で上書きして返します。
+//
+// path が空文字列の場合は [DefaultPath] が使用されます。
+// profile が空文字列の場合は、環境変数 AMBIDATA_PROFILE、それも無い場合は [DefaultProfile] が使用されます。
+//
+// path と profile のどちらも明示されていない場合、設定ファイルや該当するプロファイルが
+// 存在しなくてもエラーにはならず、環境変数のみから作成したプロファイルを返します。
+func Open(path string, profile string) (*Profile, error) {
+	explicit := path != "" || profile != "" || os.Getenv("AMBIDATA_CONFIG") != "" || os.Getenv("AMBIDATA_PROFILE") != ""
+
+	f := &File{}
+	if path == "" {
+		p, err := DefaultPath()
+		if err != nil && explicit {
+			return nil, err
+		}
+		path = p
+	}
+	if path != "" {
+		loaded, err := Load(path)
+		switch {
+		case err == nil:
+			f = loaded
+		case errors.Is(err, fs.ErrNotExist) && !explicit:
+			// use environment variables only
+		default:
+			return nil, err
+		}
+	}
+
+	if profile == "" {
+		profile = os.Getenv("AMBIDATA_PROFILE")
+	}
+	if profile == "" {
+		profile = DefaultProfile
+		if _, ok := f.Profiles[profile]; !ok {
+			return f.Profile("")
+		}
+	}
+	return f.Profile(profile)
+}
+
+// Profile は name のプロファイルを環境変数で上書きして返します。
+// 返される Profile は f とは独立したコピーで、 [Profile.Config] が設定されています。
+//
+// name が空文字列の場合は、空のプロファイルを環境変数で上書きして返します。
+// 該当するプロファイルが存在しない場合はエラーを返します。
+func (f *File) Profile(name string) (*Profile, error) {
+	p := &Profile{}
+	if name != "" {
+		src, ok := f.Profiles[name]
+		if !ok || src == nil {
+			return nil, fmt.Errorf("config: profile %q not found", name)
+		}
+		p = src.clone()
+	}
+
+	cfg := &ambidata.Config{
+		Scheme: envOr("AMBIDATA_SCHEME", f.Scheme),
+		Host:   envOr("AMBIDATA_HOST", f.Host),
+	}
+	p.Config = cfg
+	p.UserKey = envOr("AMBIDATA_USERKEY", p.UserKey)
+
+	ch := os.Getenv("AMBIDATA_CH")
+	readKey := os.Getenv("AMBIDATA_READKEY")
+	writeKey := os.Getenv("AMBIDATA_WRITEKEY")
+	if ch != "" || readKey != "" || writeKey != "" {
+		var c Channel
+		if d, err := p.Channel(ch); err == nil {
+			c = *d
+		} else if ch != "" {
+			c.Ch = ch
+		}
+		c.ReadKey = valueOr(readKey, c.ReadKey)
+		c.WriteKey = valueOr(writeKey, c.WriteKey)
+		p.override = &c
+	}
+	return p, nil
+}
+
+// Channel は name のチャネルを返します。
+// name はチャネル名またはチャネルIDで指定します。
+// name が空文字列の場合は、デフォルトのチャネルを返します。
+// 環境変数でチャネルが指定されている場合は、それがデフォルトのチャネルとなります。
+// デフォルトのチャネルが設定されておらず、チャネルが1つしか無い場合はそのチャネルを返します。
+func (p *Profile) Channel(name string) (*Channel, error) {
+	if name == "" && p.override != nil {
+		return p.override, nil
+	}
+	if name == "" {
+		name = p.DefaultChannel
+	}
+	if name == "" {
+		if len(p.Channels) == 1 {
+			for _, c := range p.Channels {
+				return c, nil
+			}
+		}
+		return nil, errors.New("config: no channel specified and no default channel configured")
+	}
+
+	if c, ok := p.Channels[name]; ok && c != nil {
+		return c, nil
+	}
+	for _, k := range p.ChannelNames() {
+		if c := p.Channels[k]; c != nil && c.Ch == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("config: channel %q not found", name)
+}
+
+// ChannelNames はプロファイルに含まれるチャネル名をソートして返します。
+func (p *Profile) ChannelNames() []string {
+	names := make([]string, 0, len(p.Channels))
+	for k := range p.Channels {
+		names = append(names, k)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Manager はプロファイルのユーザーキーを使用する [ambidata.Manager] を作成します。
+func (p *Profile) Manager() (*ambidata.Manager, error) {
+	if p.UserKey == "" {
+		return nil, errors.New("config: user key is not configured")
+	}
+	m := ambidata.NewManager(p.UserKey)
+	m.Config = p.Config
+	return m, nil
+}
+
+// Fetcher は name のチャネルからデータを取得する [ambidata.Fetcher] を作成します。
+// name の指定方法は [Profile.Channel] と同じです。
+func (p *Profile) Fetcher(name string) (*ambidata.Fetcher, error) {
+	c, err := p.Channel(name)
+	if err != nil {
+		return nil, err
+	}
+	if c.Ch == "" || c.ReadKey == "" {
+		return nil, fmt.Errorf("config: channel %q: channel ID and read key are required", name)
+	}
+	f := ambidata.NewFetcher(c.Ch, c.ReadKey)
+	f.Config = p.Config
+	return f, nil
+}
+
+// Sender は name のチャネルにデータを送信する [ambidata.Sender] を作成します。
+// name の指定方法は [Profile.Channel] と同じです。
+func (p *Profile) Sender(name string) (*ambidata.Sender, error) {
+	c, err := p.Channel(name)
+	if err != nil {
+		return nil, err
+	}
+	if c.Ch == "" || c.WriteKey == "" {
+		return nil, fmt.Errorf("config: channel %q: channel ID and write key are required", name)
+	}
+	s := ambidata.NewSender(c.Ch, c.WriteKey)
+	s.Config = p.Config
+	return s, nil
+}
+
+func (p *Profile) clone() *Profile {
+	c := *p
+	c.override = nil
+	if p.Channels != nil {
+		c.Channels = make(map[string]*Channel, len(p.Channels))
+		for k, v := range p.Channels {
+			if v != nil {
+				vc := *v
+				c.Channels[k] = &vc
+			}
+		}
+	}
+	return &c
+}
+
+func envOr(key string, def string) string {
+	return valueOr(os.Getenv(key), def)
+}
+
+func valueOr(v string, def string) string {
+	if v == "" {
+		return def
+	}
+	return v
+}
@@ -0,0 +1,219 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/google/go-cmp/cmp"
+)
+
+const testFile = `{
+  "scheme": "http",
+  "host": "localhost:8080",
+  "profiles": {
+    "default": {
+      "userKey": "uk",
+      "defaultChannel": "room",
+      "channels": {
+        "room":    {"ch": "100", "readKey": "r100", "writeKey": "w100"},
+        "outdoor": {"ch": "200", "readKey": "r200", "writeKey": "w200"}
+      }
+    },
+    "single": {
+      "channels": {
+        "only": {"ch": "300", "readKey": "r300"}
+      }
+    }
+  }
+}`
+
+func clearEnv(t *testing.T) {
+	for _, k := range []string{"AMBIDATA_CONFIG", "AMBIDATA_PROFILE", "AMBIDATA_SCHEME", "AMBIDATA_HOST", "AMBIDATA_USERKEY", "AMBIDATA_CH", "AMBIDATA_READKEY", "AMBIDATA_WRITEKEY"} {
+		t.Setenv(k, "")
+	}
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+}
+
+func writeFile(t *testing.T, content string, perm os.FileMode) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), perm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestOpen(t *testing.T) {
+	clearEnv(t)
+	path := writeFile(t, testFile, 0o600)
+
+	p, err := Open(path, "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	wantCfg := &ambidata.Config{Scheme: "http", Host: "localhost:8080"}
+	if diff := cmp.Diff(wantCfg, p.Config); diff != "" {
+		t.Errorf("config: mismatch (-want, +got)\n%s", diff)
+	}
+
+	m, err := p.Manager()
+	if err != nil {
+		t.Fatalf("manager: %v", err)
+	}
+	if m.UserKey != "uk" || m.Config != p.Config {
+		t.Errorf("manager: unexpected %#v", m)
+	}
+
+	f, err := p.Fetcher("")
+	if err != nil {
+		t.Fatalf("fetcher: %v", err)
+	}
+	if f.Ch != "100" || f.ReadKey != "r100" || f.Config != p.Config {
+		t.Errorf("fetcher: unexpected %#v", f)
+	}
+
+	s, err := p.Sender("outdoor")
+	if err != nil {
+		t.Fatalf("sender: %v", err)
+	}
+	if s.Ch != "200" || s.WriteKey != "w200" || s.Config != p.Config {
+		t.Errorf("sender: unexpected %#v", s)
+	}
+
+	s, err = p.Sender("200")
+	if err != nil {
+		t.Fatalf("sender by ID: %v", err)
+	}
+	if s.WriteKey != "w200" {
+		t.Errorf("sender by ID: unexpected %#v", s)
+	}
+}
+
+func TestOpenSingleChannel(t *testing.T) {
+	clearEnv(t)
+	path := writeFile(t, testFile, 0o600)
+
+	p, err := Open(path, "single")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	f, err := p.Fetcher("")
+	if err != nil {
+		t.Fatalf("fetcher: %v", err)
+	}
+	if f.Ch != "300" {
+		t.Errorf("fetcher: expected ch %#v, got %#v", "300", f.Ch)
+	}
+	if _, err := p.Sender(""); err == nil {
+		t.Errorf("sender: expected error for missing write key")
+	}
+	if _, err := p.Manager(); err == nil {
+		t.Errorf("manager: expected error for missing user key")
+	}
+}
+
+func TestOpenEnvOverride(t *testing.T) {
+	clearEnv(t)
+	path := writeFile(t, testFile, 0o600)
+	t.Setenv("AMBIDATA_CONFIG", path)
+	t.Setenv("AMBIDATA_HOST", "example.com")
+	t.Setenv("AMBIDATA_USERKEY", "envuk")
+	t.Setenv("AMBIDATA_CH", "200")
+	t.Setenv("AMBIDATA_WRITEKEY", "envwk")
+
+	p, err := Open("", "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if p.Config.Scheme != "http" || p.Config.Host != "example.com" {
+		t.Errorf("config: unexpected %#v", p.Config)
+	}
+	if p.UserKey != "envuk" {
+		t.Errorf("userKey: expected %#v, got %#v", "envuk", p.UserKey)
+	}
+
+	got, err := p.Channel("")
+	if err != nil {
+		t.Fatalf("channel: %v", err)
+	}
+	want := &Channel{Ch: "200", ReadKey: "r200", WriteKey: "envwk"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("channel: mismatch (-want, +got)\n%s", diff)
+	}
+
+	// 名前で指定したチャネルは上書きされない
+	room, _ := p.Channel("room")
+	if room.Ch != "100" || room.WriteKey != "w100" {
+		t.Errorf("room: unexpected %#v", room)
+	}
+}
+
+func TestOpenEnvOnly(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("AMBIDATA_CH", "400")
+	t.Setenv("AMBIDATA_READKEY", "r400")
+
+	p, err := Open("", "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	f, err := p.Fetcher("")
+	if err != nil {
+		t.Fatalf("fetcher: %v", err)
+	}
+	if f.Ch != "400" || f.ReadKey != "r400" {
+		t.Errorf("fetcher: unexpected %#v", f)
+	}
+}
+
+func TestOpenErrProfileNotFound(t *testing.T) {
+	clearEnv(t)
+	path := writeFile(t, testFile, 0o600)
+
+	_, err := Open(path, "missing")
+	if err == nil || !strings.Contains(err.Error(), `"missing"`) {
+		t.Errorf("expected profile not found error, got %v", err)
+	}
+}
+
+func TestOpenErrFileNotFound(t *testing.T) {
+	clearEnv(t)
+
+	_, err := Open(filepath.Join(t.TempDir(), "missing.json"), "")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected %v, got %v", os.ErrNotExist, err)
+	}
+}
+
+func TestLoadErrPermission(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permissions are not checked on windows")
+	}
+	path := writeFile(t, testFile, 0o644)
+
+	_, err := Load(path)
+	var permErr *PermissionError
+	if !errors.As(err, &permErr) {
+		t.Fatalf("expected *PermissionError, got %v", err)
+	}
+	if permErr.Mode.Perm() != 0o644 {
+		t.Errorf("mode: expected %#o, got %#o", 0o644, permErr.Mode.Perm())
+	}
+}
+
+func TestParseErrUnknownField(t *testing.T) {
+	_, err := Parse(strings.NewReader(`{"profile": {}}`))
+	if err == nil {
+		t.Errorf("expected error")
+	}
+}
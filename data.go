@@ -1,7 +1,10 @@
 package ambidata
 
 import (
+	"fmt"
 	"image/color"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -56,6 +59,31 @@ type ChannelInfo struct {
 	LastData   LastData        // 最後に送信されたデータ
 }
 
+// Field は指定されたデータフィールドの情報を返します。
+// 無効な [Field] を指定した場合は、ゼロ値の [FieldInfo] を返します。
+func (c *ChannelInfo) Field(f Field) FieldInfo {
+	switch f {
+	case FieldD1:
+		return c.D1
+	case FieldD2:
+		return c.D2
+	case FieldD3:
+		return c.D3
+	case FieldD4:
+		return c.D4
+	case FieldD5:
+		return c.D5
+	case FieldD6:
+		return c.D6
+	case FieldD7:
+		return c.D7
+	case FieldD8:
+		return c.D8
+	default:
+		return FieldInfo{}
+	}
+}
+
 // FieldInfo はデータフィールドの情報を保持する構造体です。
 type FieldInfo struct {
 	Name  string     // データ名
@@ -130,6 +158,119 @@ type Data struct {
 	Hide    bool            // 非表示フラグ
 }
 
+// Field は指定されたデータフィールドの値を返します。
+// 無効な [Field] を指定した場合は、ゼロ値の [Maybe] を返します。
+func (d *Data) Field(f Field) Maybe[float64] {
+	switch f {
+	case FieldD1:
+		return d.D1
+	case FieldD2:
+		return d.D2
+	case FieldD3:
+		return d.D3
+	case FieldD4:
+		return d.D4
+	case FieldD5:
+		return d.D5
+	case FieldD6:
+		return d.D6
+	case FieldD7:
+		return d.D7
+	case FieldD8:
+		return d.D8
+	default:
+		return Maybe[float64]{}
+	}
+}
+
+// SetField は指定されたデータフィールドに値 v を設定します。
+// 無効な [Field] を指定した場合はパニックします。
+func (d *Data) SetField(f Field, v Maybe[float64]) {
+	switch f {
+	case FieldD1:
+		d.D1 = v
+	case FieldD2:
+		d.D2 = v
+	case FieldD3:
+		d.D3 = v
+	case FieldD4:
+		d.D4 = v
+	case FieldD5:
+		d.D5 = v
+	case FieldD6:
+		d.D6 = v
+	case FieldD7:
+		d.D7 = v
+	case FieldD8:
+		d.D8 = v
+	default:
+		panic("ambidata: (*Data).SetField: invalid field " + f.String())
+	}
+}
+
+// Field はデータフィールド (データ1～データ8) を識別する型です。
+// [Data.Field] や [ChannelInfo.Field] などで、フィールドを番号で指定する際に使用します。
+type Field int
+
+// データフィールドの定義。
+const (
+	FieldD1 Field = iota + 1 // データ1
+	FieldD2                  // データ2
+	FieldD3                  // データ3
+	FieldD4                  // データ4
+	FieldD5                  // データ5
+	FieldD6                  // データ6
+	FieldD7                  // データ7
+	FieldD8                  // データ8
+)
+
+// Fields は全てのデータフィールドを番号順に並べた配列です。
+var Fields = [...]Field{FieldD1, FieldD2, FieldD3, FieldD4, FieldD5, FieldD6, FieldD7, FieldD8}
+
+// ParseField は "d1"～"d8" の形式の文字列を [Field] に変換します。
+// 大文字と小文字は区別しません。
+func ParseField(s string) (Field, error) {
+	if len(s) == 2 && (s[0] == 'd' || s[0] == 'D') {
+		f := Field(s[1] - '0')
+		if f.IsValid() {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("ambidata: ParseField: invalid field %q", s)
+}
+
+// IsValid は f が有効なデータフィールドである場合に true を返します。
+func (f Field) IsValid() bool {
+	return FieldD1 <= f && f <= FieldD8
+}
+
+// String は f を "d1"～"d8" の形式の文字列に変換します。
+// 無効な [Field] の場合は "Field(0)" のような形式になります。
+func (f Field) String() string {
+	if !f.IsValid() {
+		return "Field(" + strconv.Itoa(int(f)) + ")"
+	}
+	return "d" + strconv.Itoa(int(f))
+}
+
+// MarshalText は [encoding.TextMarshaler] を実装します。
+func (f Field) MarshalText() ([]byte, error) {
+	if !f.IsValid() {
+		return nil, fmt.Errorf("ambidata: (Field).MarshalText: invalid field %d", int(f))
+	}
+	return []byte(f.String()), nil
+}
+
+// UnmarshalText は [encoding.TextUnmarshaler] を実装します。
+func (f *Field) UnmarshalText(text []byte) error {
+	v, err := ParseField(strings.TrimSpace(string(text)))
+	if err != nil {
+		return err
+	}
+	*f = v
+	return nil
+}
+
 // Location は位置情報を表す構造体です。
 type Location struct {
 	Lat float64 // 緯度
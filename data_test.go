@@ -0,0 +1,105 @@
+package ambidata
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseField(t *testing.T) {
+	tt := []struct {
+		name    string
+		in      string
+		want    Field
+		wantErr bool
+	}{
+		{name: "D1", in: "d1", want: FieldD1},
+		{name: "D8", in: "d8", want: FieldD8},
+		{name: "Upper", in: "D3", want: FieldD3},
+		{name: "Zero", in: "d0", wantErr: true},
+		{name: "Nine", in: "d9", wantErr: true},
+		{name: "Empty", in: "", wantErr: true},
+		{name: "NoPrefix", in: "1", wantErr: true},
+		{name: "TooLong", in: "d10", wantErr: true},
+	}
+
+	for _, tc := range tt {
+		got, err := ParseField(tc.in)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got %#v", tc.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		} else if got != tc.want {
+			t.Errorf("%s: expected %#v, got %#v", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestFieldString(t *testing.T) {
+	tt := []struct {
+		in   Field
+		want string
+	}{
+		{in: FieldD1, want: "d1"},
+		{in: FieldD8, want: "d8"},
+		{in: 0, want: "Field(0)"},
+		{in: 9, want: "Field(9)"},
+	}
+
+	for _, tc := range tt {
+		if got := tc.in.String(); got != tc.want {
+			t.Errorf("%d: expected %#v, got %#v", int(tc.in), tc.want, got)
+		}
+	}
+}
+
+func TestDataSetField(t *testing.T) {
+	var got Data
+	for i, f := range Fields {
+		got.SetField(f, Just(float64(i+1)))
+	}
+
+	want := Data{
+		D1: Just(1.0),
+		D2: Just(2.0),
+		D3: Just(3.0),
+		D4: Just(4.0),
+		D5: Just(5.0),
+		D6: Just(6.0),
+		D7: Just(7.0),
+		D8: Just(8.0),
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want, +got)\n%s", diff)
+	}
+
+	for i, f := range Fields {
+		if v := got.Field(f); v != Just(float64(i+1)) {
+			t.Errorf("%s: expected %#v, got %#v", f, Just(float64(i+1)), v)
+		}
+	}
+	if v := got.Field(0); v.OK {
+		t.Errorf("Field(0): expected not ok, got %#v", v)
+	}
+}
+
+func TestChannelInfoField(t *testing.T) {
+	c := ChannelInfo{
+		D1: FieldInfo{Name: "d1", Color: FieldColorBlue},
+		D8: FieldInfo{Name: "d8", Color: FieldColorBlack},
+	}
+
+	if got := c.Field(FieldD1); got != c.D1 {
+		t.Errorf("d1: expected %#v, got %#v", c.D1, got)
+	}
+	if got := c.Field(FieldD8); got != c.D8 {
+		t.Errorf("d8: expected %#v, got %#v", c.D8, got)
+	}
+	if got := c.Field(0); got != (FieldInfo{}) {
+		t.Errorf("Field(0): expected zero, got %#v", got)
+	}
+}
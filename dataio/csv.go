@@ -0,0 +1,159 @@
+package dataio
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+)
+
+// csvHeader は CSV 形式で書き込む際の列名です。
+var csvHeader = []string{"created", "d1", "d2", "d3", "d4", "d5", "d6", "d7", "d8", "lat", "lng", "cmnt", "hide"}
+
+// CSVWriter はデータポイントを CSV 形式で書き込む [Writer] です。
+// 1行目には列名のヘッダー行が出力されます。
+type CSVWriter struct {
+	w      *csv.Writer
+	header bool
+}
+
+// NewCSVWriter は新しい [CSVWriter] を作成します。
+func NewCSVWriter(w io.Writer) *CSVWriter {
+	return &CSVWriter{w: csv.NewWriter(w)}
+}
+
+// Write は [Writer] を実装します。
+func (w *CSVWriter) Write(data ambidata.Data) error {
+	err := w.writeHeader()
+	if err != nil {
+		return err
+	}
+
+	rec := make([]string, len(csvHeader))
+	if !data.Created.IsZero() {
+		rec[0] = data.Created.Format(time.RFC3339Nano)
+	}
+	for i, f := range ambidata.Fields {
+		v := data.Field(f)
+		if !v.OK {
+			continue
+		}
+		if math.IsNaN(v.V) || math.IsInf(v.V, 0) {
+			return fmt.Errorf("dataio: %s: unsupported value %v", f, v.V)
+		}
+		rec[1+i] = formatFloat(v.V)
+	}
+	if data.Loc.OK {
+		rec[9] = formatFloat(data.Loc.V.Lat)
+		rec[10] = formatFloat(data.Loc.V.Lng)
+	}
+	rec[11] = data.Cmnt
+	if data.Hide {
+		rec[12] = "true"
+	}
+	return w.w.Write(rec)
+}
+
+// Close は [Writer] を実装します。
+// データポイントを1件も書き込んでいない場合でも、ヘッダー行は出力されます。
+func (w *CSVWriter) Close() error {
+	err := w.writeHeader()
+	if err != nil {
+		return err
+	}
+	w.w.Flush()
+	return w.w.Error()
+}
+
+func (w *CSVWriter) writeHeader() error {
+	if w.header {
+		return nil
+	}
+	w.header = true
+	return w.w.Write(csvHeader)
+}
+
+// CSVReader は CSV 形式のデータポイントを読み込む [Reader] です。
+//
+// 1行目は列名のヘッダー行として扱われます。
+// 列の順序は任意で、不要な列は省略できます。未知の列名は無視されます。
+type CSVReader struct {
+	r    *csv.Reader
+	cols []string
+}
+
+// NewCSVReader は新しい [CSVReader] を作成します。
+func NewCSVReader(r io.Reader) *CSVReader {
+	c := csv.NewReader(r)
+	c.FieldsPerRecord = -1
+	return &CSVReader{r: c}
+}
+
+// Read は [Reader] を実装します。
+func (r *CSVReader) Read() (ambidata.Data, error) {
+	if r.cols == nil {
+		header, err := r.r.Read()
+		if err != nil {
+			return ambidata.Data{}, err
+		}
+		r.cols = header
+	}
+
+	rec, err := r.r.Read()
+	if err != nil {
+		return ambidata.Data{}, err
+	}
+
+	var data ambidata.Data
+	var lat, lng ambidata.Maybe[float64]
+	for i, cell := range rec {
+		if i >= len(r.cols) || cell == "" {
+			continue
+		}
+
+		col := r.cols[i]
+		switch col {
+		case "created":
+			data.Created, err = time.Parse(time.RFC3339Nano, cell)
+		case "lat":
+			lat.V, err = strconv.ParseFloat(cell, 64)
+			lat.OK = true
+		case "lng":
+			lng.V, err = strconv.ParseFloat(cell, 64)
+			lng.OK = true
+		case "cmnt":
+			data.Cmnt = cell
+		case "hide":
+			data.Hide, err = strconv.ParseBool(cell)
+		default:
+			f, errField := ambidata.ParseField(col)
+			if errField != nil {
+				continue // ignore unknown column
+			}
+			var v float64
+			v, err = strconv.ParseFloat(cell, 64)
+			data.SetField(f, ambidata.Just(v))
+		}
+		if err != nil {
+			line, _ := r.r.FieldPos(i)
+			return ambidata.Data{}, fmt.Errorf("dataio: line %d: %s: %w", line, col, err)
+		}
+	}
+
+	if lat.OK != lng.OK {
+		line, _ := r.r.FieldPos(0)
+		return ambidata.Data{}, fmt.Errorf("dataio: line %d: lat and lng must be specified together", line)
+	}
+	if lat.OK {
+		data.Loc = ambidata.Just(ambidata.Location{Lat: lat.V, Lng: lng.V})
+	}
+	return data, nil
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,99 @@
+// Package dataio は、データポイント ([ambidata.Data]) を CSV や JSON 形式で読み書きする機能を提供します。
+//
+// 対応している形式は以下の通りです。
+//
+//   - CSV ([FormatCSV]): 1行目が列名のヘッダー行となる CSV 形式
+//   - JSON ([FormatJSON]): データポイントのオブジェクトを要素とする JSON 配列
+//   - NDJSON ([FormatNDJSON]): 1行に1つのデータポイントのオブジェクトを記述する形式
+//
+// いずれの形式でも、データポイントの項目名は "created", "d1"～"d8", "lat", "lng", "cmnt", "hide" です。
+// "created" は RFC 3339 形式の時刻です。値が無いデータフィールドは、JSON では項目を省略し、
+// CSV では空欄とします。
+package dataio
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/gcrtnst/ambidata"
+)
+
+// Format はデータの形式を表す型です。
+type Format string
+
+// 対応しているデータの形式。
+const (
+	FormatCSV    Format = "csv"    // CSV 形式
+	FormatJSON   Format = "json"   // JSON 配列形式
+	FormatNDJSON Format = "ndjson" // 改行区切りの JSON 形式
+)
+
+// Writer はデータポイントを書き込むインターフェースです。
+type Writer interface {
+	// Write はデータポイントを1件書き込みます。
+	Write(data ambidata.Data) error
+
+	// Close は未出力の内容を書き込み、出力を完了します。
+	// 基になる [io.Writer] は閉じません。
+	Close() error
+}
+
+// Reader はデータポイントを読み込むインターフェースです。
+type Reader interface {
+	// Read はデータポイントを1件読み込みます。
+	// 読み込むデータポイントが無い場合は [io.EOF] を返します。
+	Read() (ambidata.Data, error)
+}
+
+// NewWriter は形式 format でデータポイントを w に書き込む [Writer] を作成します。
+func NewWriter(w io.Writer, format Format) (Writer, error) {
+	switch format {
+	case FormatCSV:
+		return NewCSVWriter(w), nil
+	case FormatJSON:
+		return NewJSONWriter(w), nil
+	case FormatNDJSON:
+		return NewNDJSONWriter(w), nil
+	default:
+		return nil, fmt.Errorf("dataio: unknown format %q", format)
+	}
+}
+
+// NewReader は形式 format のデータポイントを r から読み込む [Reader] を作成します。
+// [FormatJSON] と [FormatNDJSON] はどちらの形式の入力も受け付けます。
+func NewReader(r io.Reader, format Format) (Reader, error) {
+	switch format {
+	case FormatCSV:
+		return NewCSVReader(r), nil
+	case FormatJSON, FormatNDJSON:
+		return NewJSONReader(r), nil
+	default:
+		return nil, fmt.Errorf("dataio: unknown format %q", format)
+	}
+}
+
+// ReadAll は r から全てのデータポイントを読み込みます。
+func ReadAll(r Reader) ([]ambidata.Data, error) {
+	var arr []ambidata.Data
+	for {
+		data, err := r.Read()
+		if err == io.EOF {
+			return arr, nil
+		}
+		if err != nil {
+			return arr, err
+		}
+		arr = append(arr, data)
+	}
+}
+
+// WriteAll は arr の全てのデータポイントを w に書き込み、出力を完了します。
+func WriteAll(w Writer, arr []ambidata.Data) error {
+	for i := range arr {
+		err := w.Write(arr[i])
+		if err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
@@ -0,0 +1,182 @@
+package dataio
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/google/go-cmp/cmp"
+)
+
+func testData() []ambidata.Data {
+	return []ambidata.Data{
+		{
+			Created: time.Date(2006, 1, 2, 15, 4, 5, 999000000, time.UTC),
+			D1:      ambidata.Just(101.0),
+			D2:      ambidata.Just(102.0),
+			D3:      ambidata.Just(103.0),
+			D4:      ambidata.Just(104.0),
+			D5:      ambidata.Just(105.0),
+			D6:      ambidata.Just(106.0),
+			D7:      ambidata.Just(107.0),
+			D8:      ambidata.Just(108.5),
+			Loc:     ambidata.Just(ambidata.Location{Lat: 35.5, Lng: 139.25}),
+			Cmnt:    "a,\"b\"\nc",
+			Hide:    true,
+		},
+		{
+			Created: time.Date(2006, 1, 2, 15, 4, 0, 0, time.UTC),
+			D3:      ambidata.Just(0.0),
+		},
+		{},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, format := range []Format{FormatCSV, FormatJSON, FormatNDJSON} {
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, format)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if err := WriteAll(w, testData()); err != nil {
+			t.Errorf("%s: write: %v", format, err)
+			continue
+		}
+
+		r, err := NewReader(&buf, format)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		got, err := ReadAll(r)
+		if err != nil {
+			t.Errorf("%s: read: %v", format, err)
+			continue
+		}
+		if diff := cmp.Diff(testData(), got); diff != "" {
+			t.Errorf("%s: mismatch (-want, +got)\n%s", format, diff)
+		}
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	tt := []struct {
+		format Format
+		want   string
+	}{
+		{format: FormatCSV, want: "created,d1,d2,d3,d4,d5,d6,d7,d8,lat,lng,cmnt,hide\n"},
+		{format: FormatJSON, want: "[]\n"},
+		{format: FormatNDJSON, want: ""},
+	}
+
+	for _, tc := range tt {
+		var buf bytes.Buffer
+		w, _ := NewWriter(&buf, tc.format)
+		if err := w.Close(); err != nil {
+			t.Errorf("%s: %v", tc.format, err)
+		}
+		if got := buf.String(); got != tc.want {
+			t.Errorf("%s: expected %#v, got %#v", tc.format, tc.want, got)
+		}
+
+		r, _ := NewReader(&buf, tc.format)
+		got, err := ReadAll(r)
+		if err != nil {
+			t.Errorf("%s: read: %v", tc.format, err)
+		} else if len(got) != 0 {
+			t.Errorf("%s: read: expected empty, got %#v", tc.format, got)
+		}
+	}
+}
+
+func TestJSONReaderStream(t *testing.T) {
+	const in = `{"created":"2006-01-02T15:04:05Z","d1":1} {"d2":2,"lat":1,"lng":2}
+{"cmnt":"x","hide":true}`
+	want := []ambidata.Data{
+		{Created: time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC), D1: ambidata.Just(1.0)},
+		{D2: ambidata.Just(2.0), Loc: ambidata.Just(ambidata.Location{Lat: 1, Lng: 2})},
+		{Cmnt: "x", Hide: true},
+	}
+
+	got, err := ReadAll(NewJSONReader(strings.NewReader(in)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want, +got)\n%s", diff)
+	}
+}
+
+func TestCSVReaderColumns(t *testing.T) {
+	const in = "d2,created,memo\n5,2006-01-02T15:04:05+09:00,x\n,,y\n"
+	want := []ambidata.Data{
+		{Created: time.Date(2006, 1, 2, 15, 4, 5, 0, time.FixedZone("", 9*60*60)), D2: ambidata.Just(5.0)},
+		{},
+	}
+
+	got, err := ReadAll(NewCSVReader(strings.NewReader(in)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want, +got)\n%s", diff)
+	}
+}
+
+func TestReaderErrLocation(t *testing.T) {
+	tt := []struct {
+		format Format
+		in     string
+	}{
+		{format: FormatCSV, in: "lat\n1\n"},
+		{format: FormatJSON, in: `[{"lng":1}]`},
+	}
+
+	for _, tc := range tt {
+		r, _ := NewReader(strings.NewReader(tc.in), tc.format)
+		if _, err := ReadAll(r); err == nil {
+			t.Errorf("%s: expected error", tc.format)
+		}
+	}
+}
+
+func TestCSVReaderErrValue(t *testing.T) {
+	const in = "created,d1\n2006-01-02T15:04:05Z,abc\n"
+	_, err := ReadAll(NewCSVReader(strings.NewReader(in)))
+	if err == nil || !strings.Contains(err.Error(), "line 2: d1") {
+		t.Errorf("expected error at line 2: d1, got %v", err)
+	}
+}
+
+func TestNewWriterErrFormat(t *testing.T) {
+	if _, err := NewWriter(&bytes.Buffer{}, "xml"); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	in := ambidata.Data{
+		Created: time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC),
+		D2:      ambidata.Just(2.5),
+		Loc:     ambidata.Just(ambidata.Location{Lat: 1, Lng: 2}),
+	}
+	const want = `{"created":"2006-01-02T15:04:05Z","d2":2.5,"lat":1,"lng":2}`
+
+	got, err := Marshal(in)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("marshal: expected %#v, got %#v", want, string(got))
+	}
+
+	var back ambidata.Data
+	if err := Unmarshal(got, &back); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if diff := cmp.Diff(in, back); diff != "" {
+		t.Errorf("unmarshal: mismatch (-want, +got)\n%s", diff)
+	}
+}
@@ -0,0 +1,231 @@
+package dataio
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+)
+
+type jsonData struct {
+	Created time.Time `json:"created,omitzero"`
+	D1      *float64  `json:"d1,omitempty"`
+	D2      *float64  `json:"d2,omitempty"`
+	D3      *float64  `json:"d3,omitempty"`
+	D4      *float64  `json:"d4,omitempty"`
+	D5      *float64  `json:"d5,omitempty"`
+	D6      *float64  `json:"d6,omitempty"`
+	D7      *float64  `json:"d7,omitempty"`
+	D8      *float64  `json:"d8,omitempty"`
+	Lat     *float64  `json:"lat,omitempty"`
+	Lng     *float64  `json:"lng,omitempty"`
+	Cmnt    string    `json:"cmnt,omitempty"`
+	Hide    bool      `json:"hide,omitempty"`
+}
+
+func toJSONData(data *ambidata.Data) (*jsonData, error) {
+	j := &jsonData{
+		Created: data.Created,
+		Cmnt:    data.Cmnt,
+		Hide:    data.Hide,
+	}
+	fields := [...]**float64{&j.D1, &j.D2, &j.D3, &j.D4, &j.D5, &j.D6, &j.D7, &j.D8}
+	for i, f := range ambidata.Fields {
+		v := data.Field(f)
+		if !v.OK {
+			continue
+		}
+		if math.IsNaN(v.V) || math.IsInf(v.V, 0) {
+			return nil, fmt.Errorf("dataio: %s: unsupported value %v", f, v.V)
+		}
+		*fields[i] = &v.V
+	}
+	if data.Loc.OK {
+		j.Lat = &data.Loc.V.Lat
+		j.Lng = &data.Loc.V.Lng
+	}
+	return j, nil
+}
+
+func (j *jsonData) ToData() (ambidata.Data, error) {
+	data := ambidata.Data{
+		Created: j.Created,
+		Cmnt:    j.Cmnt,
+		Hide:    j.Hide,
+	}
+	fields := [...]*float64{j.D1, j.D2, j.D3, j.D4, j.D5, j.D6, j.D7, j.D8}
+	for i, f := range ambidata.Fields {
+		if fields[i] != nil {
+			data.SetField(f, ambidata.Just(*fields[i]))
+		}
+	}
+	if (j.Lat == nil) != (j.Lng == nil) {
+		return ambidata.Data{}, errors.New("dataio: lat and lng must be specified together")
+	}
+	if j.Lat != nil {
+		data.Loc = ambidata.Just(ambidata.Location{Lat: *j.Lat, Lng: *j.Lng})
+	}
+	return data, nil
+}
+
+// JSONWriter はデータポイントを JSON 配列形式で書き込む [Writer] です。
+type JSONWriter struct {
+	w *bufio.Writer
+	n int
+}
+
+// NewJSONWriter は新しい [JSONWriter] を作成します。
+func NewJSONWriter(w io.Writer) *JSONWriter {
+	return &JSONWriter{w: bufio.NewWriter(w)}
+}
+
+// Write は [Writer] を実装します。
+func (w *JSONWriter) Write(data ambidata.Data) error {
+	b, err := marshal(&data)
+	if err != nil {
+		return err
+	}
+	if w.n == 0 {
+		w.w.WriteString("[\n")
+	} else {
+		w.w.WriteString(",\n")
+	}
+	w.n++
+	_, err = w.w.Write(b)
+	return err
+}
+
+// Close は [Writer] を実装します。
+func (w *JSONWriter) Close() error {
+	if w.n == 0 {
+		w.w.WriteString("[]\n")
+	} else {
+		w.w.WriteString("\n]\n")
+	}
+	return w.w.Flush()
+}
+
+// NDJSONWriter はデータポイントを改行区切りの JSON 形式で書き込む [Writer] です。
+type NDJSONWriter struct {
+	w *bufio.Writer
+}
+
+// NewNDJSONWriter は新しい [NDJSONWriter] を作成します。
+func NewNDJSONWriter(w io.Writer) *NDJSONWriter {
+	return &NDJSONWriter{w: bufio.NewWriter(w)}
+}
+
+// Write は [Writer] を実装します。
+func (w *NDJSONWriter) Write(data ambidata.Data) error {
+	b, err := marshal(&data)
+	if err != nil {
+		return err
+	}
+	w.w.Write(b)
+	return w.w.WriteByte('\n')
+}
+
+// Close は [Writer] を実装します。
+func (w *NDJSONWriter) Close() error {
+	return w.w.Flush()
+}
+
+func marshal(data *ambidata.Data) ([]byte, error) {
+	j, err := toJSONData(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(j)
+}
+
+// JSONReader は JSON 形式のデータポイントを読み込む [Reader] です。
+// 入力は、データポイントのオブジェクトを要素とする JSON 配列か、
+// オブジェクトを空白区切りで並べたもの (NDJSON を含む) のどちらでも構いません。
+type JSONReader struct {
+	r     *bufio.Reader
+	d     *json.Decoder
+	array bool
+}
+
+// NewJSONReader は新しい [JSONReader] を作成します。
+func NewJSONReader(r io.Reader) *JSONReader {
+	return &JSONReader{r: bufio.NewReader(r)}
+}
+
+// Read は [Reader] を実装します。
+func (r *JSONReader) Read() (ambidata.Data, error) {
+	if r.d == nil {
+		array, err := r.skipArrayStart()
+		if err != nil {
+			return ambidata.Data{}, err
+		}
+		r.array = array
+		r.d = json.NewDecoder(r.r)
+		if array {
+			_, err := r.d.Token() // '['
+			if err != nil {
+				return ambidata.Data{}, err
+			}
+		}
+	}
+
+	if r.array && !r.d.More() {
+		_, err := r.d.Token() // ']'
+		if err != nil {
+			return ambidata.Data{}, err
+		}
+		return ambidata.Data{}, io.EOF
+	}
+
+	var j jsonData
+	err := r.d.Decode(&j)
+	if err != nil {
+		return ambidata.Data{}, err
+	}
+	return j.ToData()
+}
+
+// skipArrayStart は先頭の空白を読み飛ばし、入力が JSON 配列の場合は true を返します。
+func (r *JSONReader) skipArrayStart() (bool, error) {
+	for {
+		c, err := r.r.ReadByte()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		default:
+			return c == '[', r.r.UnreadByte()
+		}
+	}
+}
+
+// Marshal はデータポイントを JSON オブジェクトに変換します。
+// 形式は [FormatNDJSON] の1行分と同じです。
+func Marshal(data ambidata.Data) ([]byte, error) {
+	return marshal(&data)
+}
+
+// Unmarshal は JSON オブジェクトをデータポイントに変換し、data に格納します。
+func Unmarshal(b []byte, data *ambidata.Data) error {
+	var j jsonData
+	err := json.Unmarshal(b, &j)
+	if err != nil {
+		return err
+	}
+	d, err := j.ToData()
+	if err != nil {
+		return err
+	}
+	*data = d
+	return nil
+}
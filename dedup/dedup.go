@@ -0,0 +1,322 @@
+// Package dedup は、送信済みのデータポイントの時刻を記録し、
+// 同じ時刻のデータポイントを再送信しないようにする機能を提供します。
+//
+// 収集プログラムの再起動などで、送信済みの期間を含むデータポイントを再送信する場合に使用します。
+// 送信済みの時刻はチャネルごとにミリ秒単位で記録し、ファイルに保存できます。
+// 既にチャネルに保存されているデータポイントの時刻を [Store.Seed] で取り込むこともできます。
+//
+// 使用例:
+//
+//	st, err := dedup.Open("sent.json")
+//	// ...
+//	s := &dedup.Sender{Sender: ambidata.NewSender(ch, writeKey), Store: st}
+//	n, err := s.SendBulk(ctx, backlog) // 送信済みの時刻のデータポイントは送信されない
+package dedup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+)
+
+// Store はチャネルごとに送信済みのデータポイントの時刻を記録します。
+//
+// 時刻はサーバーと同様にミリ秒単位に切り捨てて比較します。
+// 時刻がゼロ値のデータポイントは、サーバーが受信時刻を設定するため記録しません。
+//
+// Store のメソッドは複数の goroutine から同時に呼び出すことができます。
+type Store struct {
+	// Path は保存先のファイルのパスです。
+	// 空文字列の場合、 [Store.Save] は何もしません。
+	Path string
+
+	// Retention は時刻を記録しておく期間です。
+	// チャネルごとに、記録されている最新の時刻から Retention より前の時刻は削除されます。
+	// 削除した時刻の範囲は記録されず、代わりにその境界の時刻 (保持期間の始まり) を記録します。
+	// 保持期間の始まりより前の時刻は、記録の有無にかかわらず送信済みとして扱います。
+	// 0 以下の場合は、削除しません。
+	Retention time.Duration
+
+	mu      sync.Mutex
+	seen    map[string]map[int64]struct{}
+	horizon map[string]int64 // チャネルごとの保持期間の始まり (Unix ミリ秒)
+}
+
+// storeFile は保存先のファイルのチャネルごとの内容です。
+type storeFile struct {
+	Horizon *int64  `json:"horizon,omitempty"` // 保持期間の始まり (Unix ミリ秒)
+	Sent    []int64 `json:"sent"`              // 送信済みの時刻 (Unix ミリ秒)
+}
+
+// Open はファイル path から記録を読み込んだ [Store] を作成します。
+// ファイルが存在しない場合は、空の [Store] を作成します。
+func Open(path string) (*Store, error) {
+	s := &Store{Path: path}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var j map[string]storeFile
+	err = json.Unmarshal(b, &j)
+	if err != nil {
+		return nil, fmt.Errorf("dedup: %s: %w", path, err)
+	}
+	s.seen = map[string]map[int64]struct{}{}
+	s.horizon = map[string]int64{}
+	for ch, c := range j {
+		set := make(map[int64]struct{}, len(c.Sent))
+		for _, ms := range c.Sent {
+			set[ms] = struct{}{}
+		}
+		s.seen[ch] = set
+		if c.Horizon != nil {
+			s.horizon[ch] = *c.Horizon
+		}
+	}
+	return s, nil
+}
+
+// Save は記録をファイル [Store.Path] に保存します。
+// 保存は一時ファイルへの書き込みと名前の変更により行うため、
+// 途中で中断されても既存のファイルは壊れません。
+func (s *Store) Save() (err error) {
+	if s.Path == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	j := make(map[string]storeFile, len(s.seen))
+	for ch, set := range s.seen {
+		c := storeFile{Sent: slices.Sorted(maps.Keys(set))}
+		if h, ok := s.horizon[ch]; ok {
+			c.Horizon = &h
+		}
+		j[ch] = c
+	}
+	s.mu.Unlock()
+	b, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(s.Path), "."+filepath.Base(s.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
+
+	_, err = file.Write(b)
+	if err != nil {
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), s.Path)
+}
+
+// Seen はチャネル ch について時刻 t が送信済みとして扱われる場合に true を返します。
+// 時刻 t が記録されている場合と、保持期間の始まりより前の場合が該当します。
+func (s *Store) Seen(ch string, t time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.seenLocked(ch, t.UnixMilli())
+}
+
+// seenLocked は [Store.Seen] と同様です。 s.mu をロックした状態で呼び出してください。
+func (s *Store) seenLocked(ch string, ms int64) bool {
+	if h, ok := s.horizon[ch]; ok && ms < h {
+		return true
+	}
+	_, ok := s.seen[ch][ms]
+	return ok
+}
+
+// Len はチャネル ch について記録されている時刻の数を返します。
+func (s *Store) Len(ch string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.seen[ch])
+}
+
+// Mark はチャネル ch について arr のデータポイントの時刻を記録します。
+func (s *Store) Mark(ch string, arr ...ambidata.Data) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.seen == nil {
+		s.seen = map[string]map[int64]struct{}{}
+	}
+	set, ok := s.seen[ch]
+	if !ok {
+		set = map[int64]struct{}{}
+		s.seen[ch] = set
+	}
+	for i := range arr {
+		if !arr[i].Created.IsZero() {
+			set[arr[i].Created.UnixMilli()] = struct{}{}
+		}
+	}
+
+	if s.Retention > 0 && len(set) > 0 {
+		limit := slices.Max(slices.Collect(maps.Keys(set))) - s.Retention.Milliseconds()
+		if h, ok := s.horizon[ch]; ok {
+			limit = max(limit, h)
+		}
+		maps.DeleteFunc(set, func(ms int64, _ struct{}) bool { return ms < limit })
+		if s.horizon == nil {
+			s.horizon = map[string]int64{}
+		}
+		s.horizon[ch] = limit
+	}
+}
+
+// Filter は arr からチャネル ch について送信済みとして扱われる時刻 ([Store.Seen]) のデータポイントを取り除いた結果を返します。
+// arr の中で時刻が重複するデータポイントは、最初のもののみを残します。
+// 時刻がゼロ値のデータポイントは取り除きません。
+// Filter は時刻を記録しません。送信に成功した後に [Store.Mark] を呼び出してください。
+func (s *Store) Filter(ch string, arr []ambidata.Data) []ambidata.Data {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	batch := map[int64]struct{}{}
+	ret := []ambidata.Data{}
+	for i := range arr {
+		if arr[i].Created.IsZero() {
+			ret = append(ret, arr[i])
+			continue
+		}
+		ms := arr[i].Created.UnixMilli()
+		if s.seenLocked(ch, ms) {
+			continue
+		}
+		if _, ok := batch[ms]; ok {
+			continue
+		}
+		batch[ms] = struct{}{}
+		ret = append(ret, arr[i])
+	}
+	return ret
+}
+
+// Seed はチャネルに保存されている期間 start ～ end のデータポイントを取得し、その時刻を記録します。
+// 記録はファイルに保存されません。必要に応じて [Store.Save] を呼び出してください。
+func (s *Store) Seed(ctx context.Context, f *ambidata.Fetcher, start time.Time, end time.Time) error {
+	arr, err := f.FetchPeriodAll(ctx, start, end)
+	if err != nil {
+		return fmt.Errorf("dedup: %w", err)
+	}
+	s.Mark(f.Ch, arr...)
+	return nil
+}
+
+// Sender は [Store] に記録されている時刻のデータポイントを除外して送信します。
+// 送信に成功したデータポイントの時刻は [Store] に記録され、ファイルに保存されます。
+//
+// [Store.Save] は記録全体を書き直すため、記録が多い場合は保存の負荷が大きくなります。
+// [Sender.SaveInterval] を指定すると、保存の頻度を減らすことができます。
+//
+// Sender のメソッドは複数の goroutine から同時に呼び出すことができます。
+// 同じ時刻のデータポイントが同時に送信されることを防ぐため、送信は1つずつ行われます。
+type Sender struct {
+	// Sender はデータポイントを送信する [ambidata.Sender] です。
+	Sender *ambidata.Sender
+
+	// Store は送信済みの時刻の記録です。
+	Store *Store
+
+	// SaveInterval は記録をファイルに保存する最小の間隔です。
+	// 前回の保存から SaveInterval が経過していない場合は保存を省略するため、
+	// 終了する前に [Sender.Flush] を呼び出してください。
+	// 保存されていない記録はプログラムが異常終了した場合に失われ、その時刻のデータポイントは再送信されます。
+	// 0 以下の場合は、送信に成功するたびに保存します。
+	SaveInterval time.Duration
+
+	mu       sync.Mutex
+	dirty    bool      // 保存されていない記録がある場合は true
+	lastSave time.Time // 前回の保存の時刻
+}
+
+// Send は data の時刻が記録されていない場合に、 [ambidata.Sender.Send] で送信します。
+// 送信した場合は true を返します。
+func (s *Sender) Send(ctx context.Context, data ambidata.Data) (bool, error) {
+	n, err := s.send([]ambidata.Data{data}, func(arr []ambidata.Data) error {
+		return s.Sender.Send(ctx, arr[0])
+	})
+	return n > 0, err
+}
+
+// SendBulk は arr のうち時刻が記録されていないデータポイントを、
+// [ambidata.Sender.SendBulk] で送信します。
+// 送信したデータポイントの数を返します。
+//
+// 送信に成功した後、記録の保存に失敗した場合はエラーを返します。
+// この場合も、記録はメモリ上では更新されています。
+func (s *Sender) SendBulk(ctx context.Context, arr []ambidata.Data) (int, error) {
+	return s.send(arr, func(arr []ambidata.Data) error {
+		return s.Sender.SendBulk(ctx, arr)
+	})
+}
+
+func (s *Sender) send(arr []ambidata.Data, fn func([]ambidata.Data) error) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	arr = s.Store.Filter(s.Sender.Ch, arr)
+	if len(arr) <= 0 {
+		return 0, nil
+	}
+	err := fn(arr)
+	if err != nil {
+		return 0, fmt.Errorf("dedup: %w", err)
+	}
+	s.Store.Mark(s.Sender.Ch, arr...)
+	s.dirty = true
+	if s.SaveInterval > 0 && time.Since(s.lastSave) < s.SaveInterval {
+		return len(arr), nil
+	}
+	err = s.save()
+	if err != nil {
+		return len(arr), err
+	}
+	return len(arr), nil
+}
+
+// Flush は保存されていない記録がある場合に、記録をファイルに保存します。
+func (s *Sender) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	return s.save()
+}
+
+// save は記録をファイルに保存します。 s.mu をロックした状態で呼び出してください。
+func (s *Sender) save() error {
+	err := s.Store.Save()
+	if err != nil {
+		return fmt.Errorf("dedup: save: %w", err)
+	}
+	s.dirty = false
+	s.lastSave = time.Now()
+	return nil
+}
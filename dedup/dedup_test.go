@@ -0,0 +1,253 @@
+package dedup
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/internal/ambimock"
+	"github.com/google/go-cmp/cmp"
+)
+
+var t0 = time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+
+func point(sec int) ambidata.Data {
+	return ambidata.Data{Created: t0.Add(time.Duration(sec) * time.Second), D1: ambidata.Just(float64(sec))}
+}
+
+func TestStoreFilter(t *testing.T) {
+	s := &Store{}
+	s.Mark("1", point(0), point(1))
+	s.Mark("2", point(2))
+
+	in := []ambidata.Data{
+		point(0),
+		{Created: t0.Add(time.Second + 500*time.Microsecond), D1: ambidata.Just(9.0)}, // ミリ秒単位で point(1) と同じ時刻
+		point(2),
+		point(3),
+		{Created: t0.Add(3 * time.Second), D1: ambidata.Just(9.0)},
+		{D1: ambidata.Just(9.0)},
+		{D1: ambidata.Just(9.0)},
+	}
+	want := []ambidata.Data{
+		point(2),
+		point(3),
+		{D1: ambidata.Just(9.0)},
+		{D1: ambidata.Just(9.0)},
+	}
+	if diff := cmp.Diff(want, s.Filter("1", in)); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+	if !s.Seen("2", t0.Add(2*time.Second)) {
+		t.Errorf("Seen: expected true, got false")
+	}
+	if s.Seen("2", t0) {
+		t.Errorf("Seen: expected false, got true")
+	}
+}
+
+func TestStoreRetention(t *testing.T) {
+	s := &Store{Retention: time.Minute}
+	s.Mark("1", point(0), point(30), ambidata.Data{})
+	s.Mark("1", point(90))
+
+	if n := s.Len("1"); n != 2 {
+		t.Errorf("Len: expected 2, got %d", n)
+	}
+
+	// 削除した時刻を含め、保持期間の始まりより前の時刻は送信済みとして扱う
+	if !s.Seen("1", point(0).Created) || !s.Seen("1", point(10).Created) {
+		t.Errorf("Seen: expected time before the retention horizon to be treated as sent")
+	}
+	in := []ambidata.Data{point(0), point(10), point(30), point(45), point(90), point(91)}
+	if diff := cmp.Diff([]ambidata.Data{point(45), point(91)}, s.Filter("1", in)); diff != "" {
+		t.Errorf("Filter: mismatch (-want, +got):\n%s", diff)
+	}
+
+	// 保持期間の始まりはファイルに保存され、読み込み後も維持される
+	s.Path = filepath.Join(t.TempDir(), "sent.json")
+	err := s.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = Open(s.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Seen("1", point(10).Created) {
+		t.Errorf("Seen: expected retention horizon to be restored")
+	}
+	if s.Seen("2", point(0).Created) {
+		t.Errorf("Seen: expected other channel to be unaffected")
+	}
+}
+
+func TestStoreSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sent.json")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Len("1"); n != 0 {
+		t.Errorf("Len: expected 0, got %d", n)
+	}
+
+	s.Mark("1", point(0), point(1))
+	s.Mark("2", point(2))
+	err = s.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		ch   string
+		sec  int
+		want bool
+	}{
+		{"1", 0, true},
+		{"1", 1, true},
+		{"1", 2, false},
+		{"2", 2, true},
+	} {
+		if got := s.Seen(tt.ch, point(tt.sec).Created); got != tt.want {
+			t.Errorf("%s/%d: expected %t, got %t", tt.ch, tt.sec, tt.want, got)
+		}
+	}
+}
+
+func TestStoreSeed(t *testing.T) {
+	srv := ambimock.New(t)
+	srv.AddChannel(&ambimock.Channel{
+		Info:     ambidata.ChannelInfo{Ch: "1"},
+		ReadKey:  "rk",
+		WriteKey: "wk",
+		Data:     []ambidata.Data{point(0), point(1), point(3600)},
+	})
+
+	s := &Store{}
+	err := s.Seed(context.Background(), srv.Fetcher("1"), t0, t0.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Len("1"); n != 2 {
+		t.Errorf("Len: expected 2, got %d", n)
+	}
+	if !s.Seen("1", point(1).Created) {
+		t.Errorf("Seen: expected true, got false")
+	}
+}
+
+func TestSender(t *testing.T) {
+	ctx := context.Background()
+	srv := ambimock.New(t)
+	srv.AddChannel(&ambimock.Channel{Info: ambidata.ChannelInfo{Ch: "1"}, ReadKey: "rk", WriteKey: "wk"})
+
+	path := filepath.Join(t.TempDir(), "sent.json")
+	st, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Sender{Sender: srv.Sender("1"), Store: st}
+
+	n, err := s.SendBulk(ctx, []ambidata.Data{point(0), point(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("SendBulk: expected 2, got %d", n)
+	}
+
+	// 再起動を想定し、保存した記録から作り直す
+	st, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = &Sender{Sender: srv.Sender("1"), Store: st}
+
+	n, err = s.SendBulk(ctx, []ambidata.Data{point(0), point(1), point(2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("SendBulk: expected 1, got %d", n)
+	}
+	ok, err := s.Send(ctx, point(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Errorf("Send: expected false, got true")
+	}
+	ok, err = s.Send(ctx, point(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Errorf("Send: expected true, got false")
+	}
+
+	want := []ambidata.Data{point(0), point(1), point(2), point(3)}
+	if diff := cmp.Diff(want, srv.Data("1")); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+	if n := len(srv.Requests()); n != 3 {
+		t.Errorf("expected 3 requests, got %d", n)
+	}
+}
+
+func TestSenderError(t *testing.T) {
+	srv := ambimock.New(t)
+	srv.AddChannel(&ambimock.Channel{Info: ambidata.ChannelInfo{Ch: "1"}, ReadKey: "rk", WriteKey: "wk"})
+	srv.Hook = func(r *http.Request) int { return http.StatusServiceUnavailable }
+
+	s := &Sender{Sender: srv.Sender("1"), Store: &Store{}}
+	_, err := s.SendBulk(context.Background(), []ambidata.Data{point(0)})
+	if err == nil {
+		t.Errorf("expected error, got nil")
+	}
+	if s.Store.Seen("1", point(0).Created) {
+		t.Errorf("Seen: expected unsent time not to be recorded")
+	}
+}
+
+func TestSenderSaveInterval(t *testing.T) {
+	ctx := context.Background()
+	srv := ambimock.New(t)
+	srv.AddChannel(&ambimock.Channel{Info: ambidata.ChannelInfo{Ch: "1"}, ReadKey: "rk", WriteKey: "wk"})
+
+	path := filepath.Join(t.TempDir(), "sent.json")
+	s := &Sender{Sender: srv.Sender("1"), Store: &Store{Path: path}, SaveInterval: time.Hour}
+	for _, sec := range []int{0, 1} {
+		if _, err := s.Send(ctx, point(sec)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 2回目の送信では保存を省略する
+	st, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := st.Len("1"); n != 1 {
+		t.Errorf("before Flush: Len: expected 1, got %d", n)
+	}
+
+	err = s.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := st.Len("1"); n != 2 {
+		t.Errorf("after Flush: Len: expected 2, got %d", n)
+	}
+}
@@ -0,0 +1,327 @@
+// Package diff は、2つのデータポイントの列を比較し、差分を報告する機能を提供します。
+//
+// [Compare] はデータポイントを時刻 ([ambidata.Data.Created]) のミリ秒単位で対応付け、
+// 一方にのみ存在するデータポイントと、内容が異なるデータポイントを報告します。
+// 内容はデータ1～8の値、位置情報、コメント、表示/非表示状態を項目ごとに比較します。
+// 数値は [Options] で指定した許容誤差の範囲内であれば一致するものとみなします。
+//
+// チャネルの移行後に、移行元と移行先のチャネル、またはチャネルとアーカイブのファイルの
+// 内容が一致することを確認する用途を想定しています。
+package diff
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+)
+
+// 比較する項目の名前。データ1～8は "d1"～"d8" です。
+const (
+	ItemLoc  = "loc"
+	ItemCmnt = "cmnt"
+	ItemHide = "hide"
+)
+
+// Options は比較に関する設定です。
+// ゼロ値の Options 構造体は、全ての項目を厳密に比較する有効な構成となります。
+type Options struct {
+	// Tolerance はデータ1～8の値の許容誤差 (絶対値) です。
+	Tolerance float64
+
+	// FieldTolerance はデータ番号ごとの許容誤差です。
+	// 指定されたデータ番号では Tolerance の代わりに使用されます。
+	FieldTolerance map[ambidata.Field]float64
+
+	// LocTolerance は緯度と経度の許容誤差 (度) です。
+	LocTolerance float64
+
+	// IgnoreLoc, IgnoreCmnt, IgnoreHide が true の場合、それぞれ位置情報、コメント、
+	// 表示/非表示状態を比較しません。
+	IgnoreLoc  bool
+	IgnoreCmnt bool
+	IgnoreHide bool
+}
+
+// Change は対応するデータポイントの間で異なる項目です。
+// A と B はそれぞれの値で、値が無い場合は nil です。
+// データ1～8の値は float64、位置情報は [緯度, 経度] の []float64、コメントは string、
+// 表示/非表示状態は bool です。
+//
+// Pair は対応付けられたデータポイントの組の番号で、同じ組の項目は同じ番号になります。
+// 同じ時刻のデータポイントが複数ある場合に、どの項目が同じ組のものかを区別するために使用します。
+type Change struct {
+	Pair    int       `json:"pair"`
+	Created time.Time `json:"created"`
+	Item    string    `json:"item"`
+	A       any       `json:"a"`
+	B       any       `json:"b"`
+}
+
+// Result は比較の結果です。
+type Result struct {
+	A       int             `json:"a"`       // A のデータポイントの数
+	B       int             `json:"b"`       // B のデータポイントの数
+	Matched int             `json:"matched"` // 時刻で対応付けられたデータポイントの組の数
+	Missing []ambidata.Data `json:"-"`       // A にのみ存在するデータポイント
+	Extra   []ambidata.Data `json:"-"`       // B にのみ存在するデータポイント
+	Changed []Change        `json:"-"`       // 対応付けられたデータポイントの間で異なる項目
+}
+
+// Equal は差分が無い場合に true を返します。
+func (r *Result) Equal() bool {
+	return len(r.Missing) == 0 && len(r.Extra) == 0 && len(r.Changed) == 0
+}
+
+// Summary は比較の結果の集計です。
+type Summary struct {
+	Equal   bool           `json:"equal"`
+	A       int            `json:"a"`
+	B       int            `json:"b"`
+	Matched int            `json:"matched"`
+	Missing int            `json:"missing"`
+	Extra   int            `json:"extra"`
+	Changed int            `json:"changed"` // 異なる項目があるデータポイントの組の数
+	Items   map[string]int `json:"items"`   // 項目ごとの異なるデータポイントの組の数
+}
+
+// Summary は比較の結果を集計します。
+func (r *Result) Summary() Summary {
+	s := Summary{
+		Equal:   r.Equal(),
+		A:       r.A,
+		B:       r.B,
+		Matched: r.Matched,
+		Missing: len(r.Missing),
+		Extra:   len(r.Extra),
+		Items:   map[string]int{},
+	}
+	for i, c := range r.Changed {
+		if i == 0 || c.Pair != r.Changed[i-1].Pair {
+			s.Changed++
+		}
+		s.Items[c.Item]++
+	}
+	return s
+}
+
+// Compare はデータポイントの列 a と b を比較します。
+// opt が nil の場合は、デフォルトの設定が使用されます。
+//
+// データポイントは時刻のミリ秒単位で対応付けます。同じ時刻のデータポイントが複数ある場合は、
+// 内容が一致するものを優先して1対1に対応付け、対応付けられなかったものは一方にのみ存在するものとします。
+// 結果の各リストは時刻の昇順に並びます。
+func Compare(a []ambidata.Data, b []ambidata.Data, opt *Options) *Result {
+	if opt == nil {
+		opt = &Options{}
+	}
+	r := &Result{
+		A:       len(a),
+		B:       len(b),
+		Missing: []ambidata.Data{},
+		Extra:   []ambidata.Data{},
+		Changed: []Change{},
+	}
+
+	a = sortByCreated(a)
+	b = sortByCreated(b)
+	for i, j := 0, 0; i < len(a) || j < len(b); {
+		var ka, kb int64 = math.MaxInt64, math.MaxInt64
+		if i < len(a) {
+			ka = a[i].Created.UnixMilli()
+		}
+		if j < len(b) {
+			kb = b[j].Created.UnixMilli()
+		}
+		k := min(ka, kb)
+
+		ei := i
+		for ei < len(a) && a[ei].Created.UnixMilli() == k {
+			ei++
+		}
+		ej := j
+		for ej < len(b) && b[ej].Created.UnixMilli() == k {
+			ej++
+		}
+		r.compareGroup(a[i:ei], b[j:ej], opt)
+		i, j = ei, ej
+	}
+	return r
+}
+
+// compareGroup は同じ時刻のデータポイントの組を比較します。
+func (r *Result) compareGroup(a []ambidata.Data, b []ambidata.Data, opt *Options) {
+	paired := make([]bool, len(b))
+	var unpaired []int
+	for i := range a {
+		found := false
+		for j := range b {
+			if !paired[j] && len(changes(&a[i], &b[j], opt)) == 0 {
+				paired[j] = true
+				found = true
+				break
+			}
+		}
+		if found {
+			r.Matched++
+		} else {
+			unpaired = append(unpaired, i)
+		}
+	}
+
+	for _, i := range unpaired {
+		j := slices.Index(paired, false)
+		if j < 0 {
+			r.Missing = append(r.Missing, a[i])
+			continue
+		}
+		paired[j] = true
+		pair := r.Matched
+		r.Matched++
+		for _, c := range changes(&a[i], &b[j], opt) {
+			c.Pair = pair
+			r.Changed = append(r.Changed, c)
+		}
+	}
+	for j := range b {
+		if !paired[j] {
+			r.Extra = append(r.Extra, b[j])
+		}
+	}
+}
+
+func changes(a *ambidata.Data, b *ambidata.Data, opt *Options) []Change {
+	var ret []Change
+	add := func(item string, va any, vb any) {
+		ret = append(ret, Change{Created: a.Created, Item: item, A: va, B: vb})
+	}
+
+	for _, f := range ambidata.Fields {
+		tol := opt.Tolerance
+		if t, ok := opt.FieldTolerance[f]; ok {
+			tol = t
+		}
+		fa, fb := a.Field(f), b.Field(f)
+		if fa.OK != fb.OK || (fa.OK && !near(fa.V, fb.V, tol)) {
+			add(f.String(), fieldValue(fa), fieldValue(fb))
+		}
+	}
+	if !opt.IgnoreLoc {
+		la, lb := a.Loc, b.Loc
+		if la.OK != lb.OK || (la.OK && !(near(la.V.Lat, lb.V.Lat, opt.LocTolerance) && near(la.V.Lng, lb.V.Lng, opt.LocTolerance))) {
+			add(ItemLoc, locValue(la), locValue(lb))
+		}
+	}
+	if !opt.IgnoreCmnt && a.Cmnt != b.Cmnt {
+		add(ItemCmnt, a.Cmnt, b.Cmnt)
+	}
+	if !opt.IgnoreHide && a.Hide != b.Hide {
+		add(ItemHide, a.Hide, b.Hide)
+	}
+	return ret
+}
+
+func near(a float64, b float64, tol float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	return a == b || math.Abs(a-b) <= tol
+}
+
+func fieldValue(m ambidata.Maybe[float64]) any {
+	if !m.OK {
+		return nil
+	}
+	return m.V
+}
+
+func locValue(m ambidata.Maybe[ambidata.Location]) any {
+	if !m.OK {
+		return nil
+	}
+	return []float64{m.V.Lat, m.V.Lng}
+}
+
+func sortByCreated(arr []ambidata.Data) []ambidata.Data {
+	arr = slices.Clone(arr)
+	slices.SortStableFunc(arr, func(x, y ambidata.Data) int {
+		return cmp.Compare(x.Created.UnixMilli(), y.Created.UnixMilli())
+	})
+	return arr
+}
+
+type jsonResult struct {
+	Summary Summary     `json:"summary"`
+	Missing []time.Time `json:"missing"`
+	Extra   []time.Time `json:"extra"`
+	Changed []Change    `json:"changed"`
+}
+
+// WriteJSON は比較の結果を JSON 形式で出力します。
+// 集計 ("summary")、一方にのみ存在するデータポイントの時刻 ("missing", "extra")、
+// 異なる項目 ("changed") を含みます。
+func (r *Result) WriteJSON(w io.Writer) error {
+	j := jsonResult{
+		Summary: r.Summary(),
+		Missing: createdList(r.Missing),
+		Extra:   createdList(r.Extra),
+		Changed: r.Changed,
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(j)
+}
+
+// WriteText は比較の結果を人が読みやすいテキスト形式で出力します。
+// A にのみ存在するデータポイントは "-"、B にのみ存在するデータポイントは "+"、
+// 異なる項目は "~" で始まる行で出力し、最後に集計を出力します。
+func (r *Result) WriteText(w io.Writer) error {
+	var b strings.Builder
+	for _, d := range r.Missing {
+		fmt.Fprintf(&b, "- %s\n", formatTime(d.Created))
+	}
+	for _, d := range r.Extra {
+		fmt.Fprintf(&b, "+ %s\n", formatTime(d.Created))
+	}
+	for _, c := range r.Changed {
+		fmt.Fprintf(&b, "~ %s %s: %s -> %s\n", formatTime(c.Created), c.Item, formatValue(c.A), formatValue(c.B))
+	}
+	s := r.Summary()
+	fmt.Fprintf(&b, "a: %d, b: %d, matched: %d, missing: %d, extra: %d, changed: %d\n", s.A, s.B, s.Matched, s.Missing, s.Extra, s.Changed)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func createdList(arr []ambidata.Data) []time.Time {
+	ret := make([]time.Time, len(arr))
+	for i := range arr {
+		ret[i] = arr[i].Created
+	}
+	return ret
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z07:00")
+}
+
+func formatValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "(none)"
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case []float64:
+		return "[" + strconv.FormatFloat(v[0], 'g', -1, 64) + ", " + strconv.FormatFloat(v[1], 'g', -1, 64) + "]"
+	case string:
+		return strconv.Quote(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
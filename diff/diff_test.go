@@ -0,0 +1,197 @@
+package diff
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/google/go-cmp/cmp"
+)
+
+var t0 = time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+
+func at(sec int) time.Time {
+	return t0.Add(time.Duration(sec) * time.Second)
+}
+
+func TestCompare(t *testing.T) {
+	loc := ambidata.Just(ambidata.Location{Lat: 35, Lng: 139})
+	tests := []struct {
+		name        string
+		a           []ambidata.Data
+		b           []ambidata.Data
+		opt         Options
+		wantMissing []time.Time
+		wantExtra   []time.Time
+		wantChanged []Change
+	}{
+		{
+			name: "equal",
+			a:    []ambidata.Data{{Created: at(0), D1: ambidata.Just(1.0), Loc: loc, Cmnt: "c", Hide: true}},
+			b:    []ambidata.Data{{Created: at(0), D1: ambidata.Just(1.0), Loc: loc, Cmnt: "c", Hide: true}},
+		},
+		{
+			name: "millisecond",
+			a:    []ambidata.Data{{Created: at(0).Add(1500 * time.Microsecond)}},
+			b:    []ambidata.Data{{Created: at(0).Add(time.Millisecond)}},
+		},
+		{
+			name:        "missing-extra",
+			a:           []ambidata.Data{{Created: at(0)}, {Created: at(1)}},
+			b:           []ambidata.Data{{Created: at(2)}, {Created: at(1)}},
+			wantMissing: []time.Time{at(0)},
+			wantExtra:   []time.Time{at(2)},
+		},
+		{
+			name: "changed",
+			a:    []ambidata.Data{{Created: at(0), D1: ambidata.Just(1.0), D2: ambidata.Just(2.0), Loc: loc, Cmnt: "a"}},
+			b:    []ambidata.Data{{Created: at(0), D1: ambidata.Just(1.5), D3: ambidata.Just(3.0), Cmnt: "b", Hide: true}},
+			wantChanged: []Change{
+				{Created: at(0), Item: "d1", A: 1.0, B: 1.5},
+				{Created: at(0), Item: "d2", A: 2.0, B: nil},
+				{Created: at(0), Item: "d3", A: nil, B: 3.0},
+				{Created: at(0), Item: ItemLoc, A: []float64{35, 139}, B: nil},
+				{Created: at(0), Item: ItemCmnt, A: "a", B: "b"},
+				{Created: at(0), Item: ItemHide, A: false, B: true},
+			},
+		},
+		{
+			name: "tolerance",
+			a:    []ambidata.Data{{Created: at(0), D1: ambidata.Just(1.0), D2: ambidata.Just(1.0), Loc: loc}},
+			b:    []ambidata.Data{{Created: at(0), D1: ambidata.Just(1.05), D2: ambidata.Just(1.05), Loc: ambidata.Just(ambidata.Location{Lat: 35.00001, Lng: 139})}},
+			opt:  Options{Tolerance: 0.1, FieldTolerance: map[ambidata.Field]float64{ambidata.FieldD2: 0.01}, LocTolerance: 0.0001},
+			wantChanged: []Change{
+				{Created: at(0), Item: "d2", A: 1.0, B: 1.05},
+			},
+		},
+		{
+			name: "ignore",
+			a:    []ambidata.Data{{Created: at(0), Loc: loc, Cmnt: "a"}},
+			b:    []ambidata.Data{{Created: at(0), Cmnt: "b", Hide: true}},
+			opt:  Options{IgnoreLoc: true, IgnoreCmnt: true, IgnoreHide: true},
+		},
+		{
+			name:        "duplicate",
+			a:           []ambidata.Data{{Created: at(0), D1: ambidata.Just(1.0)}, {Created: at(0), D1: ambidata.Just(2.0)}, {Created: at(0), D1: ambidata.Just(3.0)}},
+			b:           []ambidata.Data{{Created: at(0), D1: ambidata.Just(2.0)}, {Created: at(0), D1: ambidata.Just(4.0)}},
+			wantMissing: []time.Time{at(0)},
+			wantChanged: []Change{
+				{Pair: 1, Created: at(0), Item: "d1", A: 1.0, B: 4.0},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		wantEqual := len(tt.wantMissing)+len(tt.wantExtra)+len(tt.wantChanged) == 0
+		if tt.wantMissing == nil {
+			tt.wantMissing = []time.Time{}
+		}
+		if tt.wantExtra == nil {
+			tt.wantExtra = []time.Time{}
+		}
+		if tt.wantChanged == nil {
+			tt.wantChanged = []Change{}
+		}
+
+		r := Compare(tt.a, tt.b, &tt.opt)
+		if diff := cmp.Diff(tt.wantMissing, createdList(r.Missing)); diff != "" {
+			t.Errorf("%s: Missing: mismatch (-want, +got):\n%s", tt.name, diff)
+		}
+		if diff := cmp.Diff(tt.wantExtra, createdList(r.Extra)); diff != "" {
+			t.Errorf("%s: Extra: mismatch (-want, +got):\n%s", tt.name, diff)
+		}
+		if diff := cmp.Diff(tt.wantChanged, r.Changed); diff != "" {
+			t.Errorf("%s: Changed: mismatch (-want, +got):\n%s", tt.name, diff)
+		}
+		if r.Equal() != wantEqual {
+			t.Errorf("%s: Equal: expected %v, got %v", tt.name, wantEqual, r.Equal())
+		}
+	}
+}
+
+func TestSummary(t *testing.T) {
+	a := []ambidata.Data{
+		{Created: at(0), D1: ambidata.Just(1.0), Cmnt: "a"},
+		{Created: at(1), D1: ambidata.Just(1.0)},
+		{Created: at(2)},
+	}
+	b := []ambidata.Data{
+		{Created: at(0), D1: ambidata.Just(2.0)},
+		{Created: at(1), D1: ambidata.Just(2.0)},
+		{Created: at(3)},
+		{Created: at(4)},
+	}
+	got := Compare(a, b, nil).Summary()
+	want := Summary{
+		Equal:   false,
+		A:       3,
+		B:       4,
+		Matched: 2,
+		Missing: 1,
+		Extra:   2,
+		Changed: 2,
+		Items:   map[string]int{"d1": 2, ItemCmnt: 1},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestSummaryDuplicate(t *testing.T) {
+	// 同じ時刻の複数の組が異なる場合は、組ごとに数える
+	a := []ambidata.Data{{Created: at(0), D1: ambidata.Just(1.0)}, {Created: at(0), D1: ambidata.Just(2.0)}}
+	b := []ambidata.Data{{Created: at(0), D1: ambidata.Just(3.0)}, {Created: at(0), D1: ambidata.Just(4.0)}}
+	got := Compare(a, b, nil).Summary()
+	if got.Changed != 2 || got.Items["d1"] != 2 {
+		t.Errorf("expected changed=2, d1=2, got changed=%d, d1=%d", got.Changed, got.Items["d1"])
+	}
+}
+
+func TestWrite(t *testing.T) {
+	a := []ambidata.Data{{Created: at(0), D1: ambidata.Just(1.0)}, {Created: at(1)}}
+	b := []ambidata.Data{{Created: at(0), D1: ambidata.Just(2.0), Cmnt: "x"}, {Created: at(2)}}
+	r := Compare(a, b, nil)
+
+	var buf bytes.Buffer
+	err := r.WriteText(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantText := "" +
+		"- 2006-01-02T15:04:06.000Z\n" +
+		"+ 2006-01-02T15:04:07.000Z\n" +
+		"~ 2006-01-02T15:04:05.000Z d1: 1 -> 2\n" +
+		"~ 2006-01-02T15:04:05.000Z cmnt: \"\" -> \"x\"\n" +
+		"a: 2, b: 2, matched: 1, missing: 1, extra: 1, changed: 1\n"
+	if diff := cmp.Diff(wantText, buf.String()); diff != "" {
+		t.Errorf("WriteText: mismatch (-want, +got):\n%s", diff)
+	}
+
+	buf.Reset()
+	err = r.WriteJSON(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	err = json.Unmarshal(buf.Bytes(), &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"summary": map[string]any{
+			"equal": false, "a": 2.0, "b": 2.0, "matched": 1.0, "missing": 1.0, "extra": 1.0, "changed": 1.0,
+			"items": map[string]any{"d1": 1.0, "cmnt": 1.0},
+		},
+		"missing": []any{"2006-01-02T15:04:06Z"},
+		"extra":   []any{"2006-01-02T15:04:07Z"},
+		"changed": []any{
+			map[string]any{"pair": 0.0, "created": "2006-01-02T15:04:05Z", "item": "d1", "a": 1.0, "b": 2.0},
+			map[string]any{"pair": 0.0, "created": "2006-01-02T15:04:05Z", "item": "cmnt", "a": "", "b": "x"},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("WriteJSON: mismatch (-want, +got):\n%s", diff)
+	}
+}
@@ -8,6 +8,9 @@ import (
 	"time"
 )
 
+// 推測に基づく情報: 1回のリクエストで取得できるデータ数の上限です。
+const maxFetchCount = 3000
+
 // Fetcher は Ambient からデータを取得するクライアントです。
 type Fetcher struct {
 	Ch      string // チャネルID
@@ -100,6 +103,53 @@ func (f *Fetcher) FetchPeriod(ctx context.Context, start time.Time, end time.Tim
 	return ret, nil
 }
 
+// FetchPeriodAll は [Fetcher.FetchPeriod] と同様に指定された期間のデータを取得します。
+// 1回のリクエストで取得できる件数を超える場合は、終了時刻をずらしながら複数回に分けて取得します。
+// データは新しいものから古いものの順に並びます。
+//
+// 期間内のデータが多い場合、多数のリクエストが発生することに注意してください。
+func (f *Fetcher) FetchPeriodAll(ctx context.Context, start time.Time, end time.Time) ([]Data, error) {
+	ret := []Data{}
+	var held time.Time // 前回のリクエストで取得を保留した時刻
+	for {
+		page, err := f.FetchPeriod(ctx, start, end)
+		if err != nil {
+			return nil, err
+		}
+		full := len(page) >= maxFetchCount
+
+		// 終了時刻を含むかどうかに関わらず取得できるよう、終了時刻は保留した時刻より後にずらしている。
+		// そのため、保留した時刻より新しいデータは取得済みである。
+		if !held.IsZero() {
+			i := 0
+			for i < len(page) && page[i].Created.After(held) {
+				i++
+			}
+			page = page[i:]
+		}
+		if !full || len(page) == 0 {
+			return append(ret, page...), nil
+		}
+
+		// 最も古い時刻のデータは、同じ時刻のデータが取得しきれていない可能性があるため、次のリクエストで取得する
+		oldest := page[len(page)-1].Created
+		n := len(page)
+		for n > 0 && page[n-1].Created.Equal(oldest) {
+			n--
+		}
+		if n == 0 {
+			// 全て同じ時刻の場合は、その時刻を読み飛ばす
+			ret = append(ret, page...)
+			end = oldest.Add(-time.Millisecond)
+			held = time.Time{}
+			continue
+		}
+		ret = append(ret, page[:n]...)
+		end = oldest.Add(time.Millisecond)
+		held = oldest
+	}
+}
+
 func (f *Fetcher) httpGet(ctx context.Context, path string, query url.Values, v any) error {
 	const key = "readKey"
 	val := f.ReadKey
@@ -909,3 +909,138 @@ func TestFetcherFetchPeriodErrJSON(t *testing.T) {
 		t.Errorf("err: expected %#v, got %#v", io.EOF.Error(), gotErr.Error())
 	}
 }
+
+func TestFetcherFetchPeriodAll(t *testing.T) {
+	const inCh = "83601"
+	const inReadKey = "74545caba2bfd44f"
+	base := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	inStart := base
+	inEnd := base.Add(time.Hour)
+
+	// 古いものから新しいものの順。ページ境界に同じ時刻のデータを含める。
+	var stored []Data
+	for i := range 7000 {
+		created := base.Add(time.Duration(i) * 100 * time.Millisecond)
+		stored = append(stored, Data{Created: created, D1: Just(float64(i))})
+		if i == 3999 || i == 1000 {
+			stored = append(stored, Data{Created: created, D2: Just(float64(i))})
+		}
+	}
+	stored = append(stored, Data{Created: inEnd.Add(time.Second)})
+
+	var wantRet []Data
+	for i := len(stored) - 2; i >= 0; i-- {
+		wantRet = append(wantRet, stored[i])
+	}
+
+	for _, inclusive := range []bool{true, false} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		handler := func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query()
+			start, _ := time.Parse(time.RFC3339Nano, q.Get("start"))
+			end, _ := time.Parse(time.RFC3339Nano, q.Get("end"))
+			var arr []Data
+			for i := len(stored) - 1; i >= 0 && len(arr) < 3000; i-- {
+				d := stored[i]
+				if d.Created.Before(start) || d.Created.After(end) || (!inclusive && d.Created.Equal(end)) {
+					continue
+				}
+				arr = append(arr, d)
+			}
+
+			w.Write([]byte("["))
+			for i, d := range arr {
+				if i > 0 {
+					w.Write([]byte(","))
+				}
+				created := d.Created.UTC().Format("2006-01-02T15:04:05.000Z")
+				if d.D2.OK {
+					w.Write([]byte(`{"created":"` + created + `","d2":` + strconv.FormatFloat(d.D2.V, 'g', -1, 64) + `}`))
+				} else {
+					w.Write([]byte(`{"created":"` + created + `","d1":` + strconv.FormatFloat(d.D1.V, 'g', -1, 64) + `}`))
+				}
+			}
+			w.Write([]byte("]"))
+		}
+
+		srv := httptest.NewServer(http.HandlerFunc(handler))
+		defer srv.Close()
+		srvURL, _ := url.Parse(srv.URL)
+
+		f := &Fetcher{
+			Ch:      inCh,
+			ReadKey: inReadKey,
+			Config: &Config{
+				Scheme: srvURL.Scheme,
+				Host:   srvURL.Host,
+				Client: srv.Client(),
+			},
+		}
+
+		gotRet, gotErr := f.FetchPeriodAll(ctx, inStart, inEnd)
+		if gotErr != nil {
+			t.Fatalf("inclusive=%t: err: %v", inclusive, gotErr)
+		}
+		if diff := cmp.Diff(wantRet, gotRet); diff != "" {
+			t.Errorf("inclusive=%t: ret: mismatch (-want, +got)\n%s", inclusive, diff)
+		}
+	}
+}
+
+func TestFetcherFetchPeriodAllErrStatus(t *testing.T) {
+	const inCh = "83601"
+	const inReadKey = "74545caba2bfd44f"
+	base := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// 1回目のリクエストは上限件数を返し、2回目のリクエストは失敗する
+	requests := 0
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests > 1 {
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("["))
+		for i := range maxFetchCount {
+			if i > 0 {
+				w.Write([]byte(","))
+			}
+			created := base.Add(-time.Duration(i) * time.Second).Format("2006-01-02T15:04:05.000Z")
+			w.Write([]byte(`{"created":"` + created + `","d1":1}`))
+		}
+		w.Write([]byte("]"))
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(handler))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+
+	f := &Fetcher{
+		Ch:      inCh,
+		ReadKey: inReadKey,
+		Config: &Config{
+			Scheme: srvURL.Scheme,
+			Host:   srvURL.Host,
+			Client: srv.Client(),
+		},
+	}
+
+	gotRet, gotErr := f.FetchPeriodAll(ctx, base.Add(-24*time.Hour), base)
+	if gotRet != nil {
+		t.Errorf("ret: expected nil, got %d data points", len(gotRet))
+	}
+	var gotStatusErr *StatusCodeError
+	if !errors.As(gotErr, &gotStatusErr) {
+		t.Errorf("err: expected (*ambidata.StatusCodeError), got %#v", gotErr)
+	} else if gotStatusErr.StatusCode != http.StatusInternalServerError {
+		t.Errorf("err.StatusCode: expected %d, got %d", http.StatusInternalServerError, gotStatusErr.StatusCode)
+	}
+	if requests != 2 {
+		t.Errorf("requests: expected 2, got %d", requests)
+	}
+}
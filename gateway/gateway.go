@@ -0,0 +1,491 @@
+// Package gateway は、ライトキーを保持できないデバイスのために、
+// デバイスからのデータを中継して Ambient に送信するゲートウェイを提供します。
+//
+// デバイスはライトキーの代わりにデバイスごとの共有鍵を持ち、
+// HMAC-SHA256 の署名を付けたリクエストをゲートウェイに送信します。
+// ゲートウェイはデバイスキーから [ambidata.Manager.GetDeviceChannelLv1] で
+// 送信先のチャネルとライトキーを取得し (結果はキャッシュされます)、
+// [ambidata.Sender] でデータを転送します。
+// デバイスとゲートウェイの間は TLS を使用しないことも想定しています。
+//
+// # リクエストの形式
+//
+// デバイスは POST リクエストで以下のヘッダーを送信します。
+//
+//	X-Ambidata-Device: デバイス ID
+//	X-Ambidata-Timestamp: UNIX 時刻 (秒)
+//	X-Ambidata-Signature: 署名 (16進数)
+//
+// ヘッダーを設定できない場合は、クエリパラメータ device, ts, sig でも指定できます。
+// 署名は、共有鍵を鍵として「タイムスタンプ + 改行 + リクエストボディ」の HMAC-SHA256 を計算したものです
+// ([Sign] を参照してください)。
+// タイムスタンプがゲートウェイの時刻から [Gateway.MaxSkew] 以上ずれている場合や、
+// 同じ署名のリクエストを再度受信した場合は、リクエストを拒否します。
+//
+// リクエストボディは、Content-Type が application/x-www-form-urlencoded の場合は
+// "d1=23.5&d2=60&cmnt=ok" のようなフォーム形式、それ以外の場合は
+// [dataio] の JSON 形式 (オブジェクトまたはその配列) です。
+// 時刻を省略した場合は、ゲートウェイが受信した時刻が使用されます。
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/dataio"
+	"github.com/gcrtnst/ambidata/internal/batch"
+)
+
+const (
+	// DefaultMaxSkew は [Gateway.MaxSkew] のデフォルト値です。
+	DefaultMaxSkew = 5 * time.Minute
+
+	// DefaultCacheTTL は [Gateway.CacheTTL] のデフォルト値です。
+	DefaultCacheTTL = 24 * time.Hour
+
+	// MaxBodySize はゲートウェイが受け付けるリクエストボディの最大サイズです。
+	MaxBodySize = 64 << 10
+)
+
+// ErrClosed は [Gateway.Close] の後にリクエストを受信した場合のエラーです。
+var ErrClosed = errors.New("gateway: gateway is closed")
+
+// Device はゲートウェイを利用するデバイスの設定です。
+type Device struct {
+	ID     string `json:"id"`     // デバイス ID
+	Secret string `json:"secret"` // 署名に使用する共有鍵
+	DevKey string `json:"devKey"` // Ambient のデバイスキー
+}
+
+// ParseDevices は JSON 形式の [Device] の配列を読み込みます。
+func ParseDevices(r io.Reader) ([]Device, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	var devices []Device
+	if err := dec.Decode(&devices); err != nil {
+		return nil, fmt.Errorf("gateway: ParseDevices: %w", err)
+	}
+	seen := map[string]bool{}
+	for i, d := range devices {
+		switch {
+		case d.ID == "":
+			return nil, fmt.Errorf("gateway: ParseDevices: devices[%d]: id must be specified", i)
+		case d.Secret == "":
+			return nil, fmt.Errorf("gateway: ParseDevices: devices[%d]: secret must be specified", i)
+		case d.DevKey == "":
+			return nil, fmt.Errorf("gateway: ParseDevices: devices[%d]: devKey must be specified", i)
+		case seen[d.ID]:
+			return nil, fmt.Errorf("gateway: ParseDevices: devices[%d]: duplicate id %q", i, d.ID)
+		}
+		seen[d.ID] = true
+	}
+	return devices, nil
+}
+
+// Sign はタイムスタンプ ts とリクエストボディ body の署名を計算します。
+func Sign(secret string, ts int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(ts, 10)))
+	mac.Write([]byte("\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Gateway はデバイスからのリクエストを受け付け、Ambient に転送する [http.Handler] です。
+//
+// 受信したデータはチャネルごとのキューに蓄積され、送信間隔の制限 ([ambidata.MinSendInterval]) を
+// 守りながら送信されます。そのため、リクエストの応答は送信の完了を待たずに 202 Accepted となります。
+//
+// Gateway のメソッドは複数の goroutine から同時に呼び出すことができます。
+// ただし、フィールドは使用を開始した後に変更しないでください。
+type Gateway struct {
+	// Manager はデバイスキーからチャネルを取得するために使用します。
+	Manager *ambidata.Manager
+
+	// Devices はゲートウェイを利用するデバイスの一覧です。
+	Devices []Device
+
+	// MaxSkew はデバイスのタイムスタンプとゲートウェイの時刻のずれの許容範囲です。
+	// 0 以下の場合は、 [DefaultMaxSkew] が使用されます。
+	MaxSkew time.Duration
+
+	// CacheTTL はデバイスキーから取得したチャネルのキャッシュの有効期間です。
+	// 送信時に 403 Forbidden または 404 Not Found となった場合は、期間内でもキャッシュを破棄します。
+	// 0 以下の場合は、 [DefaultCacheTTL] が使用されます。
+	CacheTTL time.Duration
+
+	// Interval は同一チャネルへの送信間隔です。
+	// 0 以下の場合は、 [ambidata.MinSendInterval] が使用されます。
+	Interval time.Duration
+
+	// OnError は転送中にエラーが発生した場合に呼び出されます。
+	// nil の場合は、エラーは無視されます。
+	OnError func(err error)
+
+	// Now は現在時刻を返す関数です。
+	// nil の場合は、 [time.Now] が使用されます。
+	Now func() time.Time
+
+	mu       sync.Mutex
+	devices  map[string]*Device
+	channels map[string]*channelEntry // キーはデバイスキー
+	seen     map[string]time.Time     // 受信済みの署名と、その有効期限
+	batcher  *batch.Batcher
+	closed   bool
+}
+
+type channelEntry struct {
+	Ready   chan struct{}
+	Access  ambidata.ChannelAccessLv1
+	Sender  *ambidata.Sender
+	Err     error
+	Expires time.Time
+}
+
+// ServeHTTP はデバイスからのリクエストを処理します。
+//
+// 署名の検証に失敗した場合は 401 Unauthorized を、
+// リクエストボディが [MaxBodySize] を超える場合は 413 Request Entity Too Large を、
+// リクエストボディの形式に誤りがある場合は 400 Bad Request を、
+// チャネルの取得に失敗した場合は 502 Bad Gateway を、
+// 正常に受け付けた場合は 202 Accepted を返します。
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxBodySize))
+	if err != nil {
+		if maxErr := (*http.MaxBytesError)(nil); errors.As(err, &maxErr) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := g.now()
+	dev, err := g.authenticate(r, body, now)
+	if err != nil {
+		// デバイス ID の存在を推測されないよう、失敗の理由によらず同じ応答を返す
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	arr, err := decodeBody(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	for i := range arr {
+		if arr[i].Created.IsZero() {
+			arr[i].Created = now
+		}
+		arr[i].Created = arr[i].Created.Truncate(time.Millisecond)
+	}
+
+	s, err := g.sender(r.Context(), dev)
+	if err != nil {
+		g.reportError(fmt.Errorf("gateway: device %q: %w", dev.ID, err))
+		http.Error(w, "channel lookup failed", http.StatusBadGateway)
+		return
+	}
+	if err := g.add(s, arr); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// authenticate はリクエストの署名を検証し、送信元のデバイスを返します。
+func (g *Gateway) authenticate(r *http.Request, body []byte, now time.Time) (*Device, error) {
+	q := r.URL.Query()
+	id := headerOrQuery(r, "X-Ambidata-Device", q, "device")
+	tsStr := headerOrQuery(r, "X-Ambidata-Timestamp", q, "ts")
+	sig := headerOrQuery(r, "X-Ambidata-Signature", q, "sig")
+	if id == "" || tsStr == "" || sig == "" {
+		return nil, errors.New("missing credentials")
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	dev, ok := g.device(id)
+
+	ts, err := strconv.ParseInt(tsStr, 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid timestamp")
+	}
+
+	// 未知のデバイスでも署名を計算し、応答時間からデバイス ID を推測されないようにする
+	secret := ""
+	if ok {
+		secret = dev.Secret
+	}
+	want := Sign(secret, ts, body)
+	if !hmac.Equal([]byte(want), []byte(sig)) || !ok {
+		return nil, errors.New("invalid signature")
+	}
+
+	skew := g.MaxSkew
+	if skew <= 0 {
+		skew = DefaultMaxSkew
+	}
+	if d := now.Sub(time.Unix(ts, 0)); d >= skew || d <= -skew {
+		return nil, errors.New("timestamp out of range")
+	}
+
+	// リプレイ攻撃を防ぐため、有効期間内の署名を記録する
+	if g.seen == nil {
+		g.seen = map[string]time.Time{}
+	}
+	for k, exp := range g.seen {
+		if now.After(exp) {
+			delete(g.seen, k)
+		}
+	}
+	key := id + "\x00" + sig
+	if _, ok := g.seen[key]; ok {
+		return nil, errors.New("replayed request")
+	}
+	g.seen[key] = time.Unix(ts, 0).Add(skew)
+	return dev, nil
+}
+
+// device は ID に対応するデバイスを返します。 g.mu をロックした状態で呼び出してください。
+func (g *Gateway) device(id string) (*Device, bool) {
+	if g.devices == nil {
+		g.devices = map[string]*Device{}
+		for i := range g.Devices {
+			g.devices[g.Devices[i].ID] = &g.Devices[i]
+		}
+	}
+	dev, ok := g.devices[id]
+	return dev, ok
+}
+
+func headerOrQuery(r *http.Request, header string, q url.Values, param string) string {
+	if v := r.Header.Get(header); v != "" {
+		return v
+	}
+	return q.Get(param)
+}
+
+func decodeBody(contentType string, body []byte) ([]ambidata.Data, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == "application/x-www-form-urlencoded" {
+		q, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, err
+		}
+		d, err := decodeForm(q)
+		if err != nil {
+			return nil, err
+		}
+		return []ambidata.Data{d}, nil
+	}
+
+	r, err := dataio.NewReader(bytes.NewReader(body), dataio.FormatJSON)
+	if err != nil {
+		return nil, err
+	}
+	arr, err := dataio.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(arr) == 0 {
+		return nil, errors.New("no data")
+	}
+	return arr, nil
+}
+
+func decodeForm(q url.Values) (ambidata.Data, error) {
+	var d ambidata.Data
+	parse := func(key string) (float64, bool, error) {
+		s := q.Get(key)
+		if s == "" {
+			return 0, false, nil
+		}
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return 0, false, fmt.Errorf("%s: invalid number %q", key, s)
+		}
+		return v, true, nil
+	}
+
+	ok := false
+	for _, f := range ambidata.Fields {
+		v, has, err := parse(f.String())
+		if err != nil {
+			return ambidata.Data{}, err
+		}
+		if has {
+			d.SetField(f, ambidata.Just(v))
+			ok = true
+		}
+	}
+	lat, hasLat, err := parse("lat")
+	if err != nil {
+		return ambidata.Data{}, err
+	}
+	lng, hasLng, err := parse("lng")
+	if err != nil {
+		return ambidata.Data{}, err
+	}
+	if hasLat && hasLng {
+		d.Loc = ambidata.Just(ambidata.Location{Lat: lat, Lng: lng})
+		ok = true
+	}
+	if s := q.Get("cmnt"); s != "" {
+		d.Cmnt = s
+		ok = true
+	}
+	if s := q.Get("created"); s != "" {
+		if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+			d.Created = time.Unix(sec, 0)
+		} else if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			d.Created = t
+		} else {
+			return ambidata.Data{}, fmt.Errorf("created: invalid time %q", s)
+		}
+	}
+	if !ok {
+		return ambidata.Data{}, errors.New("no data")
+	}
+	return d, nil
+}
+
+// sender はデバイスの送信先チャネルの [ambidata.Sender] を返します。
+// 同じデバイスキーの取得が同時に行われた場合は、1回のみ取得します。
+func (g *Gateway) sender(ctx context.Context, dev *Device) (*ambidata.Sender, error) {
+	now := g.now()
+
+	g.mu.Lock()
+	if g.channels == nil {
+		g.channels = map[string]*channelEntry{}
+	}
+	e, ok := g.channels[dev.DevKey]
+	fetch := !ok || (isReady(e) && !now.Before(e.Expires))
+	if fetch {
+		e = &channelEntry{Ready: make(chan struct{})}
+		g.channels[dev.DevKey] = e
+	}
+	g.mu.Unlock()
+
+	if fetch {
+		ttl := g.CacheTTL
+		if ttl <= 0 {
+			ttl = DefaultCacheTTL
+		}
+		if g.Manager == nil {
+			e.Err = errors.New("Gateway.Manager is nil")
+		} else {
+			e.Access, e.Err = g.Manager.GetDeviceChannelLv1(context.WithoutCancel(ctx), dev.DevKey)
+		}
+		e.Expires = now.Add(ttl)
+		if e.Err == nil {
+			e.Sender = ambidata.NewSenderFromChannelAccessLv1(&e.Access)
+			e.Sender.Config = g.Manager.Config
+		} else {
+			g.mu.Lock()
+			if g.channels[dev.DevKey] == e {
+				delete(g.channels, dev.DevKey)
+			}
+			g.mu.Unlock()
+		}
+		close(e.Ready)
+	}
+
+	select {
+	case <-e.Ready:
+		return e.Sender, e.Err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func isReady(e *channelEntry) bool {
+	select {
+	case <-e.Ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func (g *Gateway) add(s *ambidata.Sender, arr []ambidata.Data) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return ErrClosed
+	}
+	if g.batcher == nil {
+		g.batcher = &batch.Batcher{Interval: g.Interval, OnError: g.onSendError}
+	}
+	return g.batcher.Add(s, arr...)
+}
+
+// onSendError は送信エラーを報告し、キーが無効になった可能性がある場合はキャッシュを破棄します。
+func (g *Gateway) onSendError(ch string, err error) {
+	var sc *ambidata.StatusCodeError
+	if errors.As(err, &sc) && (sc.StatusCode == http.StatusForbidden || sc.StatusCode == http.StatusNotFound) {
+		g.mu.Lock()
+		for k, e := range g.channels {
+			if isReady(e) && e.Err == nil && e.Access.Ch == ch {
+				delete(g.channels, k)
+			}
+		}
+		g.mu.Unlock()
+	}
+	g.reportError(fmt.Errorf("gateway: ch %s: %w", ch, err))
+}
+
+// Close は新たなリクエストの受け付けを停止し、キューに残っているデータポイントを送信します。
+// 全てのデータポイントの送信が完了するか、ctx が終了するまで待機します。
+func (g *Gateway) Close(ctx context.Context) error {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return nil
+	}
+	g.closed = true
+	b := g.batcher
+	g.mu.Unlock()
+
+	if b == nil {
+		return nil
+	}
+	if err := b.Close(ctx); err != nil {
+		return fmt.Errorf("gateway: %w", err)
+	}
+	return nil
+}
+
+func (g *Gateway) now() time.Time {
+	if g.Now == nil {
+		return time.Now()
+	}
+	return g.Now()
+}
+
+func (g *Gateway) reportError(err error) {
+	if g.OnError != nil {
+		g.OnError(err)
+	}
+}
@@ -0,0 +1,223 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/internal/ambimock"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSign(t *testing.T) {
+	// printf '1136214245\n{"d1":1}' | openssl dgst -sha256 -hmac secret
+	const want = "3cd4c9b55024366b14fc0907b8a51e0350af0cecc01efb99e2b866b48d4ef896"
+	if got := Sign("secret", 1136214245, []byte(`{"d1":1}`)); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestParseDevices(t *testing.T) {
+	got, err := ParseDevices(strings.NewReader(`[{"id":"dev1","secret":"s1","devKey":"k1"}]`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]Device{{ID: "dev1", Secret: "s1", DevKey: "k1"}}, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+
+	for _, in := range []string{
+		`[{"secret":"s1","devKey":"k1"}]`,
+		`[{"id":"dev1","devKey":"k1"}]`,
+		`[{"id":"dev1","secret":"s1"}]`,
+		`[{"id":"dev1","secret":"s1","devKey":"k1"},{"id":"dev1","secret":"s2","devKey":"k2"}]`,
+		`[{"id":"dev1","secret":"s1","devKey":"k1","writeKey":"w"}]`,
+	} {
+		if _, err := ParseDevices(strings.NewReader(in)); err == nil {
+			t.Errorf("%s: expected error, got nil", in)
+		}
+	}
+}
+
+type testRequest struct {
+	device      string
+	secret      string
+	ts          int64
+	body        string
+	contentType string
+	query       bool // 認証情報をクエリパラメータで送る
+	sig         string
+}
+
+func (tr *testRequest) do(g *Gateway) *httptest.ResponseRecorder {
+	sig := tr.sig
+	if sig == "" {
+		sig = Sign(tr.secret, tr.ts, []byte(tr.body))
+	}
+	target := "/"
+	if tr.query {
+		target += "?device=" + tr.device + "&ts=" + strconv.FormatInt(tr.ts, 10) + "&sig=" + sig
+	}
+	req := httptest.NewRequest("POST", target, strings.NewReader(tr.body))
+	if !tr.query {
+		req.Header.Set("X-Ambidata-Device", tr.device)
+		req.Header.Set("X-Ambidata-Timestamp", strconv.FormatInt(tr.ts, 10))
+		req.Header.Set("X-Ambidata-Signature", sig)
+	}
+	if tr.contentType != "" {
+		req.Header.Set("Content-Type", tr.contentType)
+	}
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestGateway(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := ambimock.New(t)
+	srv.AddChannel(&ambimock.Channel{
+		Info:     ambidata.ChannelInfo{Ch: "100", DevKeys: []string{"devkey1"}},
+		UserKey:  "user",
+		WriteKey: "w100",
+	})
+
+	now := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	ts := now.Unix()
+	var errs []error
+	g := &Gateway{
+		Manager: srv.Manager("user"),
+		Devices: []Device{
+			{ID: "dev1", Secret: "s1", DevKey: "devkey1"},
+			{ID: "dev2", Secret: "s2", DevKey: "unknown"},
+		},
+		Interval: time.Millisecond,
+		OnError:  func(err error) { errs = append(errs, err) },
+		Now:      func() time.Time { return now },
+	}
+
+	tests := []struct {
+		name string
+		req  testRequest
+		code int
+	}{
+		{"json", testRequest{device: "dev1", secret: "s1", ts: ts, body: `{"d1":23.5,"cmnt":"ok"}`}, http.StatusAccepted},
+		{"json array", testRequest{device: "dev1", secret: "s1", ts: ts + 1, body: `[{"created":"2006-01-02T15:00:00Z","d2":1},{"created":"2006-01-02T15:01:00Z","d2":2}]`}, http.StatusAccepted},
+		{"form", testRequest{device: "dev1", secret: "s1", ts: ts - 60, body: "d3=7&lat=35.5&lng=139.5&created=1136214000", contentType: "application/x-www-form-urlencoded", query: true}, http.StatusAccepted},
+		{"replay", testRequest{device: "dev1", secret: "s1", ts: ts, body: `{"d1":23.5,"cmnt":"ok"}`}, http.StatusUnauthorized},
+		{"bad signature", testRequest{device: "dev1", secret: "wrong", ts: ts, body: `{"d1":1}`}, http.StatusUnauthorized},
+		{"tampered", testRequest{device: "dev1", secret: "s1", ts: ts, body: `{"d1":2}`, sig: Sign("s1", ts, []byte(`{"d1":1}`))}, http.StatusUnauthorized},
+		{"skew", testRequest{device: "dev1", secret: "s1", ts: ts - 600, body: `{"d1":1}`}, http.StatusUnauthorized},
+		{"unknown device", testRequest{device: "dev9", secret: "s1", ts: ts, body: `{"d1":1}`}, http.StatusUnauthorized},
+		{"missing", testRequest{secret: "s1", ts: ts, body: `{"d1":1}`}, http.StatusUnauthorized},
+		{"bad json", testRequest{device: "dev1", secret: "s1", ts: ts + 2, body: `{"d1":`}, http.StatusBadRequest},
+		{"empty form", testRequest{device: "dev1", secret: "s1", ts: ts + 3, body: "x=1", contentType: "application/x-www-form-urlencoded"}, http.StatusBadRequest},
+		{"lookup failure", testRequest{device: "dev2", secret: "s2", ts: ts, body: `{"d1":1}`}, http.StatusBadGateway},
+		{"too large", testRequest{device: "dev1", secret: "s1", ts: ts + 4, body: strings.Repeat(" ", MaxBodySize+1)}, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		rec := tt.req.do(g)
+		if rec.Code != tt.code {
+			t.Errorf("%s: expected %d, got %d: %s", tt.name, tt.code, rec.Code, rec.Body.String())
+		}
+		// 認証の失敗は理由によらず同じ応答になる
+		if got := strings.TrimSpace(rec.Body.String()); tt.code == http.StatusUnauthorized && got != "unauthorized" {
+			t.Errorf("%s: expected body %q, got %q", tt.name, "unauthorized", got)
+		}
+	}
+
+	if err := g.Close(ctx); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	want := []ambidata.Data{
+		{Created: time.Date(2006, 1, 2, 15, 0, 0, 0, time.UTC), D2: ambidata.Just(1.0), D3: ambidata.Just(7.0), Loc: ambidata.Just(ambidata.Location{Lat: 35.5, Lng: 139.5})},
+		{Created: time.Date(2006, 1, 2, 15, 1, 0, 0, time.UTC), D2: ambidata.Just(2.0)},
+		{Created: now, D1: ambidata.Just(23.5), Cmnt: "ok"},
+	}
+	if diff := cmp.Diff(want, srv.Data("100")); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+
+	// デバイスキーの問い合わせはキャッシュされる
+	n := 0
+	for _, req := range srv.Requests() {
+		if req.Path == "/api/v2/channels/" && req.Query.Get("devKey") == "devkey1" {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("expected 1 device lookup, got %d", n)
+	}
+	if len(errs) != 1 {
+		t.Errorf("expected 1 error, got %v", errs)
+	}
+}
+
+func TestGatewayInvalidateCache(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := ambimock.New(t)
+	ch := &ambimock.Channel{
+		Info:     ambidata.ChannelInfo{Ch: "100", DevKeys: []string{"devkey1"}},
+		UserKey:  "user",
+		WriteKey: "old",
+	}
+	srv.AddChannel(ch)
+
+	now := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	errc := make(chan error, 10)
+	g := &Gateway{
+		Manager:  srv.Manager("user"),
+		Devices:  []Device{{ID: "dev1", Secret: "s1", DevKey: "devkey1"}},
+		Interval: time.Millisecond,
+		OnError:  func(err error) { errc <- err },
+		Now:      func() time.Time { return now },
+	}
+	req := testRequest{device: "dev1", secret: "s1", ts: now.Unix(), body: `{"d1":1}`}
+	req.do(g)
+	<-waitSent(t, srv, 1)
+
+	// ライトキーが変更されると送信が 403 になり、キャッシュが破棄される
+	srv.AddChannel(&ambimock.Channel{Info: ch.Info, UserKey: "user", WriteKey: "new", Data: srv.Data("100")})
+	req.ts++
+	req.body = `{"d1":2}`
+	req.do(g)
+	select {
+	case <-errc:
+	case <-ctx.Done():
+		t.Fatalf("expected send error")
+	}
+
+	req.ts++
+	req.body = `{"d1":3}`
+	now = now.Add(time.Second)
+	req.do(g)
+	if err := g.Close(ctx); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	data := srv.Data("100")
+	if len(data) != 2 || data[1].D1 != ambidata.Just(3.0) {
+		t.Errorf("expected d1=1 and d1=3 to be stored, got %v", data)
+	}
+}
+
+func waitSent(t *testing.T, srv *ambimock.Server, n int) <-chan struct{} {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for len(srv.Data("100")) < n {
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	return done
+}
@@ -0,0 +1,614 @@
+// Package grafana は、Grafana の JSON データソース (SimpleJSON) の API を実装した
+// [http.Handler] を提供します。
+//
+// [Server] は /search, /query, /annotations の各エンドポイントを提供し、
+// [ambidata.Fetcher] で取得したチャネルのデータを Grafana のパネルに表示できるようにします。
+// 取得したデータとチャネル情報はメモリにキャッシュされ、
+// ダッシュボードの自動更新で Ambient に過剰なリクエストが送られないようにします。
+// データは固定の期間 ([Server.ChunkSize]) ごとにキャッシュされるため、
+// 「直近7日間」のような相対的な期間のダッシュボードを更新した場合も、
+// 再取得するのは現在時刻を含む期間のみです。
+// 外部ライブラリには依存しません。
+//
+// メトリクス (target) は "チャネル名:データ" の形式で指定します。
+// チャネル名は [Server.Fetchers] のキー、データはデータ名 ([ambidata.FieldInfo.Name])
+// または "d1"～"d8" です。例えば "room:温度" や "room:d1" のように指定します。
+//
+// アノテーションのクエリにはチャネル名を指定します。
+// コメント ([ambidata.Data.Cmnt]) が設定されたデータポイントがアノテーションになります。
+//
+// 使用例:
+//
+//	s := grafana.New(map[string]*ambidata.Fetcher{"room": ambidata.NewFetcher(ch, readKey)})
+//	http.ListenAndServe(":8080", s)
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+)
+
+// DefaultCacheTTL は [Server.CacheTTL] のデフォルト値です。
+const DefaultCacheTTL = 30 * time.Second
+
+// DefaultChunkSize は [Server.ChunkSize] のデフォルト値です。
+const DefaultChunkSize = time.Hour
+
+// DefaultMaxCacheEntries は [Server.MaxCacheEntries] のデフォルト値です。
+const DefaultMaxCacheEntries = 512
+
+// DefaultFetchTimeout は [Server.FetchTimeout] のデフォルト値です。
+const DefaultFetchTimeout = 30 * time.Second
+
+// Server は Grafana の JSON データソースの API を実装した [http.Handler] です。
+//
+// Server のメソッドは複数の goroutine から同時に呼び出すことができます。
+// ただし、フィールドは使用を開始した後に変更しないでください。
+type Server struct {
+	// Fetchers はチャネル名と [ambidata.Fetcher] の対応です。
+	Fetchers map[string]*ambidata.Fetcher
+
+	// CacheTTL はチャネル情報と、現在時刻を含む期間のデータのキャッシュの有効期間です。
+	// 0 以下の場合は、 [DefaultCacheTTL] が使用されます。
+	CacheTTL time.Duration
+
+	// ChunkSize はデータをキャッシュする期間の単位です。
+	// データは ChunkSize ごとに区切った期間 (チャンク) 単位で取得し、キャッシュします。
+	// 終了時刻から CacheTTL 以上経過したチャンクは以降変化しないものとみなし、
+	// 有効期間を設けずにキャッシュします。
+	// 0 以下の場合は、 [DefaultChunkSize] が使用されます。
+	ChunkSize time.Duration
+
+	// MaxCacheEntries はキャッシュするチャンクの最大数です。
+	// これを超えた場合、最後に使用されてから最も時間が経過したチャンクから削除されます。
+	// 0 以下の場合は、 [DefaultMaxCacheEntries] が使用されます。
+	//
+	// 1回のクエリの期間が MaxCacheEntries 個以上のチャンクにまたがる場合は、
+	// キャッシュを使用せずにデータを取得します。
+	MaxCacheEntries int
+
+	// FetchTimeout は Ambient への1回の取得処理の制限時間です。
+	// 取得したデータは他のリクエストと共有するため、取得はリクエストがキャンセルされても継続しますが、
+	// この時間を超えた場合は打ち切ります。
+	// 0 以下の場合は、 [DefaultFetchTimeout] が使用されます。
+	FetchTimeout time.Duration
+
+	// Now は現在時刻を返す関数です。
+	// nil の場合は、 [time.Now] が使用されます。
+	Now func() time.Time
+
+	mu    sync.Mutex
+	data  map[dataKey]*cacheEntry[[]ambidata.Data]
+	infos map[string]*cacheEntry[ambidata.ChannelInfo]
+}
+
+// New は新しい [Server] を作成します。
+func New(fetchers map[string]*ambidata.Fetcher) *Server {
+	return &Server{Fetchers: fetchers}
+}
+
+type dataKey struct {
+	Channel string
+	Start   int64 // チャンクの開始時刻 (UNIX 時刻、ミリ秒)
+}
+
+type cacheEntry[T any] struct {
+	Ready   chan struct{} // 取得が完了すると close される
+	Value   T
+	Err     error
+	Expires time.Time // ゼロ値の場合は期限切れにならない
+	Used    time.Time // 最後に使用された時刻
+}
+
+// ServeHTTP は Grafana からのリクエストを処理します。
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimSuffix(r.URL.Path, "/") {
+	case "":
+		// 接続テスト
+		w.WriteHeader(http.StatusOK)
+	case "/search":
+		s.handle(w, r, s.search)
+	case "/query":
+		s.handle(w, r, s.query)
+	case "/annotations":
+		s.handle(w, r, s.annotations)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type httpError struct {
+	Code int
+	Msg  string
+}
+
+func (err *httpError) Error() string {
+	return err.Msg
+}
+
+func badRequest(format string, args ...any) error {
+	return &httpError{Code: http.StatusBadRequest, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request, fn func(ctx context.Context, body []byte) (any, error)) {
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Allow", "POST, OPTIONS")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body json.RawMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&body); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, err := fn(r.Context(), body)
+	if err != nil {
+		code := http.StatusBadGateway
+		if hErr := (*httpError)(nil); errors.As(err, &hErr) {
+			code = hErr.Code
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// search は /search を処理し、指定可能なメトリクスの一覧を返します。
+// データ名が設定されているデータは "チャネル名:データ名" を、
+// データ名が1つも設定されていないチャネルは "チャネル名:d1"～"チャネル名:d8" を返します。
+func (s *Server) search(ctx context.Context, body []byte) (any, error) {
+	var req struct {
+		Target string `json:"target"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, badRequest("invalid request: %v", err)
+	}
+	filter := strings.ToLower(req.Target)
+
+	ret := []string{}
+	for _, name := range s.channelNames() {
+		info, err := s.channelInfo(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+
+		var targets []string
+		for _, f := range ambidata.Fields {
+			if fi := info.Field(f); fi.Name != "" {
+				targets = append(targets, name+":"+fi.Name)
+			}
+		}
+		if len(targets) == 0 {
+			for _, f := range ambidata.Fields {
+				targets = append(targets, name+":"+f.String())
+			}
+		}
+		for _, t := range targets {
+			if strings.Contains(strings.ToLower(t), filter) {
+				ret = append(ret, t)
+			}
+		}
+	}
+	return ret, nil
+}
+
+type timeRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+type queryTarget struct {
+	Target string `json:"target"`
+	RefID  string `json:"refId"`
+	Type   string `json:"type"`
+}
+
+type timeSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+type table struct {
+	Type    string        `json:"type"`
+	Columns []tableColumn `json:"columns"`
+	Rows    [][2]float64  `json:"rows"`
+}
+
+type tableColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+// query は /query を処理し、メトリクスの時系列を返します。
+// 非表示のデータポイントは含めません。
+func (s *Server) query(ctx context.Context, body []byte) (any, error) {
+	var req struct {
+		Range         timeRange     `json:"range"`
+		Targets       []queryTarget `json:"targets"`
+		MaxDataPoints int           `json:"maxDataPoints"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, badRequest("invalid request: %v", err)
+	}
+
+	ret := []any{}
+	for _, t := range req.Targets {
+		if t.Target == "" {
+			continue
+		}
+		name, field, err := s.resolveTarget(ctx, t.Target)
+		if err != nil {
+			return nil, err
+		}
+		arr, err := s.fetch(ctx, name, req.Range.From, req.Range.To)
+		if err != nil {
+			return nil, err
+		}
+
+		points := [][2]float64{}
+		for i := range arr {
+			d := &arr[i]
+			if v := d.Field(field); v.OK && !d.Hide {
+				points = append(points, [2]float64{v.V, float64(d.Created.UnixMilli())})
+			}
+		}
+		points = thin(points, req.MaxDataPoints)
+
+		if t.Type == "table" {
+			rows := make([][2]float64, len(points))
+			for i, p := range points {
+				rows[i] = [2]float64{p[1], p[0]}
+			}
+			ret = append(ret, table{
+				Type:    "table",
+				Columns: []tableColumn{{Text: "Time", Type: "time"}, {Text: t.Target, Type: "number"}},
+				Rows:    rows,
+			})
+			continue
+		}
+		ret = append(ret, timeSeries{Target: t.Target, Datapoints: points})
+	}
+	return ret, nil
+}
+
+// thin は点の数が n を超える場合、等間隔に間引きます。n が 0 以下の場合は間引きません。
+func thin(points [][2]float64, n int) [][2]float64 {
+	if n <= 0 || len(points) <= n {
+		return points
+	}
+	ret := make([][2]float64, n)
+	for i := range n {
+		ret[i] = points[i*len(points)/n]
+	}
+	ret[n-1] = points[len(points)-1]
+	return ret
+}
+
+type annotation struct {
+	Annotation json.RawMessage `json:"annotation"`
+	Time       int64           `json:"time"`
+	Title      string          `json:"title"`
+	Text       string          `json:"text"`
+	Tags       []string        `json:"tags"`
+}
+
+// annotations は /annotations を処理し、コメントが設定されたデータポイントをアノテーションとして返します。
+func (s *Server) annotations(ctx context.Context, body []byte) (any, error) {
+	var req struct {
+		Range      timeRange       `json:"range"`
+		Annotation json.RawMessage `json:"annotation"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, badRequest("invalid request: %v", err)
+	}
+	var anno struct {
+		Query string `json:"query"`
+	}
+	_ = json.Unmarshal(req.Annotation, &anno)
+	name := strings.TrimSpace(anno.Query)
+	if _, ok := s.Fetchers[name]; !ok {
+		return nil, badRequest("unknown channel %q", name)
+	}
+
+	arr, err := s.fetch(ctx, name, req.Range.From, req.Range.To)
+	if err != nil {
+		return nil, err
+	}
+	ret := []annotation{}
+	for i := range arr {
+		d := &arr[i]
+		if d.Cmnt == "" {
+			continue
+		}
+		ret = append(ret, annotation{
+			Annotation: req.Annotation,
+			Time:       d.Created.UnixMilli(),
+			Title:      d.Cmnt,
+			Text:       d.Cmnt,
+			Tags:       []string{name},
+		})
+	}
+	return ret, nil
+}
+
+// resolveTarget は "チャネル名:データ" 形式のメトリクスを解釈します。
+func (s *Server) resolveTarget(ctx context.Context, target string) (string, ambidata.Field, error) {
+	name, data, ok := strings.Cut(target, ":")
+	if !ok {
+		return "", 0, badRequest("invalid target %q: expected \"channel:field\"", target)
+	}
+	if _, ok := s.Fetchers[name]; !ok {
+		return "", 0, badRequest("unknown channel %q", name)
+	}
+	if f, err := ambidata.ParseField(data); err == nil {
+		return name, f, nil
+	}
+
+	info, err := s.channelInfo(ctx, name)
+	if err != nil {
+		return "", 0, err
+	}
+	for _, f := range ambidata.Fields {
+		if info.Field(f).Name == data {
+			return name, f, nil
+		}
+	}
+	return "", 0, badRequest("unknown field %q in channel %q", data, name)
+}
+
+func (s *Server) channelNames() []string {
+	names := make([]string, 0, len(s.Fetchers))
+	for name := range s.Fetchers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// channelInfo はチャネル情報をキャッシュから取得します。キャッシュに無い場合は Ambient から取得します。
+func (s *Server) channelInfo(ctx context.Context, name string) (ambidata.ChannelInfo, error) {
+	f := s.Fetchers[name]
+	s.mu.Lock()
+	if s.infos == nil {
+		s.infos = map[string]*cacheEntry[ambidata.ChannelInfo]{}
+	}
+	e, fetch := lookup(s, s.infos, name)
+	s.mu.Unlock()
+
+	if fetch {
+		fctx, cancel := s.fetchContext(ctx)
+		e.Value, e.Err = f.GetChannel(fctx)
+		cancel()
+		complete(s, s.infos, name, e)
+	}
+	return wait(ctx, e)
+}
+
+// fetch は期間内のデータを古いものから新しいものの順に返します。
+// データはチャンク単位で取得し、キャッシュします。
+// キャッシュに無いチャンクが連続する場合は、1回のリクエストでまとめて取得します。
+// 期間がキャッシュの上限以上のチャンクにまたがる場合は、キャッシュを使用しません。
+func (s *Server) fetch(ctx context.Context, name string, from time.Time, to time.Time) ([]ambidata.Data, error) {
+	f, ok := s.Fetchers[name]
+	if !ok {
+		return nil, badRequest("unknown channel %q", name)
+	}
+	if !from.Before(to) {
+		return nil, nil
+	}
+
+	size := s.chunkSize()
+	if n := to.Sub(from.Truncate(size)) / size; n >= time.Duration(s.maxCacheEntries()) {
+		return s.fetchUncached(ctx, f, from, to)
+	}
+
+	now := s.now()
+	var chunks []chunk
+	s.mu.Lock()
+	if s.data == nil {
+		s.data = map[dataKey]*cacheEntry[[]ambidata.Data]{}
+	}
+	for t := from.Truncate(size); !t.After(to); t = t.Add(size) {
+		key := dataKey{Channel: name, Start: t.UnixMilli()}
+		e, fetch := lookup(s, s.data, key)
+		if fetch && !t.Add(size).Add(s.cacheTTL()).After(now) {
+			e.Expires = time.Time{}
+		}
+		chunks = append(chunks, chunk{key: key, start: t, entry: e, fetch: fetch})
+	}
+	s.evict()
+	s.mu.Unlock()
+
+	for i := 0; i < len(chunks); {
+		if !chunks[i].fetch {
+			i++
+			continue
+		}
+		j := i + 1
+		for j < len(chunks) && chunks[j].fetch {
+			j++
+		}
+		s.fetchChunks(ctx, f, chunks[i:j])
+		i = j
+	}
+
+	var ret []ambidata.Data
+	for _, c := range chunks {
+		arr, err := wait(ctx, c.entry)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range arr {
+			if !d.Created.Before(from) && !d.Created.After(to) {
+				ret = append(ret, d)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// fetchUncached はキャッシュを使用せずに、期間内のデータを古いものから新しいものの順に返します。
+func (s *Server) fetchUncached(ctx context.Context, f *ambidata.Fetcher, from time.Time, to time.Time) ([]ambidata.Data, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.fetchTimeout())
+	defer cancel()
+	arr, err := f.FetchPeriodAll(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	slices.Reverse(arr)
+
+	var ret []ambidata.Data
+	for _, d := range arr {
+		if !d.Created.Before(from) && !d.Created.After(to) {
+			ret = append(ret, d)
+		}
+	}
+	return ret, nil
+}
+
+// chunk はデータをキャッシュする期間の単位です。
+type chunk struct {
+	key   dataKey
+	start time.Time
+	entry *cacheEntry[[]ambidata.Data]
+	fetch bool // 呼び出し側が取得すべき場合は true
+}
+
+// fetchChunks は連続した chunks のデータを1回のリクエストで取得し、チャンクごとに振り分けます。
+func (s *Server) fetchChunks(ctx context.Context, f *ambidata.Fetcher, chunks []chunk) {
+	size := s.chunkSize()
+	start := chunks[0].start
+	end := chunks[len(chunks)-1].start.Add(size)
+	fctx, cancel := s.fetchContext(ctx)
+	arr, err := f.FetchPeriodAll(fctx, start, end)
+	cancel()
+	slices.Reverse(arr)
+
+	for _, c := range chunks {
+		c.entry.Err = err
+		if err == nil {
+			i, _ := slices.BinarySearchFunc(arr, c.start, func(d ambidata.Data, t time.Time) int { return d.Created.Compare(t) })
+			j, _ := slices.BinarySearchFunc(arr, c.start.Add(size), func(d ambidata.Data, t time.Time) int { return d.Created.Compare(t) })
+			c.entry.Value = arr[i:j:j]
+		}
+		complete(s, s.data, c.key, c.entry)
+	}
+}
+
+// lookup はキャッシュのエントリを返します。
+// 有効なエントリが無い場合は新しいエントリを作成し、呼び出し側が取得すべきであることを示す true を返します。
+// s.mu をロックした状態で呼び出してください。
+func lookup[K comparable, T any](s *Server, m map[K]*cacheEntry[T], key K) (*cacheEntry[T], bool) {
+	now := s.now()
+	if e, ok := m[key]; ok && (e.Expires.IsZero() || now.Before(e.Expires)) {
+		e.Used = now
+		return e, false
+	}
+	e := &cacheEntry[T]{Ready: make(chan struct{}), Expires: now.Add(s.cacheTTL()), Used: now}
+	m[key] = e
+	return e, true
+}
+
+// complete は取得が完了したことを通知します。
+// 取得に失敗した場合は、次回に再取得するようエントリを削除します。
+func complete[K comparable, T any](s *Server, m map[K]*cacheEntry[T], key K, e *cacheEntry[T]) {
+	if e.Err != nil {
+		s.mu.Lock()
+		if m[key] == e {
+			delete(m, key)
+		}
+		s.mu.Unlock()
+	}
+	close(e.Ready)
+}
+
+// evict は期限切れのエントリと、上限を超えたエントリを削除します。
+// 上限を超えた場合は、最後に使用されてから最も時間が経過したエントリから削除します。
+// s.mu をロックした状態で呼び出してください。
+func (s *Server) evict() {
+	now := s.now()
+	for k, e := range s.data {
+		if !e.Expires.IsZero() && !now.Before(e.Expires) {
+			delete(s.data, k)
+		}
+	}
+
+	limit := s.maxCacheEntries()
+	if len(s.data) <= limit {
+		return
+	}
+	keys := slices.Collect(maps.Keys(s.data))
+	slices.SortFunc(keys, func(a, b dataKey) int { return s.data[a].Used.Compare(s.data[b].Used) })
+	for _, k := range keys[:len(keys)-limit] {
+		delete(s.data, k)
+	}
+}
+
+func wait[T any](ctx context.Context, e *cacheEntry[T]) (T, error) {
+	select {
+	case <-e.Ready:
+		return e.Value, e.Err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+func (s *Server) cacheTTL() time.Duration {
+	if s.CacheTTL <= 0 {
+		return DefaultCacheTTL
+	}
+	return s.CacheTTL
+}
+
+func (s *Server) chunkSize() time.Duration {
+	if s.ChunkSize <= 0 {
+		return DefaultChunkSize
+	}
+	return s.ChunkSize
+}
+
+func (s *Server) maxCacheEntries() int {
+	if s.MaxCacheEntries <= 0 {
+		return DefaultMaxCacheEntries
+	}
+	return s.MaxCacheEntries
+}
+
+func (s *Server) fetchTimeout() time.Duration {
+	if s.FetchTimeout <= 0 {
+		return DefaultFetchTimeout
+	}
+	return s.FetchTimeout
+}
+
+// fetchContext はキャッシュに格納するデータの取得に使用するコンテキストを返します。
+// 取得結果は他のリクエストと共有するため、 ctx のキャンセルは引き継がず、 [Server.FetchTimeout] で打ち切ります。
+func (s *Server) fetchContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), s.fetchTimeout())
+}
+
+func (s *Server) now() time.Time {
+	if s.Now == nil {
+		return time.Now()
+	}
+	return s.Now()
+}
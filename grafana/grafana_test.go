@@ -0,0 +1,239 @@
+package grafana
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/internal/ambimock"
+)
+
+func newTestServer(t *testing.T) (*Server, *ambimock.Server) {
+	srv := ambimock.New(t)
+	t0 := time.Date(2006, 1, 2, 15, 0, 0, 0, time.UTC)
+	srv.AddChannel(&ambimock.Channel{
+		Info: ambidata.ChannelInfo{
+			Ch: "100",
+			D1: ambidata.FieldInfo{Name: "temp"},
+			D2: ambidata.FieldInfo{Name: "humi"},
+		},
+		ReadKey: "r100",
+		Data: []ambidata.Data{
+			{Created: t0, D1: ambidata.Just(20.0), D2: ambidata.Just(50.0)},
+			{Created: t0.Add(time.Minute), D1: ambidata.Just(21.0), Cmnt: "door open"},
+			{Created: t0.Add(2 * time.Minute), D1: ambidata.Just(99.0), Hide: true},
+			{Created: t0.Add(3 * time.Minute), D1: ambidata.Just(22.0)},
+		},
+	})
+	srv.AddChannel(&ambimock.Channel{Info: ambidata.ChannelInfo{Ch: "200"}, ReadKey: "r200"})
+
+	s := New(map[string]*ambidata.Fetcher{
+		"room":  srv.Fetcher("100"),
+		"plain": srv.Fetcher("200"),
+	})
+	return s, srv
+}
+
+func do(s *Server, method string, path string, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return rec
+}
+
+func TestServerSearch(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	tests := []struct {
+		body string
+		want string
+	}{
+		{`{"target":""}`, `["plain:d1","plain:d2","plain:d3","plain:d4","plain:d5","plain:d6","plain:d7","plain:d8","room:temp","room:humi"]`},
+		{`{"target":"TEMP"}`, `["room:temp"]`},
+	}
+	for _, tt := range tests {
+		rec := do(s, "POST", "/search", tt.body)
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: expected %d, got %d: %s", tt.body, http.StatusOK, rec.Code, rec.Body.String())
+			continue
+		}
+		if got := strings.TrimSpace(rec.Body.String()); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.body, tt.want, got)
+		}
+	}
+}
+
+func TestServerQuery(t *testing.T) {
+	s, srv := newTestServer(t)
+
+	tests := []struct {
+		body string
+		want string
+	}{
+		{
+			body: `{"range":{"from":"2006-01-02T15:00:00.000Z","to":"2006-01-02T15:10:00.000Z"},"targets":[{"target":"room:temp"},{"target":"room:d2","type":"table"}]}`,
+			want: `[{"target":"room:temp","datapoints":[[20,1136214000000],[21,1136214060000],[22,1136214180000]]},` +
+				`{"type":"table","columns":[{"text":"Time","type":"time"},{"text":"room:d2","type":"number"}],"rows":[[1136214000000,50]]}]`,
+		},
+		{
+			body: `{"range":{"from":"2006-01-02T15:00:10.000Z","to":"2006-01-02T15:10:10.000Z"},"targets":[{"target":"room:temp"}]}`,
+			want: `[{"target":"room:temp","datapoints":[[21,1136214060000],[22,1136214180000]]}]`,
+		},
+		{
+			body: `{"range":{"from":"2006-01-02T15:00:00.000Z","to":"2006-01-02T15:10:00.000Z"},"targets":[{"target":"room:temp"}],"maxDataPoints":2}`,
+			want: `[{"target":"room:temp","datapoints":[[20,1136214000000],[22,1136214180000]]}]`,
+		},
+	}
+	for _, tt := range tests {
+		rec := do(s, "POST", "/query", tt.body)
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: expected %d, got %d: %s", tt.body, http.StatusOK, rec.Code, rec.Body.String())
+			continue
+		}
+		if got := strings.TrimSpace(rec.Body.String()); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.body, tt.want, got)
+		}
+	}
+
+	// 範囲がキャッシュの単位内でずれても、データの取得は1回のみ
+	n := 0
+	for _, req := range srv.Requests() {
+		if req.Path == "/api/v2/channels/100/data" {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("expected 1 data request, got %d", n)
+	}
+}
+
+func TestServerQueryCacheExpire(t *testing.T) {
+	s, srv := newTestServer(t)
+	now := time.Date(2006, 1, 2, 16, 0, 0, 0, time.UTC)
+	s.Now = func() time.Time { return now }
+
+	body := `{"range":{"from":"2006-01-02T15:00:00.000Z","to":"2006-01-02T15:10:00.000Z"},"targets":[{"target":"room:d1"}]}`
+	do(s, "POST", "/query", body)
+	now = now.Add(DefaultCacheTTL)
+	do(s, "POST", "/query", body)
+
+	n := 0
+	for _, req := range srv.Requests() {
+		if req.Path == "/api/v2/channels/100/data" {
+			n++
+		}
+	}
+	if n != 2 {
+		t.Errorf("expected 2 data requests, got %d", n)
+	}
+}
+
+func TestServerQueryRelativeRange(t *testing.T) {
+	s, srv := newTestServer(t)
+	now := time.Date(2006, 1, 2, 15, 5, 0, 0, time.UTC)
+	s.Now = func() time.Time { return now }
+
+	// 「直近7日間」のダッシュボードを自動更新する
+	refresh := func() string {
+		from := now.Add(-7 * 24 * time.Hour).Format(time.RFC3339Nano)
+		to := now.Format(time.RFC3339Nano)
+		rec := do(s, "POST", "/query", `{"range":{"from":"`+from+`","to":"`+to+`"},"targets":[{"target":"room:temp"}]}`)
+		return strings.TrimSpace(rec.Body.String())
+	}
+	const want = `[{"target":"room:temp","datapoints":[[20,1136214000000],[21,1136214060000],[22,1136214180000]]}]`
+	for i := range 3 {
+		if got := refresh(); got != want {
+			t.Errorf("refresh %d: expected %s, got %s", i, want, got)
+		}
+		now = now.Add(DefaultCacheTTL)
+	}
+
+	// 1回目は全期間を1回で取得し、以降は現在時刻を含むチャンクのみを再取得する
+	var starts []string
+	for _, req := range srv.Requests() {
+		if req.Path == "/api/v2/channels/100/data" {
+			starts = append(starts, req.Query.Get("start"))
+		}
+	}
+	wantStarts := []string{"2005-12-26T15:00:00Z", "2006-01-02T15:00:00Z", "2006-01-02T15:00:00Z"}
+	if strings.Join(starts, ",") != strings.Join(wantStarts, ",") {
+		t.Errorf("expected requests starting at %v, got %v", wantStarts, starts)
+	}
+}
+
+func TestServerQueryLongRange(t *testing.T) {
+	s, srv := newTestServer(t)
+
+	// キャッシュの上限を超える期間はキャッシュせずに1回で取得する
+	body := `{"range":{"from":"0001-01-01T00:00:00.000Z","to":"9999-12-31T23:59:59.999Z"},"targets":[{"target":"room:temp"}]}`
+	rec := do(s, "POST", "/query", body)
+	const want = `[{"target":"room:temp","datapoints":[[20,1136214000000],[21,1136214060000],[22,1136214180000]]}]`
+	if got := strings.TrimSpace(rec.Body.String()); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+	if n := len(s.data); n != 0 {
+		t.Errorf("expected no cache entries, got %d", n)
+	}
+	if n := len(srv.Requests()); n != 2 {
+		t.Errorf("expected 2 requests, got %d", n)
+	}
+}
+
+func TestServerQueryFetchTimeout(t *testing.T) {
+	s, srv := newTestServer(t)
+	s.FetchTimeout = 50 * time.Millisecond
+	block := make(chan struct{})
+	srv.Hook = func(r *http.Request) int {
+		<-block
+		return 0
+	}
+	t.Cleanup(func() { close(block) })
+
+	body := `{"range":{"from":"2006-01-02T15:00:00.000Z","to":"2006-01-02T15:10:00.000Z"},"targets":[{"target":"room:temp"}]}`
+	if rec := do(s, "POST", "/query", body); rec.Code == http.StatusOK {
+		t.Errorf("expected error, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestServerAnnotations(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	body := `{"range":{"from":"2006-01-02T15:00:00.000Z","to":"2006-01-02T15:10:00.000Z"},"annotation":{"name":"notes","query":"room"}}`
+	rec := do(s, "POST", "/annotations", body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	want := `[{"annotation":{"name":"notes","query":"room"},"time":1136214060000,"title":"door open","text":"door open","tags":["room"]}]`
+	if got := strings.TrimSpace(rec.Body.String()); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestServerError(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{"GET", "/", "", http.StatusOK},
+		{"GET", "/unknown", "", http.StatusNotFound},
+		{"GET", "/query", "", http.StatusMethodNotAllowed},
+		{"OPTIONS", "/query", "", http.StatusOK},
+		{"POST", "/query", "{", http.StatusBadRequest},
+		{"POST", "/query", `{"targets":[{"target":"room"}]}`, http.StatusBadRequest},
+		{"POST", "/query", `{"targets":[{"target":"nowhere:d1"}]}`, http.StatusBadRequest},
+		{"POST", "/query", `{"targets":[{"target":"room:pressure"}]}`, http.StatusBadRequest},
+		{"POST", "/annotations", `{"annotation":{"query":"nowhere"}}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		rec := do(s, tt.method, tt.path, tt.body)
+		if rec.Code != tt.code {
+			t.Errorf("%s %s %s: expected %d, got %d: %s", tt.method, tt.path, tt.body, tt.code, rec.Code, rec.Body.String())
+		}
+	}
+}
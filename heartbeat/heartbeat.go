@@ -0,0 +1,294 @@
+// Package heartbeat は、チャネルのデータの時刻を分析し、
+// 送信の途絶や異常な送信を検出する機能を提供します。
+//
+// [Analyze] は期待する送信間隔 ([Options.Expected]) を基に、以下の事象を検出します。
+//
+//   - 送信間隔が長すぎる区間 ([KindGap])
+//   - 送信間隔が短すぎる連続した送信 ([KindBurst])
+//   - 時刻が重複したデータポイント ([KindDuplicate])
+//   - 未来の時刻のデータポイント ([KindFuture])。デバイスの時計のずれが考えられます。
+//
+// [Check] はチャネルの詳細情報の最終送信日時と一日あたりのデータ数から、
+// デバイスが送信を続けているかを判定します。
+package heartbeat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+)
+
+const (
+	// DefaultGapFactor は [Options.GapFactor] のデフォルト値です。
+	DefaultGapFactor = 2.0
+
+	// DefaultBurstFactor は [Options.BurstFactor] のデフォルト値です。
+	DefaultBurstFactor = 0.5
+
+	// DefaultSkewTolerance は [Options.SkewTolerance] のデフォルト値です。
+	DefaultSkewTolerance = time.Minute
+)
+
+// ErrNoExpected は [Options.Expected] が指定されていない場合に [Analyze] が返すエラーです。
+var ErrNoExpected = errors.New("heartbeat: expected interval is not specified")
+
+// Kind は検出された事象の種類です。
+type Kind string
+
+const (
+	KindGap       Kind = "gap"       // 送信間隔が長すぎる
+	KindBurst     Kind = "burst"     // 送信間隔が短すぎる
+	KindDuplicate Kind = "duplicate" // 時刻が重複している
+	KindFuture    Kind = "future"    // 時刻が未来である
+)
+
+// Event は検出された事象です。
+//
+// Start と End は事象の期間で、種類ごとに以下の値となります。
+// Count も種類ごとに意味が異なります。
+//
+//   - [KindGap]: 途絶の前後のデータポイントの時刻。 Count は期待する送信間隔から推定した欠落数です。
+//   - [KindBurst]: 連続した送信の最初と最後のデータポイントの時刻。 Count はその間のデータポイントの数です。
+//   - [KindDuplicate]: 重複した時刻 (Start と End は同じ値) 。 Count は重複したデータポイントの数です。
+//   - [KindFuture]: データポイントの時刻 (Start と End は同じ値) 。 Count は 1 です。
+type Event struct {
+	Kind  Kind      `json:"kind"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Count int       `json:"count"`
+}
+
+func (e Event) String() string {
+	switch e.Kind {
+	case KindGap:
+		return fmt.Sprintf("gap of %s from %s to %s (about %d missing)", e.End.Sub(e.Start), formatTime(e.Start), formatTime(e.End), e.Count)
+	case KindBurst:
+		return fmt.Sprintf("burst of %d data points from %s to %s", e.Count, formatTime(e.Start), formatTime(e.End))
+	case KindDuplicate:
+		return fmt.Sprintf("%d data points at %s", e.Count, formatTime(e.Start))
+	case KindFuture:
+		return fmt.Sprintf("future data point at %s", formatTime(e.Start))
+	default:
+		return fmt.Sprintf("%s from %s to %s", e.Kind, formatTime(e.Start), formatTime(e.End))
+	}
+}
+
+// Options は分析に関する設定です。
+type Options struct {
+	// Expected は期待する送信間隔です。
+	// [Analyze] では必須です。
+	// [Check] では、0 以下の場合はチャネルの一日あたりのデータ数から推定します。
+	Expected time.Duration
+
+	// GapFactor は送信間隔が Expected のこの倍数を超えた場合に、途絶と判定する倍数です。
+	// 0 以下の場合は、 [DefaultGapFactor] が使用されます。
+	GapFactor float64
+
+	// BurstFactor は送信間隔が Expected のこの倍数未満の場合に、短すぎると判定する倍数です。
+	// 0 以下の場合は、 [DefaultBurstFactor] が使用されます。
+	BurstFactor float64
+
+	// SkewTolerance は未来の時刻と判定しない、現在時刻からの許容時間です。
+	// 0 以下の場合は、 [DefaultSkewTolerance] が使用されます。
+	SkewTolerance time.Duration
+
+	// Now は現在時刻を返す関数です。
+	// nil の場合は、 [time.Now] が使用されます。
+	Now func() time.Time
+}
+
+func (opt *Options) gapFactor() float64 {
+	if opt.GapFactor <= 0 {
+		return DefaultGapFactor
+	}
+	return opt.GapFactor
+}
+
+func (opt *Options) now() time.Time {
+	if opt.Now == nil {
+		return time.Now()
+	}
+	return opt.Now()
+}
+
+// Result は分析の結果です。
+type Result struct {
+	Points int       `json:"points"`         // 分析したデータポイントの数
+	First  time.Time `json:"first,omitzero"` // 最も古いデータポイントの時刻
+	Last   time.Time `json:"last,omitzero"`  // 最も新しいデータポイントの時刻 (未来の時刻を除く)
+	Events []Event   `json:"events"`         // 検出された事象 (開始時刻順)
+}
+
+// Filter は Events のうち種類が kind のものを返します。
+func (r *Result) Filter(kind Kind) []Event {
+	ret := []Event{}
+	for _, e := range r.Events {
+		if e.Kind == kind {
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+// Analyze は seq のデータポイントの時刻を分析し、検出された事象を返します。
+// seq の順序は問いません。 [ambidata.Fetcher.FetchPeriod] の結果のように新しい順でも構いません。
+// 時刻はサーバーと同様にミリ秒単位で比較し、時刻がゼロ値のデータポイントは無視します。
+// opt.Expected が指定されていない場合は [ErrNoExpected] を返します。
+//
+// 未来の時刻のデータポイントは、送信間隔の分析には使用しません。
+// 時刻が重複したデータポイントは、送信間隔の分析では1つとして扱います。
+func Analyze(seq iter.Seq[ambidata.Data], opt *Options) (*Result, error) {
+	if opt == nil || opt.Expected <= 0 {
+		return nil, ErrNoExpected
+	}
+	burstFactor := opt.BurstFactor
+	if burstFactor <= 0 {
+		burstFactor = DefaultBurstFactor
+	}
+	skew := opt.SkewTolerance
+	if skew <= 0 {
+		skew = DefaultSkewTolerance
+	}
+	gapAfter := time.Duration(float64(opt.Expected) * opt.gapFactor())
+	burstBefore := time.Duration(float64(opt.Expected) * burstFactor)
+	limit := opt.now().Add(skew)
+
+	var ts []int64
+	for data := range seq {
+		if !data.Created.IsZero() {
+			ts = append(ts, data.Created.UnixMilli())
+		}
+	}
+	slices.Sort(ts)
+
+	r := &Result{Points: len(ts), Events: []Event{}}
+	var uniq []time.Time
+	for i := 0; i < len(ts); {
+		j := i + 1
+		for j < len(ts) && ts[j] == ts[i] {
+			j++
+		}
+		t := time.UnixMilli(ts[i]).UTC()
+		if j-i > 1 {
+			r.Events = append(r.Events, Event{Kind: KindDuplicate, Start: t, End: t, Count: j - i})
+		}
+		if t.After(limit) {
+			for range j - i {
+				r.Events = append(r.Events, Event{Kind: KindFuture, Start: t, End: t, Count: 1})
+			}
+		} else {
+			uniq = append(uniq, t)
+		}
+		i = j
+	}
+	if len(ts) > 0 {
+		r.First = time.UnixMilli(ts[0]).UTC()
+	}
+	if len(uniq) > 0 {
+		r.Last = uniq[len(uniq)-1]
+	}
+
+	burst := -1 // 連続した短い送信の最初のデータポイントの位置
+	for i := 1; i <= len(uniq); i++ {
+		var d time.Duration
+		if i < len(uniq) {
+			d = uniq[i].Sub(uniq[i-1])
+		}
+		if i < len(uniq) && d < burstBefore {
+			if burst < 0 {
+				burst = i - 1
+			}
+			continue
+		}
+		if burst >= 0 {
+			r.Events = append(r.Events, Event{Kind: KindBurst, Start: uniq[burst], End: uniq[i-1], Count: i - burst})
+			burst = -1
+		}
+		if i < len(uniq) && d > gapAfter {
+			missing := int(math.Round(float64(d)/float64(opt.Expected))) - 1
+			r.Events = append(r.Events, Event{Kind: KindGap, Start: uniq[i-1], End: uniq[i], Count: missing})
+		}
+	}
+
+	slices.SortStableFunc(r.Events, func(a, b Event) int { return a.Start.Compare(b.Start) })
+	return r, nil
+}
+
+// AnalyzeSlice は arr のデータポイントについて [Analyze] を呼び出します。
+func AnalyzeSlice(arr []ambidata.Data, opt *Options) (*Result, error) {
+	return Analyze(slices.Values(arr), opt)
+}
+
+// Status はデバイスの送信状況の判定結果です。
+type Status struct {
+	Ch         string        `json:"ch"`
+	LastPost   time.Time     `json:"lastPost,omitzero"` // 最終送信日時
+	DataPerDay int           `json:"dataPerDay"`        // 一日あたりのデータ数
+	Expected   time.Duration `json:"expected"`          // 判定に使用した送信間隔
+	Silence    time.Duration `json:"silence"`           // 最終送信日時からの経過時間
+	Alive      bool          `json:"alive"`             // 送信を続けている場合は true
+}
+
+func (s *Status) String() string {
+	if s.LastPost.IsZero() {
+		return fmt.Sprintf("channel %s: dead (no data)", s.Ch)
+	}
+	state := "alive"
+	if !s.Alive {
+		state = "dead"
+	}
+	return fmt.Sprintf("channel %s: %s (last post %s ago, expected every %s)", s.Ch, state, s.Silence.Round(time.Second), s.Expected.Round(time.Second))
+}
+
+// Check は f のチャネルの詳細情報を取得し、 [CheckInfo] で送信状況を判定します。
+func Check(ctx context.Context, f *ambidata.Fetcher, opt *Options) (*Status, error) {
+	info, err := f.GetChannel(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if info.Ch == "" {
+		info.Ch = f.Ch
+	}
+	return CheckInfo(&info, opt), nil
+}
+
+// CheckInfo はチャネルの詳細情報から送信状況を判定します。
+// opt が nil の場合は、デフォルトの設定が使用されます。
+//
+// 最終送信日時からの経過時間が、送信間隔の [Options.GapFactor] 倍以下であれば送信を続けていると判定します。
+// 送信間隔は [Options.Expected] を使用し、指定されていない場合は一日あたりのデータ数から推定します。
+// 一日あたりのデータ数が 0 の場合は、送信間隔を1日とします。
+// データが一度も送信されていないチャネルは、送信を続けていないと判定します。
+func CheckInfo(info *ambidata.ChannelInfo, opt *Options) *Status {
+	if opt == nil {
+		opt = &Options{}
+	}
+	s := &Status{
+		Ch:         info.Ch,
+		LastPost:   info.LastPost,
+		DataPerDay: info.DataPerDay,
+		Expected:   opt.Expected,
+	}
+	if s.Expected <= 0 {
+		s.Expected = 24 * time.Hour
+		if info.DataPerDay > 0 {
+			s.Expected /= time.Duration(info.DataPerDay)
+		}
+	}
+	if info.LastPost.IsZero() {
+		return s
+	}
+	s.Silence = max(opt.now().Sub(info.LastPost), 0)
+	s.Alive = s.Silence <= time.Duration(float64(s.Expected)*opt.gapFactor())
+	return s
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,149 @@
+package heartbeat
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/internal/ambimock"
+	"github.com/google/go-cmp/cmp"
+)
+
+var t0 = time.Date(2006, 1, 2, 15, 4, 0, 0, time.UTC)
+
+func at(d time.Duration) time.Time {
+	return t0.Add(d)
+}
+
+func TestAnalyze(t *testing.T) {
+	var arr []ambidata.Data
+	for _, d := range []time.Duration{
+		0,
+		time.Minute,
+		2 * time.Minute,
+		2 * time.Minute,
+		3 * time.Minute,
+		3*time.Minute + 10*time.Second,
+		3*time.Minute + 20*time.Second,
+		4*time.Minute + 20*time.Second,
+		10*time.Minute + 20*time.Second,
+		2 * time.Hour,
+	} {
+		arr = append(arr, ambidata.Data{Created: at(d)})
+	}
+	arr = append(arr, ambidata.Data{})
+	slices.Reverse(arr)
+
+	opt := &Options{Expected: time.Minute, Now: func() time.Time { return at(time.Hour) }}
+	got, err := AnalyzeSlice(arr, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Result{
+		Points: 10,
+		First:  t0,
+		Last:   at(10*time.Minute + 20*time.Second),
+		Events: []Event{
+			{Kind: KindDuplicate, Start: at(2 * time.Minute), End: at(2 * time.Minute), Count: 2},
+			{Kind: KindBurst, Start: at(3 * time.Minute), End: at(3*time.Minute + 20*time.Second), Count: 3},
+			{Kind: KindGap, Start: at(4*time.Minute + 20*time.Second), End: at(10*time.Minute + 20*time.Second), Count: 5},
+			{Kind: KindFuture, Start: at(2 * time.Hour), End: at(2 * time.Hour), Count: 1},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(want.Events[2:3], got.Filter(KindGap)); diff != "" {
+		t.Errorf("Filter: mismatch (-want, +got):\n%s", diff)
+	}
+
+	const wantGap = "gap of 6m0s from 2006-01-02T15:08:20Z to 2006-01-02T15:14:20Z (about 5 missing)"
+	if s := got.Events[2].String(); s != wantGap {
+		t.Errorf("String: expected %q, got %q", wantGap, s)
+	}
+}
+
+func TestAnalyzeEmpty(t *testing.T) {
+	got, err := Analyze(slices.Values([]ambidata.Data(nil)), &Options{Expected: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(&Result{Events: []Event{}}, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+
+	_, err = AnalyzeSlice(nil, &Options{})
+	if !errors.Is(err, ErrNoExpected) {
+		t.Errorf("expected ErrNoExpected, got %v", err)
+	}
+}
+
+func TestCheckInfo(t *testing.T) {
+	now := at(time.Hour)
+	tests := []struct {
+		name string
+		info ambidata.ChannelInfo
+		opt  Options
+		want Status
+	}{
+		{
+			name: "NoData",
+			info: ambidata.ChannelInfo{Ch: "1"},
+			want: Status{Ch: "1", Expected: 24 * time.Hour},
+		},
+		{
+			name: "Alive",
+			info: ambidata.ChannelInfo{Ch: "1", LastPost: now.Add(-90 * time.Second), DataPerDay: 1440},
+			want: Status{Ch: "1", LastPost: now.Add(-90 * time.Second), DataPerDay: 1440, Expected: time.Minute, Silence: 90 * time.Second, Alive: true},
+		},
+		{
+			name: "Dead",
+			info: ambidata.ChannelInfo{Ch: "1", LastPost: now.Add(-3 * time.Minute), DataPerDay: 1440},
+			want: Status{Ch: "1", LastPost: now.Add(-3 * time.Minute), DataPerDay: 1440, Expected: time.Minute, Silence: 3 * time.Minute},
+		},
+		{
+			name: "Expected",
+			info: ambidata.ChannelInfo{Ch: "1", LastPost: now.Add(-3 * time.Minute), DataPerDay: 1440},
+			opt:  Options{Expected: 5 * time.Minute, GapFactor: 1},
+			want: Status{Ch: "1", LastPost: now.Add(-3 * time.Minute), DataPerDay: 1440, Expected: 5 * time.Minute, Silence: 3 * time.Minute, Alive: true},
+		},
+		{
+			name: "Future",
+			info: ambidata.ChannelInfo{Ch: "1", LastPost: now.Add(time.Hour)},
+			want: Status{Ch: "1", LastPost: now.Add(time.Hour), Expected: 24 * time.Hour, Alive: true},
+		},
+	}
+
+	for _, tt := range tests {
+		tt.opt.Now = func() time.Time { return now }
+		got := CheckInfo(&tt.info, &tt.opt)
+		if diff := cmp.Diff(&tt.want, got); diff != "" {
+			t.Errorf("%s: mismatch (-want, +got):\n%s", tt.name, diff)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	srv := ambimock.New(t)
+	srv.AddChannel(&ambimock.Channel{
+		Info:    ambidata.ChannelInfo{Ch: "1", DataPerDay: 144},
+		ReadKey: "rk",
+		Data:    []ambidata.Data{{Created: t0, D1: ambidata.Just(1.0)}},
+	})
+
+	got, err := Check(context.Background(), srv.Fetcher("1"), &Options{Now: func() time.Time { return at(15 * time.Minute) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Status{Ch: "1", LastPost: t0, DataPerDay: 144, Expected: 10 * time.Minute, Silence: 15 * time.Minute, Alive: true}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+	const wantString = "channel 1: alive (last post 15m0s ago, expected every 10m0s)"
+	if s := got.String(); s != wantString {
+		t.Errorf("String: expected %q, got %q", wantString, s)
+	}
+}
@@ -0,0 +1,393 @@
+// Package influx は、InfluxDB の line protocol を解釈し、
+// Ambient のチャネルにデータを転送する機能を提供します。
+//
+// [Bridge] は InfluxDB の /write (1.x) および /api/v2/write (2.x) と互換性のある [http.Handler] です。
+// 受信したポイントは [Mapping] の設定に従ってチャネルとデータ番号 (d1～d8) に対応付けられ、
+// チャネルごとのキューに蓄積されたうえで、送信間隔の制限 ([ambidata.MinSendInterval]) を守りながら
+// [ambidata.Sender.SendBulk] でまとめて送信されます。
+// 外部ライブラリには依存しません。
+//
+// 使用例:
+//
+//	p, err := config.Open("", "")
+//	// ...
+//	b := &influx.Bridge{Mappings: mappings, Sender: p.Sender}
+//	defer b.Close(context.Background())
+//	http.Handle("/write", b)
+package influx
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/internal/batch"
+)
+
+// MaxBodySize は [Bridge] が受け付けるリクエストボディの最大サイズです。
+const MaxBodySize = 32 << 20
+
+// ErrClosed は [Bridge.Close] の後にポイントを受信した場合のエラーです。
+var ErrClosed = errors.New("influx: bridge is closed")
+
+// Mapping はポイントをチャネルのデータに対応付ける設定です。
+//
+// ポイントの measurement が Measurement と一致し、かつ Tags の全てのタグが一致する場合に、
+// そのポイントをチャネルに転送します。
+// Measurement が空文字列の場合は、measurement を問いません。
+// 1つのポイントが複数の Mapping に一致した場合は、全ての Mapping に従って転送します。
+type Mapping struct {
+	Measurement string            `json:"measurement"`
+	Tags        map[string]string `json:"tags,omitempty"`
+
+	// Channel は [SenderFunc] に渡すチャネル名です。
+	Channel string `json:"channel,omitempty"`
+
+	// ChannelTag が空でない場合、この名前のタグの値をチャネル名として使用します。
+	// ポイントにこのタグが無い場合は、 Channel を使用します。
+	ChannelTag string `json:"channelTag,omitempty"`
+
+	// Fields はフィールド名とデータ番号の対応です。
+	// 数値と真偽値 (true は 1、false は 0) のフィールドを転送できます。
+	Fields map[string]ambidata.Field `json:"fields"`
+
+	// Lat と Lng は緯度と経度のフィールド名です。
+	// 両方のフィールドが存在する場合、 [ambidata.Data.Loc] に設定します。
+	// 空文字列の場合は、それぞれ "lat" と "lng" が使用されます。
+	Lat string `json:"lat,omitempty"`
+	Lng string `json:"lng,omitempty"`
+
+	// Cmnt はコメントとして転送する文字列フィールドの名前です。
+	// 空文字列の場合は、コメントを転送しません。
+	Cmnt string `json:"cmnt,omitempty"`
+}
+
+// ParseMappings は JSON 形式の [Mapping] の配列を読み込みます。
+//
+// 例:
+//
+//	[
+//	  {"measurement": "env", "channelTag": "site", "fields": {"temp": "d1", "humi": "d2"}},
+//	  {"measurement": "gps", "channel": "car", "fields": {"speed": "d1"}, "cmnt": "status"}
+//	]
+func ParseMappings(r io.Reader) ([]Mapping, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	var mappings []Mapping
+	if err := dec.Decode(&mappings); err != nil {
+		return nil, fmt.Errorf("influx: ParseMappings: %w", err)
+	}
+	for i := range mappings {
+		if err := mappings[i].validate(); err != nil {
+			return nil, fmt.Errorf("influx: ParseMappings: mappings[%d]: %w", i, err)
+		}
+	}
+	return mappings, nil
+}
+
+func (m *Mapping) validate() error {
+	if m.Channel == "" && m.ChannelTag == "" {
+		return errors.New("channel or channelTag must be specified")
+	}
+	for k, f := range m.Fields {
+		if !f.IsValid() {
+			return fmt.Errorf("fields[%q]: invalid field %v", k, f)
+		}
+	}
+	return nil
+}
+
+func (m *Mapping) match(p *Point) bool {
+	if m.Measurement != "" && p.Measurement != m.Measurement {
+		return false
+	}
+	for k, v := range m.Tags {
+		if p.Tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *Mapping) channel(p *Point) string {
+	if m.ChannelTag != "" {
+		if v, ok := p.Tags[m.ChannelTag]; ok {
+			return v
+		}
+	}
+	return m.Channel
+}
+
+// data はポイントをデータポイントに変換します。転送するデータが無い場合は false を返します。
+func (m *Mapping) data(p *Point) (ambidata.Data, bool) {
+	var d ambidata.Data
+	ok := false
+	for k, f := range m.Fields {
+		if v, isNum := number(p.Fields[k]); isNum {
+			d.SetField(f, ambidata.Just(v))
+			ok = true
+		}
+	}
+
+	lat, latOK := number(p.Fields[valueOr(m.Lat, "lat")])
+	lng, lngOK := number(p.Fields[valueOr(m.Lng, "lng")])
+	if latOK && lngOK {
+		d.Loc = ambidata.Just(ambidata.Location{Lat: lat, Lng: lng})
+		ok = true
+	}
+
+	if m.Cmnt != "" {
+		if s, isStr := p.Fields[m.Cmnt].(string); isStr {
+			d.Cmnt = s
+			ok = true
+		}
+	}
+	return d, ok
+}
+
+func number(v any) (float64, bool) {
+	var f float64
+	switch v := v.(type) {
+	case float64:
+		f = v
+	case int64:
+		f = float64(v)
+	case uint64:
+		f = float64(v)
+	case bool:
+		if v {
+			f = 1
+		}
+	default:
+		return 0, false
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, false
+	}
+	return f, true
+}
+
+// SenderFunc はチャネル名に対応する [ambidata.Sender] を返す関数です。
+// [config.Profile.Sender] をそのまま使用できます。
+//
+// [config.Profile.Sender]: https://pkg.go.dev/github.com/gcrtnst/ambidata/config#Profile.Sender
+type SenderFunc func(channel string) (*ambidata.Sender, error)
+
+// Bridge は line protocol のポイントを Ambient に転送します。
+//
+// 同じチャネルの同じ時刻 (ミリ秒単位) のポイントは、未送信であれば1つのデータポイントにまとめられます。
+// 送信するデータポイントの数は1日あたり [ambidata.MaxDataPerDay] 件に制限されているため、
+// 書き込み側で送信頻度を調整してください。
+//
+// Bridge のメソッドは複数の goroutine から同時に呼び出すことができます。
+// ただし、フィールドは使用を開始した後に変更しないでください。
+type Bridge struct {
+	// Mappings はポイントをチャネルのデータに対応付ける設定です。
+	// いずれの Mapping にも一致しないポイントは破棄されます。
+	Mappings []Mapping
+
+	// Sender はチャネル名に対応する [ambidata.Sender] を返す関数です。
+	// 同じチャネル名に対しては、成功するまで書き込みごとに呼び出され、成功した後は呼び出されません。
+	Sender SenderFunc
+
+	// Interval は同一チャネルへの送信間隔です。
+	// 0 以下の場合は、 [ambidata.MinSendInterval] が使用されます。
+	Interval time.Duration
+
+	// OnError は転送中にエラーが発生した場合に呼び出されます。
+	// nil の場合は、エラーは無視されます。
+	OnError func(err error)
+
+	// Now は現在時刻を返す関数です。タイムスタンプが省略されたポイントに使用します。
+	// nil の場合は、 [time.Now] が使用されます。
+	Now func() time.Time
+
+	mu      sync.Mutex
+	batcher *batch.Batcher
+	senders map[string]*ambidata.Sender
+	closed  bool
+}
+
+// ServeHTTP は InfluxDB の書き込み API と互換性のあるリクエストを処理します。
+//
+// クエリパラメータ precision でタイムスタンプの精度を指定できます (既定はナノ秒)。
+// db, bucket などのその他のパラメータは無視します。
+// Content-Encoding: gzip で圧縮されたリクエストボディを受け付けます。
+// 正常に受け付けた場合は 204 No Content を返します。
+// エラーの場合は InfluxDB と同様に {"error": "..."} 形式の JSON を返します。
+func (b *Bridge) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	precision, err := ParsePrecision(req.URL.Query().Get("precision"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var body io.Reader = http.MaxBytesReader(w, req.Body, MaxBodySize)
+	switch req.Header.Get("Content-Encoding") {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		defer zr.Close()
+		body = io.LimitReader(zr, MaxBodySize)
+	default:
+		writeError(w, http.StatusUnsupportedMediaType, "unsupported content encoding")
+		return
+	}
+
+	points, err := Parse(body, precision)
+	if err != nil {
+		if maxErr := (*http.MaxBytesError)(nil); errors.As(err, &maxErr) {
+			writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+			return
+		}
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := b.Write(points...); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Write はポイントを送信キューに追加します。
+// チャネルの解決に失敗したポイントは破棄され、エラーは [Bridge.OnError] に渡されます。
+// [Bridge.Close] の後に呼び出された場合は [ErrClosed] を返します。
+func (b *Bridge) Write(points ...Point) error {
+	now := b.now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	if b.batcher == nil {
+		b.batcher = &batch.Batcher{
+			Interval: b.Interval,
+			OnError: func(ch string, err error) {
+				b.reportError(fmt.Errorf("influx: ch %s: %w", ch, err))
+			},
+		}
+	}
+
+	for i := range points {
+		p := &points[i]
+		created := p.Time
+		if created.IsZero() {
+			created = now
+		}
+		created = created.Truncate(time.Millisecond)
+
+		for j := range b.Mappings {
+			m := &b.Mappings[j]
+			if !m.match(p) {
+				continue
+			}
+			data, ok := m.data(p)
+			if !ok {
+				continue
+			}
+			name := m.channel(p)
+			s, err := b.sender(name)
+			if err != nil {
+				b.reportError(fmt.Errorf("influx: channel %q: %w", name, err))
+				continue
+			}
+
+			data.Created = created
+			if err := b.batcher.Add(s, data); err != nil {
+				return fmt.Errorf("influx: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// sender はチャネル名に対応する [ambidata.Sender] を返します。
+// b.mu をロックした状態で呼び出してください。
+func (b *Bridge) sender(name string) (*ambidata.Sender, error) {
+	if s, ok := b.senders[name]; ok {
+		return s, nil
+	}
+	if name == "" {
+		return nil, errors.New("empty channel name")
+	}
+	if b.Sender == nil {
+		return nil, errors.New("Bridge.Sender is nil")
+	}
+	s, err := b.Sender(name)
+	if err != nil {
+		return nil, err
+	}
+	if b.senders == nil {
+		b.senders = map[string]*ambidata.Sender{}
+	}
+	b.senders[name] = s
+	return s, nil
+}
+
+// Close は新たなポイントの受け付けを停止し、キューに残っている全てのデータポイントを送信します。
+// 全てのデータポイントの送信が完了するか、ctx が終了するまで待機します。
+func (b *Bridge) Close(ctx context.Context) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	bt := b.batcher
+	b.mu.Unlock()
+
+	if bt == nil {
+		return nil
+	}
+	if err := bt.Close(ctx); err != nil {
+		return fmt.Errorf("influx: %w", err)
+	}
+	return nil
+}
+
+func (b *Bridge) now() time.Time {
+	if b.Now == nil {
+		return time.Now()
+	}
+	return b.Now()
+}
+
+func (b *Bridge) reportError(err error) {
+	if b.OnError != nil {
+		b.OnError(err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Influxdb-Error", msg)
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+func valueOr(v string, def string) string {
+	if v == "" {
+		return def
+	}
+	return v
+}
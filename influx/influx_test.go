@@ -0,0 +1,267 @@
+package influx
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/internal/ambimock"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		in        string
+		precision time.Duration
+		want      Point
+	}{
+		{
+			in:        "env,site=a,room=b temp=23.5,humi=60i,ok=t,state=\"on\" 1136214245000000000",
+			precision: time.Nanosecond,
+			want: Point{
+				Measurement: "env",
+				Tags:        map[string]string{"site": "a", "room": "b"},
+				Fields:      map[string]any{"temp": 23.5, "humi": int64(60), "ok": true, "state": "on"},
+				Time:        time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC),
+			},
+		},
+		{
+			in:        "env count=3u,flag=FALSE 1136214245500",
+			precision: time.Millisecond,
+			want: Point{
+				Measurement: "env",
+				Tags:        map[string]string{},
+				Fields:      map[string]any{"count": uint64(3), "flag": false},
+				Time:        time.Date(2006, 1, 2, 15, 4, 5, 500000000, time.UTC),
+			},
+		},
+		{
+			in:        `my\ meas,tag\,k=v\=1 f\ 1="a \"q\" \\ b",f2=-1e3`,
+			precision: time.Nanosecond,
+			want: Point{
+				Measurement: "my meas",
+				Tags:        map[string]string{"tag,k": "v=1"},
+				Fields:      map[string]any{"f 1": `a "q" \ b`, "f2": -1e3},
+			},
+		},
+	}
+	for _, tt := range tests {
+		got, err := ParseLine(tt.in, tt.precision)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.in, err)
+			continue
+		}
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("%s: mismatch (-want, +got):\n%s", tt.in, diff)
+		}
+	}
+}
+
+func TestParseLineError(t *testing.T) {
+	tests := []string{
+		"",
+		"env",
+		"env,site temp=1",
+		"env,site= temp=1",
+		"env temp",
+		"env temp=",
+		"env temp=abc",
+		"env temp=1x",
+		`env temp="abc`,
+		`env temp="abc"x`,
+		"env temp=1 abc",
+	}
+	for _, tt := range tests {
+		if _, err := ParseLine(tt, time.Nanosecond); err == nil {
+			t.Errorf("%q: expected error, got nil", tt)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	in := "# comment\n\nenv temp=1 1\nenv temp=2 2\n"
+	got, err := Parse(strings.NewReader(in), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 2 || !got[1].Time.Equal(time.Unix(2, 0)) {
+		t.Errorf("unexpected result: %#v", got)
+	}
+
+	_, err = Parse(strings.NewReader("env temp=1\nenv temp\n"), time.Second)
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expected error on line 2, got %v", err)
+	}
+}
+
+func TestParsePrecision(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+	}{
+		{"", time.Nanosecond},
+		{"n", time.Nanosecond},
+		{"ns", time.Nanosecond},
+		{"u", time.Microsecond},
+		{"us", time.Microsecond},
+		{"ms", time.Millisecond},
+		{"s", time.Second},
+		{"m", time.Minute},
+		{"h", time.Hour},
+	}
+	for _, tt := range tests {
+		got, err := ParsePrecision(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("%q: expected %v, got %v (err=%v)", tt.in, tt.want, got, err)
+		}
+	}
+	if _, err := ParsePrecision("d"); err == nil {
+		t.Errorf("\"d\": expected error, got nil")
+	}
+}
+
+func TestParseMappings(t *testing.T) {
+	in := `[{"measurement":"env","channelTag":"site","fields":{"temp":"d1","humi":"d2"}},{"channel":"car","fields":{},"cmnt":"status"}]`
+	got, err := ParseMappings(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []Mapping{
+		{Measurement: "env", ChannelTag: "site", Fields: map[string]ambidata.Field{"temp": ambidata.FieldD1, "humi": ambidata.FieldD2}},
+		{Channel: "car", Fields: map[string]ambidata.Field{}, Cmnt: "status"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+
+	for _, in := range []string{
+		`[{"measurement":"env","fields":{"temp":"d1"}}]`,
+		`[{"channel":"a","fields":{"temp":"d0"}}]`,
+		`[{"channel":"a","unknown":1}]`,
+	} {
+		if _, err := ParseMappings(strings.NewReader(in)); err == nil {
+			t.Errorf("%s: expected error, got nil", in)
+		}
+	}
+}
+
+func TestBridge(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := ambimock.New(t)
+	srv.AddChannel(&ambimock.Channel{Info: ambidata.ChannelInfo{Ch: "100"}, WriteKey: "w100"})
+	srv.AddChannel(&ambimock.Channel{Info: ambidata.ChannelInfo{Ch: "200"}, WriteKey: "w200"})
+	channels := map[string]string{"a": "100", "b": "200"}
+
+	now := time.Date(2006, 1, 2, 15, 5, 0, 0, time.UTC)
+	var errs []error
+	b := &Bridge{
+		Mappings: []Mapping{
+			{Measurement: "env", ChannelTag: "site", Fields: map[string]ambidata.Field{"temp": ambidata.FieldD1, "humi": ambidata.FieldD2}},
+			{Measurement: "gps", Channel: "a", Fields: map[string]ambidata.Field{"speed": ambidata.FieldD3}, Cmnt: "status"},
+		},
+		Sender: func(channel string) (*ambidata.Sender, error) {
+			ch, ok := channels[channel]
+			if !ok {
+				return nil, errors.New("no such channel")
+			}
+			return srv.Sender(ch), nil
+		},
+		Interval: time.Millisecond,
+		OnError:  func(err error) { errs = append(errs, err) },
+		Now:      func() time.Time { return now },
+	}
+
+	body := strings.Join([]string{
+		"env,site=a temp=23.5,humi=60i 1136214245",
+		"env,site=b temp=10 1136214245",
+		"env,site=c temp=0 1136214245",
+		"gps lat=35.5,lng=139.5,speed=40u,status=\"moving\" 1136214245",
+		"gps lat=35.6 1136214250",
+		"other value=1",
+		"env temp=1",
+	}, "\n")
+	var zbuf bytes.Buffer
+	zw := gzip.NewWriter(&zbuf)
+	zw.Write([]byte(body))
+	zw.Close()
+
+	req := httptest.NewRequest("POST", "/write?db=x&precision=s", &zbuf)
+	req.Header.Set("Content-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	b.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected %d, got %d: %s", http.StatusNoContent, rec.Code, rec.Body.String())
+	}
+
+	if err := b.Close(ctx); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	t0 := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	want100 := []ambidata.Data{
+		{
+			Created: t0,
+			D1:      ambidata.Just(23.5),
+			D2:      ambidata.Just(60.0),
+			D3:      ambidata.Just(40.0),
+			Loc:     ambidata.Just(ambidata.Location{Lat: 35.5, Lng: 139.5}),
+			Cmnt:    "moving",
+		},
+	}
+	if diff := cmp.Diff(want100, srv.Data("100")); diff != "" {
+		t.Errorf("ch 100: mismatch (-want, +got):\n%s", diff)
+	}
+	want200 := []ambidata.Data{{Created: t0, D1: ambidata.Just(10.0)}}
+	if diff := cmp.Diff(want200, srv.Data("200")); diff != "" {
+		t.Errorf("ch 200: mismatch (-want, +got):\n%s", diff)
+	}
+
+	// site=c は存在しないチャネル、site タグが無いポイントはチャネル名が空
+	if len(errs) != 2 {
+		t.Errorf("expected 2 errors, got %v", errs)
+	}
+	if err := b.Write(Point{Measurement: "env"}); !errors.Is(err, ErrClosed) {
+		t.Errorf("write after close: expected ErrClosed, got %v", err)
+	}
+}
+
+func TestBridgeBadRequest(t *testing.T) {
+	b := &Bridge{}
+	tests := []struct {
+		method string
+		target string
+		enc    string
+		body   string
+		code   int
+	}{
+		{"GET", "/write", "", "", http.StatusMethodNotAllowed},
+		{"POST", "/write?precision=d", "", "", http.StatusBadRequest},
+		{"POST", "/write", "br", "", http.StatusUnsupportedMediaType},
+		{"POST", "/write", "gzip", "x", http.StatusBadRequest},
+		{"POST", "/write", "", "env temp", http.StatusBadRequest},
+		{"POST", "/write", "", "", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+		if tt.enc != "" {
+			req.Header.Set("Content-Encoding", tt.enc)
+		}
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("%s %s %q: expected %d, got %d", tt.method, tt.target, tt.body, tt.code, rec.Code)
+		}
+		if tt.code != http.StatusNoContent && !strings.Contains(rec.Body.String(), `"error"`) {
+			t.Errorf("%s %s %q: expected error body, got %q", tt.method, tt.target, tt.body, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package influx
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Point は line protocol の1行を表します。
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+
+	// Fields はフィールドの値です。
+	// 値の型は float64, int64, uint64, string, bool のいずれかです。
+	Fields map[string]any
+
+	// Time はタイムスタンプです。省略された場合はゼロ値です。
+	Time time.Time
+}
+
+// ParsePrecision はタイムスタンプの精度を表す文字列を解釈します。
+// InfluxDB 1.x の "n", "u", "ms", "s", "m", "h" と、
+// InfluxDB 2.x の "ns", "us", "ms", "s" を受け付けます。
+// 空文字列はナノ秒として扱います。
+func ParsePrecision(s string) (time.Duration, error) {
+	switch s {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us", "µ", "µs":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	default:
+		return 0, fmt.Errorf("influx: ParsePrecision: invalid precision %q", s)
+	}
+}
+
+// Parse は line protocol を読み込み、全ての行を解釈します。
+// タイムスタンプは precision を単位として解釈します。
+// 空行と '#' で始まる行は無視します。
+func Parse(r io.Reader, precision time.Duration) ([]Point, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	var points []Point
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		p, err := parseLine(line, precision)
+		if err != nil {
+			return nil, fmt.Errorf("influx: line %d: %w", n, err)
+		}
+		points = append(points, p)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("influx: %w", err)
+	}
+	return points, nil
+}
+
+// ParseLine は line protocol の1行を解釈します。
+// タイムスタンプは precision を単位として解釈します。
+func ParseLine(line string, precision time.Duration) (Point, error) {
+	p, err := parseLine(strings.TrimSpace(line), precision)
+	if err != nil {
+		return Point{}, fmt.Errorf("influx: ParseLine: %w", err)
+	}
+	return p, nil
+}
+
+func parseLine(s string, precision time.Duration) (Point, error) {
+	p := Point{Tags: map[string]string{}, Fields: map[string]any{}}
+
+	var sep byte
+	p.Measurement, s, sep = scanToken(s, ", ")
+	if p.Measurement == "" {
+		return Point{}, errors.New("missing measurement")
+	}
+
+	for sep == ',' {
+		var k, v string
+		k, s, sep = scanToken(s, "=")
+		if sep != '=' || k == "" {
+			return Point{}, errors.New("invalid tag")
+		}
+		v, s, sep = scanToken(s, ", ")
+		if v == "" {
+			return Point{}, fmt.Errorf("missing value of tag %q", k)
+		}
+		p.Tags[k] = v
+	}
+	if sep != ' ' {
+		return Point{}, errors.New("missing fields")
+	}
+	s = strings.TrimLeft(s, " ")
+
+	for {
+		var k string
+		k, s, sep = scanToken(s, "=")
+		if sep != '=' || k == "" {
+			return Point{}, errors.New("invalid field")
+		}
+		var v any
+		var err error
+		v, s, sep, err = scanFieldValue(s)
+		if err != nil {
+			return Point{}, fmt.Errorf("field %q: %w", k, err)
+		}
+		p.Fields[k] = v
+		if sep != ',' {
+			break
+		}
+	}
+
+	s = strings.TrimSpace(s)
+	if s != "" {
+		ts, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return Point{}, fmt.Errorf("invalid timestamp %q", s)
+		}
+		p.Time = time.Unix(0, ts*int64(precision))
+	}
+	return p, nil
+}
+
+// scanToken は s の先頭から、エスケープされていない delims のいずれかの文字までを読み込みます。
+// エスケープを解除したトークン、区切り文字より後の文字列、区切り文字を返します。
+// 区切り文字が見つからなかった場合は、区切り文字として 0 を返します。
+func scanToken(s string, delims string) (token string, rest string, sep byte) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' && i+1 < len(s) && strings.IndexByte(`, ="\`, s[i+1]) >= 0 {
+			b.WriteByte(s[i+1])
+			i++
+			continue
+		}
+		if strings.IndexByte(delims, c) >= 0 {
+			return b.String(), s[i+1:], c
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), "", 0
+}
+
+func scanFieldValue(s string) (v any, rest string, sep byte, err error) {
+	if strings.HasPrefix(s, `"`) {
+		var b strings.Builder
+		for i := 1; i < len(s); i++ {
+			c := s[i]
+			if c == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') {
+				b.WriteByte(s[i+1])
+				i++
+				continue
+			}
+			if c == '"' {
+				rest = s[i+1:]
+				if rest != "" {
+					sep, rest = rest[0], rest[1:]
+					if sep != ',' && sep != ' ' {
+						return nil, "", 0, errors.New("unexpected character after string")
+					}
+				}
+				return b.String(), rest, sep, nil
+			}
+			b.WriteByte(c)
+		}
+		return nil, "", 0, errors.New("unterminated string")
+	}
+
+	var raw string
+	raw, rest, sep = scanToken(s, ", ")
+	v, err = parseFieldValue(raw)
+	return v, rest, sep, err
+}
+
+func parseFieldValue(s string) (any, error) {
+	switch s {
+	case "t", "T", "true", "True", "TRUE":
+		return true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return false, nil
+	}
+	if s == "" {
+		return nil, errors.New("missing value")
+	}
+	switch s[len(s)-1] {
+	case 'i':
+		v, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer %q", s)
+		}
+		return v, nil
+	case 'u':
+		v, err := strconv.ParseUint(s[:len(s)-1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid unsigned integer %q", s)
+		}
+		return v, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q", s)
+	}
+	return v, nil
+}
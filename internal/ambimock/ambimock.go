@@ -0,0 +1,485 @@
+// Package ambimock は、テスト用に Ambient の API を模倣するインメモリのサーバーを提供します。
+//
+// 本物の Ambient サーバーとの差異 (送信間隔や1日あたりの件数の制限が無いことなど) に注意してください。
+// 時刻はサーバーと同様にミリ秒単位に切り捨てて保存します。
+package ambimock
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+)
+
+// Channel はモックサーバー上のチャネルです。
+type Channel struct {
+	Info     ambidata.ChannelInfo // チャネル情報 (LastPost と LastData は保存されたデータから計算されます)
+	UserKey  string
+	ReadKey  string
+	WriteKey string
+	Data     []ambidata.Data // 保存されたデータ (古いものから新しいものの順)
+}
+
+// Request はモックサーバーが受け付けたリクエストの記録です。
+type Request struct {
+	Time   time.Time
+	Method string
+	Path   string
+	Query  url.Values
+	Body   []byte
+}
+
+// Server は Ambient の API を模倣するテスト用のサーバーです。
+type Server struct {
+	*httptest.Server
+
+	// Hook はリクエストを処理する前に呼び出されます。
+	// 0 以外のステータスコードを返した場合、リクエストを処理せずにそのステータスコードで応答します。
+	Hook func(r *http.Request) int
+
+	mu       sync.Mutex
+	channels map[string]*Channel
+	requests []Request
+}
+
+// New は新しいモックサーバーを起動します。
+// サーバーはテストの終了時に停止されます。
+func New(t testing.TB) *Server {
+	s := &Server{channels: map[string]*Channel{}}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", http.NotFoundHandler())
+	mux.HandleFunc("GET /api/v2/channels/{$}", s.handleList)
+	mux.HandleFunc("GET /api/v2/channels/{ch}/{$}", s.handleInfo)
+	mux.HandleFunc("GET /api/v2/channels/{ch}/data", s.handleFetch)
+	mux.HandleFunc("POST /api/v2/channels/{ch}/data", s.handleSend)
+	mux.HandleFunc("POST /api/v2/channels/{ch}/dataarray", s.handleSendBulk)
+	mux.HandleFunc("PUT /api/v2/channels/{ch}/data", s.handlePut)
+	mux.HandleFunc("DELETE /api/v2/channels/{ch}/data", s.handleDelete)
+
+	s.Server = httptest.NewServer(s.record(mux))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// AddChannel はチャネルを追加します。
+func (s *Server) AddChannel(c *Channel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range c.Data {
+		c.Data[i].Created = c.Data[i].Created.Truncate(time.Millisecond)
+	}
+	sortData(c.Data)
+	s.channels[c.Info.Ch] = c
+}
+
+// Data はチャネル ch に保存されているデータのコピーを、古いものから新しいものの順に返します。
+func (s *Server) Data(ch string) []ambidata.Data {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.channels[ch]
+	if !ok {
+		return nil
+	}
+	return slices.Clone(c.Data)
+}
+
+// Requests はこれまでに受け付けたリクエストの記録を返します。
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.requests)
+}
+
+// Config はモックサーバーに接続するための [ambidata.Config] を返します。
+func (s *Server) Config() *ambidata.Config {
+	u, _ := url.Parse(s.URL)
+	return &ambidata.Config{Scheme: u.Scheme, Host: u.Host, Client: s.Client()}
+}
+
+// Fetcher はチャネル ch に接続する [ambidata.Fetcher] を返します。
+func (s *Server) Fetcher(ch string) *ambidata.Fetcher {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := &ambidata.Fetcher{Ch: ch, Config: s.Config()}
+	if c, ok := s.channels[ch]; ok {
+		f.ReadKey = c.ReadKey
+	}
+	return f
+}
+
+// Sender はチャネル ch に接続する [ambidata.Sender] を返します。
+func (s *Server) Sender(ch string) *ambidata.Sender {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snd := &ambidata.Sender{Ch: ch, Config: s.Config()}
+	if c, ok := s.channels[ch]; ok {
+		snd.WriteKey = c.WriteKey
+	}
+	return snd
+}
+
+// Manager はユーザーキー userKey を使用する [ambidata.Manager] を返します。
+func (s *Server) Manager(userKey string) *ambidata.Manager {
+	return &ambidata.Manager{UserKey: userKey, Config: s.Config()}
+}
+
+func (s *Server) record(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		s.mu.Lock()
+		s.requests = append(s.requests, Request{
+			Time:   time.Now(),
+			Method: r.Method,
+			Path:   r.URL.Path,
+			Query:  r.URL.Query(),
+			Body:   body,
+		})
+		hook := s.Hook
+		s.mu.Unlock()
+
+		if hook != nil {
+			if code := hook(r); code != 0 {
+				w.WriteHeader(code)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q := r.URL.Query()
+	userKey := q.Get("userKey")
+	if devKey := q.Get("devKey"); devKey != "" {
+		for _, c := range s.channels {
+			if c.UserKey == userKey && slices.Contains(c.Info.DevKeys, devKey) {
+				if q.Get("level") == "1" {
+					writeJSON(w, map[string]string{"ch": c.Info.Ch, "writeKey": c.WriteKey})
+					return
+				}
+				writeJSON(w, channelJSON(c, true))
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	list := []map[string]any{}
+	for _, k := range sortedKeys(s.channels) {
+		c := s.channels[k]
+		if c.UserKey == userKey {
+			list = append(list, channelJSON(c, true))
+		}
+	}
+	if userKey == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	writeJSON(w, list)
+}
+
+func (s *Server) handleInfo(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.auth(w, r, r.URL.Query().Get("readKey"), func(c *Channel) string { return c.ReadKey })
+	if !ok {
+		return
+	}
+	writeJSON(w, channelJSON(c, false))
+}
+
+func (s *Server) handleFetch(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q := r.URL.Query()
+	c, ok := s.auth(w, r, q.Get("readKey"), func(c *Channel) string { return c.ReadKey })
+	if !ok {
+		return
+	}
+
+	// 新しいものから古いものの順
+	arr := slices.Clone(c.Data)
+	slices.Reverse(arr)
+
+	if q.Has("start") || q.Has("end") {
+		stt, err1 := time.Parse(time.RFC3339Nano, q.Get("start"))
+		end, err2 := time.Parse(time.RFC3339Nano, q.Get("end"))
+		if err1 != nil || err2 != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		stt = stt.Truncate(time.Millisecond)
+		end = end.Truncate(time.Millisecond)
+		arr = slices.DeleteFunc(arr, func(d ambidata.Data) bool {
+			return d.Created.Before(stt) || d.Created.After(end)
+		})
+	} else {
+		n, _ := strconv.Atoi(q.Get("n"))
+		skip, _ := strconv.Atoi(q.Get("skip"))
+		skip = min(skip, len(arr))
+		arr = arr[skip:]
+		arr = arr[:min(n, len(arr))]
+	}
+	if len(arr) > 3000 {
+		arr = arr[:3000]
+	}
+
+	list := make([]map[string]any, len(arr))
+	for i := range arr {
+		list[i] = dataJSON(&arr[i])
+	}
+	writeJSON(w, list)
+}
+
+type sendData struct {
+	Created *time.Time `json:"created"`
+	D1      *float64   `json:"d1"`
+	D2      *float64   `json:"d2"`
+	D3      *float64   `json:"d3"`
+	D4      *float64   `json:"d4"`
+	D5      *float64   `json:"d5"`
+	D6      *float64   `json:"d6"`
+	D7      *float64   `json:"d7"`
+	D8      *float64   `json:"d8"`
+	Lat     *float64   `json:"lat"`
+	Lng     *float64   `json:"lng"`
+	Cmnt    string     `json:"cmnt"`
+}
+
+func (j *sendData) ToData(now time.Time) ambidata.Data {
+	d := ambidata.Data{Created: now, Cmnt: j.Cmnt}
+	if j.Created != nil {
+		d.Created = *j.Created
+	}
+	d.Created = d.Created.Truncate(time.Millisecond)
+	if len(d.Cmnt) > 64 {
+		d.Cmnt = d.Cmnt[:64]
+	}
+	for i, v := range []*float64{j.D1, j.D2, j.D3, j.D4, j.D5, j.D6, j.D7, j.D8} {
+		if v != nil {
+			d.SetField(ambidata.Fields[i], ambidata.Just(*v))
+		}
+	}
+	if j.Lat != nil && j.Lng != nil {
+		d.Loc = ambidata.Just(ambidata.Location{Lat: *j.Lat, Lng: *j.Lng})
+	}
+	return d
+}
+
+func (s *Server) handleSend(w http.ResponseWriter, r *http.Request) {
+	var j struct {
+		sendData
+		WriteKey string `json:"writeKey"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&j); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.auth(w, r, j.WriteKey, func(c *Channel) string { return c.WriteKey })
+	if !ok {
+		return
+	}
+	c.Data = append(c.Data, j.ToData(time.Now()))
+	sortData(c.Data)
+}
+
+func (s *Server) handleSendBulk(w http.ResponseWriter, r *http.Request) {
+	var j struct {
+		WriteKey string     `json:"writeKey"`
+		Data     []sendData `json:"data"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&j); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.auth(w, r, j.WriteKey, func(c *Channel) string { return c.WriteKey })
+	if !ok {
+		return
+	}
+	now := time.Now()
+	for i := range j.Data {
+		c.Data = append(c.Data, j.Data[i].ToData(now))
+	}
+	sortData(c.Data)
+}
+
+func (s *Server) handlePut(w http.ResponseWriter, r *http.Request) {
+	var j struct {
+		WriteKey string    `json:"writeKey"`
+		Created  time.Time `json:"created"`
+		Cmnt     *string   `json:"cmnt"`
+		Hide     *bool     `json:"hide"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&j); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.auth(w, r, j.WriteKey, func(c *Channel) string { return c.WriteKey })
+	if !ok {
+		return
+	}
+	created := j.Created.Truncate(time.Millisecond)
+	for i := range c.Data {
+		if !c.Data[i].Created.Equal(created) {
+			continue
+		}
+		if j.Cmnt != nil {
+			c.Data[i].Cmnt = *j.Cmnt
+			if len(c.Data[i].Cmnt) > 64 {
+				c.Data[i].Cmnt = c.Data[i].Cmnt[:64]
+			}
+		}
+		if j.Hide != nil {
+			c.Data[i].Hide = *j.Hide
+		}
+		break
+	}
+}
+
+func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.auth(w, r, r.URL.Query().Get("userKey"), func(c *Channel) string { return c.UserKey })
+	if !ok {
+		return
+	}
+	c.Data = nil
+}
+
+// auth はチャネルの存在とキーを確認します。失敗した場合は応答を書き込み、false を返します。
+// s.mu をロックした状態で呼び出してください。
+func (s *Server) auth(w http.ResponseWriter, r *http.Request, key string, want func(*Channel) string) (*Channel, bool) {
+	c, ok := s.channels[r.PathValue("ch")]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, false
+	}
+	if key == "" || key != want(c) {
+		w.WriteHeader(http.StatusForbidden)
+		return nil, false
+	}
+	return c, true
+}
+
+func channelJSON(c *Channel, keys bool) map[string]any {
+	info := &c.Info
+	j := map[string]any{
+		"ch":         info.Ch,
+		"user":       info.User,
+		"created":    formatTime(info.Created),
+		"modified":   formatTime(info.Modified),
+		"lastpost":   formatTime(time.Time{}),
+		"charts":     info.Charts,
+		"dataperday": info.DataPerDay,
+		"d_ch":       info.DCh,
+		"chName":     info.ChName,
+		"chDesc":     info.ChDesc,
+		"photoid":    info.PhotoID,
+		"devkeys":    info.DevKeys,
+		"bd":         info.Bd,
+		"lastdata":   map[string]any{},
+	}
+	if info.DevKeys == nil {
+		j["devkeys"] = []string{}
+	}
+	for _, f := range ambidata.Fields {
+		fi := info.Field(f)
+		fj := map[string]any{}
+		if fi.Name != "" {
+			fj["name"] = fi.Name
+		}
+		if fi.Color != "" {
+			fj["color"] = string(fi.Color)
+		}
+		j[f.String()] = fj
+	}
+	if info.Loc.OK {
+		j["loc"] = []float64{info.Loc.V.Lng, info.Loc.V.Lat}
+	}
+	if n := len(c.Data); n > 0 {
+		last := &c.Data[n-1]
+		j["lastpost"] = formatTime(last.Created)
+		ld := dataJSON(last)
+		ld["_id"] = strconv.Itoa(n)
+		j["lastdata"] = ld
+	}
+	if keys {
+		j["readKey"] = c.ReadKey
+		j["writeKey"] = c.WriteKey
+	}
+	return j
+}
+
+func dataJSON(d *ambidata.Data) map[string]any {
+	j := map[string]any{"created": formatTime(d.Created)}
+	for _, f := range ambidata.Fields {
+		if v := d.Field(f); v.OK && !math.IsNaN(v.V) {
+			j[f.String()] = v.V
+		}
+	}
+	if d.Loc.OK {
+		j["loc"] = []float64{d.Loc.V.Lng, d.Loc.V.Lat}
+	}
+	if d.Cmnt != "" {
+		j["cmnt"] = d.Cmnt
+	}
+	if d.Hide {
+		j["hide"] = true
+	}
+	return j
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		t = time.Unix(0, 0)
+	}
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+func sortData(arr []ambidata.Data) {
+	slices.SortStableFunc(arr, func(a, b ambidata.Data) int {
+		return a.Created.Compare(b.Created)
+	})
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,433 @@
+// Package batch は、チャネルごとのキューにデータポイントを蓄積し、
+// 送信間隔の制限を守りながら [ambidata.Sender.SendBulk] でまとめて送信する機能を提供します。
+//
+// 各種ブリッジ (promremote, influx, mqttbridge など) や senderpool, async で共通して使用します。
+package batch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+)
+
+// DefaultMaxBatch は [Batcher.MaxBatch] のデフォルト値です。
+// [ambidata.Sender.SendBulk] のリクエストボディのサイズ制限に余裕を持たせた値です。
+const DefaultMaxBatch = 250
+
+// DefaultMaxPending は [Batcher.MaxPending] のデフォルト値です。
+const DefaultMaxPending = 10000
+
+var (
+	// ErrClosed は [Batcher.Close] の後に [Batcher.Add] が呼び出された場合のエラーです。
+	ErrClosed = errors.New("batch: batcher is closed")
+
+	// ErrQueueFull はキューが満杯になり、古いデータポイントが破棄されたことを表すエラーです。
+	// [Batcher.OnError] に渡されます。
+	ErrQueueFull = errors.New("batch: queue is full; oldest data points were dropped")
+)
+
+// Batcher はチャネルごとのキューにデータポイントを蓄積し、まとめて送信します。
+// キューはチャネルID ([ambidata.Sender.Ch]) ごとに作成されます。
+//
+// FIFO が false の場合、キューのデータポイントは時刻順に並び、同じ時刻 ([ambidata.Data.Created]) のデータポイントが未送信のまま複数追加された場合、
+// それらは1つのデータポイントに統合されます。
+// 統合では、後から追加されたデータポイントの値が存在するフィールドが優先されます。
+// 送信中のデータポイントはキューから取り出されているため、統合の対象になりません。
+// FIFO が true の場合は統合を行わず、追加された順序のまま送信します。
+//
+// フィールドは最初の [Batcher.Add] の呼び出しより前に設定してください。
+type Batcher struct {
+	// Interval は同一チャネルへの送信間隔です。
+	// 0 以下の場合は、 [ambidata.MinSendInterval] が使用されます。
+	Interval time.Duration
+
+	// MaxBatch は1回の送信に含める最大のデータポイント数です。
+	// 0 以下の場合は、 [DefaultMaxBatch] が使用されます。
+	MaxBatch int
+
+	// MaxPending はチャネルごとのキューに保持する最大のデータポイント数です。
+	// これを超えた場合、古いデータポイントから破棄されます。
+	// 0 以下の場合は、 [DefaultMaxPending] が使用されます。
+	MaxPending int
+
+	// FIFO が true の場合、データポイントを統合せず、追加された順序で送信します。
+	FIFO bool
+
+	// Concurrency は全てのチャネルを合わせた同時送信数の上限です。
+	// 0 以下の場合は、制限しません。
+	Concurrency int
+
+	// OnError は送信エラーやデータポイントの破棄が発生した場合に呼び出されます。
+	// nil の場合は、エラーは無視されます。
+	OnError func(ch string, err error)
+
+	// OnSend は送信を試みるたびに、送信したデータポイントと結果のエラーを引数として呼び出されます。
+	// err が nil でない場合、 [Retryable] なエラーであればデータポイントはキューに戻されており、
+	// そうでなければ破棄されています。 [Batcher.Close] により送信を打ち切った場合は呼び出されません。
+	// nil の場合は、何もしません。
+	OnSend func(ch string, arr []ambidata.Data, err error)
+
+	mu     sync.Mutex
+	queues map[string]*queue
+	closed bool
+	sem    chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+type queue struct {
+	sender   *ambidata.Sender
+	pending  []ambidata.Data
+	inflight int // 送信中のデータポイントの数
+	notify   chan struct{}
+}
+
+// Add は s のチャネルのキューにデータポイントを追加します。
+// キューのデータポイントは、そのチャネルに対して最後に Add または [Batcher.Update] に渡された s で送信されます。
+func (b *Batcher) Add(s *ambidata.Sender, arr ...ambidata.Data) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	q := b.queue(s)
+
+	if b.FIFO {
+		q.pending = append(q.pending, arr...)
+	} else {
+		for _, data := range arr {
+			q.pending = Merge(q.pending, data)
+		}
+	}
+	if over := len(q.pending) + q.inflight - b.maxPending(); over > 0 {
+		// 送信中のデータポイントは破棄できないため、キューに残っているものから破棄する
+		q.pending = slices.Delete(q.pending, 0, min(over, len(q.pending)))
+		b.reportError(s.Ch, ErrQueueFull)
+	}
+	q.signal()
+	return nil
+}
+
+// Update は s のチャネルのキューのうち、送信中でないデータポイントを fn の戻り値で置き換えます。
+// fn がエラーを返した場合は、キューを変更せずにそのエラーを返します。
+//
+// fn は Batcher のロックを保持した状態で呼び出されるため、Batcher のメソッドを呼び出してはいけません。
+// Update では MaxPending による破棄は行わないため、キューの大きさは呼び出し側で管理してください。
+func (b *Batcher) Update(s *ambidata.Sender, fn func(pending []ambidata.Data) ([]ambidata.Data, error)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	q := b.queue(s)
+
+	pending, err := fn(slices.Clip(q.pending))
+	if err != nil {
+		return err
+	}
+	q.pending = pending
+	q.signal()
+	return nil
+}
+
+// queue は s のチャネルのキューを返します。キューが無い場合は作成し、送信する goroutine を開始します。
+// b.mu をロックした状態で呼び出してください。
+func (b *Batcher) queue(s *ambidata.Sender) *queue {
+	if b.queues == nil {
+		b.queues = map[string]*queue{}
+		if b.Concurrency > 0 {
+			b.sem = make(chan struct{}, b.Concurrency)
+		}
+		b.ctx, b.cancel = context.WithCancel(context.Background())
+		b.stop = make(chan struct{})
+	}
+
+	q, ok := b.queues[s.Ch]
+	if !ok {
+		q = &queue{notify: make(chan struct{}, 1)}
+		b.queues[s.Ch] = q
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			b.run(q)
+		}()
+	}
+	q.sender = s
+	return q
+}
+
+// signal は送信する goroutine にデータポイントの追加を通知します。
+func (q *queue) signal() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Pending はチャネル ch のキューにある未送信のデータポイント数を返します。
+// 送信中のデータポイントも含みます。
+func (b *Batcher) Pending(ch string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if q, ok := b.queues[ch]; ok {
+		return len(q.pending) + q.inflight
+	}
+	return 0
+}
+
+// Queued はチャネル ch のキューにある、送信中でないデータポイント数を返します。
+func (b *Batcher) Queued(ch string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if q, ok := b.queues[ch]; ok {
+		return len(q.pending)
+	}
+	return 0
+}
+
+// UnsentError は [Batcher.Close] が全てのデータポイントを送信できなかった場合のエラーです。
+type UnsentError struct {
+	Err    error                      // 送信を打ち切った原因
+	Unsent map[string][]ambidata.Data // チャネルIDをキーとする未送信のデータポイント
+}
+
+func (err *UnsentError) Error() string {
+	n := 0
+	for _, arr := range err.Unsent {
+		n += len(arr)
+	}
+	return fmt.Sprintf("batch: %s (%d data points unsent)", err.Err.Error(), n)
+}
+
+func (err *UnsentError) Unwrap() error {
+	return err.Err
+}
+
+// Close は新たなデータポイントの追加を停止し、キューに残っているデータポイントを送信します。
+// 全てのデータポイントの送信が完了するか、ctx が終了するまで待機します。
+// ctx が終了した場合は送信を打ち切り、未送信のデータポイントを含む [*UnsentError] を返します。
+func (b *Batcher) Close(ctx context.Context) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	if b.queues == nil {
+		b.mu.Unlock()
+		return nil
+	}
+	close(b.stop)
+	b.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		b.cancel()
+		return nil
+	case <-ctx.Done():
+	}
+
+	b.cancel()
+	<-done
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	unsent := map[string][]ambidata.Data{}
+	for ch, q := range b.queues {
+		if len(q.pending) > 0 {
+			unsent[ch] = slices.Clone(q.pending)
+		}
+	}
+	if len(unsent) == 0 {
+		return nil
+	}
+	return &UnsentError{Err: ctx.Err(), Unsent: unsent}
+}
+
+func (b *Batcher) run(q *queue) {
+	interval := b.Interval
+	if interval <= 0 {
+		interval = ambidata.MinSendInterval
+	}
+	maxBatch := b.MaxBatch
+	if maxBatch <= 0 {
+		maxBatch = DefaultMaxBatch
+	}
+
+	var next time.Time
+	for {
+		// キューにデータが入るのを待つ
+		b.mu.Lock()
+		n := len(q.pending)
+		b.mu.Unlock()
+		if n == 0 {
+			select {
+			case <-q.notify:
+				continue
+			case <-b.stop:
+				b.mu.Lock()
+				n = len(q.pending)
+				b.mu.Unlock()
+				if n == 0 {
+					return
+				}
+			case <-b.ctx.Done():
+				return
+			}
+		}
+
+		// 送信間隔を空ける
+		if wait := time.Until(next); wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-b.ctx.Done():
+				t.Stop()
+				return
+			}
+		}
+
+		// 同時送信数の枠を確保する
+		if b.sem != nil {
+			select {
+			case b.sem <- struct{}{}:
+			case <-b.ctx.Done():
+				return
+			}
+		}
+
+		// 送信中に追加されたデータポイントと区別できるよう、送信するデータポイントはキューから取り出す。
+		// 枠を待つ間に追加されたデータポイントもまとめて送信する。
+		b.mu.Lock()
+		n = min(len(q.pending), maxBatch)
+		batch := slices.Clone(q.pending[:n])
+		q.pending = slices.Delete(q.pending, 0, n)
+		q.inflight = n
+		sender := q.sender
+		b.mu.Unlock()
+		if n == 0 {
+			b.release()
+			continue
+		}
+
+		err := sender.SendBulk(b.ctx, batch)
+		b.release()
+		next = time.Now().Add(interval)
+
+		b.mu.Lock()
+		q.inflight = 0
+		if err != nil && (b.ctx.Err() != nil || Retryable(err)) {
+			q.pending = b.requeue(batch, q.pending)
+		}
+		b.mu.Unlock()
+
+		if err != nil && b.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			b.reportError(sender.Ch, err)
+		}
+		if b.OnSend != nil {
+			b.OnSend(sender.Ch, batch, err)
+		}
+	}
+}
+
+// release は同時送信数の枠を解放します。
+func (b *Batcher) release() {
+	if b.sem != nil {
+		<-b.sem
+	}
+}
+
+func (b *Batcher) reportError(ch string, err error) {
+	if b.OnError != nil {
+		b.OnError(ch, err)
+	}
+}
+
+func (b *Batcher) maxPending() int {
+	if b.MaxPending <= 0 {
+		return DefaultMaxPending
+	}
+	return b.MaxPending
+}
+
+// requeue は送信に失敗した batch を pending の先頭に戻した結果を返します。
+// 送信中に追加されたデータポイントは、 [Merge] により batch の後に追加されたものとして統合します。
+func (b *Batcher) requeue(batch []ambidata.Data, pending []ambidata.Data) []ambidata.Data {
+	if b.FIFO {
+		return append(batch, pending...)
+	}
+	for _, data := range pending {
+		batch = Merge(batch, data)
+	}
+	return batch
+}
+
+// Retryable は送信エラーが再試行により解決する可能性がある場合に true を返します。
+// リクエスト内容に起因する 4xx エラー (429 と 408 を除く) は再試行しません。
+func Retryable(err error) bool {
+	var sc *ambidata.StatusCodeError
+	if !errors.As(err, &sc) {
+		return true
+	}
+	switch {
+	case sc.StatusCode == http.StatusTooManyRequests, sc.StatusCode == http.StatusRequestTimeout:
+		return true
+	case 400 <= sc.StatusCode && sc.StatusCode < 500:
+		return false
+	default:
+		return true
+	}
+}
+
+// Merge は時刻順に並んだ arr に data を追加した結果を返します。
+//
+// arr に data と同じ時刻のデータポイントが存在する場合は、1つのデータポイントに統合します。
+// 統合では data の値が存在するフィールドが優先されます。
+// 時刻がゼロ値のデータポイントは統合せず、末尾に追加します。
+func Merge(arr []ambidata.Data, data ambidata.Data) []ambidata.Data {
+	if data.Created.IsZero() {
+		return append(arr, data)
+	}
+
+	i, found := slices.BinarySearchFunc(arr, data.Created, func(d ambidata.Data, t time.Time) int {
+		if d.Created.IsZero() {
+			return 1
+		}
+		return d.Created.Compare(t)
+	})
+	if !found {
+		return slices.Insert(arr, i, data)
+	}
+
+	dst := &arr[i]
+	for _, f := range ambidata.Fields {
+		if v := data.Field(f); v.OK {
+			dst.SetField(f, v)
+		}
+	}
+	if data.Loc.OK {
+		dst.Loc = data.Loc
+	}
+	if data.Cmnt != "" {
+		dst.Cmnt = data.Cmnt
+	}
+	dst.Hide = dst.Hide || data.Hide
+	return arr
+}
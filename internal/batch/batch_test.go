@@ -0,0 +1,245 @@
+package batch
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/internal/ambimock"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMerge(t *testing.T) {
+	t0 := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	t1 := t0.Add(time.Second)
+	t2 := t0.Add(2 * time.Second)
+
+	var arr []ambidata.Data
+	arr = Merge(arr, ambidata.Data{Created: t2, D1: ambidata.Just(2.0)})
+	arr = Merge(arr, ambidata.Data{Created: t0, D1: ambidata.Just(0.0)})
+	arr = Merge(arr, ambidata.Data{D1: ambidata.Just(9.0)})
+	arr = Merge(arr, ambidata.Data{Created: t1, D1: ambidata.Just(1.0), Cmnt: "a"})
+	arr = Merge(arr, ambidata.Data{Created: t1, D1: ambidata.Just(1.5), D2: ambidata.Just(10.0)})
+	arr = Merge(arr, ambidata.Data{D1: ambidata.Just(8.0)})
+
+	want := []ambidata.Data{
+		{Created: t0, D1: ambidata.Just(0.0)},
+		{Created: t1, D1: ambidata.Just(1.5), D2: ambidata.Just(10.0), Cmnt: "a"},
+		{Created: t2, D1: ambidata.Just(2.0)},
+		{D1: ambidata.Just(9.0)},
+		{D1: ambidata.Just(8.0)},
+	}
+	if diff := cmp.Diff(want, arr); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestBatcher(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := ambimock.New(t)
+	srv.AddChannel(&ambimock.Channel{Info: ambidata.ChannelInfo{Ch: "1"}, WriteKey: "w1"})
+	srv.AddChannel(&ambimock.Channel{Info: ambidata.ChannelInfo{Ch: "2"}, WriteKey: "w2"})
+
+	b := &Batcher{Interval: 10 * time.Millisecond, MaxBatch: 3}
+	t0 := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	var want1, want2 []ambidata.Data
+	for i := range 10 {
+		d := ambidata.Data{Created: t0.Add(time.Duration(i) * time.Second), D1: ambidata.Just(float64(i))}
+		want1 = append(want1, d)
+		if err := b.Add(srv.Sender("1"), d); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	for i := range 2 {
+		d := ambidata.Data{Created: t0.Add(time.Duration(i) * time.Second), D2: ambidata.Just(float64(i))}
+		want2 = append(want2, d)
+		if err := b.Add(srv.Sender("2"), d); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	if err := b.Close(ctx); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if diff := cmp.Diff(want1, srv.Data("1")); diff != "" {
+		t.Errorf("ch 1: mismatch (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(want2, srv.Data("2")); diff != "" {
+		t.Errorf("ch 2: mismatch (-want, +got):\n%s", diff)
+	}
+	if err := b.Add(srv.Sender("1"), ambidata.Data{}); !errors.Is(err, ErrClosed) {
+		t.Errorf("add after close: expected ErrClosed, got %v", err)
+	}
+
+	// 同一チャネルへの送信は Interval 以上の間隔を空ける
+	var last time.Time
+	for _, req := range srv.Requests() {
+		if req.Path != "/api/v2/channels/1/dataarray" {
+			continue
+		}
+		if !last.IsZero() && req.Time.Sub(last) < b.Interval {
+			t.Errorf("interval: expected at least %v, got %v", b.Interval, req.Time.Sub(last))
+		}
+		last = req.Time
+	}
+}
+
+func TestBatcherError(t *testing.T) {
+	tests := []struct {
+		code    int
+		retried bool
+	}{
+		{http.StatusBadRequest, false},
+		{http.StatusTooManyRequests, true},
+		{http.StatusInternalServerError, true},
+	}
+	for _, tt := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		srv := ambimock.New(t)
+		srv.AddChannel(&ambimock.Channel{Info: ambidata.ChannelInfo{Ch: "1"}, WriteKey: "w1"})
+		var mu sync.Mutex
+		fails := 1
+		srv.Hook = func(r *http.Request) int {
+			mu.Lock()
+			defer mu.Unlock()
+			if fails > 0 {
+				fails--
+				return tt.code
+			}
+			return 0
+		}
+
+		var errs []error
+		b := &Batcher{
+			Interval: time.Millisecond,
+			OnError: func(ch string, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				errs = append(errs, err)
+			},
+		}
+		data := ambidata.Data{Created: time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC), D1: ambidata.Just(1.0)}
+		if err := b.Add(srv.Sender("1"), data); err != nil {
+			t.Fatalf("%d: add: %v", tt.code, err)
+		}
+		if err := b.Close(ctx); err != nil {
+			t.Fatalf("%d: close: %v", tt.code, err)
+		}
+
+		if len(errs) != 1 {
+			t.Errorf("%d: expected 1 error, got %v", tt.code, errs)
+		}
+		if got := len(srv.Data("1")) == 1; got != tt.retried {
+			t.Errorf("%d: expected retried=%t, got %t", tt.code, tt.retried, got)
+		}
+	}
+}
+
+func TestBatcherCloseTimeout(t *testing.T) {
+	srv := ambimock.New(t)
+	srv.AddChannel(&ambimock.Channel{Info: ambidata.ChannelInfo{Ch: "1"}, WriteKey: "w1"})
+	srv.Hook = func(r *http.Request) int { return http.StatusServiceUnavailable }
+
+	b := &Batcher{Interval: time.Millisecond}
+	if err := b.Add(srv.Sender("1"), ambidata.Data{D1: ambidata.Just(1.0)}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := b.Close(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestBatcherMaxPending(t *testing.T) {
+	srv := ambimock.New(t)
+	srv.AddChannel(&ambimock.Channel{Info: ambidata.ChannelInfo{Ch: "1"}, WriteKey: "w1"})
+	block := make(chan struct{})
+	srv.Hook = func(r *http.Request) int {
+		<-block
+		return 0
+	}
+
+	var errs []error
+	var mu sync.Mutex
+	b := &Batcher{
+		Interval:   time.Millisecond,
+		MaxPending: 2,
+		OnError: func(ch string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			errs = append(errs, err)
+		},
+	}
+	t0 := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	for i := range 3 {
+		if err := b.Add(srv.Sender("1"), ambidata.Data{Created: t0.Add(time.Duration(i) * time.Second)}); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	if got := b.Pending("1"); got != 2 {
+		t.Errorf("pending: expected 2, got %d", got)
+	}
+	close(block)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := b.Close(ctx); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], ErrQueueFull) {
+		t.Errorf("expected [ErrQueueFull], got %v", errs)
+	}
+}
+
+func TestBatcherAddDuringSend(t *testing.T) {
+	srv := ambimock.New(t)
+	srv.AddChannel(&ambimock.Channel{Info: ambidata.ChannelInfo{Ch: "1"}, WriteKey: "w1"})
+	sending := make(chan struct{})
+	block := make(chan struct{})
+	var once sync.Once
+	srv.Hook = func(r *http.Request) int {
+		once.Do(func() {
+			close(sending)
+			<-block
+		})
+		return 0
+	}
+
+	b := &Batcher{Interval: time.Millisecond}
+	t0 := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	d1 := ambidata.Data{Created: t0.Add(time.Second), D1: ambidata.Just(1.0)}
+	if err := b.Add(srv.Sender("1"), d1); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	<-sending
+
+	// 送信中のデータポイントより古いデータポイントを追加する
+	d0 := ambidata.Data{Created: t0, D1: ambidata.Just(0.0)}
+	if err := b.Add(srv.Sender("1"), d0); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if got := b.Pending("1"); got != 2 {
+		t.Errorf("pending: expected 2, got %d", got)
+	}
+	close(block)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := b.Close(ctx); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if diff := cmp.Diff([]ambidata.Data{d0, d1}, srv.Data("1")); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,119 @@
+// Package snappy は、Snappy 圧縮のブロック形式の最小限の実装を提供します。
+//
+// Prometheus の remote write プロトコルで使用されるブロック形式
+// (フレーミング形式ではない) のみに対応しています。
+// 圧縮 ([Encode]) は無圧縮のリテラルのみを出力する簡易的なものです。
+package snappy
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	ErrCorrupt  = errors.New("snappy: corrupt input")
+	ErrTooLarge = errors.New("snappy: decoded block is too large")
+)
+
+// MaxDecodedLen は [Decode] が受け付ける展開後の最大サイズです。
+const MaxDecodedLen = 32 << 20
+
+// Decode はブロック形式で圧縮されたデータ src を展開します。
+func Decode(src []byte) ([]byte, error) {
+	n, k := binary.Uvarint(src)
+	if k <= 0 {
+		return nil, ErrCorrupt
+	}
+	if n > MaxDecodedLen {
+		return nil, ErrTooLarge
+	}
+	src = src[k:]
+	dst := make([]byte, 0, n)
+
+	for len(src) > 0 {
+		tag := src[0]
+		var length, offset int
+		switch tag & 0x03 {
+		case 0x00: // literal
+			length = int(tag >> 2)
+			src = src[1:]
+			if length >= 60 {
+				nb := length - 59
+				if len(src) < nb {
+					return nil, ErrCorrupt
+				}
+				length = 0
+				for i := nb - 1; i >= 0; i-- {
+					length = length<<8 | int(src[i])
+				}
+				src = src[nb:]
+			}
+			length++
+			if length <= 0 || len(src) < length || len(dst)+length > int(n) {
+				return nil, ErrCorrupt
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+
+		case 0x01: // copy with 1-byte offset
+			if len(src) < 2 {
+				return nil, ErrCorrupt
+			}
+			length = 4 + int(tag>>2)&0x07
+			offset = int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+
+		case 0x02: // copy with 2-byte offset
+			if len(src) < 3 {
+				return nil, ErrCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+
+		case 0x03: // copy with 4-byte offset
+			if len(src) < 5 {
+				return nil, ErrCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+
+		if offset <= 0 || offset > len(dst) || len(dst)+length > int(n) {
+			return nil, ErrCorrupt
+		}
+		// 領域が重なる場合があるため、1バイトずつコピーする
+		p := len(dst) - offset
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[p+i])
+		}
+	}
+
+	if len(dst) != int(n) {
+		return nil, ErrCorrupt
+	}
+	return dst, nil
+}
+
+// Encode は src をブロック形式で圧縮します。
+// 出力は無圧縮のリテラルのみで構成されます。
+func Encode(src []byte) []byte {
+	dst := binary.AppendUvarint(nil, uint64(len(src)))
+	for len(src) > 0 {
+		n := min(len(src), 1<<16)
+		m := n - 1
+		switch {
+		case m < 60:
+			dst = append(dst, byte(m)<<2)
+		case m < 1<<8:
+			dst = append(dst, 60<<2, byte(m))
+		default:
+			dst = append(dst, 61<<2, byte(m), byte(m>>8))
+		}
+		dst = append(dst, src[:n]...)
+		src = src[n:]
+	}
+	return dst
+}
@@ -0,0 +1,66 @@
+package snappy
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDecodeCopy(t *testing.T) {
+	// "abcd" のリテラルに続いて、offset=4, length=8 のコピー (1バイトオフセット)
+	in := []byte{12, 3 << 2, 'a', 'b', 'c', 'd', 0x01 | (8-4)<<2, 4}
+	want := []byte("abcdabcdabcd")
+
+	got, err := Decode(in)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestDecodeCopy2(t *testing.T) {
+	// "ab" のリテラルに続いて、offset=1, length=3 のコピー (2バイトオフセット)
+	in := []byte{5, 1 << 2, 'a', 'b', 0x02 | (3-1)<<2, 1, 0}
+	want := []byte("abbbb")
+
+	got, err := Decode(in)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, n := range []int{0, 1, 59, 60, 61, 255, 256, 300, 70000} {
+		in := make([]byte, n)
+		for i := range in {
+			in[i] = byte(i * 7)
+		}
+		got, err := Decode(Encode(in))
+		if err != nil {
+			t.Errorf("%d: %v", n, err)
+		} else if !bytes.Equal(got, in) {
+			t.Errorf("%d: mismatch", n)
+		}
+	}
+}
+
+func TestDecodeErrCorrupt(t *testing.T) {
+	tt := []struct {
+		name string
+		in   []byte
+	}{
+		{name: "Empty", in: nil},
+		{name: "ShortLiteral", in: []byte{4, 3 << 2, 'a'}},
+		{name: "BadOffset", in: []byte{8, 0 << 2, 'a', 0x01 | 0<<2, 2}},
+		{name: "LengthMismatch", in: []byte{3, 0 << 2, 'a'}},
+	}
+	for _, tc := range tt {
+		if _, err := Decode(tc.in); err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+// Package meter は、アプリケーションの指標 (KPI) を計測し、
+// 一定間隔で Ambient のチャネルに送信する機能を提供します。
+//
+// OpenTelemetry のメトリクス API (Meter と PeriodicReader と Exporter) を参考にした、
+// 外部ライブラリに依存しない簡易的な実装です。
+// 1つの [Exporter] は1つのチャネルに対応し、最大8つの計器 (instrument) を
+// データ1～8に割り当てることができます。
+// 計器の値はエクスポート間隔ごとに集約され、1つのデータポイントとして
+// [ambidata.Sender.Send] で送信されます。
+//
+// 計器の種類と、エクスポート時に送信される値は以下の通りです。
+//
+//   - [Counter]: 間隔内に加算された値の合計 (OpenTelemetry のデルタ集計に相当)
+//   - [UpDownCounter]: 加算された値の累計
+//   - [Gauge]: 間隔内に最後に記録された値
+//   - [Histogram]: 間隔内に記録された値の平均
+//
+// [Gauge] と [Histogram] は、間隔内に値が記録されなかった場合は送信されません。
+//
+// 使用例:
+//
+//	e := meter.New(ambidata.NewSender(ch, writeKey))
+//	reqs, _ := e.Counter("requests", ambidata.FieldD1)
+//	latency, _ := e.Histogram("latency_ms", ambidata.FieldD2)
+//	go e.Run(ctx)
+//	defer e.Shutdown(context.Background())
+//
+//	reqs.Add(1)
+//	latency.Record(12.5)
+package meter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+)
+
+// DefaultInterval は [Exporter.Interval] のデフォルト値です。
+const DefaultInterval = time.Minute
+
+// ErrShutdown は [Exporter.Shutdown] の後にエクスポートしようとした場合のエラーです。
+var ErrShutdown = errors.New("meter: exporter is shut down")
+
+// Exporter は計器の値を集約し、Ambient のチャネルに送信します。
+//
+// Exporter と計器のメソッドは複数の goroutine から同時に呼び出すことができます。
+// ただし、フィールドは使用を開始した後に変更しないでください。
+type Exporter struct {
+	// Sender は送信先のチャネルの [ambidata.Sender] です。
+	Sender *ambidata.Sender
+
+	// Interval は [Exporter.Run] がエクスポートする間隔です。
+	// 0 以下の場合は、 [DefaultInterval] が使用されます。
+	// [ambidata.MinSendInterval] 未満の場合は、 [ambidata.MinSendInterval] が使用されます。
+	// 1日あたりのデータポイント数の制限 ([ambidata.MaxDataPerDay]) を超えないよう、
+	// 29秒以上の値を推奨します。
+	Interval time.Duration
+
+	// OnError は [Exporter.Run] によるエクスポートでエラーが発生した場合に呼び出されます。
+	// nil の場合は、エラーは無視されます。
+	OnError func(err error)
+
+	// Now は現在時刻を返す関数です。送信するデータポイントの時刻に使用します。
+	// nil の場合は、 [time.Now] が使用されます。
+	Now func() time.Time
+
+	mu          sync.Mutex
+	instruments [len(ambidata.Fields)]*instrument
+	shutdown    bool
+}
+
+// New は新しい [Exporter] を作成します。
+func New(s *ambidata.Sender) *Exporter {
+	return &Exporter{Sender: s}
+}
+
+type kind int
+
+const (
+	kindCounter kind = iota
+	kindUpDownCounter
+	kindGauge
+	kindHistogram
+)
+
+type instrument struct {
+	name string
+	kind kind
+
+	sum   float64 // Counter, UpDownCounter, Histogram
+	count int     // Gauge, Histogram
+	last  float64 // Gauge
+}
+
+// Counter は単調増加する値を計測する計器です。
+// エクスポート時には、前回のエクスポートから加算された値の合計が送信されます。
+type Counter struct {
+	e    *Exporter
+	inst *instrument
+}
+
+// Add は値を加算します。負の値は無視されます。
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		return
+	}
+	c.e.mu.Lock()
+	defer c.e.mu.Unlock()
+	c.inst.sum += v
+}
+
+// UpDownCounter は増減する値を計測する計器です。
+// エクスポート時には、加算された値の累計が送信されます。
+type UpDownCounter struct {
+	e    *Exporter
+	inst *instrument
+}
+
+// Add は値を加算します。
+func (c *UpDownCounter) Add(v float64) {
+	c.e.mu.Lock()
+	defer c.e.mu.Unlock()
+	c.inst.sum += v
+}
+
+// Gauge は現在の値を計測する計器です。
+// エクスポート時には、前回のエクスポートから最後に記録された値が送信されます。
+type Gauge struct {
+	e    *Exporter
+	inst *instrument
+}
+
+// Record は値を記録します。
+func (g *Gauge) Record(v float64) {
+	g.e.mu.Lock()
+	defer g.e.mu.Unlock()
+	g.inst.last = v
+	g.inst.count++
+}
+
+// Histogram は値の分布を計測する計器です。
+// エクスポート時には、前回のエクスポートから記録された値の平均が送信されます。
+type Histogram struct {
+	e    *Exporter
+	inst *instrument
+}
+
+// Record は値を記録します。
+func (h *Histogram) Record(v float64) {
+	h.e.mu.Lock()
+	defer h.e.mu.Unlock()
+	h.inst.sum += v
+	h.inst.count++
+}
+
+// Counter はデータ番号 f に割り当てた [Counter] を作成します。
+func (e *Exporter) Counter(name string, f ambidata.Field) (*Counter, error) {
+	inst, err := e.register(name, f, kindCounter)
+	if err != nil {
+		return nil, err
+	}
+	return &Counter{e: e, inst: inst}, nil
+}
+
+// UpDownCounter はデータ番号 f に割り当てた [UpDownCounter] を作成します。
+func (e *Exporter) UpDownCounter(name string, f ambidata.Field) (*UpDownCounter, error) {
+	inst, err := e.register(name, f, kindUpDownCounter)
+	if err != nil {
+		return nil, err
+	}
+	return &UpDownCounter{e: e, inst: inst}, nil
+}
+
+// Gauge はデータ番号 f に割り当てた [Gauge] を作成します。
+func (e *Exporter) Gauge(name string, f ambidata.Field) (*Gauge, error) {
+	inst, err := e.register(name, f, kindGauge)
+	if err != nil {
+		return nil, err
+	}
+	return &Gauge{e: e, inst: inst}, nil
+}
+
+// Histogram はデータ番号 f に割り当てた [Histogram] を作成します。
+func (e *Exporter) Histogram(name string, f ambidata.Field) (*Histogram, error) {
+	inst, err := e.register(name, f, kindHistogram)
+	if err != nil {
+		return nil, err
+	}
+	return &Histogram{e: e, inst: inst}, nil
+}
+
+func (e *Exporter) register(name string, f ambidata.Field, k kind) (*instrument, error) {
+	if !f.IsValid() {
+		return nil, fmt.Errorf("meter: instrument %q: invalid field %v", name, f)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if prev := e.instruments[f-1]; prev != nil {
+		return nil, fmt.Errorf("meter: instrument %q: field %v is already used by %q", name, f, prev.name)
+	}
+	inst := &instrument{name: name, kind: k}
+	e.instruments[f-1] = inst
+	return inst, nil
+}
+
+// Instruments はデータ番号ごとの計器の名前を返します。
+// 計器が割り当てられていないデータ番号は含まれません。
+// [ambidata.ChannelInfo] のデータ名の設定に利用できます。
+func (e *Exporter) Instruments() map[ambidata.Field]string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ret := map[ambidata.Field]string{}
+	for i, inst := range e.instruments {
+		if inst != nil {
+			ret[ambidata.Fields[i]] = inst.name
+		}
+	}
+	return ret
+}
+
+// collect は計器の値を集約したデータポイントを返し、間隔ごとの状態をリセットします。
+// e.mu をロックした状態で呼び出してください。
+func (e *Exporter) collect() (ambidata.Data, bool) {
+	var data ambidata.Data
+	ok := false
+	for i, inst := range e.instruments {
+		if inst == nil {
+			continue
+		}
+
+		var v float64
+		switch inst.kind {
+		case kindCounter:
+			v = inst.sum
+			inst.sum = 0
+		case kindUpDownCounter:
+			v = inst.sum
+		case kindGauge:
+			if inst.count == 0 {
+				continue
+			}
+			v = inst.last
+			inst.count = 0
+		case kindHistogram:
+			if inst.count == 0 {
+				continue
+			}
+			v = inst.sum / float64(inst.count)
+			inst.sum, inst.count = 0, 0
+		}
+		data.SetField(ambidata.Fields[i], ambidata.Just(v))
+		ok = true
+	}
+	return data, ok
+}
+
+// ForceFlush は現在の計器の値を集約し、すぐに送信します。
+// 送信に失敗した場合、その間隔の値は失われます。
+func (e *Exporter) ForceFlush(ctx context.Context) error {
+	e.mu.Lock()
+	if e.shutdown {
+		e.mu.Unlock()
+		return ErrShutdown
+	}
+	data, ok := e.collect()
+	e.mu.Unlock()
+	return e.send(ctx, data, ok)
+}
+
+func (e *Exporter) send(ctx context.Context, data ambidata.Data, ok bool) error {
+	if !ok {
+		return nil
+	}
+	data.Created = e.now().Truncate(time.Millisecond)
+	if err := e.Sender.Send(ctx, data); err != nil {
+		return fmt.Errorf("meter: %w", err)
+	}
+	return nil
+}
+
+// Run は [Exporter.Interval] ごとに [Exporter.ForceFlush] を呼び出します。
+// ctx がキャンセルされるか、 [Exporter.Shutdown] が呼び出されるまで戻りません。
+// 戻り値は ctx.Err() または [ErrShutdown] です。
+func (e *Exporter) Run(ctx context.Context) error {
+	interval := e.Interval
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	interval = max(interval, ambidata.MinSendInterval)
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			err := e.ForceFlush(ctx)
+			if errors.Is(err, ErrShutdown) {
+				return err
+			}
+			if err != nil && e.OnError != nil {
+				e.OnError(err)
+			}
+		}
+	}
+}
+
+// Shutdown は残っている計器の値を送信し、以降のエクスポートを停止します。
+// Shutdown の後も計器のメソッドを呼び出すことはできますが、値は送信されません。
+func (e *Exporter) Shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	if e.shutdown {
+		e.mu.Unlock()
+		return nil
+	}
+	e.shutdown = true
+	data, ok := e.collect()
+	e.mu.Unlock()
+	return e.send(ctx, data, ok)
+}
+
+func (e *Exporter) now() time.Time {
+	if e.Now == nil {
+		return time.Now()
+	}
+	return e.Now()
+}
@@ -0,0 +1,112 @@
+package meter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/internal/ambimock"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestExporter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := ambimock.New(t)
+	srv.AddChannel(&ambimock.Channel{Info: ambidata.ChannelInfo{Ch: "100"}, WriteKey: "w100"})
+
+	now := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	e := New(srv.Sender("100"))
+	e.Now = func() time.Time { return now }
+
+	reqs, err := e.Counter("requests", ambidata.FieldD1)
+	if err != nil {
+		t.Fatalf("counter: %v", err)
+	}
+	conns, err := e.UpDownCounter("conns", ambidata.FieldD2)
+	if err != nil {
+		t.Fatalf("updowncounter: %v", err)
+	}
+	temp, err := e.Gauge("temp", ambidata.FieldD3)
+	if err != nil {
+		t.Fatalf("gauge: %v", err)
+	}
+	latency, err := e.Histogram("latency", ambidata.FieldD8)
+	if err != nil {
+		t.Fatalf("histogram: %v", err)
+	}
+	if _, err := e.Gauge("dup", ambidata.FieldD1); err == nil {
+		t.Errorf("duplicate field: expected error, got nil")
+	}
+	if _, err := e.Gauge("invalid", ambidata.Field(9)); err == nil {
+		t.Errorf("invalid field: expected error, got nil")
+	}
+
+	wantNames := map[ambidata.Field]string{
+		ambidata.FieldD1: "requests",
+		ambidata.FieldD2: "conns",
+		ambidata.FieldD3: "temp",
+		ambidata.FieldD8: "latency",
+	}
+	if diff := cmp.Diff(wantNames, e.Instruments()); diff != "" {
+		t.Errorf("instruments: mismatch (-want, +got):\n%s", diff)
+	}
+
+	reqs.Add(1)
+	reqs.Add(2)
+	reqs.Add(-5)
+	conns.Add(3)
+	conns.Add(-1)
+	temp.Record(20)
+	temp.Record(21)
+	latency.Record(10)
+	latency.Record(20)
+	if err := e.ForceFlush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	now = now.Add(time.Minute)
+	conns.Add(1)
+	if err := e.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if err := e.ForceFlush(ctx); !errors.Is(err, ErrShutdown) {
+		t.Errorf("flush after shutdown: expected ErrShutdown, got %v", err)
+	}
+
+	t0 := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	want := []ambidata.Data{
+		{
+			Created: t0,
+			D1:      ambidata.Just(3.0),
+			D2:      ambidata.Just(2.0),
+			D3:      ambidata.Just(21.0),
+			D8:      ambidata.Just(15.0),
+		},
+		{
+			Created: t0.Add(time.Minute),
+			D1:      ambidata.Just(0.0),
+			D2:      ambidata.Just(3.0),
+		},
+	}
+	if diff := cmp.Diff(want, srv.Data("100")); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestExporterEmpty(t *testing.T) {
+	srv := ambimock.New(t)
+	e := New(srv.Sender("100"))
+	if _, err := e.Gauge("temp", ambidata.FieldD1); err != nil {
+		t.Fatalf("gauge: %v", err)
+	}
+	if err := e.ForceFlush(context.Background()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if n := len(srv.Requests()); n != 0 {
+		t.Errorf("expected no requests, got %d", n)
+	}
+}
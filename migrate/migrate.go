@@ -0,0 +1,241 @@
+// Package migrate は、チャネルのデータを別のチャネルにコピーする機能を提供します。
+//
+// [Copy] はコピー元の [ambidata.Fetcher] でデータを取得し、 [Options] の設定に従って
+// 期間の絞り込み、データ番号の付け替え、非表示のデータポイントの選別を行った後、
+// [archive.Restore] でコピー先の [ambidata.Sender] に送信します。
+// 送信間隔と一日あたりのデータ数の制限は [archive.Restore] と同様に守られ、
+// 進捗ファイルを指定すれば中断したコピーを再開できます。
+// コピー先の [ambidata.Fetcher] を指定した場合は、コピーした後にデータを取得し直して照合します。
+//
+// 使用例:
+//
+//	res, err := migrate.Copy(ctx, src, dst, dstFetcher, &migrate.Options{
+//		Fields: map[ambidata.Field]ambidata.Field{ambidata.FieldD3: ambidata.FieldD1},
+//		Hidden: migrate.HiddenSkip,
+//	})
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/archive"
+)
+
+// ErrVerify はコピー先のデータがコピーしたデータと一致しない場合のエラーです。
+var ErrVerify = errors.New("migrate: verification failed")
+
+// HiddenFilter は非表示のデータポイント ([ambidata.Data.Hide]) の扱いを表す型です。
+type HiddenFilter int
+
+const (
+	HiddenKeep HiddenFilter = iota // 非表示のデータポイントもコピーする
+	HiddenSkip                     // 非表示のデータポイントをコピーしない
+	HiddenOnly                     // 非表示のデータポイントのみをコピーする
+)
+
+// ParseHiddenFilter は "keep", "skip", "only" のいずれかの文字列を [HiddenFilter] に変換します。
+func ParseHiddenFilter(s string) (HiddenFilter, error) {
+	switch s {
+	case "keep":
+		return HiddenKeep, nil
+	case "skip":
+		return HiddenSkip, nil
+	case "only":
+		return HiddenOnly, nil
+	default:
+		return 0, fmt.Errorf("migrate: ParseHiddenFilter: invalid filter %q", s)
+	}
+}
+
+// Options はコピーに関する設定です。
+// ゼロ値の Options 構造体は、全てのデータをそのままコピーする有効な構成となります。
+type Options struct {
+	// Start と End はコピーするデータの期間です。
+	// Start がゼロ値の場合は UNIX 時刻の 0 が、End がゼロ値の場合は現在時刻の1日後が使用されます。
+	Start time.Time
+	End   time.Time
+
+	// Fields はコピー元のデータ番号からコピー先のデータ番号への対応です。
+	// 対応が無いデータ番号の値はコピーしません。
+	// nil の場合は、全てのデータ番号を同じ番号にコピーします。
+	Fields map[ambidata.Field]ambidata.Field
+
+	// Hidden は非表示のデータポイントの扱いです。
+	Hidden HiddenFilter
+
+	// DryRun が true の場合、コピーするデータを決定するだけで、送信は行いません。
+	DryRun bool
+
+	// Restore はコピー先への送信に関する設定です。
+	// 進捗ファイル ([archive.RestoreOptions.ProgressFile]) を指定した場合、中断したコピーを再開できます。
+	// 再開するには、コピー元のデータと Options が前回と同じである必要があります。
+	// コピー元にデータが送信され続けている場合は、End を指定してください。
+	Restore archive.RestoreOptions
+
+	// Now は現在時刻を返す関数です。
+	// nil の場合は、 [time.Now] が使用されます。
+	Now func() time.Time
+}
+
+// Result はコピーの結果です。
+type Result struct {
+	// Data はコピーした (DryRun の場合はコピーする) データポイントです。古いものから順に並びます。
+	Data []ambidata.Data
+
+	// Progress はコピー先への送信の進捗です。
+	// DryRun の場合は nil です。
+	Progress *archive.Progress
+
+	// Verification はコピー先の照合結果です。
+	// DryRun の場合や、コピー先の [ambidata.Fetcher] が指定されなかった場合は nil です。
+	Verification *Verification
+}
+
+// Copy は src のチャネルのデータを dst のチャネルにコピーします。
+// opt が nil の場合は、デフォルトの設定が使用されます。
+//
+// dstFetcher が nil でない場合は、コピーした後にコピー先のデータを取得し直して [Verify] で照合し、
+// 一致しない場合は [ErrVerify] を返します。
+//
+// エラーが発生した場合も、それまでの結果を返します。
+func Copy(ctx context.Context, src *ambidata.Fetcher, dst *ambidata.Sender, dstFetcher *ambidata.Fetcher, opt *Options) (*Result, error) {
+	if opt == nil {
+		opt = &Options{}
+	}
+
+	arr, err := Plan(ctx, src, opt)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{Data: arr}
+	if opt.DryRun {
+		return res, nil
+	}
+
+	ropt := opt.Restore
+	if ropt.Now == nil {
+		ropt.Now = opt.Now
+	}
+	res.Progress, err = archive.Restore(ctx, dst, arr, &ropt)
+	if err != nil {
+		return res, err
+	}
+
+	if dstFetcher == nil {
+		return res, nil
+	}
+	res.Verification, err = Verify(ctx, dstFetcher, arr)
+	if err != nil {
+		return res, err
+	}
+	if !res.Verification.OK() {
+		return res, fmt.Errorf("%w: %s", ErrVerify, res.Verification)
+	}
+	return res, nil
+}
+
+// Plan は src のチャネルからデータを取得し、 opt に従ってコピーするデータポイントを決定します。
+// データポイントは古いものから順に並びます。
+func Plan(ctx context.Context, src *ambidata.Fetcher, opt *Options) ([]ambidata.Data, error) {
+	if opt == nil {
+		opt = &Options{}
+	}
+	err := validateFields(opt.Fields)
+	if err != nil {
+		return nil, err
+	}
+
+	start := opt.Start
+	if start.IsZero() {
+		start = time.Unix(0, 0)
+	}
+	end := opt.End
+	if end.IsZero() {
+		now := time.Now()
+		if opt.Now != nil {
+			now = opt.Now()
+		}
+		end = now.Add(24 * time.Hour)
+	}
+
+	fetched, err := src.FetchPeriodAll(ctx, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	arr := make([]ambidata.Data, 0, len(fetched))
+	for i := len(fetched) - 1; i >= 0; i-- {
+		data := &fetched[i]
+		switch {
+		case opt.Hidden == HiddenSkip && data.Hide:
+			continue
+		case opt.Hidden == HiddenOnly && !data.Hide:
+			continue
+		}
+		arr = append(arr, remap(data, opt.Fields))
+	}
+	return arr, nil
+}
+
+func validateFields(m map[ambidata.Field]ambidata.Field) error {
+	used := map[ambidata.Field]ambidata.Field{}
+	for from, to := range m {
+		if !from.IsValid() || !to.IsValid() {
+			return fmt.Errorf("migrate: invalid field mapping %v -> %v", from, to)
+		}
+		if prev, ok := used[to]; ok {
+			return fmt.Errorf("migrate: both %v and %v are mapped to %v", min(prev, from), max(prev, from), to)
+		}
+		used[to] = from
+	}
+	return nil
+}
+
+func remap(data *ambidata.Data, m map[ambidata.Field]ambidata.Field) ambidata.Data {
+	if m == nil {
+		return *data
+	}
+	ret := ambidata.Data{
+		Created: data.Created,
+		Loc:     data.Loc,
+		Cmnt:    data.Cmnt,
+		Hide:    data.Hide,
+	}
+	for from, to := range m {
+		ret.SetField(to, data.Field(from))
+	}
+	return ret
+}
+
+// ParseFields は "d3=d1,d1=d2" の形式の文字列を、コピー元からコピー先へのデータ番号の対応に変換します。
+func ParseFields(s string) (map[ambidata.Field]ambidata.Field, error) {
+	m := map[ambidata.Field]ambidata.Field{}
+	for item := range strings.SplitSeq(s, ",") {
+		fromStr, toStr, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			return nil, fmt.Errorf("migrate: ParseFields: %q: expected FROM=TO", item)
+		}
+		from, err := ambidata.ParseField(fromStr)
+		if err != nil {
+			return nil, fmt.Errorf("migrate: ParseFields: %w", err)
+		}
+		to, err := ambidata.ParseField(toStr)
+		if err != nil {
+			return nil, fmt.Errorf("migrate: ParseFields: %w", err)
+		}
+		if _, ok := m[from]; ok {
+			return nil, fmt.Errorf("migrate: ParseFields: %v is mapped more than once", from)
+		}
+		m[from] = to
+	}
+	err := validateFields(m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
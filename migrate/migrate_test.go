@@ -0,0 +1,169 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/archive"
+	"github.com/gcrtnst/ambidata/internal/ambimock"
+	"github.com/google/go-cmp/cmp"
+)
+
+var now = time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+
+func newServer(t *testing.T) *ambimock.Server {
+	s := ambimock.New(t)
+	src := &ambimock.Channel{Info: ambidata.ChannelInfo{Ch: "1"}, ReadKey: "rk1", WriteKey: "wk1"}
+	for i := range 10 {
+		src.Data = append(src.Data, ambidata.Data{
+			Created: now.Add(time.Duration(i-10) * time.Minute),
+			D1:      ambidata.Just(float64(i)),
+			D3:      ambidata.Just(float64(i * 10)),
+			Hide:    i%3 == 0,
+		})
+	}
+	src.Data[1].Cmnt = "c"
+	src.Data[2].Loc = ambidata.Just(ambidata.Location{Lat: 35, Lng: 139})
+	s.AddChannel(src)
+	s.AddChannel(&ambimock.Channel{Info: ambidata.ChannelInfo{Ch: "2"}, ReadKey: "rk2", WriteKey: "wk2"})
+	return s
+}
+
+func fastRestore() archive.RestoreOptions {
+	return archive.RestoreOptions{Interval: time.Millisecond, AnnotateInterval: time.Millisecond}
+}
+
+func TestPlan(t *testing.T) {
+	s := newServer(t)
+	all := s.Data("1")
+
+	tests := []struct {
+		name string
+		opt  Options
+		want []ambidata.Data
+	}{
+		{
+			name: "all",
+			want: all,
+		},
+		{
+			name: "period",
+			opt:  Options{Start: all[2].Created, End: all[4].Created},
+			want: all[2:5],
+		},
+		{
+			name: "hidden-skip",
+			opt:  Options{Hidden: HiddenSkip},
+			want: []ambidata.Data{all[1], all[2], all[4], all[5], all[7], all[8]},
+		},
+		{
+			name: "hidden-only",
+			opt:  Options{Hidden: HiddenOnly},
+			want: []ambidata.Data{all[0], all[3], all[6], all[9]},
+		},
+		{
+			name: "fields",
+			opt:  Options{Start: all[2].Created, End: all[2].Created.Add(time.Millisecond), Fields: map[ambidata.Field]ambidata.Field{ambidata.FieldD3: ambidata.FieldD1}},
+			want: []ambidata.Data{{Created: all[2].Created, D1: ambidata.Just(20.0), Loc: all[2].Loc}},
+		},
+	}
+
+	for _, tt := range tests {
+		tt.opt.Now = func() time.Time { return now }
+		got, err := Plan(context.Background(), s.Fetcher("1"), &tt.opt)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("%s: mismatch (-want, +got):\n%s", tt.name, diff)
+		}
+	}
+}
+
+func TestCopy(t *testing.T) {
+	s := newServer(t)
+
+	res, err := Copy(context.Background(), s.Fetcher("1"), s.Sender("2"), s.Fetcher("2"), &Options{Restore: fastRestore()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(s.Data("1"), s.Data("2")); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+	if res.Verification == nil || !res.Verification.OK() || res.Verification.Checked != 10 {
+		t.Errorf("unexpected verification: %+v", res.Verification)
+	}
+	if !res.Progress.Done() {
+		t.Errorf("expected progress to be done, got %+v", res.Progress)
+	}
+}
+
+func TestCopyDryRun(t *testing.T) {
+	s := newServer(t)
+
+	res, err := Copy(context.Background(), s.Fetcher("1"), s.Sender("2"), s.Fetcher("2"), &Options{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Data) != 10 {
+		t.Errorf("expected 10 data points, got %d", len(res.Data))
+	}
+	for _, req := range s.Requests() {
+		if req.Method != http.MethodGet {
+			t.Errorf("unexpected %s request", req.Method)
+		}
+	}
+	if n := len(s.Data("2")); n != 0 {
+		t.Errorf("expected no data to be copied, got %d", n)
+	}
+}
+
+func TestCopyErrVerify(t *testing.T) {
+	s := newServer(t)
+	// 表示/非表示状態の設定が反映されない
+	s.Hook = func(r *http.Request) int {
+		if r.Method == http.MethodPut {
+			return http.StatusOK
+		}
+		return 0
+	}
+
+	res, err := Copy(context.Background(), s.Fetcher("1"), s.Sender("2"), s.Fetcher("2"), &Options{Restore: fastRestore()})
+	if !errors.Is(err, ErrVerify) {
+		t.Fatalf("expected ErrVerify, got %v", err)
+	}
+	v := res.Verification
+	if len(v.Missing) != 0 || len(v.Changed) != 4 {
+		t.Errorf("unexpected verification: %v", v)
+	}
+}
+
+func TestParseFields(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    map[ambidata.Field]ambidata.Field
+		wantErr bool
+	}{
+		{in: "d3=d1", want: map[ambidata.Field]ambidata.Field{ambidata.FieldD3: ambidata.FieldD1}},
+		{in: "d3=d1, D1=d2", want: map[ambidata.Field]ambidata.Field{ambidata.FieldD3: ambidata.FieldD1, ambidata.FieldD1: ambidata.FieldD2}},
+		{in: "d3", wantErr: true},
+		{in: "d9=d1", wantErr: true},
+		{in: "d1=d3,d2=d3", wantErr: true},
+		{in: "d1=d3,d1=d2", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseFields(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: unexpected error: %v", tt.in, err)
+			continue
+		}
+		if diff := cmp.Diff(tt.want, got); !tt.wantErr && diff != "" {
+			t.Errorf("%q: mismatch (-want, +got):\n%s", tt.in, diff)
+		}
+	}
+}
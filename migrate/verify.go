@@ -0,0 +1,95 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+)
+
+// Verification はコピー先のデータの照合結果です。
+type Verification struct {
+	Checked int         // 照合したデータポイントの数
+	Missing []time.Time // コピー先に存在しないデータポイントの時刻
+	Changed []time.Time // コピー先で内容が異なるデータポイントの時刻
+}
+
+// OK は全てのデータポイントが一致した場合に true を返します。
+func (v *Verification) OK() bool {
+	return len(v.Missing) == 0 && len(v.Changed) == 0
+}
+
+func (v *Verification) String() string {
+	return fmt.Sprintf("%d checked, %d missing, %d changed", v.Checked, len(v.Missing), len(v.Changed))
+}
+
+// Verify は want の各データポイントがコピー先に存在し、内容が一致することを確認します。
+// データポイントは時刻 (ミリ秒単位) で対応付け、データ1～8の値、位置情報、コメント、
+// 表示/非表示状態を比較します。コピー先にのみ存在するデータポイントは無視します。
+func Verify(ctx context.Context, dst *ambidata.Fetcher, want []ambidata.Data) (*Verification, error) {
+	v := &Verification{Missing: []time.Time{}, Changed: []time.Time{}}
+	if len(want) <= 0 {
+		return v, nil
+	}
+
+	start, end := want[0].Created, want[0].Created
+	for i := range want {
+		start = minTime(start, want[i].Created)
+		end = maxTime(end, want[i].Created)
+	}
+	got, err := dst.FetchPeriodAll(ctx, start, end.Add(time.Millisecond))
+	if err != nil {
+		return nil, err
+	}
+
+	index := make(map[int64][]*ambidata.Data, len(got))
+	for i := range got {
+		k := got[i].Created.UnixMilli()
+		index[k] = append(index[k], &got[i])
+	}
+	for i := range want {
+		w := &want[i]
+		candidates := index[w.Created.UnixMilli()]
+		switch {
+		case len(candidates) == 0:
+			v.Missing = append(v.Missing, w.Created)
+		case !containsEqual(candidates, w):
+			v.Changed = append(v.Changed, w.Created)
+		}
+		v.Checked++
+	}
+	return v, nil
+}
+
+func containsEqual(candidates []*ambidata.Data, w *ambidata.Data) bool {
+	for _, g := range candidates {
+		if equal(g, w) {
+			return true
+		}
+	}
+	return false
+}
+
+func equal(a *ambidata.Data, b *ambidata.Data) bool {
+	for _, f := range ambidata.Fields {
+		if a.Field(f) != b.Field(f) {
+			return false
+		}
+	}
+	return a.Loc == b.Loc && a.Cmnt == b.Cmnt && a.Hide == b.Hide
+}
+
+func minTime(a time.Time, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
+
+func maxTime(a time.Time, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,505 @@
+// Package mqttbridge は、MQTT ブローカーから購読したメッセージを
+// Ambient のチャネルに転送するブリッジを提供します。
+//
+// [Bridge] は [Mapping] に指定されたトピックフィルターを購読し、
+// JSON またはプレーンテキストのペイロードをデータポイントに変換します。
+// 時刻を含まないメッセージは、チャネルごとに [Bridge.Window] の間蓄積され、
+// 1つのデータポイントにまとめて送信されます。
+// 送信は送信間隔の制限 ([ambidata.MinSendInterval]) を守りながら [ambidata.Sender.SendBulk] で行われます。
+//
+// MQTT クライアントは [Client] インターフェースを介して使用します。
+// 本パッケージは特定の MQTT ライブラリに依存しません。
+// テスト用のインメモリのブローカーが [github.com/gcrtnst/ambidata/mqttbridge/mqtttest] にあります。
+//
+// 使用例:
+//
+//	b := &mqttbridge.Bridge{Client: client, Mappings: mappings, Sender: p.Sender}
+//	err := b.Run(ctx)
+//	// ...
+//	b.Close(context.Background())
+package mqttbridge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/internal/batch"
+)
+
+// DefaultWindow は [Bridge.Window] のデフォルト値です。
+// 1日あたりのデータポイント数は最大 2880 件となり、 [ambidata.MaxDataPerDay] を超えません。
+const DefaultWindow = 30 * time.Second
+
+// ErrClosed は [Bridge.Close] の後に [Bridge.Run] が呼び出された場合のエラーです。
+var ErrClosed = errors.New("mqttbridge: bridge is closed")
+
+// Message は MQTT のメッセージです。
+type Message struct {
+	Topic   string
+	Payload []byte
+}
+
+// Client は MQTT ブローカーへの接続を表すインターフェースです。
+// 既存の MQTT ライブラリをこのインターフェースに適合させて使用してください。
+type Client interface {
+	// Subscribe はトピックフィルター filter を購読し、受信したメッセージごとに handler を呼び出します。
+	// handler は複数の goroutine から同時に呼び出されても構いません。
+	Subscribe(ctx context.Context, filter string, handler func(Message)) error
+
+	// Unsubscribe はトピックフィルター filter の購読を解除します。
+	Unsubscribe(ctx context.Context, filter string) error
+}
+
+// Format はペイロードの形式です。
+type Format string
+
+const (
+	// FormatJSON は JSON オブジェクトのペイロードです。
+	FormatJSON Format = "json"
+
+	// FormatPlain は数値1つのみのテキストのペイロードです。
+	// "true" と "false" はそれぞれ 1 と 0 として扱います。
+	FormatPlain Format = "plain"
+)
+
+// Mapping はトピックをチャネルのデータに対応付ける設定です。
+type Mapping struct {
+	// Topic は購読するトピックフィルターです。
+	Topic string `json:"topic"`
+
+	// Channel は [SenderFunc] に渡すチャネル名です。
+	Channel string `json:"channel,omitempty"`
+
+	// ChannelLevel が 1 以上の場合、トピックのこの階層 (1 始まり) の文字列をチャネル名として使用します。
+	// 例えば "sensors/room1/env" で ChannelLevel が 2 の場合、チャネル名は "room1" です。
+	ChannelLevel int `json:"channelLevel,omitempty"`
+
+	// Format はペイロードの形式です。空文字列の場合は [FormatJSON] です。
+	Format Format `json:"format,omitempty"`
+
+	// Field は [FormatPlain] の値を設定するデータ番号です。
+	Field ambidata.Field `json:"field,omitempty"`
+
+	// Fields は [FormatJSON] のキーとデータ番号の対応です。
+	// キーは "." で区切ることで、入れ子のオブジェクトを参照できます。
+	// 数値と真偽値 (true は 1、false は 0) の値を転送できます。
+	Fields map[string]ambidata.Field `json:"fields,omitempty"`
+
+	// Lat と Lng は [FormatJSON] の緯度と経度のキーです。
+	// 両方の値が存在する場合、 [ambidata.Data.Loc] に設定します。
+	// 空文字列の場合は、それぞれ "lat" と "lng" が使用されます。
+	Lat string `json:"lat,omitempty"`
+	Lng string `json:"lng,omitempty"`
+
+	// Cmnt は [FormatJSON] のコメントのキーです。
+	// 空文字列の場合は、コメントを転送しません。
+	Cmnt string `json:"cmnt,omitempty"`
+
+	// Time は [FormatJSON] の時刻のキーです。
+	// 値は RFC 3339 形式の文字列、または UNIX 時刻 (秒) の数値です。
+	// 時刻を含むメッセージは蓄積されず、その時刻のデータポイントとして送信されます。
+	// 空文字列の場合は、時刻を読み取りません。
+	Time string `json:"time,omitempty"`
+}
+
+// ParseMappings は JSON 形式の [Mapping] の配列を読み込みます。
+//
+// 例:
+//
+//	[
+//	  {"topic": "sensors/+/env", "channelLevel": 2, "fields": {"temp": "d1", "humi": "d2"}},
+//	  {"topic": "home/power", "channel": "home", "format": "plain", "field": "d3"}
+//	]
+func ParseMappings(r io.Reader) ([]Mapping, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	var mappings []Mapping
+	if err := dec.Decode(&mappings); err != nil {
+		return nil, fmt.Errorf("mqttbridge: ParseMappings: %w", err)
+	}
+	for i := range mappings {
+		if err := mappings[i].validate(); err != nil {
+			return nil, fmt.Errorf("mqttbridge: ParseMappings: mappings[%d]: %w", i, err)
+		}
+	}
+	return mappings, nil
+}
+
+func (m *Mapping) validate() error {
+	if !ValidFilter(m.Topic) {
+		return fmt.Errorf("invalid topic filter %q", m.Topic)
+	}
+	if m.Channel == "" && m.ChannelLevel <= 0 {
+		return errors.New("channel or channelLevel must be specified")
+	}
+	switch m.Format {
+	case "", FormatJSON:
+		for k, f := range m.Fields {
+			if !f.IsValid() {
+				return fmt.Errorf("fields[%q]: invalid field %v", k, f)
+			}
+		}
+	case FormatPlain:
+		if !m.Field.IsValid() {
+			return fmt.Errorf("invalid field %v", m.Field)
+		}
+	default:
+		return fmt.Errorf("invalid format %q", m.Format)
+	}
+	return nil
+}
+
+func (m *Mapping) channel(topic string) string {
+	if m.ChannelLevel > 0 {
+		levels := strings.Split(topic, "/")
+		if m.ChannelLevel <= len(levels) && levels[m.ChannelLevel-1] != "" {
+			return levels[m.ChannelLevel-1]
+		}
+	}
+	return m.Channel
+}
+
+// decode はペイロードをデータポイントに変換します。
+// [ambidata.Data.Created] はペイロードに時刻が含まれる場合のみ設定されます。
+func (m *Mapping) decode(payload []byte) (ambidata.Data, error) {
+	var d ambidata.Data
+	if m.Format == FormatPlain {
+		v, ok := plainNumber(string(bytes.TrimSpace(payload)))
+		if !ok {
+			return ambidata.Data{}, fmt.Errorf("invalid number %q", payload)
+		}
+		d.SetField(m.Field, ambidata.Just(v))
+		return d, nil
+	}
+
+	var obj map[string]any
+	if err := json.Unmarshal(payload, &obj); err != nil {
+		return ambidata.Data{}, err
+	}
+	for k, f := range m.Fields {
+		if v, ok := number(lookup(obj, k)); ok {
+			d.SetField(f, ambidata.Just(v))
+		}
+	}
+	lat, latOK := number(lookup(obj, valueOr(m.Lat, "lat")))
+	lng, lngOK := number(lookup(obj, valueOr(m.Lng, "lng")))
+	if latOK && lngOK {
+		d.Loc = ambidata.Just(ambidata.Location{Lat: lat, Lng: lng})
+	}
+	if m.Cmnt != "" {
+		if s, ok := lookup(obj, m.Cmnt).(string); ok {
+			d.Cmnt = s
+		}
+	}
+	if m.Time != "" {
+		switch v := lookup(obj, m.Time).(type) {
+		case nil:
+		case string:
+			t, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				return ambidata.Data{}, fmt.Errorf("%s: %w", m.Time, err)
+			}
+			d.Created = t
+		case float64:
+			sec, frac := math.Modf(v)
+			d.Created = time.Unix(int64(sec), int64(frac*1e9))
+		default:
+			return ambidata.Data{}, fmt.Errorf("%s: invalid time %v", m.Time, v)
+		}
+	}
+	return d, nil
+}
+
+func lookup(obj map[string]any, key string) any {
+	var v any = obj
+	for k := range strings.SplitSeq(key, ".") {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
+
+func number(v any) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	default:
+		return 0, false
+	}
+}
+
+func plainNumber(s string) (float64, bool) {
+	switch s {
+	case "true":
+		return 1, true
+	case "false":
+		return 0, true
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, false
+	}
+	return v, true
+}
+
+// SenderFunc はチャネル名に対応する [ambidata.Sender] を返す関数です。
+// [config.Profile.Sender] をそのまま使用できます。
+//
+// [config.Profile.Sender]: https://pkg.go.dev/github.com/gcrtnst/ambidata/config#Profile.Sender
+type SenderFunc func(channel string) (*ambidata.Sender, error)
+
+// Bridge は MQTT のメッセージを Ambient に転送します。
+//
+// Bridge のメソッドは複数の goroutine から同時に呼び出すことができます。
+// ただし、フィールドは使用を開始した後に変更しないでください。
+type Bridge struct {
+	// Client は MQTT ブローカーへの接続です。
+	Client Client
+
+	// Mappings はトピックをチャネルのデータに対応付ける設定です。
+	Mappings []Mapping
+
+	// Sender はチャネル名に対応する [ambidata.Sender] を返す関数です。
+	// 同じチャネル名に対しては、成功するまでメッセージごとに呼び出され、成功した後は呼び出されません。
+	Sender SenderFunc
+
+	// Window は時刻を含まないメッセージを蓄積する期間です。
+	// 期間内に受信したメッセージは1つのデータポイントにまとめられます (後のメッセージの値が優先されます)。
+	// 0 以下の場合は、 [DefaultWindow] が使用されます。
+	Window time.Duration
+
+	// Interval は同一チャネルへの送信間隔です。
+	// 0 以下の場合は、 [ambidata.MinSendInterval] が使用されます。
+	Interval time.Duration
+
+	// OnError は転送中にエラーが発生した場合に呼び出されます。
+	// nil の場合は、エラーは無視されます。
+	OnError func(err error)
+
+	// Now は現在時刻を返す関数です。
+	// nil の場合は、 [time.Now] が使用されます。
+	Now func() time.Time
+
+	mu       sync.Mutex
+	batcher  *batch.Batcher
+	channels map[string]*channelState
+	closed   bool
+}
+
+type channelState struct {
+	Sender *ambidata.Sender
+	Open   *ambidata.Data // 蓄積中のデータポイント
+}
+
+// Run は全ての [Mapping] のトピックを購読し、 [Bridge.Window] ごとに蓄積したデータポイントを送信キューに渡します。
+// ctx がキャンセルされるまで戻りません。戻る前に購読を解除します。
+// 購読に失敗した場合は、そのエラーを返します。それ以外の場合、戻り値は ctx.Err() です。
+// キューに残ったデータポイントを送信するには、 [Bridge.Close] を呼び出してください。
+func (b *Bridge) Run(ctx context.Context) error {
+	b.mu.Lock()
+	closed := b.closed
+	b.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+
+	var subscribed []string
+	defer func() {
+		for _, filter := range subscribed {
+			if err := b.Client.Unsubscribe(context.WithoutCancel(ctx), filter); err != nil {
+				b.reportError(fmt.Errorf("mqttbridge: unsubscribe %q: %w", filter, err))
+			}
+		}
+	}()
+	for i := range b.Mappings {
+		m := &b.Mappings[i]
+		if err := b.Client.Subscribe(ctx, m.Topic, func(msg Message) { b.handle(m, msg) }); err != nil {
+			return fmt.Errorf("mqttbridge: subscribe %q: %w", m.Topic, err)
+		}
+		subscribed = append(subscribed, m.Topic)
+	}
+
+	window := b.Window
+	if window <= 0 {
+		window = DefaultWindow
+	}
+	t := time.NewTicker(window)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			b.Flush()
+		}
+	}
+}
+
+// HandleMessage は [Mapping] のトピックフィルターに一致するメッセージを処理します。
+// [Client] を介さずにメッセージを渡す場合に使用します。
+func (b *Bridge) HandleMessage(msg Message) {
+	for i := range b.Mappings {
+		if m := &b.Mappings[i]; MatchTopic(m.Topic, msg.Topic) {
+			b.handle(m, msg)
+		}
+	}
+}
+
+func (b *Bridge) handle(m *Mapping, msg Message) {
+	data, err := m.decode(msg.Payload)
+	if err != nil {
+		b.reportError(fmt.Errorf("mqttbridge: topic %q: %w", msg.Topic, err))
+		return
+	}
+	name := m.channel(msg.Topic)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	st := b.channel(name)
+	if st == nil {
+		return
+	}
+
+	if !data.Created.IsZero() {
+		data.Created = data.Created.Truncate(time.Millisecond)
+		b.add(st, data)
+		return
+	}
+	data.Created = b.now().Truncate(time.Millisecond)
+	if st.Open == nil {
+		st.Open = &data
+		return
+	}
+
+	// 蓄積中のデータポイントの時刻は、最後に受信したメッセージの時刻とする
+	open := *st.Open
+	open.Created = data.Created
+	st.Open = &batch.Merge([]ambidata.Data{open}, data)[0]
+}
+
+// channel はチャネル名に対応する状態を返します。 b.mu をロックした状態で呼び出してください。
+// Sender の取得に失敗した場合は、エラーを報告して nil を返します。
+// 失敗は記録しないため、次のメッセージで再び取得を試みます。
+func (b *Bridge) channel(name string) *channelState {
+	if st, ok := b.channels[name]; ok {
+		return st
+	}
+
+	var s *ambidata.Sender
+	var err error
+	switch {
+	case name == "":
+		err = errors.New("empty channel name")
+	case b.Sender == nil:
+		err = errors.New("Bridge.Sender is nil")
+	default:
+		s, err = b.Sender(name)
+	}
+	if err != nil {
+		b.reportError(fmt.Errorf("mqttbridge: channel %q: %w", name, err))
+		return nil
+	}
+
+	if b.channels == nil {
+		b.channels = map[string]*channelState{}
+	}
+	st := &channelState{Sender: s}
+	b.channels[name] = st
+	return st
+}
+
+// add はデータポイントを送信キューに追加します。 b.mu をロックした状態で呼び出してください。
+func (b *Bridge) add(st *channelState, data ambidata.Data) {
+	if b.batcher == nil {
+		b.batcher = &batch.Batcher{
+			Interval: b.Interval,
+			OnError: func(ch string, err error) {
+				b.reportError(fmt.Errorf("mqttbridge: ch %s: %w", ch, err))
+			},
+		}
+	}
+	if err := b.batcher.Add(st.Sender, data); err != nil {
+		b.reportError(fmt.Errorf("mqttbridge: ch %s: %w", st.Sender.Ch, err))
+	}
+}
+
+// Flush は蓄積中のデータポイントを送信キューに渡します。
+// 通常は [Bridge.Run] が [Bridge.Window] ごとに呼び出します。
+func (b *Bridge) Flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flush()
+}
+
+func (b *Bridge) flush() {
+	for _, st := range b.channels {
+		if st.Open != nil {
+			b.add(st, *st.Open)
+			st.Open = nil
+		}
+	}
+}
+
+// Close は新たなメッセージの処理を停止し、蓄積中のデータポイントとキューに残っているデータポイントを送信します。
+// 全てのデータポイントの送信が完了するか、ctx が終了するまで待機します。
+// 購読の解除は [Bridge.Run] が行います。
+func (b *Bridge) Close(ctx context.Context) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.flush()
+	b.closed = true
+	bt := b.batcher
+	b.mu.Unlock()
+
+	if bt == nil {
+		return nil
+	}
+	if err := bt.Close(ctx); err != nil {
+		return fmt.Errorf("mqttbridge: %w", err)
+	}
+	return nil
+}
+
+func (b *Bridge) now() time.Time {
+	if b.Now == nil {
+		return time.Now()
+	}
+	return b.Now()
+}
+
+func (b *Bridge) reportError(err error) {
+	if b.OnError != nil {
+		b.OnError(err)
+	}
+}
+
+func valueOr(v string, def string) string {
+	if v == "" {
+		return def
+	}
+	return v
+}
@@ -0,0 +1,251 @@
+package mqttbridge_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/internal/ambimock"
+	"github.com/gcrtnst/ambidata/mqttbridge"
+	"github.com/gcrtnst/ambidata/mqttbridge/mqtttest"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"a/b/c", "a/b/c", true},
+		{"a/b/c", "a/b", false},
+		{"a/b", "a/b/c", false},
+		{"a/+/c", "a/x/c", true},
+		{"a/+/c", "a//c", true},
+		{"a/+", "a/x/c", false},
+		{"a/#", "a/x/c", true},
+		{"a/#", "a", true},
+		{"#", "a/b", true},
+		{"+/+", "a/b", true},
+		{"#", "$SYS/x", false},
+		{"+/x", "$SYS/x", false},
+		{"$SYS/#", "$SYS/x", true},
+	}
+	for _, tt := range tests {
+		if got := mqttbridge.MatchTopic(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("%q %q: expected %t, got %t", tt.filter, tt.topic, tt.want, got)
+		}
+	}
+}
+
+func TestValidFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		{"a/b", true},
+		{"a/+/b", true},
+		{"a/#", true},
+		{"#", true},
+		{"", false},
+		{"a/#/b", false},
+		{"a/b+", false},
+		{"a#", false},
+	}
+	for _, tt := range tests {
+		if got := mqttbridge.ValidFilter(tt.filter); got != tt.want {
+			t.Errorf("%q: expected %t, got %t", tt.filter, tt.want, got)
+		}
+	}
+}
+
+func TestParseMappings(t *testing.T) {
+	in := `[{"topic":"sensors/+/env","channelLevel":2,"fields":{"temp":"d1"}},{"topic":"home/power","channel":"home","format":"plain","field":"d3"}]`
+	got, err := mqttbridge.ParseMappings(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []mqttbridge.Mapping{
+		{Topic: "sensors/+/env", ChannelLevel: 2, Fields: map[string]ambidata.Field{"temp": ambidata.FieldD1}},
+		{Topic: "home/power", Channel: "home", Format: mqttbridge.FormatPlain, Field: ambidata.FieldD3},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+
+	for _, in := range []string{
+		`[{"topic":"a/#/b","channel":"x"}]`,
+		`[{"topic":"a"}]`,
+		`[{"topic":"a","channel":"x","format":"plain"}]`,
+		`[{"topic":"a","channel":"x","format":"xml"}]`,
+		`[{"topic":"a","channel":"x","fields":{"v":"d9"}}]`,
+	} {
+		if _, err := mqttbridge.ParseMappings(strings.NewReader(in)); err == nil {
+			t.Errorf("%s: expected error, got nil", in)
+		}
+	}
+}
+
+func TestBridge(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := ambimock.New(t)
+	srv.AddChannel(&ambimock.Channel{Info: ambidata.ChannelInfo{Ch: "100"}, WriteKey: "w100"})
+	srv.AddChannel(&ambimock.Channel{Info: ambidata.ChannelInfo{Ch: "200"}, WriteKey: "w200"})
+	channels := map[string]string{"room1": "100", "home": "200"}
+
+	broker := mqtttest.NewBroker()
+	var mu sync.Mutex
+	now := time.Date(2006, 1, 2, 15, 4, 0, 0, time.UTC)
+	var errs []error
+	b := &mqttbridge.Bridge{
+		Client: broker.Client(),
+		Mappings: []mqttbridge.Mapping{
+			{Topic: "sensors/+/env", ChannelLevel: 2, Fields: map[string]ambidata.Field{"temp": ambidata.FieldD1, "env.humi": ambidata.FieldD2}, Cmnt: "note"},
+			{Topic: "sensors/+/gps", ChannelLevel: 2, Time: "ts"},
+			{Topic: "home/power", Channel: "home", Format: mqttbridge.FormatPlain, Field: ambidata.FieldD3},
+		},
+		Sender: func(channel string) (*ambidata.Sender, error) {
+			ch, ok := channels[channel]
+			if !ok {
+				return nil, errors.New("no such channel")
+			}
+			return srv.Sender(ch), nil
+		},
+		Window:   time.Hour,
+		Interval: time.Millisecond,
+		OnError: func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			errs = append(errs, err)
+		},
+		Now: func() time.Time {
+			mu.Lock()
+			defer mu.Unlock()
+			return now
+		},
+	}
+	advance := func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(d)
+	}
+
+	runCtx, stop := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() { done <- b.Run(runCtx) }()
+	for len(broker.Subscriptions()) < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// 蓄積期間中のメッセージは1つにまとめられる
+	broker.Publish("sensors/room1/env", []byte(`{"temp":20,"env":{"humi":50}}`), false)
+	advance(time.Second)
+	broker.Publish("sensors/room1/env", []byte(`{"temp":21,"note":"ok"}`), false)
+	broker.Publish("home/power", []byte(" 1200\n"), false)
+	b.Flush()
+	advance(time.Minute)
+	broker.Publish("home/power", []byte("true"), false)
+
+	// 時刻を含むメッセージはそのまま送信される
+	broker.Publish("sensors/room1/gps", []byte(`{"lat":35.5,"lng":139.5,"ts":"2006-01-02T15:00:00.123Z"}`), false)
+
+	// エラー
+	broker.Publish("sensors/room2/env", []byte(`{"temp":1}`), false)
+	broker.Publish("home/power", []byte("abc"), false)
+	broker.Publish("sensors/room1/env", []byte(`[1]`), false)
+
+	stop()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("run: expected Canceled, got %v", err)
+	}
+	if subs := broker.Subscriptions(); len(subs) != 0 {
+		t.Errorf("expected no subscriptions after run, got %v", subs)
+	}
+	if err := b.Close(ctx); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	t0 := time.Date(2006, 1, 2, 15, 4, 0, 0, time.UTC)
+	want100 := []ambidata.Data{
+		{Created: time.Date(2006, 1, 2, 15, 0, 0, 123000000, time.UTC), Loc: ambidata.Just(ambidata.Location{Lat: 35.5, Lng: 139.5})},
+		{Created: t0.Add(time.Second), D1: ambidata.Just(21.0), D2: ambidata.Just(50.0), Cmnt: "ok"},
+	}
+	if diff := cmp.Diff(want100, srv.Data("100")); diff != "" {
+		t.Errorf("ch 100: mismatch (-want, +got):\n%s", diff)
+	}
+	want200 := []ambidata.Data{
+		{Created: t0.Add(time.Second), D3: ambidata.Just(1200.0)},
+		{Created: t0.Add(time.Second + time.Minute), D3: ambidata.Just(1.0)},
+	}
+	if diff := cmp.Diff(want200, srv.Data("200")); diff != "" {
+		t.Errorf("ch 200: mismatch (-want, +got):\n%s", diff)
+	}
+	if len(errs) != 3 {
+		t.Errorf("expected 3 errors, got %v", errs)
+	}
+
+	if err := b.Run(ctx); !errors.Is(err, mqttbridge.ErrClosed) {
+		t.Errorf("run after close: expected ErrClosed, got %v", err)
+	}
+}
+
+type failClient struct{}
+
+func (failClient) Subscribe(context.Context, string, func(mqttbridge.Message)) error {
+	return errors.New("not connected")
+}
+
+func (failClient) Unsubscribe(context.Context, string) error { return nil }
+
+func TestBridgeSubscribeError(t *testing.T) {
+	b := &mqttbridge.Bridge{
+		Client:   failClient{},
+		Mappings: []mqttbridge.Mapping{{Topic: "a", Channel: "x"}},
+	}
+	err := b.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "not connected") {
+		t.Errorf("expected subscribe error, got %v", err)
+	}
+}
+
+func TestBridgeSenderRetry(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := ambimock.New(t)
+	srv.AddChannel(&ambimock.Channel{Info: ambidata.ChannelInfo{Ch: "100"}, WriteKey: "w100"})
+
+	// 1回目の Sender の取得は失敗する
+	calls := 0
+	var errs []error
+	b := &mqttbridge.Bridge{
+		Mappings: []mqttbridge.Mapping{{Topic: "power", Channel: "room", Format: mqttbridge.FormatPlain, Field: ambidata.FieldD1}},
+		Sender: func(channel string) (*ambidata.Sender, error) {
+			calls++
+			if calls == 1 {
+				return nil, errors.New("temporary failure")
+			}
+			return srv.Sender("100"), nil
+		},
+		Interval: time.Millisecond,
+		OnError:  func(err error) { errs = append(errs, err) },
+	}
+	b.HandleMessage(mqttbridge.Message{Topic: "power", Payload: []byte("1")})
+	b.HandleMessage(mqttbridge.Message{Topic: "power", Payload: []byte("2")})
+	if err := b.Close(ctx); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	if len(errs) != 1 {
+		t.Errorf("expected 1 error, got %v", errs)
+	}
+	if arr := srv.Data("100"); len(arr) != 1 || arr[0].D1 != ambidata.Just(2.0) {
+		t.Errorf("expected the second message to be sent, got %v", arr)
+	}
+}
@@ -0,0 +1,133 @@
+// Package mqtttest は、 [mqttbridge.Client] のテストに使用するインメモリの MQTT ブローカーを提供します。
+//
+// ネットワーク通信は行わず、 [Broker.Publish] で発行されたメッセージを
+// 一致する購読のハンドラーへ同期的に配送します。QoS やセッションは扱いません。
+package mqtttest
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gcrtnst/ambidata/mqttbridge"
+)
+
+// Broker はインメモリの MQTT ブローカーです。
+// ゼロ値の Broker は使用可能な状態です。
+type Broker struct {
+	mu       sync.Mutex
+	subs     []*subscription
+	retained map[string]mqttbridge.Message
+}
+
+type subscription struct {
+	client  *Client
+	filter  string
+	handler func(mqttbridge.Message)
+}
+
+// NewBroker は新しい [Broker] を作成します。
+func NewBroker() *Broker {
+	return &Broker{}
+}
+
+// Client は新しいクライアントを作成します。
+func (b *Broker) Client() *Client {
+	return &Client{broker: b}
+}
+
+// Publish はトピック topic にメッセージを発行します。
+// 一致する購読のハンドラーを呼び出し、全てのハンドラーが戻ってから戻ります。
+// retain が true の場合、メッセージを保持し、後から購読したクライアントにも配送します。
+// 空のペイロードで retain が true の場合、保持されたメッセージを削除します。
+func (b *Broker) Publish(topic string, payload []byte, retain bool) {
+	msg := mqttbridge.Message{Topic: topic, Payload: slices.Clone(payload)}
+
+	b.mu.Lock()
+	if retain {
+		if b.retained == nil {
+			b.retained = map[string]mqttbridge.Message{}
+		}
+		if len(payload) == 0 {
+			delete(b.retained, topic)
+		} else {
+			b.retained[topic] = msg
+		}
+	}
+	var handlers []func(mqttbridge.Message)
+	for _, s := range b.subs {
+		if mqttbridge.MatchTopic(s.filter, topic) {
+			handlers = append(handlers, s.handler)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, h := range handlers {
+		h(msg)
+	}
+}
+
+// Subscriptions は現在購読されているトピックフィルターの一覧を返します。
+func (b *Broker) Subscriptions() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	filters := make([]string, len(b.subs))
+	for i, s := range b.subs {
+		filters[i] = s.filter
+	}
+	return filters
+}
+
+// Client は [Broker] に接続するクライアントです。 [mqttbridge.Client] を実装します。
+type Client struct {
+	broker *Broker
+}
+
+var _ mqttbridge.Client = (*Client)(nil)
+
+// Subscribe はトピックフィルター filter を購読します。
+// 同じクライアントが同じフィルターを再度購読した場合、ハンドラーを置き換えます。
+// 保持されたメッセージのうち filter に一致するものは、戻る前に handler に配送します。
+func (c *Client) Subscribe(ctx context.Context, filter string, handler func(mqttbridge.Message)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !mqttbridge.ValidFilter(filter) {
+		return fmt.Errorf("mqtttest: invalid topic filter %q", filter)
+	}
+
+	b := c.broker
+	b.mu.Lock()
+	b.subs = slices.DeleteFunc(b.subs, func(s *subscription) bool {
+		return s.client == c && s.filter == filter
+	})
+	b.subs = append(b.subs, &subscription{client: c, filter: filter, handler: handler})
+	var retained []mqttbridge.Message
+	for topic, msg := range b.retained {
+		if mqttbridge.MatchTopic(filter, topic) {
+			retained = append(retained, msg)
+		}
+	}
+	b.mu.Unlock()
+
+	slices.SortFunc(retained, func(a, b mqttbridge.Message) int {
+		return strings.Compare(a.Topic, b.Topic)
+	})
+	for _, msg := range retained {
+		handler(msg)
+	}
+	return nil
+}
+
+// Unsubscribe はトピックフィルター filter の購読を解除します。
+func (c *Client) Unsubscribe(ctx context.Context, filter string) error {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs = slices.DeleteFunc(b.subs, func(s *subscription) bool {
+		return s.client == c && s.filter == filter
+	})
+	return nil
+}
@@ -0,0 +1,54 @@
+package mqtttest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gcrtnst/ambidata/mqttbridge"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBroker(t *testing.T) {
+	ctx := context.Background()
+	b := NewBroker()
+	b.Publish("a/retained", []byte("r"), true)
+	b.Publish("a/removed", []byte("x"), true)
+	b.Publish("a/removed", nil, true)
+	b.Publish("a/lost", []byte("l"), false)
+
+	var got1, got2 []mqttbridge.Message
+	c1, c2 := b.Client(), b.Client()
+	if err := c1.Subscribe(ctx, "a/#", func(m mqttbridge.Message) { got1 = append(got1, m) }); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	if err := c2.Subscribe(ctx, "a/+/c", func(m mqttbridge.Message) { got2 = append(got2, m) }); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	if err := c2.Subscribe(ctx, "a/#/c", func(mqttbridge.Message) {}); err == nil {
+		t.Errorf("invalid filter: expected error, got nil")
+	}
+
+	b.Publish("a/b/c", []byte("1"), false)
+	if err := c1.Unsubscribe(ctx, "a/#"); err != nil {
+		t.Fatalf("unsubscribe: %v", err)
+	}
+	b.Publish("a/b/c", []byte("2"), false)
+
+	want1 := []mqttbridge.Message{
+		{Topic: "a/retained", Payload: []byte("r")},
+		{Topic: "a/b/c", Payload: []byte("1")},
+	}
+	if diff := cmp.Diff(want1, got1); diff != "" {
+		t.Errorf("c1: mismatch (-want, +got):\n%s", diff)
+	}
+	want2 := []mqttbridge.Message{
+		{Topic: "a/b/c", Payload: []byte("1")},
+		{Topic: "a/b/c", Payload: []byte("2")},
+	}
+	if diff := cmp.Diff(want2, got2); diff != "" {
+		t.Errorf("c2: mismatch (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"a/+/c"}, b.Subscriptions()); diff != "" {
+		t.Errorf("subscriptions: mismatch (-want, +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,49 @@
+package mqttbridge
+
+import "strings"
+
+// MatchTopic はトピック topic がトピックフィルター filter に一致する場合に true を返します。
+//
+// filter には、1階層に一致するワイルドカード '+' と、
+// 残りの全ての階層に一致するワイルドカード '#' (末尾のみ) を使用できます。
+// MQTT の仕様に従い、'$' で始まるトピックは先頭がワイルドカードのフィルターには一致しません。
+func MatchTopic(filter string, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	fs := strings.Split(filter, "/")
+	ts := strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return i == len(fs)-1
+		}
+		if i >= len(ts) {
+			return false
+		}
+		if f != "+" && f != ts[i] {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
+
+// ValidFilter はトピックフィルター filter が正しい書式の場合に true を返します。
+func ValidFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	fs := strings.Split(filter, "/")
+	for i, f := range fs {
+		switch {
+		case f == "#":
+			if i != len(fs)-1 {
+				return false
+			}
+		case f == "+":
+		case strings.ContainsAny(f, "+#"):
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,348 @@
+// Package outlier は、センサーの故障などによる外れ値を検出し、
+// 該当するデータポイントを非表示にする機能を提供します。
+//
+// 外れ値の検出はデータ番号ごとに [Rule] で指定した [Detector] により行います。
+// 以下の Detector を用意しています。
+//
+//   - [ZScore]: 平均値からの標準偏差の倍数 (z スコア) が閾値を超える値
+//   - [MAD]: 中央値からの中央絶対偏差 (MAD) に基づく修正 z スコアが閾値を超える値
+//   - [RateOfChange]: 直前の値からの単位時間あたりの変化量が上限を超える値
+//   - [Bounds]: 固定の範囲外の値
+//
+// 検出結果はまず [Detect] で確認し、問題がなければ [Apply] で非表示と理由のコメントを設定します。
+//
+// 使用例:
+//
+//	arr, _ := annotate.Find(ctx, f, &annotate.Options{Start: start, End: end})
+//	suspects := outlier.Detect(arr, []outlier.Rule{
+//		{Field: ambidata.FieldD1, Detector: outlier.MAD{}},
+//		{Field: ambidata.FieldD1, Detector: outlier.Bounds{Min: -40, Max: 85}},
+//	})
+//	outlier.WriteText(os.Stdout, suspects)
+//	res, err := outlier.Apply(ctx, f, s, arr, suspects, nil)
+package outlier
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/annotate"
+)
+
+const (
+	// DefaultZScore は [ZScore.Threshold] のデフォルト値です。
+	DefaultZScore = 3.0
+
+	// DefaultMAD は [MAD.Threshold] のデフォルト値です。
+	// Iglewicz と Hoaglin が推奨する値です。
+	DefaultMAD = 3.5
+
+	// CmntPrefix は [Apply] が設定するコメントの接頭辞です。
+	CmntPrefix = "outlier: "
+)
+
+// 推測に基づく情報: コメントの最大長は 64 バイトのようです。
+const maxCmntLen = 64
+
+// Detector は外れ値を検出する方法です。
+type Detector interface {
+	// Detect は時刻順に並んだ値 vs のうち外れ値であるものについて、その理由を返します。
+	// 戻り値は vs と同じ長さで、外れ値でない要素は空文字列です。
+	// ts は vs の各値の時刻です。
+	Detect(ts []time.Time, vs []float64) []string
+}
+
+// ZScore は平均値からの偏差が標準偏差の Threshold 倍を超える値を外れ値とします。
+// 外れ値自体が平均値と標準偏差に影響するため、データ数が少ない場合は [MAD] を推奨します。
+type ZScore struct {
+	// Threshold は z スコアの閾値です。
+	// 0 以下の場合は、 [DefaultZScore] が使用されます。
+	Threshold float64
+}
+
+// Detect は [Detector] を実装します。
+func (d ZScore) Detect(ts []time.Time, vs []float64) []string {
+	th := d.Threshold
+	if th <= 0 {
+		th = DefaultZScore
+	}
+
+	ret := make([]string, len(vs))
+	if len(vs) < 2 {
+		return ret
+	}
+	var sum float64
+	for _, v := range vs {
+		sum += v
+	}
+	mean := sum / float64(len(vs))
+	var sq float64
+	for _, v := range vs {
+		sq += (v - mean) * (v - mean)
+	}
+	std := math.Sqrt(sq / float64(len(vs)))
+	if std == 0 {
+		return ret
+	}
+
+	for i, v := range vs {
+		if z := math.Abs(v-mean) / std; z > th {
+			ret[i] = fmt.Sprintf("z-score %.2f > %g", z, th)
+		}
+	}
+	return ret
+}
+
+// MAD は中央値と中央絶対偏差 (MAD) から計算する修正 z スコアが Threshold を超える値を外れ値とします。
+// 修正 z スコアは 0.6745 × (値 − 中央値) ÷ MAD です。
+// 半数以上の値が中央値と等しく MAD が 0 の場合は、外れ値を検出しません。
+type MAD struct {
+	// Threshold は修正 z スコアの閾値です。
+	// 0 以下の場合は、 [DefaultMAD] が使用されます。
+	Threshold float64
+}
+
+// Detect は [Detector] を実装します。
+func (d MAD) Detect(ts []time.Time, vs []float64) []string {
+	th := d.Threshold
+	if th <= 0 {
+		th = DefaultMAD
+	}
+
+	ret := make([]string, len(vs))
+	if len(vs) < 2 {
+		return ret
+	}
+	med := median(slices.Clone(vs))
+	dev := make([]float64, len(vs))
+	for i, v := range vs {
+		dev[i] = math.Abs(v - med)
+	}
+	mad := median(dev)
+	if mad == 0 {
+		return ret
+	}
+
+	for i, v := range vs {
+		if z := 0.6745 * math.Abs(v-med) / mad; z > th {
+			ret[i] = fmt.Sprintf("modified z-score %.2f > %g", z, th)
+		}
+	}
+	return ret
+}
+
+// median は arr の中央値を返します。arr は並べ替えられます。
+func median(arr []float64) float64 {
+	slices.Sort(arr)
+	n := len(arr)
+	if n%2 == 1 {
+		return arr[n/2]
+	}
+	return (arr[n/2-1] + arr[n/2]) / 2
+}
+
+// RateOfChange は直前の値からの変化量が、 Per あたり Max を超える値を外れ値とします。
+//
+// 外れ値と判定した値は、以降の値の比較には使用しません。
+// そのため、一時的な突出値 (スパイク) は突出した値のみが外れ値となり、
+// 元の水準に戻った値は外れ値となりません。
+// 時刻が直前の値と同じ値は比較しません。
+type RateOfChange struct {
+	// Max は Per あたりの変化量の上限です。
+	Max float64
+
+	// Per は変化量の単位時間です。
+	// 0 以下の場合は、1秒が使用されます。
+	Per time.Duration
+}
+
+// Detect は [Detector] を実装します。
+func (d RateOfChange) Detect(ts []time.Time, vs []float64) []string {
+	per := d.Per
+	if per <= 0 {
+		per = time.Second
+	}
+
+	ret := make([]string, len(vs))
+	prev := 0
+	for i := 1; i < len(vs); i++ {
+		dt := ts[i].Sub(ts[prev])
+		if dt <= 0 {
+			continue
+		}
+		rate := math.Abs(vs[i]-vs[prev]) / (float64(dt) / float64(per))
+		if rate > d.Max {
+			ret[i] = fmt.Sprintf("change %.4g/%s > %g/%s", rate, per, d.Max, per)
+			continue
+		}
+		prev = i
+	}
+	return ret
+}
+
+// Bounds は Min 未満または Max を超える値を外れ値とします。
+// 下限または上限を設けない場合は、 [math.Inf] を指定してください。
+type Bounds struct {
+	Min float64
+	Max float64
+}
+
+// Detect は [Detector] を実装します。
+func (d Bounds) Detect(ts []time.Time, vs []float64) []string {
+	ret := make([]string, len(vs))
+	for i, v := range vs {
+		if v < d.Min || v > d.Max {
+			ret[i] = fmt.Sprintf("%g out of range [%g, %g]", v, d.Min, d.Max)
+		}
+	}
+	return ret
+}
+
+// Rule はデータ番号 Field に Detector を適用する規則です。
+type Rule struct {
+	Field    ambidata.Field
+	Detector Detector
+}
+
+// Suspect は外れ値の疑いがある値です。
+type Suspect struct {
+	Created time.Time      // データポイントの時刻
+	Field   ambidata.Field // データ番号
+	Value   float64        // 値
+	Reason  string         // 外れ値と判定した理由
+}
+
+// Detect は arr に rules を適用し、外れ値の疑いがある値を時刻順に返します。
+// arr は時刻順に並んでいる必要はありません。
+//
+// 既に非表示のデータポイントと、時刻がゼロ値のデータポイントは対象外とし、
+// 平均値などの計算にも使用しません。
+// 同じ値が複数の規則で外れ値と判定された場合は、それぞれ別の [Suspect] となります。
+func Detect(arr []ambidata.Data, rules []Rule) []Suspect {
+	arr = slices.Clone(arr)
+	slices.SortStableFunc(arr, func(a, b ambidata.Data) int { return a.Created.Compare(b.Created) })
+
+	ret := []Suspect{}
+	for _, rule := range rules {
+		var ts []time.Time
+		var vs []float64
+		for i := range arr {
+			v := arr[i].Field(rule.Field)
+			if arr[i].Hide || arr[i].Created.IsZero() || !v.OK {
+				continue
+			}
+			ts = append(ts, arr[i].Created)
+			vs = append(vs, v.V)
+		}
+
+		for i, reason := range rule.Detector.Detect(ts, vs) {
+			if reason != "" {
+				ret = append(ret, Suspect{Created: ts[i], Field: rule.Field, Value: vs[i], Reason: reason})
+			}
+		}
+	}
+
+	slices.SortStableFunc(ret, func(a, b Suspect) int {
+		if c := a.Created.Compare(b.Created); c != 0 {
+			return c
+		}
+		return int(a.Field - b.Field)
+	})
+	return ret
+}
+
+// Cmnt は suspects のうち時刻が t のものについて、 [Apply] が設定するコメントを返します。
+// コメントはサーバーに保存できる長さに切り詰めます。
+// 該当するものがない場合は空文字列を返します。
+func Cmnt(suspects []Suspect, t time.Time) string {
+	var reasons []string
+	for _, s := range suspects {
+		if s.Created.UnixMilli() == t.UnixMilli() {
+			reasons = append(reasons, s.Field.String()+" "+s.Reason)
+		}
+	}
+	if len(reasons) <= 0 {
+		return ""
+	}
+	c := CmntPrefix + strings.Join(reasons, "; ")
+	for len(c) > maxCmntLen {
+		_, size := utf8.DecodeLastRuneInString(c)
+		c = c[:len(c)-size]
+	}
+	return c
+}
+
+// Apply は suspects に該当する arr のデータポイントを非表示にし、理由をコメントに設定します。
+// 既存のコメントは上書きされます。
+// arr は [Detect] に渡したデータポイントで、 f と s は同じチャネルのものを指定してください。
+//
+// 処理は [annotate.ApplyFunc] と [annotate.VerifyFunc] により行い、opt もそれらに従います。
+// opt.DryRun が true の場合は、対象のデータポイントを決定するだけで設定を行いません。
+// 照合で一致しないデータポイントが見つかった場合は [annotate.ErrVerify] を返します。
+func Apply(ctx context.Context, f *ambidata.Fetcher, s *ambidata.Sender, arr []ambidata.Data, suspects []Suspect, opt *annotate.Options) (*annotate.Result, error) {
+	if opt == nil {
+		opt = &annotate.Options{}
+	}
+
+	cmnts := map[int64]string{}
+	for i := range arr {
+		if c := Cmnt(suspects, arr[i].Created); c != "" {
+			cmnts[arr[i].Created.UnixMilli()] = c
+		}
+	}
+	targets := []ambidata.Data{}
+	for i := range arr {
+		if _, ok := cmnts[arr[i].Created.UnixMilli()]; ok {
+			targets = append(targets, arr[i])
+		}
+	}
+	slices.SortStableFunc(targets, func(a, b ambidata.Data) int { return a.Created.Compare(b.Created) })
+	fn := func(data *ambidata.Data) annotate.Action {
+		return annotate.Action{
+			Cmnt: ambidata.Just(cmnts[data.Created.UnixMilli()]),
+			Hide: ambidata.Just(true),
+		}
+	}
+
+	res := &annotate.Result{Targets: targets}
+	if opt.DryRun {
+		return res, nil
+	}
+	var err error
+	res.Progress, err = annotate.ApplyFunc(ctx, s, targets, fn, opt)
+	if err != nil {
+		return res, err
+	}
+	if opt.NoVerify {
+		return res, nil
+	}
+	res.Verification, err = annotate.VerifyFunc(ctx, f, targets, fn)
+	if err != nil {
+		return res, err
+	}
+	if !res.Verification.OK() {
+		return res, fmt.Errorf("%w: %s", annotate.ErrVerify, res.Verification)
+	}
+	return res, nil
+}
+
+// WriteText は suspects を1行に1つずつテキスト形式で書き出します。
+// 最後に外れ値の疑いがあるデータポイントの数を書き出します。
+func WriteText(w io.Writer, suspects []Suspect) error {
+	b := &strings.Builder{}
+	points := map[int64]struct{}{}
+	for _, s := range suspects {
+		fmt.Fprintf(b, "%s %s=%g %s\n", s.Created.UTC().Format(time.RFC3339Nano), s.Field, s.Value, s.Reason)
+		points[s.Created.UnixMilli()] = struct{}{}
+	}
+	fmt.Fprintf(b, "%d suspect values in %d data points\n", len(suspects), len(points))
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,167 @@
+package outlier
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/annotate"
+	"github.com/gcrtnst/ambidata/internal/ambimock"
+	"github.com/google/go-cmp/cmp"
+)
+
+var t0 = time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+
+func times(n int) []time.Time {
+	ret := make([]time.Time, n)
+	for i := range ret {
+		ret[i] = t0.Add(time.Duration(i) * time.Second)
+	}
+	return ret
+}
+
+func TestDetector(t *testing.T) {
+	tests := []struct {
+		name string
+		d    Detector
+		vs   []float64
+		want []string
+	}{
+		{
+			name: "ZScore",
+			d:    ZScore{},
+			vs:   []float64{10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 100},
+			want: []string{"", "", "", "", "", "", "", "", "", "", "z-score 3.16 > 3"},
+		},
+		{
+			name: "ZScoreConstant",
+			d:    ZScore{Threshold: 1},
+			vs:   []float64{5, 5, 5},
+			want: []string{"", "", ""},
+		},
+		{
+			name: "MAD",
+			d:    MAD{},
+			vs:   []float64{1, 2, 3, 4, 100},
+			want: []string{"", "", "", "", "modified z-score 65.43 > 3.5"},
+		},
+		{
+			name: "MADZero",
+			d:    MAD{},
+			vs:   []float64{1, 1, 1, 2},
+			want: []string{"", "", "", ""},
+		},
+		{
+			name: "RateOfChange",
+			d:    RateOfChange{Max: 10},
+			vs:   []float64{0, 5, 100, 8, 9},
+			want: []string{"", "", "change 95/1s > 10/1s", "", ""},
+		},
+		{
+			name: "RateOfChangePer",
+			d:    RateOfChange{Max: 100, Per: time.Minute},
+			vs:   []float64{0, 1, 3},
+			want: []string{"", "", "change 120/1m0s > 100/1m0s"},
+		},
+		{
+			name: "Bounds",
+			d:    Bounds{Min: 0, Max: math.Inf(1)},
+			vs:   []float64{-1, 10, 60},
+			want: []string{"-1 out of range [0, +Inf]", "", ""},
+		},
+	}
+
+	for _, tt := range tests {
+		got := tt.d.Detect(times(len(tt.vs)), tt.vs)
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("%s: mismatch (-want, +got):\n%s", tt.name, diff)
+		}
+	}
+}
+
+func TestDetect(t *testing.T) {
+	arr := []ambidata.Data{
+		{Created: t0.Add(2 * time.Second), D1: ambidata.Just(60.0), D2: ambidata.Just(-5.0)},
+		{Created: t0, D1: ambidata.Just(20.0), D2: ambidata.Just(1.0)},
+		{Created: t0.Add(time.Second), D1: ambidata.Just(99.0), Hide: true},
+		{Created: t0.Add(3 * time.Second), D2: ambidata.Just(2.0)},
+	}
+	rules := []Rule{
+		{Field: ambidata.FieldD2, Detector: Bounds{Min: 0, Max: 10}},
+		{Field: ambidata.FieldD1, Detector: Bounds{Min: 0, Max: 50}},
+		{Field: ambidata.FieldD1, Detector: RateOfChange{Max: 10}},
+	}
+
+	want := []Suspect{
+		{Created: t0.Add(2 * time.Second), Field: ambidata.FieldD1, Value: 60, Reason: "60 out of range [0, 50]"},
+		{Created: t0.Add(2 * time.Second), Field: ambidata.FieldD1, Value: 60, Reason: "change 20/1s > 10/1s"},
+		{Created: t0.Add(2 * time.Second), Field: ambidata.FieldD2, Value: -5, Reason: "-5 out of range [0, 10]"},
+	}
+	got := Detect(arr, rules)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+
+	const wantCmnt = "outlier: d1 60 out of range [0, 50]; d1 change 20/1s > 10/1s; d2"
+	if c := Cmnt(got, t0.Add(2*time.Second)); c != wantCmnt {
+		t.Errorf("Cmnt: expected %q, got %q", wantCmnt, c)
+	}
+	if c := Cmnt(got, t0); c != "" {
+		t.Errorf("Cmnt: expected empty, got %q", c)
+	}
+
+	buf := &bytes.Buffer{}
+	err := WriteText(buf, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const wantText = "2006-01-02T15:04:07Z d1=60 60 out of range [0, 50]\n" +
+		"2006-01-02T15:04:07Z d1=60 change 20/1s > 10/1s\n" +
+		"2006-01-02T15:04:07Z d2=-5 -5 out of range [0, 10]\n" +
+		"3 suspect values in 1 data points\n"
+	if diff := cmp.Diff(wantText, buf.String()); diff != "" {
+		t.Errorf("WriteText: mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestApply(t *testing.T) {
+	ctx := context.Background()
+	arr := []ambidata.Data{
+		{Created: t0, D1: ambidata.Just(20.0)},
+		{Created: t0.Add(time.Second), D1: ambidata.Just(999.0), Cmnt: "c"},
+		{Created: t0.Add(2 * time.Second), D1: ambidata.Just(21.0)},
+	}
+	srv := ambimock.New(t)
+	srv.AddChannel(&ambimock.Channel{Info: ambidata.ChannelInfo{Ch: "1"}, ReadKey: "rk", WriteKey: "wk", Data: arr})
+
+	suspects := Detect(arr, []Rule{{Field: ambidata.FieldD1, Detector: Bounds{Min: -40, Max: 85}}})
+	res, err := Apply(ctx, srv.Fetcher("1"), srv.Sender("1"), arr, suspects, &annotate.Options{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(arr[1:2], res.Targets); diff != "" {
+		t.Errorf("dry run: mismatch (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(arr, srv.Data("1")); diff != "" {
+		t.Errorf("dry run: expected data to be unchanged (-want, +got):\n%s", diff)
+	}
+
+	res, err = Apply(ctx, srv.Fetcher("1"), srv.Sender("1"), arr, suspects, &annotate.Options{Interval: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Verification.OK() {
+		t.Errorf("Verification: unexpected result %s", res.Verification)
+	}
+	want := []ambidata.Data{
+		arr[0],
+		{Created: t0.Add(time.Second), D1: ambidata.Just(999.0), Cmnt: "outlier: d1 999 out of range [-40, 85]", Hide: true},
+		arr[2],
+	}
+	if diff := cmp.Diff(want, srv.Data("1")); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,257 @@
+// Package promexporter は、チャネルの最新値を Prometheus のメトリクスとして公開する
+// [http.Handler] を提供します。
+//
+// [Exporter] は定期的に [ambidata.Fetcher.GetChannel] を呼び出してチャネル情報を取得し、
+// Prometheus のテキスト形式 (text exposition format) で以下のメトリクスを出力します。
+// 外部ライブラリには依存しません。
+//
+//   - ambidata_field_value: 最後に送信されたデータのデータ1～8の値
+//     (ラベル: ch, channel, field, name)
+//   - ambidata_last_post_timestamp_seconds: データの最終送信日時 (UNIX 時刻)
+//   - ambidata_last_post_age_seconds: データの最終送信日時からの経過秒数
+//   - ambidata_data_per_day: データの一日あたりの平均数
+//   - ambidata_up: 直近のチャネル情報の取得に成功した場合は 1、失敗した場合は 0
+//
+// ラベル channel にはチャネル名 ([ambidata.ChannelInfo.ChName]) が、
+// name にはデータ名 ([ambidata.FieldInfo.Name]) が設定されます。
+//
+// 使用例:
+//
+//	e := promexporter.New(ambidata.NewFetcher(ch, readKey))
+//	go e.Run(ctx)
+//	http.Handle("/metrics", e)
+package promexporter
+
+import (
+	"bufio"
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+)
+
+// DefaultInterval は [Exporter.Interval] のデフォルト値です。
+const DefaultInterval = time.Minute
+
+// DefaultNamespace は [Exporter.Namespace] のデフォルト値です。
+const DefaultNamespace = "ambidata"
+
+// Exporter はチャネルの最新値を Prometheus のメトリクスとして公開する [http.Handler] です。
+//
+// Exporter のメソッドは複数の goroutine から同時に呼び出すことができます。
+// ただし、フィールドは使用を開始した後に変更しないでください。
+type Exporter struct {
+	// Fetchers はメトリクスを公開するチャネルの [ambidata.Fetcher] です。
+	Fetchers []*ambidata.Fetcher
+
+	// Interval はチャネル情報を取得する間隔です。
+	// 0 以下の場合は、 [DefaultInterval] が使用されます。
+	Interval time.Duration
+
+	// Namespace はメトリクス名の接頭辞です。
+	// 空文字列の場合は、 [DefaultNamespace] が使用されます。
+	Namespace string
+
+	// Now は現在時刻を返す関数です。
+	// nil の場合は、 [time.Now] が使用されます。
+	Now func() time.Time
+
+	mu       sync.Mutex
+	channels map[string]*channelState
+}
+
+type channelState struct {
+	Info ambidata.ChannelInfo
+	OK   bool // 一度でも取得に成功した場合は true
+	Up   bool // 直近の取得に成功した場合は true
+}
+
+// New は新しい [Exporter] を作成します。
+func New(fetchers ...*ambidata.Fetcher) *Exporter {
+	return &Exporter{Fetchers: fetchers}
+}
+
+// Run は [Exporter.Interval] ごとに [Exporter.Refresh] を呼び出します。
+// ctx がキャンセルされるまで戻りません。戻り値は常に ctx.Err() です。
+func (e *Exporter) Run(ctx context.Context) error {
+	interval := e.Interval
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+
+	_ = e.Refresh(ctx)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			_ = e.Refresh(ctx)
+		}
+	}
+}
+
+// Refresh は全てのチャネルの情報を取得し、公開するメトリクスを更新します。
+// 取得に失敗したチャネルがある場合、最初のエラーを返します。
+// 取得に失敗したチャネルは、前回取得した値を公開し続け、ambidata_up が 0 になります。
+func (e *Exporter) Refresh(ctx context.Context) error {
+	var first error
+	for _, f := range e.Fetchers {
+		info, err := f.GetChannel(ctx)
+
+		e.mu.Lock()
+		if e.channels == nil {
+			e.channels = map[string]*channelState{}
+		}
+		st, ok := e.channels[f.Ch]
+		if !ok {
+			st = &channelState{Info: ambidata.ChannelInfo{Ch: f.Ch}}
+			e.channels[f.Ch] = st
+		}
+		st.Up = err == nil
+		if err == nil {
+			st.Info = info
+			st.OK = true
+		}
+		e.mu.Unlock()
+
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// ServeHTTP は公開するメトリクスを Prometheus のテキスト形式で出力します。
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	b := bufio.NewWriter(w)
+	e.writeMetrics(b)
+	_ = b.Flush()
+}
+
+type sample struct {
+	Labels []label
+	Value  float64
+}
+
+type label struct {
+	Name  string
+	Value string
+}
+
+func (e *Exporter) writeMetrics(b *bufio.Writer) {
+	ns := e.Namespace
+	if ns == "" {
+		ns = DefaultNamespace
+	}
+	now := time.Now
+	if e.Now != nil {
+		now = e.Now
+	}
+	t := now()
+
+	var values, lastPost, age, perDay, up []sample
+
+	e.mu.Lock()
+	for _, f := range e.Fetchers {
+		st, ok := e.channels[f.Ch]
+		if !ok {
+			continue
+		}
+		info := &st.Info
+		ch := []label{{"ch", info.Ch}}
+		chName := []label{{"ch", info.Ch}, {"channel", info.ChName}}
+
+		up = append(up, sample{ch, boolValue(st.Up)})
+		if !st.OK {
+			continue
+		}
+
+		perDay = append(perDay, sample{chName, float64(info.DataPerDay)})
+		if !info.LastPost.IsZero() {
+			lastPost = append(lastPost, sample{chName, unixSeconds(info.LastPost)})
+			age = append(age, sample{chName, t.Sub(info.LastPost).Seconds()})
+		}
+		for _, fl := range ambidata.Fields {
+			v := info.LastData.Field(fl)
+			if !v.OK {
+				continue
+			}
+			labels := append(chName[:2:2], label{"field", fl.String()}, label{"name", info.Field(fl).Name})
+			values = append(values, sample{labels, v.V})
+		}
+	}
+	e.mu.Unlock()
+
+	writeFamily(b, ns+"_field_value", "Last value of the data field.", values)
+	writeFamily(b, ns+"_last_post_timestamp_seconds", "Time of the last post in seconds since the Unix epoch.", lastPost)
+	writeFamily(b, ns+"_last_post_age_seconds", "Seconds elapsed since the last post.", age)
+	writeFamily(b, ns+"_data_per_day", "Average number of data points per day.", perDay)
+	writeFamily(b, ns+"_up", "Whether the last fetch of the channel information succeeded.", up)
+}
+
+func writeFamily(b *bufio.Writer, name string, help string, samples []sample) {
+	if len(samples) <= 0 {
+		return
+	}
+
+	b.WriteString("# HELP " + name + " " + help + "\n")
+	b.WriteString("# TYPE " + name + " gauge\n")
+	for _, s := range samples {
+		b.WriteString(name)
+		if len(s.Labels) > 0 {
+			b.WriteByte('{')
+			for i, l := range s.Labels {
+				if i > 0 {
+					b.WriteByte(',')
+				}
+				b.WriteString(l.Name + `="` + escapeLabel(l.Value) + `"`)
+			}
+			b.WriteByte('}')
+		}
+		b.WriteByte(' ')
+		b.WriteString(formatValue(s.Value))
+		b.WriteByte('\n')
+	}
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelReplacer.Replace(s)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixMilli()) / 1000
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
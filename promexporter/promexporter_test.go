@@ -0,0 +1,138 @@
+package promexporter
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+)
+
+func newTestFetchers(t *testing.T, fail map[string]bool) []*ambidata.Fetcher {
+	mux := http.NewServeMux()
+	mux.Handle("/", http.NotFoundHandler())
+	mux.HandleFunc("GET /api/v2/channels/100/{$}", func(w http.ResponseWriter, r *http.Request) {
+		if fail["100"] {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"ch":"100","chName":"room \"A\"","lastpost":"2006-01-02T15:04:05.500Z","dataperday":288,"d1":{"name":"temp","color":"1"},"d2":{"name":"humi"},"lastdata":{"d1":23.5,"d2":60,"created":"2006-01-02T15:04:05.500Z","_id":"x"}}`))
+	})
+	mux.HandleFunc("GET /api/v2/channels/200/{$}", func(w http.ResponseWriter, r *http.Request) {
+		if fail["200"] {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"ch":"200","chName":"empty","lastpost":"1970-01-01T00:00:00.000Z","dataperday":0}`))
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	srvURL, _ := url.Parse(srv.URL)
+	cfg := &ambidata.Config{Scheme: srvURL.Scheme, Host: srvURL.Host, Client: srv.Client()}
+
+	return []*ambidata.Fetcher{
+		{Ch: "100", ReadKey: "r100", Config: cfg},
+		{Ch: "200", ReadKey: "r200", Config: cfg},
+	}
+}
+
+func scrape(e *Exporter) (string, string) {
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	return rec.Body.String(), rec.Header().Get("Content-Type")
+}
+
+func TestExporter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	fail := map[string]bool{}
+	e := New(newTestFetchers(t, fail)...)
+	e.Now = func() time.Time { return time.Date(2006, 1, 2, 15, 5, 5, 500000000, time.UTC) }
+
+	if err := e.Refresh(ctx); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+
+	const want = `# HELP ambidata_field_value Last value of the data field.
+# TYPE ambidata_field_value gauge
+ambidata_field_value{ch="100",channel="room \"A\"",field="d1",name="temp"} 23.5
+ambidata_field_value{ch="100",channel="room \"A\"",field="d2",name="humi"} 60
+# HELP ambidata_last_post_timestamp_seconds Time of the last post in seconds since the Unix epoch.
+# TYPE ambidata_last_post_timestamp_seconds gauge
+ambidata_last_post_timestamp_seconds{ch="100",channel="room \"A\""} 1.1362142455e+09
+# HELP ambidata_last_post_age_seconds Seconds elapsed since the last post.
+# TYPE ambidata_last_post_age_seconds gauge
+ambidata_last_post_age_seconds{ch="100",channel="room \"A\""} 60
+# HELP ambidata_data_per_day Average number of data points per day.
+# TYPE ambidata_data_per_day gauge
+ambidata_data_per_day{ch="100",channel="room \"A\""} 288
+ambidata_data_per_day{ch="200",channel="empty"} 0
+# HELP ambidata_up Whether the last fetch of the channel information succeeded.
+# TYPE ambidata_up gauge
+ambidata_up{ch="100"} 1
+ambidata_up{ch="200"} 1
+`
+	got, ct := scrape(e)
+	if got != want {
+		t.Errorf("body: expected\n%s\ngot\n%s", want, got)
+	}
+	if ct != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("content-type: unexpected %#v", ct)
+	}
+}
+
+func TestExporterRefreshError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	fail := map[string]bool{"200": true}
+	e := New(newTestFetchers(t, fail)...)
+	e.Namespace = "test"
+
+	if err := e.Refresh(ctx); err == nil {
+		t.Errorf("refresh: expected error")
+	}
+	got, _ := scrape(e)
+	for _, want := range []string{`test_up{ch="100"} 1` + "\n", `test_up{ch="200"} 0` + "\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected to contain %#v, got\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, `channel="empty"`) {
+		t.Errorf("expected not to contain failed channel metrics, got\n%s", got)
+	}
+
+	// 一度取得に成功したチャネルは、失敗しても前回の値を公開し続ける
+	fail["100"] = true
+	_ = e.Refresh(ctx)
+	got, _ = scrape(e)
+	for _, want := range []string{`test_up{ch="100"} 0` + "\n", `test_data_per_day{ch="100",channel="room \"A\""} 288` + "\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected to contain %#v, got\n%s", want, got)
+		}
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	tt := []struct {
+		in   float64
+		want string
+	}{
+		{in: 1.5, want: "1.5"},
+		{in: math.NaN(), want: "NaN"},
+		{in: math.Inf(1), want: "+Inf"},
+		{in: math.Inf(-1), want: "-Inf"},
+	}
+	for _, tc := range tt {
+		if got := formatValue(tc.in); got != tc.want {
+			t.Errorf("%v: expected %#v, got %#v", tc.in, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+// Package promremote は、Prometheus の remote write を受信し、
+// 選択した系列のサンプルを Ambient のチャネルに転送する [http.Handler] を提供します。
+//
+// [Receiver] は snappy 圧縮された protobuf 形式の WriteRequest (remote write 1.0) を受け付け、
+// [Route] の設定に従って系列をチャネルとデータ番号 (d1～d8) に対応付けます。
+// サンプルは [Receiver.Resolution] ごとの時刻にまとめられ、
+// 同じ時刻に対応付けられた複数の系列は1つのデータポイントになります。
+// データポイントはチャネルごとのキューに蓄積され、送信間隔の制限
+// ([ambidata.MinSendInterval]) を守りながら [ambidata.Sender.SendBulk] で送信されます。
+// 外部ライブラリには依存しません。
+//
+// 使用例:
+//
+//	p, err := config.Open("", "")
+//	// ...
+//	r := &promremote.Receiver{Routes: routes, Sender: p.Sender}
+//	go r.Run(ctx)
+//	defer r.Close(context.Background())
+//	http.Handle("/api/v1/write", r)
+package promremote
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/internal/batch"
+	"github.com/gcrtnst/ambidata/internal/snappy"
+)
+
+// DefaultResolution は [Receiver.Resolution] のデフォルト値です。
+// 1日あたりのデータポイント数は 2880 件となり、 [ambidata.MaxDataPerDay] を超えません。
+const DefaultResolution = 30 * time.Second
+
+// ErrClosed は [Receiver.Close] の後にリクエストを受信した場合のエラーです。
+var ErrClosed = errors.New("promremote: receiver is closed")
+
+// Route は Prometheus の系列をチャネルのデータに対応付ける設定です。
+//
+// 系列のメトリクス名が Metric と一致し、かつ Labels の全てのラベルが一致する場合に、
+// その系列のサンプルをチャネル Channel のデータ Field として転送します。
+// Metric が空文字列の場合は、メトリクス名を問いません。
+// 1つの系列が複数の Route に一致した場合は、全ての Route に従って転送します。
+type Route struct {
+	Metric  string            `json:"metric"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Channel string            `json:"channel"` // [SenderFunc] に渡すチャネル名
+	Field   ambidata.Field    `json:"field"`
+}
+
+// ParseRoutes は JSON 形式の [Route] の配列を読み込みます。
+//
+// 例:
+//
+//	[
+//	  {"metric": "node_hwmon_temp_celsius", "labels": {"instance": "pi:9100"}, "channel": "room", "field": "d1"},
+//	  {"metric": "node_load1", "channel": "room", "field": "d2"}
+//	]
+func ParseRoutes(r io.Reader) ([]Route, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	var routes []Route
+	if err := dec.Decode(&routes); err != nil {
+		return nil, fmt.Errorf("promremote: ParseRoutes: %w", err)
+	}
+	for i := range routes {
+		if err := routes[i].validate(); err != nil {
+			return nil, fmt.Errorf("promremote: ParseRoutes: routes[%d]: %w", i, err)
+		}
+	}
+	return routes, nil
+}
+
+func (rt *Route) validate() error {
+	if rt.Metric == "" && len(rt.Labels) == 0 {
+		return errors.New("metric or labels must be specified")
+	}
+	if rt.Channel == "" {
+		return errors.New("channel must be specified")
+	}
+	if !rt.Field.IsValid() {
+		return fmt.Errorf("invalid field %v", rt.Field)
+	}
+	return nil
+}
+
+func (rt *Route) match(labels []label) bool {
+	n := 0
+	for _, l := range labels {
+		if l.Name == "__name__" {
+			if rt.Metric != "" && l.Value != rt.Metric {
+				return false
+			}
+			continue
+		}
+		if v, ok := rt.Labels[l.Name]; ok {
+			if l.Value != v {
+				return false
+			}
+			n++
+		}
+	}
+	return n == len(rt.Labels)
+}
+
+// SenderFunc はチャネル名に対応する [ambidata.Sender] を返す関数です。
+// [config.Profile.Sender] をそのまま使用できます。
+//
+// [config.Profile.Sender]: https://pkg.go.dev/github.com/gcrtnst/ambidata/config#Profile.Sender
+type SenderFunc func(channel string) (*ambidata.Sender, error)
+
+// Receiver は Prometheus の remote write を受信し、Ambient に転送する [http.Handler] です。
+//
+// Receiver のメソッドは複数の goroutine から同時に呼び出すことができます。
+// ただし、フィールドは使用を開始した後に変更しないでください。
+type Receiver struct {
+	// Routes は系列をチャネルのデータに対応付ける設定です。
+	// いずれの Route にも一致しない系列は破棄されます。
+	Routes []Route
+
+	// Sender はチャネル名に対応する [ambidata.Sender] を返す関数です。
+	// 同じチャネル名に対しては最初の1回のみ呼び出されます。
+	Sender SenderFunc
+
+	// Resolution はデータポイントの時刻の間隔です。
+	// サンプルの時刻は Resolution の倍数に切り捨てられ、
+	// 同じ時刻になったサンプルは1つのデータポイントにまとめられます (後のサンプルが優先されます)。
+	// 0 以下の場合は、 [DefaultResolution] が使用されます。
+	Resolution time.Duration
+
+	// Interval は同一チャネルへの送信間隔です。
+	// 0 以下の場合は、 [ambidata.MinSendInterval] が使用されます。
+	Interval time.Duration
+
+	// OnError は転送中にエラーが発生した場合に呼び出されます。
+	// nil の場合は、エラーは無視されます。
+	OnError func(err error)
+
+	// Now は現在時刻を返す関数です。
+	// nil の場合は、 [time.Now] が使用されます。
+	Now func() time.Time
+
+	mu       sync.Mutex
+	batcher  *batch.Batcher
+	channels map[string]*channelState
+	closed   bool
+}
+
+type channelState struct {
+	Sender  *ambidata.Sender
+	Err     error           // Sender の取得に失敗した場合のエラー
+	Open    []ambidata.Data // まだキューに渡していないデータポイント (時刻順)
+	Flushed time.Time       // キューに渡した最新のデータポイントの時刻
+}
+
+// ServeHTTP は remote write のリクエストを処理します。
+//
+// 受信したサンプルはすぐには送信されません。
+// リクエストの内容に誤りがある場合は 400 Bad Request を、
+// 正常に受け付けた場合は 204 No Content を返します。
+func (r *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if enc := req.Header.Get("Content-Encoding"); enc != "" && enc != "snappy" {
+		http.Error(w, "unsupported content encoding: "+enc, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, snappy.MaxDecodedLen))
+	if err != nil {
+		if maxErr := (*http.MaxBytesError)(nil); errors.As(err, &maxErr) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, err := snappy.Decode(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	series, err := decodeWriteRequest(b)
+	if err != nil {
+		http.Error(w, "invalid write request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := r.ingest(series); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (r *Receiver) ingest(series []timeSeries) error {
+	res := r.resolution()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return ErrClosed
+	}
+
+	touched := map[*channelState]bool{}
+	for i := range series {
+		ts := &series[i]
+		for j := range r.Routes {
+			rt := &r.Routes[j]
+			if !rt.match(ts.Labels) {
+				continue
+			}
+			st := r.channel(rt.Channel)
+			if st.Err != nil {
+				continue
+			}
+
+			for _, s := range ts.Samples {
+				// NaN は Prometheus の staleness marker として使われるため、値としては扱わない
+				if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+					continue
+				}
+				created := time.UnixMilli(s.Timestamp).Truncate(res)
+				if !created.After(st.Flushed) {
+					continue // 既に送信済みの時刻
+				}
+				var data ambidata.Data
+				data.Created = created
+				data.SetField(rt.Field, ambidata.Just(s.Value))
+				st.Open = batch.Merge(st.Open, data)
+			}
+			touched[st] = true
+		}
+	}
+
+	// 最新の2つの時刻は、遅れて届く系列のためにまとめずに残しておく
+	for st := range touched {
+		if n := len(st.Open); n > 0 {
+			r.flush(st, st.Open[n-1].Created.Add(-res))
+		}
+	}
+	return nil
+}
+
+// channel はチャネル名に対応する状態を返します。 r.mu をロックした状態で呼び出してください。
+func (r *Receiver) channel(name string) *channelState {
+	if r.channels == nil {
+		r.channels = map[string]*channelState{}
+	}
+	if st, ok := r.channels[name]; ok {
+		return st
+	}
+
+	st := &channelState{}
+	if r.Sender == nil {
+		st.Err = errors.New("promremote: Receiver.Sender is nil")
+	} else {
+		st.Sender, st.Err = r.Sender(name)
+	}
+	if st.Err != nil {
+		r.reportError(fmt.Errorf("promremote: channel %q: %w", name, st.Err))
+	}
+	r.channels[name] = st
+	return st
+}
+
+// flush は時刻が before より前のデータポイントを送信キューに渡します。
+// r.mu をロックした状態で呼び出してください。
+func (r *Receiver) flush(st *channelState, before time.Time) {
+	n := 0
+	for n < len(st.Open) && st.Open[n].Created.Before(before) {
+		n++
+	}
+	if n == 0 {
+		return
+	}
+
+	if r.batcher == nil {
+		r.batcher = &batch.Batcher{
+			Interval: r.Interval,
+			OnError: func(ch string, err error) {
+				r.reportError(fmt.Errorf("promremote: ch %s: %w", ch, err))
+			},
+		}
+	}
+	if err := r.batcher.Add(st.Sender, st.Open[:n]...); err != nil {
+		r.reportError(fmt.Errorf("promremote: ch %s: %w", st.Sender.Ch, err))
+	}
+	st.Flushed = st.Open[n-1].Created
+	st.Open = append(st.Open[:0], st.Open[n:]...)
+}
+
+// Run は [Receiver.Resolution] ごとに、新しいサンプルが届かなくなった時刻のデータポイントを送信キューに渡します。
+// これを呼び出さない場合、最新の時刻のデータポイントは次のサンプルが届くか
+// [Receiver.Close] が呼び出されるまで送信されません。
+// ctx がキャンセルされるまで戻りません。戻り値は常に ctx.Err() です。
+func (r *Receiver) Run(ctx context.Context) error {
+	res := r.resolution()
+	t := time.NewTicker(res)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			r.flushStale(r.now().Add(-2 * res))
+		}
+	}
+}
+
+func (r *Receiver) flushStale(before time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	for _, st := range r.channels {
+		if st.Err == nil {
+			r.flush(st, before)
+		}
+	}
+}
+
+// Close は新たなリクエストの受け付けを停止し、残っている全てのデータポイントを送信します。
+// 全てのデータポイントの送信が完了するか、ctx が終了するまで待機します。
+func (r *Receiver) Close(ctx context.Context) error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	for _, st := range r.channels {
+		if st.Err == nil && len(st.Open) > 0 {
+			r.flush(st, st.Open[len(st.Open)-1].Created.Add(1))
+		}
+	}
+	r.closed = true
+	b := r.batcher
+	r.mu.Unlock()
+
+	if b == nil {
+		return nil
+	}
+	if err := b.Close(ctx); err != nil {
+		return fmt.Errorf("promremote: %w", err)
+	}
+	return nil
+}
+
+func (r *Receiver) resolution() time.Duration {
+	if r.Resolution <= 0 {
+		return DefaultResolution
+	}
+	return r.Resolution
+}
+
+func (r *Receiver) now() time.Time {
+	if r.Now == nil {
+		return time.Now()
+	}
+	return r.Now()
+}
+
+func (r *Receiver) reportError(err error) {
+	if r.OnError != nil {
+		r.OnError(err)
+	}
+}
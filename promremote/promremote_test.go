@@ -0,0 +1,270 @@
+package promremote
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/internal/ambimock"
+	"github.com/gcrtnst/ambidata/internal/snappy"
+	"github.com/google/go-cmp/cmp"
+)
+
+type pbuf []byte
+
+func (b pbuf) tag(num int, typ int) pbuf {
+	return binary.AppendUvarint(b, uint64(num)<<3|uint64(typ))
+}
+
+func (b pbuf) bytes(num int, p []byte) pbuf {
+	b = b.tag(num, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(p)))
+	return append(b, p...)
+}
+
+func (b pbuf) double(num int, v float64) pbuf {
+	return binary.LittleEndian.AppendUint64(b.tag(num, wireFixed64), math.Float64bits(v))
+}
+
+func (b pbuf) varint(num int, v uint64) pbuf {
+	return binary.AppendUvarint(b.tag(num, wireVarint), v)
+}
+
+func encodeWriteRequest(series []timeSeries) []byte {
+	var req pbuf
+	for _, ts := range series {
+		var tsb pbuf
+		for _, l := range ts.Labels {
+			tsb = tsb.bytes(1, pbuf(nil).bytes(1, []byte(l.Name)).bytes(2, []byte(l.Value)))
+		}
+		for _, s := range ts.Samples {
+			tsb = tsb.bytes(2, pbuf(nil).double(1, s.Value).varint(2, uint64(s.Timestamp)))
+		}
+		tsb = tsb.varint(15, 1) // 未知のフィールド
+		req = req.bytes(1, tsb)
+	}
+	return req
+}
+
+func TestDecodeWriteRequest(t *testing.T) {
+	want := []timeSeries{
+		{
+			Labels:  []label{{"__name__", "temp"}, {"room", "a"}},
+			Samples: []sample{{23.5, 1136214245000}, {-1, 1136214275000}},
+		},
+		{
+			Labels:  []label{{"__name__", "humi"}},
+			Samples: []sample{{60, 1136214245000}},
+		},
+	}
+	got, err := decodeWriteRequest(encodeWriteRequest(want))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+
+	b := encodeWriteRequest(want)
+	if _, err := decodeWriteRequest(b[:len(b)-3]); err == nil {
+		t.Errorf("truncated: expected error, got nil")
+	}
+}
+
+func TestParseRoutes(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []Route
+		err  bool
+	}{
+		{
+			in: `[{"metric":"temp","labels":{"room":"a"},"channel":"room","field":"d1"},{"metric":"humi","channel":"room","field":"D2"}]`,
+			want: []Route{
+				{Metric: "temp", Labels: map[string]string{"room": "a"}, Channel: "room", Field: ambidata.FieldD1},
+				{Metric: "humi", Channel: "room", Field: ambidata.FieldD2},
+			},
+		},
+		{in: `[{"channel":"room","field":"d1"}]`, err: true},
+		{in: `[{"metric":"temp","field":"d1"}]`, err: true},
+		{in: `[{"metric":"temp","channel":"room"}]`, err: true},
+		{in: `[{"metric":"temp","channel":"room","field":"d9"}]`, err: true},
+		{in: `[{"metric":"temp","channel":"room","field":"d1","extra":1}]`, err: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRoutes(strings.NewReader(tt.in))
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected error, got nil", tt.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.in, err)
+			continue
+		}
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("%s: mismatch (-want, +got):\n%s", tt.in, diff)
+		}
+	}
+}
+
+func post(r *Receiver, series []timeSeries) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/api/v1/write", bytes.NewReader(snappy.Encode(encodeWriteRequest(series))))
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestReceiver(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := ambimock.New(t)
+	srv.AddChannel(&ambimock.Channel{Info: ambidata.ChannelInfo{Ch: "100"}, WriteKey: "w100"})
+
+	var errs []error
+	r := &Receiver{
+		Routes: []Route{
+			{Metric: "temp", Labels: map[string]string{"room": "a"}, Channel: "room", Field: ambidata.FieldD1},
+			{Metric: "humi", Channel: "room", Field: ambidata.FieldD2},
+			{Metric: "temp", Channel: "missing", Field: ambidata.FieldD1},
+		},
+		Sender: func(channel string) (*ambidata.Sender, error) {
+			if channel == "room" {
+				return srv.Sender("100"), nil
+			}
+			return nil, errors.New("no such channel")
+		},
+		Resolution: 10 * time.Second,
+		Interval:   time.Millisecond,
+		OnError:    func(err error) { errs = append(errs, err) },
+	}
+
+	t0 := time.Date(2006, 1, 2, 15, 4, 0, 0, time.UTC)
+	ms := func(d time.Duration) int64 { return t0.Add(d).UnixMilli() }
+	rec := post(r, []timeSeries{
+		{
+			Labels:  []label{{"__name__", "temp"}, {"room", "a"}},
+			Samples: []sample{{20, ms(1 * time.Second)}, {21, ms(5 * time.Second)}, {22, ms(12 * time.Second)}},
+		},
+		{
+			Labels:  []label{{"__name__", "temp"}, {"room", "b"}},
+			Samples: []sample{{99, ms(1 * time.Second)}},
+		},
+		{
+			Labels:  []label{{"__name__", "humi"}},
+			Samples: []sample{{50, ms(2 * time.Second)}, {math.NaN(), ms(13 * time.Second)}},
+		},
+	})
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected %d, got %d: %s", http.StatusNoContent, rec.Code, rec.Body.String())
+	}
+	rec = post(r, []timeSeries{
+		{
+			Labels:  []label{{"__name__", "humi"}},
+			Samples: []sample{{51, ms(14 * time.Second)}, {52, ms(21 * time.Second)}},
+		},
+	})
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected %d, got %d: %s", http.StatusNoContent, rec.Code, rec.Body.String())
+	}
+
+	// 送信済みの時刻のサンプルは破棄される
+	rec = post(r, []timeSeries{
+		{
+			Labels:  []label{{"__name__", "humi"}},
+			Samples: []sample{{40, ms(3 * time.Second)}},
+		},
+	})
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected %d, got %d: %s", http.StatusNoContent, rec.Code, rec.Body.String())
+	}
+
+	if err := r.Close(ctx); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	want := []ambidata.Data{
+		{Created: t0, D1: ambidata.Just(21.0), D2: ambidata.Just(50.0)},
+		{Created: t0.Add(10 * time.Second), D1: ambidata.Just(22.0), D2: ambidata.Just(51.0)},
+		{Created: t0.Add(20 * time.Second), D2: ambidata.Just(52.0)},
+	}
+	if diff := cmp.Diff(want, srv.Data("100")); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), `"missing"`) {
+		t.Errorf("expected 1 error for channel \"missing\", got %v", errs)
+	}
+
+	if rec := post(r, nil); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("after close: expected %d, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+}
+
+func TestReceiverBadRequest(t *testing.T) {
+	r := &Receiver{}
+	tests := []struct {
+		method string
+		enc    string
+		body   []byte
+		code   int
+	}{
+		{"GET", "", nil, http.StatusMethodNotAllowed},
+		{"POST", "gzip", nil, http.StatusUnsupportedMediaType},
+		{"POST", "snappy", []byte{0x05, 0x00}, http.StatusBadRequest},
+		{"POST", "snappy", snappy.Encode([]byte{0x0a, 0x05}), http.StatusBadRequest},
+		{"POST", "snappy", snappy.Encode(nil), http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/", bytes.NewReader(tt.body))
+		if tt.enc != "" {
+			req.Header.Set("Content-Encoding", tt.enc)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("%s %q %x: expected %d, got %d", tt.method, tt.enc, tt.body, tt.code, rec.Code)
+		}
+	}
+}
+
+func TestReceiverFlushStale(t *testing.T) {
+	srv := ambimock.New(t)
+	srv.AddChannel(&ambimock.Channel{Info: ambidata.ChannelInfo{Ch: "100"}, WriteKey: "w100"})
+
+	t0 := time.Date(2006, 1, 2, 15, 4, 0, 0, time.UTC)
+	r := &Receiver{
+		Routes:     []Route{{Metric: "temp", Channel: "room", Field: ambidata.FieldD1}},
+		Sender:     func(string) (*ambidata.Sender, error) { return srv.Sender("100"), nil },
+		Resolution: 10 * time.Second,
+		Interval:   time.Millisecond,
+	}
+	post(r, []timeSeries{{Labels: []label{{"__name__", "temp"}}, Samples: []sample{{20, t0.UnixMilli()}}}})
+
+	r.flushStale(t0.Add(5 * time.Second))
+	r.mu.Lock()
+	flushed := r.channels["room"].Flushed
+	r.mu.Unlock()
+	if !flushed.Equal(t0) {
+		t.Errorf("expected flushed %v, got %v", t0, flushed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := r.Close(ctx); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	want := []ambidata.Data{{Created: t0, D1: ambidata.Just(20.0)}}
+	if diff := cmp.Diff(want, srv.Data("100")); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
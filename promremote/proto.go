@@ -0,0 +1,159 @@
+package promremote
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Prometheus remote write 1.0 の WriteRequest のうち、必要な部分のみを表します。
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; ... }
+//	message TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; ... }
+//	message Label        { string name = 1; string value = 2; }
+//	message Sample       { double value = 1; int64 timestamp = 2; }
+
+type timeSeries struct {
+	Labels  []label
+	Samples []sample
+}
+
+type label struct {
+	Name  string
+	Value string
+}
+
+type sample struct {
+	Value     float64
+	Timestamp int64 // UNIX 時刻 (ミリ秒)
+}
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncated = errors.New("unexpected end of message")
+
+func decodeWriteRequest(b []byte) ([]timeSeries, error) {
+	var ret []timeSeries
+	err := walk(b, func(num int, typ int, v uint64, p []byte) error {
+		if num != 1 || typ != wireBytes {
+			return nil
+		}
+		ts, err := decodeTimeSeries(p)
+		if err != nil {
+			return fmt.Errorf("timeseries[%d]: %w", len(ret), err)
+		}
+		ret = append(ret, ts)
+		return nil
+	})
+	return ret, err
+}
+
+func decodeTimeSeries(b []byte) (timeSeries, error) {
+	var ts timeSeries
+	err := walk(b, func(num int, typ int, v uint64, p []byte) error {
+		switch {
+		case num == 1 && typ == wireBytes:
+			l, err := decodeLabel(p)
+			if err != nil {
+				return fmt.Errorf("labels[%d]: %w", len(ts.Labels), err)
+			}
+			ts.Labels = append(ts.Labels, l)
+		case num == 2 && typ == wireBytes:
+			s, err := decodeSample(p)
+			if err != nil {
+				return fmt.Errorf("samples[%d]: %w", len(ts.Samples), err)
+			}
+			ts.Samples = append(ts.Samples, s)
+		}
+		return nil
+	})
+	return ts, err
+}
+
+func decodeLabel(b []byte) (label, error) {
+	var l label
+	err := walk(b, func(num int, typ int, v uint64, p []byte) error {
+		switch {
+		case num == 1 && typ == wireBytes:
+			l.Name = string(p)
+		case num == 2 && typ == wireBytes:
+			l.Value = string(p)
+		}
+		return nil
+	})
+	return l, err
+}
+
+func decodeSample(b []byte) (sample, error) {
+	var s sample
+	err := walk(b, func(num int, typ int, v uint64, p []byte) error {
+		switch {
+		case num == 1 && typ == wireFixed64:
+			s.Value = math.Float64frombits(v)
+		case num == 2 && typ == wireVarint:
+			s.Timestamp = int64(v)
+		}
+		return nil
+	})
+	return s, err
+}
+
+// walk はメッセージ b の各フィールドについて fn を呼び出します。
+// 数値型のフィールドの値は v に、長さ付きのフィールドの値は p に渡されます。
+func walk(b []byte, fn func(num int, typ int, v uint64, p []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errTruncated
+		}
+		b = b[n:]
+
+		num, typ := int(key>>3), int(key&7)
+		if num <= 0 {
+			return fmt.Errorf("invalid field number %d", num)
+		}
+
+		var v uint64
+		var p []byte
+		switch typ {
+		case wireVarint:
+			v, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errTruncated
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return errTruncated
+			}
+			v = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return errTruncated
+			}
+			p = b[n : n+int(l)]
+			b = b[n+int(l):]
+		case wireFixed32:
+			if len(b) < 4 {
+				return errTruncated
+			}
+			v = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		default:
+			return fmt.Errorf("unsupported wire type %d", typ)
+		}
+
+		if err := fn(num, typ, v, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,417 @@
+// Package provision は、デバイスキーから送信先のチャネルを解決し、
+// デバイスの [ambidata.Sender] を自動的に用意する機能を提供します。
+//
+// [Provisioner] は [ambidata.Manager.GetDeviceChannelLv1] で取得したチャネル ID とライトキーを
+// メモリとディスクにキャッシュします。キャッシュには有効期限があり、期限が切れると再取得します。
+// 同じデバイスキーの取得が同時に要求された場合は、1回のみ取得します (singleflight)。
+// 多数のデバイスを扱う場合は [Provisioner.ResolveAll] で並行して解決できます。
+//
+// [Provisioner.Sender] が返す [Sender] は、送信が認証エラー (401, 403, 404) で失敗した場合に
+// キャッシュを破棄してチャネルを再取得し、1回だけ再試行します。
+//
+// 使用例:
+//
+//	p := provision.New(ambidata.NewManager(userKey), cacheDir)
+//	s := p.Sender("00:11:22:33:44:55")
+//	err := s.Send(ctx, data)
+package provision
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+)
+
+// DefaultTTL は [Provisioner.TTL] のデフォルト値です。
+const DefaultTTL = 7 * 24 * time.Hour
+
+// DefaultConcurrency は [Provisioner.ResolveAll] の並行数のデフォルト値です。
+const DefaultConcurrency = 4
+
+// Provisioner はデバイスキーから送信先のチャネルを解決します。
+//
+// Provisioner のメソッドは複数の goroutine から同時に呼び出すことができます。
+// ただし、フィールドは使用を開始した後に変更しないでください。
+type Provisioner struct {
+	// Manager はデバイスキーからチャネルを取得するために使用します。
+	// 作成する [ambidata.Sender] の Config には、Manager の Config が設定されます。
+	Manager *ambidata.Manager
+
+	// CacheDir はキャッシュを保存するディレクトリです。
+	// 空文字列の場合は、ディスクにキャッシュしません。
+	// キャッシュにはライトキーが含まれるため、その他のユーザーが読み取れない場所を指定してください。
+	CacheDir string
+
+	// TTL はキャッシュの有効期間です。
+	// 0 以下の場合は、 [DefaultTTL] が使用されます。
+	TTL time.Duration
+
+	// OnError はキャッシュの書き込みに失敗した場合に呼び出されます。
+	// 取得したチャネルはキャッシュの書き込みに失敗しても使用されます。
+	// nil の場合は、エラーは無視されます。
+	OnError func(err error)
+
+	// Now は現在時刻を返す関数です。
+	// nil の場合は、 [time.Now] が使用されます。
+	Now func() time.Time
+
+	mu       sync.Mutex
+	entries  map[string]*entry
+	inflight map[string]*call
+}
+
+type entry struct {
+	Access  ambidata.ChannelAccessLv1
+	Expires time.Time
+}
+
+type call struct {
+	done        chan struct{}
+	access      ambidata.ChannelAccessLv1
+	err         error
+	refresh     bool // 無効なキャッシュを破棄して再取得する場合は true
+	invalidated bool // 取得中に Invalidate が呼び出された場合は true (p.mu で保護)
+}
+
+// New は新しい [Provisioner] を作成します。
+func New(m *ambidata.Manager, cacheDir string) *Provisioner {
+	return &Provisioner{Manager: m, CacheDir: cacheDir}
+}
+
+// Resolve はデバイスキー devKey に関連付けられたチャネルの ID とライトキーを返します。
+// 有効なキャッシュがある場合は、キャッシュを返します。
+func (p *Provisioner) Resolve(ctx context.Context, devKey string) (ambidata.ChannelAccessLv1, error) {
+	return p.resolve(ctx, devKey, nil)
+}
+
+// resolve は [Provisioner.Resolve] の実装です。
+// 同じデバイスキーの取得が実行中の場合は、新たに取得せずにその結果を待ちます。
+//
+// stale が nil でない場合、 *stale と同じ内容のキャッシュは無効とみなし、Ambient から再取得します。
+// 既に他の呼び出しにより再取得されていれば、その結果を返します。
+func (p *Provisioner) resolve(ctx context.Context, devKey string, stale *ambidata.ChannelAccessLv1) (ambidata.ChannelAccessLv1, error) {
+	for {
+		now := p.now()
+
+		p.mu.Lock()
+		if c, ok := p.inflight[devKey]; ok {
+			p.mu.Unlock()
+			access, err := c.wait(ctx)
+			if err != nil || stale == nil || c.refresh || access != *stale {
+				return access, err
+			}
+			// ディスクのキャッシュから無効な内容を読み込んだため、再取得する
+			continue
+		}
+		if e, ok := p.entries[devKey]; ok && now.Before(e.Expires) && (stale == nil || e.Access != *stale) {
+			p.mu.Unlock()
+			return e.Access, nil
+		}
+		c := &call{done: make(chan struct{}), refresh: stale != nil}
+		if p.inflight == nil {
+			p.inflight = map[string]*call{}
+		}
+		p.inflight[devKey] = c
+		if c.refresh {
+			delete(p.entries, devKey)
+		}
+		p.mu.Unlock()
+
+		c.access, c.err = p.load(context.WithoutCancel(ctx), devKey, now, c)
+
+		p.mu.Lock()
+		delete(p.inflight, devKey)
+		p.mu.Unlock()
+		close(c.done)
+		return c.wait(ctx)
+	}
+}
+
+func (c *call) wait(ctx context.Context) (ambidata.ChannelAccessLv1, error) {
+	select {
+	case <-c.done:
+		return c.access, c.err
+	case <-ctx.Done():
+		return ambidata.ChannelAccessLv1{}, ctx.Err()
+	}
+}
+
+// load はディスクのキャッシュ、または Ambient からチャネルを取得し、キャッシュに保存します。
+// c.refresh が true の場合は、ディスクのキャッシュを削除して Ambient から取得します。
+// キャッシュの書き込みに失敗した場合は、 [Provisioner.OnError] に通知し、取得した内容を返します。
+func (p *Provisioner) load(ctx context.Context, devKey string, now time.Time, c *call) (ambidata.ChannelAccessLv1, error) {
+	var e *entry
+	var err error
+	if c.refresh {
+		err = p.removeCache(devKey)
+		if err != nil {
+			return ambidata.ChannelAccessLv1{}, err
+		}
+	} else {
+		e, err = p.readCache(devKey)
+	}
+	if err != nil || e == nil || !now.Before(e.Expires) {
+		if p.Manager == nil {
+			return ambidata.ChannelAccessLv1{}, errors.New("provision: Provisioner.Manager is nil")
+		}
+		access, err := p.Manager.GetDeviceChannelLv1(ctx, devKey)
+		if err != nil {
+			return ambidata.ChannelAccessLv1{}, fmt.Errorf("provision: %w", err)
+		}
+		e = &entry{Access: access, Expires: now.Add(p.ttl())}
+		if err := p.writeCache(devKey, e); err != nil && p.OnError != nil {
+			p.OnError(err)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c.invalidated {
+		// 取得中に Invalidate が呼び出された場合は、取得した内容をキャッシュしない
+		return e.Access, nil
+	}
+	if p.entries == nil {
+		p.entries = map[string]*entry{}
+	}
+	p.entries[devKey] = e
+	return e.Access, nil
+}
+
+// Invalidate はデバイスキー devKey のキャッシュを破棄します。
+// 取得が実行中の場合、その結果はキャッシュされません。
+func (p *Provisioner) Invalidate(devKey string) error {
+	p.mu.Lock()
+	delete(p.entries, devKey)
+	if c, ok := p.inflight[devKey]; ok {
+		c.invalidated = true
+	}
+	p.mu.Unlock()
+	return p.removeCache(devKey)
+}
+
+// ResolveAll は複数のデバイスキーを並行して解決します。
+// concurrency は同時に行う取得の最大数で、0 以下の場合は [DefaultConcurrency] が使用されます。
+// 解決に成功したデバイスキーの結果を返します。
+// 失敗したデバイスキーがある場合は、それらのエラーをまとめたエラーも返します。
+func (p *Provisioner) ResolveAll(ctx context.Context, devKeys []string, concurrency int) (map[string]ambidata.ChannelAccessLv1, error) {
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+
+	var mu sync.Mutex
+	ret := make(map[string]ambidata.ChannelAccessLv1, len(devKeys))
+	var errs []error
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, devKey := range devKeys {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", devKey, ctx.Err()))
+				mu.Unlock()
+				return
+			}
+			defer func() { <-sem }()
+
+			access, err := p.Resolve(ctx, devKey)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", devKey, err))
+				return
+			}
+			ret[devKey] = access
+		}()
+	}
+	wg.Wait()
+	return ret, errors.Join(errs...)
+}
+
+type cacheFile struct {
+	DevKey   string    `json:"devKey"`
+	Ch       string    `json:"ch"`
+	WriteKey string    `json:"writeKey"`
+	Expires  time.Time `json:"expires"`
+}
+
+// cachePath はキャッシュファイルのパスを返します。
+// デバイスキーはファイル名に使用できない文字を含む可能性があるため、ハッシュ値をファイル名にします。
+func (p *Provisioner) cachePath(devKey string) string {
+	sum := sha256.Sum256([]byte(devKey))
+	return filepath.Join(p.CacheDir, hex.EncodeToString(sum[:16])+".json")
+}
+
+func (p *Provisioner) readCache(devKey string) (*entry, error) {
+	if p.CacheDir == "" {
+		return nil, fs.ErrNotExist
+	}
+	b, err := os.ReadFile(p.cachePath(devKey))
+	if err != nil {
+		return nil, err
+	}
+	var j cacheFile
+	if err := json.Unmarshal(b, &j); err != nil {
+		return nil, err
+	}
+	if j.DevKey != devKey {
+		return nil, fs.ErrNotExist
+	}
+	return &entry{Access: ambidata.ChannelAccessLv1{Ch: j.Ch, WriteKey: j.WriteKey}, Expires: j.Expires}, nil
+}
+
+func (p *Provisioner) removeCache(devKey string) error {
+	if p.CacheDir == "" {
+		return nil
+	}
+	if err := os.Remove(p.cachePath(devKey)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("provision: %w", err)
+	}
+	return nil
+}
+
+func (p *Provisioner) writeCache(devKey string, e *entry) error {
+	if p.CacheDir == "" {
+		return nil
+	}
+	b, err := json.Marshal(cacheFile{DevKey: devKey, Ch: e.Access.Ch, WriteKey: e.Access.WriteKey, Expires: e.Expires})
+	if err != nil {
+		return fmt.Errorf("provision: %w", err)
+	}
+	if err := os.MkdirAll(p.CacheDir, 0o700); err != nil {
+		return fmt.Errorf("provision: %w", err)
+	}
+
+	// 書き込み途中のファイルを読み込まないよう、一時ファイルに書き込んでから置き換える
+	tmp, err := os.CreateTemp(p.CacheDir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("provision: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("provision: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("provision: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), p.cachePath(devKey)); err != nil {
+		return fmt.Errorf("provision: %w", err)
+	}
+	return nil
+}
+
+// Sender はデバイスキー devKey のデバイスのための [Sender] を返します。
+// チャネルの解決は最初の送信時に行われます。
+func (p *Provisioner) Sender(devKey string) *Sender {
+	return &Sender{p: p, devKey: devKey}
+}
+
+// Sender はデバイスキーで送信先を解決する [ambidata.Sender] のラッパーです。
+// 送信が認証エラーで失敗した場合は、チャネルを再取得して1回だけ再試行します。
+type Sender struct {
+	p      *Provisioner
+	devKey string
+}
+
+// DevKey はデバイスキーを返します。
+func (s *Sender) DevKey() string {
+	return s.devKey
+}
+
+// Resolve はデバイスの送信先の [ambidata.Sender] を返します。
+func (s *Sender) Resolve(ctx context.Context) (*ambidata.Sender, error) {
+	access, err := s.p.Resolve(ctx, s.devKey)
+	if err != nil {
+		return nil, err
+	}
+	return s.sender(&access), nil
+}
+
+func (s *Sender) sender(access *ambidata.ChannelAccessLv1) *ambidata.Sender {
+	snd := ambidata.NewSenderFromChannelAccessLv1(access)
+	if s.p.Manager != nil {
+		snd.Config = s.p.Manager.Config
+	}
+	return snd
+}
+
+// Send は [ambidata.Sender.Send] を呼び出します。
+func (s *Sender) Send(ctx context.Context, data ambidata.Data) error {
+	return s.do(ctx, func(snd *ambidata.Sender) error { return snd.Send(ctx, data) })
+}
+
+// SendBulk は [ambidata.Sender.SendBulk] を呼び出します。
+func (s *Sender) SendBulk(ctx context.Context, arr []ambidata.Data) error {
+	return s.do(ctx, func(snd *ambidata.Sender) error { return snd.SendBulk(ctx, arr) })
+}
+
+// SetCmnt は [ambidata.Sender.SetCmnt] を呼び出します。
+func (s *Sender) SetCmnt(ctx context.Context, created time.Time, cmnt string) error {
+	return s.do(ctx, func(snd *ambidata.Sender) error { return snd.SetCmnt(ctx, created, cmnt) })
+}
+
+// SetHide は [ambidata.Sender.SetHide] を呼び出します。
+func (s *Sender) SetHide(ctx context.Context, created time.Time, hide bool) error {
+	return s.do(ctx, func(snd *ambidata.Sender) error { return snd.SetHide(ctx, created, hide) })
+}
+
+func (s *Sender) do(ctx context.Context, fn func(*ambidata.Sender) error) error {
+	access, err := s.p.Resolve(ctx, s.devKey)
+	if err != nil {
+		return err
+	}
+	err = fn(s.sender(&access))
+	if !isAuthError(err) {
+		return err
+	}
+
+	// 同じデバイスの複数の Sender が同時に失敗した場合も、再取得は1回のみ行う
+	access, err = s.p.resolve(ctx, s.devKey, &access)
+	if err != nil {
+		return err
+	}
+	return fn(s.sender(&access))
+}
+
+func isAuthError(err error) bool {
+	var sc *ambidata.StatusCodeError
+	if !errors.As(err, &sc) {
+		return false
+	}
+	switch sc.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *Provisioner) ttl() time.Duration {
+	if p.TTL <= 0 {
+		return DefaultTTL
+	}
+	return p.TTL
+}
+
+func (p *Provisioner) now() time.Time {
+	if p.Now == nil {
+		return time.Now()
+	}
+	return p.Now()
+}
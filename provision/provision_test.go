@@ -0,0 +1,264 @@
+package provision
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/internal/ambimock"
+	"github.com/google/go-cmp/cmp"
+)
+
+func newTestServer(t *testing.T) *ambimock.Server {
+	srv := ambimock.New(t)
+	srv.AddChannel(&ambimock.Channel{
+		Info:     ambidata.ChannelInfo{Ch: "100", DevKeys: []string{"aa:bb:cc:00:00:01"}},
+		UserKey:  "user",
+		WriteKey: "w100",
+	})
+	srv.AddChannel(&ambimock.Channel{
+		Info:     ambidata.ChannelInfo{Ch: "200", DevKeys: []string{"aa:bb:cc:00:00:02"}},
+		UserKey:  "user",
+		WriteKey: "w200",
+	})
+	return srv
+}
+
+func countLookups(srv *ambimock.Server) int {
+	n := 0
+	for _, req := range srv.Requests() {
+		if req.Path == "/api/v2/channels/" && req.Query.Has("devKey") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestProvisionerResolve(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := newTestServer(t)
+	dir := t.TempDir()
+	now := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	p := New(srv.Manager("user"), dir)
+	p.Now = func() time.Time { return now }
+
+	want := ambidata.ChannelAccessLv1{Ch: "100", WriteKey: "w100"}
+	for range 2 {
+		got, err := p.Resolve(ctx, "aa:bb:cc:00:00:01")
+		if err != nil {
+			t.Fatalf("resolve: %v", err)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("mismatch (-want, +got):\n%s", diff)
+		}
+	}
+	if n := countLookups(srv); n != 1 {
+		t.Errorf("expected 1 lookup, got %d", n)
+	}
+
+	// ディスクのキャッシュは別の Provisioner からも読み込める
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 1 {
+		t.Fatalf("expected 1 cache file, got %v", files)
+	}
+	if st, err := os.Stat(files[0]); err == nil && st.Mode().Perm()&0o077 != 0 {
+		t.Errorf("cache file: expected private permissions, got %v", st.Mode().Perm())
+	}
+	p2 := New(srv.Manager("user"), dir)
+	p2.Now = p.Now
+	if got, err := p2.Resolve(ctx, "aa:bb:cc:00:00:01"); err != nil || got != want {
+		t.Errorf("from disk: expected %v, got %v (err=%v)", want, got, err)
+	}
+	if n := countLookups(srv); n != 1 {
+		t.Errorf("expected 1 lookup, got %d", n)
+	}
+
+	// 有効期限が切れると再取得する
+	now = now.Add(DefaultTTL)
+	if _, err := p2.Resolve(ctx, "aa:bb:cc:00:00:01"); err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if n := countLookups(srv); n != 2 {
+		t.Errorf("expected 2 lookups, got %d", n)
+	}
+
+	if err := p2.Invalidate("aa:bb:cc:00:00:01"); err != nil {
+		t.Fatalf("invalidate: %v", err)
+	}
+	files, _ = filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 0 {
+		t.Errorf("expected no cache files after invalidate, got %v", files)
+	}
+}
+
+func TestProvisionerSingleflight(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := newTestServer(t)
+	release := make(chan struct{})
+	srv.Hook = func(r *http.Request) int {
+		<-release
+		return 0
+	}
+	p := New(srv.Manager("user"), "")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := p.Resolve(ctx, "aa:bb:cc:00:00:01")
+			errs <- err
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("resolve: %v", err)
+		}
+	}
+	if n := countLookups(srv); n != 1 {
+		t.Errorf("expected 1 lookup, got %d", n)
+	}
+}
+
+func TestProvisionerResolveAll(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := newTestServer(t)
+	p := New(srv.Manager("user"), "")
+
+	got, err := p.ResolveAll(ctx, []string{"aa:bb:cc:00:00:01", "aa:bb:cc:00:00:02", "unknown"}, 2)
+	if err == nil {
+		t.Errorf("expected error for unknown device key")
+	}
+	want := map[string]ambidata.ChannelAccessLv1{
+		"aa:bb:cc:00:00:01": {Ch: "100", WriteKey: "w100"},
+		"aa:bb:cc:00:00:02": {Ch: "200", WriteKey: "w200"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestSenderRefresh(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := newTestServer(t)
+	p := New(srv.Manager("user"), t.TempDir())
+	s := p.Sender("aa:bb:cc:00:00:01")
+
+	t0 := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	if err := s.Send(ctx, ambidata.Data{Created: t0, D1: ambidata.Just(1.0)}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	// ライトキーが変更されても、再取得して送信できる
+	srv.AddChannel(&ambimock.Channel{
+		Info:     ambidata.ChannelInfo{Ch: "100", DevKeys: []string{"aa:bb:cc:00:00:01"}},
+		UserKey:  "user",
+		WriteKey: "w100-new",
+		Data:     srv.Data("100"),
+	})
+	if err := s.SendBulk(ctx, []ambidata.Data{{Created: t0.Add(time.Second), D1: ambidata.Just(2.0)}}); err != nil {
+		t.Fatalf("send bulk: %v", err)
+	}
+	if err := s.SetCmnt(ctx, t0, "first"); err != nil {
+		t.Fatalf("set cmnt: %v", err)
+	}
+
+	want := []ambidata.Data{
+		{Created: t0, D1: ambidata.Just(1.0), Cmnt: "first"},
+		{Created: t0.Add(time.Second), D1: ambidata.Just(2.0)},
+	}
+	if diff := cmp.Diff(want, srv.Data("100")); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+	if n := countLookups(srv); n != 2 {
+		t.Errorf("expected 2 lookups, got %d", n)
+	}
+}
+
+func TestSenderRefreshConcurrent(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := newTestServer(t)
+	p := New(srv.Manager("user"), t.TempDir())
+	if _, err := p.Resolve(ctx, "aa:bb:cc:00:00:01"); err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	srv.AddChannel(&ambimock.Channel{
+		Info:     ambidata.ChannelInfo{Ch: "100", DevKeys: []string{"aa:bb:cc:00:00:01"}},
+		UserKey:  "user",
+		WriteKey: "w100-new",
+	})
+
+	// 同じデバイスの複数の Sender が同時に認証エラーになっても、再取得は1回のみ
+	t0 := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- p.Sender("aa:bb:cc:00:00:01").Send(ctx, ambidata.Data{Created: t0.Add(time.Duration(i) * time.Second)})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("send: %v", err)
+		}
+	}
+	if n := len(srv.Data("100")); n != 10 {
+		t.Errorf("expected 10 data points, got %d", n)
+	}
+	if n := countLookups(srv); n != 2 {
+		t.Errorf("expected 2 lookups, got %d", n)
+	}
+}
+
+func TestProvisionerCacheWriteError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// キャッシュのディレクトリを作成できないよう、同じパスにファイルを置く
+	dir := filepath.Join(t.TempDir(), "cache")
+	if err := os.WriteFile(dir, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := newTestServer(t)
+	p := New(srv.Manager("user"), dir)
+	var errs []error
+	p.OnError = func(err error) { errs = append(errs, err) }
+
+	got, err := p.Resolve(ctx, "aa:bb:cc:00:00:01")
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if want := (ambidata.ChannelAccessLv1{Ch: "100", WriteKey: "w100"}); got != want {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if len(errs) != 1 {
+		t.Errorf("expected 1 error, got %v", errs)
+	}
+}
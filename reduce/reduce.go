@@ -0,0 +1,404 @@
+// Package reduce は、一定の時間幅 (ウィンドウ) ごとにデータポイントを集約し、
+// ウィンドウごとに1つのデータポイントとして送信する機能を提供します。
+//
+// 1日あたりのデータポイント数の制限 ([ambidata.MaxDataPerDay]) より高い頻度で
+// サンプリングする場合に、値の特徴を保ったまま送信するデータポイント数を減らすことができます。
+// データ1～8には、それぞれ異なる集約関数 ([Func]) を指定できます。
+//
+// 使用例:
+//
+//	r := reduce.New(ambidata.NewSender(ch, writeKey))
+//	r.Window = time.Minute
+//	r.Funcs = map[ambidata.Field]reduce.Func{ambidata.FieldD1: reduce.Mean, ambidata.FieldD2: reduce.Max}
+//	go r.Run(ctx)
+//	defer r.Close(context.Background())
+//
+//	err := r.Add(ambidata.Data{Created: time.Now(), D1: ambidata.Just(temp), D2: ambidata.Just(peak)})
+package reduce
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/internal/batch"
+)
+
+// DefaultWindow は [Options.Window] のデフォルト値です。
+const DefaultWindow = time.Minute
+
+var (
+	// ErrClosed は [Reducer.Close] の後に [Reducer.Add] が呼び出された場合のエラーです。
+	ErrClosed = errors.New("reduce: reducer is closed")
+
+	// ErrLate は現在のウィンドウより前、または送信済みのウィンドウの時刻のデータポイントが [Reducer.Add] に渡された場合のエラーです。
+	// データポイントは破棄されます。
+	ErrLate = errors.New("reduce: data point belongs to a window that is already past or sent")
+)
+
+// Func はウィンドウ内の値の集約関数です。
+type Func int
+
+const (
+	Mean  Func = iota // 平均値
+	Min               // 最小値
+	Max               // 最大値
+	First             // 最初の値
+	Last              // 最後の値
+	Sum               // 合計
+	Count             // 値の数
+)
+
+var funcNames = [...]string{"mean", "min", "max", "first", "last", "sum", "count"}
+
+// String は f を "mean" のような形式の文字列に変換します。
+func (f Func) String() string {
+	if f < 0 || int(f) >= len(funcNames) {
+		return fmt.Sprintf("Func(%d)", int(f))
+	}
+	return funcNames[f]
+}
+
+// ParseFunc は "mean", "min", "max", "first", "last", "sum", "count" のいずれかの文字列を [Func] に変換します。
+func ParseFunc(s string) (Func, error) {
+	i := slices.Index(funcNames[:], s)
+	if i < 0 {
+		return 0, fmt.Errorf("reduce: invalid function %q", s)
+	}
+	return Func(i), nil
+}
+
+// Align は集約したデータポイントの時刻を、ウィンドウのどの位置に合わせるかを表します。
+type Align int
+
+const (
+	AlignStart Align = iota // ウィンドウの開始時刻
+	AlignMid                // ウィンドウの中間の時刻
+	AlignEnd                // ウィンドウの終了時刻 (次のウィンドウの開始時刻)
+)
+
+// Options は集約の設定です。
+type Options struct {
+	// Window はウィンドウの時間幅です。
+	// ウィンドウの境界は時刻を Window で切り捨てた値 ([time.Time.Truncate]) です。
+	// 1日を割り切る値の場合、境界は UTC の0時を基準とします。
+	// 0 以下の場合は、 [DefaultWindow] が使用されます。
+	Window time.Duration
+
+	// Funcs はデータ番号ごとの集約関数です。
+	// 含まれないデータ番号には [Mean] が使用されます。
+	Funcs map[ambidata.Field]Func
+
+	// Align は集約したデータポイントの時刻の位置です。
+	Align Align
+}
+
+func (opt *Options) window() time.Duration {
+	if opt.Window <= 0 {
+		return DefaultWindow
+	}
+	return opt.Window
+}
+
+// Reduce は arr のデータポイントをウィンドウごとに集約し、時刻順に並べて返します。
+// arr は時刻順に並んでいる必要はありません。
+//
+// 値が1つも存在しないデータ番号は、集約後のデータポイントにも含まれません。
+// 位置情報とコメントはウィンドウ内で最後に存在するものが使用され、
+// 非表示フラグはいずれかのデータポイントで設定されていれば設定されます。
+//
+// 時刻がゼロ値のデータポイント (時刻をサーバーが設定するもの) は時刻を決められないため、
+// それらだけを1つのデータポイントに集約し、時刻をゼロ値のまま最後に追加します。
+func Reduce(arr []ambidata.Data, opt Options) []ambidata.Data {
+	arr = slices.Clone(arr)
+	slices.SortStableFunc(arr, func(a, b ambidata.Data) int { return a.Created.Compare(b.Created) })
+
+	ret := []ambidata.Data{}
+	var zero, cur *acc
+	for i := range arr {
+		if arr[i].Created.IsZero() {
+			if zero == nil {
+				zero = &acc{}
+			}
+			zero.add(&arr[i])
+			continue
+		}
+		start := arr[i].Created.Truncate(opt.window())
+		if cur != nil && !start.Equal(cur.start) {
+			ret = append(ret, cur.result(&opt))
+			cur = nil
+		}
+		if cur == nil {
+			cur = &acc{start: start}
+		}
+		cur.add(&arr[i])
+	}
+	if cur != nil {
+		ret = append(ret, cur.result(&opt))
+	}
+	if zero != nil {
+		data := zero.result(&opt)
+		data.Created = time.Time{}
+		ret = append(ret, data)
+	}
+	return ret
+}
+
+// acc は1つのウィンドウの集約の途中経過です。
+type acc struct {
+	start time.Time
+	n     [len(ambidata.Fields)]int
+	sum   [len(ambidata.Fields)]float64
+	min   [len(ambidata.Fields)]float64
+	max   [len(ambidata.Fields)]float64
+	first [len(ambidata.Fields)]float64
+	last  [len(ambidata.Fields)]float64
+	loc   ambidata.Maybe[ambidata.Location]
+	cmnt  string
+	hide  bool
+}
+
+func (a *acc) add(d *ambidata.Data) {
+	for i, f := range ambidata.Fields {
+		v := d.Field(f)
+		if !v.OK {
+			continue
+		}
+		if a.n[i] == 0 {
+			a.min[i], a.max[i], a.first[i] = v.V, v.V, v.V
+		}
+		a.min[i] = min(a.min[i], v.V)
+		a.max[i] = max(a.max[i], v.V)
+		a.sum[i] += v.V
+		a.last[i] = v.V
+		a.n[i]++
+	}
+	if d.Loc.OK {
+		a.loc = d.Loc
+	}
+	if d.Cmnt != "" {
+		a.cmnt = d.Cmnt
+	}
+	a.hide = a.hide || d.Hide
+}
+
+func (a *acc) result(opt *Options) ambidata.Data {
+	data := ambidata.Data{Loc: a.loc, Cmnt: a.cmnt, Hide: a.hide}
+	switch opt.Align {
+	case AlignMid:
+		data.Created = a.start.Add(opt.window() / 2).Truncate(time.Millisecond)
+	case AlignEnd:
+		data.Created = a.start.Add(opt.window())
+	default:
+		data.Created = a.start
+	}
+
+	for i, f := range ambidata.Fields {
+		if a.n[i] == 0 {
+			continue
+		}
+		var v float64
+		switch cmp.Or(opt.Funcs[f], Mean) {
+		case Min:
+			v = a.min[i]
+		case Max:
+			v = a.max[i]
+		case First:
+			v = a.first[i]
+		case Last:
+			v = a.last[i]
+		case Sum:
+			v = a.sum[i]
+		case Count:
+			v = float64(a.n[i])
+		default:
+			v = a.sum[i] / float64(a.n[i])
+		}
+		data.SetField(f, ambidata.Just(v))
+	}
+	return data
+}
+
+// Reducer は追加されたデータポイントをウィンドウごとに集約し、
+// ウィンドウが終了するたびに送信します。
+//
+// ウィンドウの終了は、次のウィンドウのデータポイントが追加された時点、
+// または [Reducer.Run] によりウィンドウの終了時刻が経過したことが検出された時点で判定されます。
+// 送信済みのウィンドウと、それより前のウィンドウのデータポイントは追加できません ([ErrLate]) 。
+//
+// 集約したデータポイントはキューに追加され、 [Reducer.Interval] 以上の間隔を空けて、集約した順に送信されます。
+// 過去のデータポイントを一度に追加した場合など、キューに複数のウィンドウがある場合は
+// [ambidata.Sender.SendBulk] でまとめて送信します。
+// キューと送信の処理は、各種ブリッジと共通の internal/batch パッケージにより行います。
+//
+// Reducer のメソッドは複数の goroutine から同時に呼び出すことができます。
+// フィールドは使用を開始した後に変更しないでください。
+type Reducer struct {
+	Options
+
+	// Sender は送信先のチャネルの [ambidata.Sender] です。
+	Sender *ambidata.Sender
+
+	// Interval は送信間隔です。
+	// 0 以下の場合は、 [ambidata.MinSendInterval] が使用されます。
+	Interval time.Duration
+
+	// OnError は送信エラーが発生した場合に呼び出されます。
+	// 再試行しても解決しないエラーの場合、送信しようとしたデータポイントは破棄されます。
+	// nil の場合は、エラーは無視されます。
+	OnError func(err error)
+
+	// Now は現在時刻を返す関数です。 [Reducer.Run] がウィンドウの終了を判定する際と、
+	// [Reducer.Add] に時刻がゼロ値のデータポイントが渡された際に使用します。
+	// nil の場合は、 [time.Now] が使用されます。
+	Now func() time.Time
+
+	mu      sync.Mutex
+	cur     *acc
+	last    time.Time // 最後に集約したウィンドウの開始時刻
+	emitted bool      // ウィンドウを集約したことがある場合は true
+	closed  bool
+	batcher *batch.Batcher
+}
+
+// New は新しい [Reducer] を作成します。
+func New(s *ambidata.Sender) *Reducer {
+	return &Reducer{Sender: s}
+}
+
+// Add はデータポイントを現在のウィンドウに追加します。
+// data が次以降のウィンドウに属する場合は、現在のウィンドウを集約して送信のキューに追加してから追加します。
+// data の時刻がゼロ値の場合は、現在時刻 ([Reducer.Now]) のデータポイントとして扱います。
+// 送信の完了は待ちません。送信エラーは [Reducer.OnError] に渡されます。
+func (r *Reducer) Add(data ambidata.Data) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return ErrClosed
+	}
+	if data.Created.IsZero() {
+		data.Created = r.now()
+	}
+	start := data.Created.Truncate(r.window())
+	if (r.cur != nil && start.Before(r.cur.start)) || (r.emitted && !start.After(r.last)) {
+		return ErrLate
+	}
+	if r.cur != nil && start.After(r.cur.start) {
+		r.emit()
+	}
+	if r.cur == nil {
+		r.cur = &acc{start: start}
+	}
+	r.cur.add(&data)
+	return nil
+}
+
+// Flush は現在のウィンドウを終了を待たずに集約し、送信のキューに追加します。
+// 以降、そのウィンドウのデータポイントは追加できません。
+func (r *Reducer) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return ErrClosed
+	}
+	r.emit()
+	return nil
+}
+
+// Run はウィンドウの境界ごとに、終了時刻を経過したウィンドウを集約して送信します。
+// データポイントの追加が途絶えた場合も、ウィンドウの値が送信されずに残ることを防ぎます。
+// ctx がキャンセルされるか、 [Reducer.Close] が呼び出されるまで戻りません。
+// 戻り値は ctx.Err() または [ErrClosed] です。
+func (r *Reducer) Run(ctx context.Context) error {
+	w := r.window()
+	for {
+		now := r.now()
+		t := time.NewTimer(now.Truncate(w).Add(w).Sub(now))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			return ErrClosed
+		}
+		if r.cur != nil && !r.now().Before(r.cur.start.Add(w)) {
+			r.emit()
+		}
+		r.mu.Unlock()
+	}
+}
+
+// Close は現在のウィンドウを集約し、以降のデータポイントの追加を停止します。
+// キューに残っているデータポイントの送信が完了するか、ctx が終了するまで待機します。
+// ctx が終了した場合、未送信のデータポイントは破棄され、その数を含むエラーを返します。
+func (r *Reducer) Close(ctx context.Context) error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.emit()
+	r.closed = true
+	b := r.batcher
+	r.mu.Unlock()
+	if b == nil {
+		return nil
+	}
+
+	err := b.Close(ctx)
+	var ue *batch.UnsentError
+	if !errors.As(err, &ue) {
+		return err
+	}
+	n := 0
+	for _, arr := range ue.Unsent {
+		n += len(arr)
+	}
+	return fmt.Errorf("reduce: %w (%d data points unsent)", ue.Err, n)
+}
+
+// emit は現在のウィンドウを集約したデータポイントを送信のキューに追加し、ウィンドウをリセットします。
+// ウィンドウにデータポイントがない場合は何もしません。
+// r.mu をロックした状態で呼び出してください。
+func (r *Reducer) emit() {
+	if r.cur == nil {
+		return
+	}
+	data := r.cur.result(&r.Options)
+	r.last = r.cur.start
+	r.emitted = true
+	r.cur = nil
+
+	if r.batcher == nil {
+		r.batcher = &batch.Batcher{
+			Interval: r.Interval,
+			FIFO:     true,
+			OnError:  r.onError,
+		}
+	}
+	// r.closed が true になる前に呼び出すため、 ErrClosed は返らない
+	_ = r.batcher.Add(r.Sender, data)
+}
+
+func (r *Reducer) onError(ch string, err error) {
+	if r.OnError != nil {
+		r.OnError(err)
+	}
+}
+
+func (r *Reducer) now() time.Time {
+	if r.Now == nil {
+		return time.Now()
+	}
+	return r.Now()
+}
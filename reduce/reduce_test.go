@@ -0,0 +1,318 @@
+package reduce
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/internal/ambimock"
+	"github.com/google/go-cmp/cmp"
+)
+
+var t0 = time.Date(2006, 1, 2, 15, 4, 0, 0, time.UTC)
+
+func TestReduce(t *testing.T) {
+	loc := ambidata.Just(ambidata.Location{Lat: 35, Lng: 139})
+	in := []ambidata.Data{
+		{Created: t0.Add(70 * time.Second), D1: ambidata.Just(10.0)},
+		{Created: t0.Add(10 * time.Second), D1: ambidata.Just(3.0), D2: ambidata.Just(1.0), Cmnt: "a"},
+		{Created: t0, D1: ambidata.Just(1.0), D2: ambidata.Just(4.0), Loc: loc},
+		{Created: t0.Add(20 * time.Second), D1: ambidata.Just(2.0), Hide: true},
+	}
+
+	tests := []struct {
+		name string
+		opt  Options
+		want []ambidata.Data
+	}{
+		{
+			name: "Default",
+			opt:  Options{},
+			want: []ambidata.Data{
+				{Created: t0, D1: ambidata.Just(2.0), D2: ambidata.Just(2.5), Loc: loc, Cmnt: "a", Hide: true},
+				{Created: t0.Add(time.Minute), D1: ambidata.Just(10.0)},
+			},
+		},
+		{
+			name: "Funcs",
+			opt: Options{Window: time.Hour, Funcs: map[ambidata.Field]Func{
+				ambidata.FieldD1: Max,
+				ambidata.FieldD2: Count,
+			}},
+			want: []ambidata.Data{
+				{Created: t0.Truncate(time.Hour), D1: ambidata.Just(10.0), D2: ambidata.Just(2.0), Loc: loc, Cmnt: "a", Hide: true},
+			},
+		},
+		{
+			name: "FirstLast",
+			opt: Options{Funcs: map[ambidata.Field]Func{
+				ambidata.FieldD1: First,
+				ambidata.FieldD2: Last,
+			}},
+			want: []ambidata.Data{
+				{Created: t0, D1: ambidata.Just(1.0), D2: ambidata.Just(1.0), Loc: loc, Cmnt: "a", Hide: true},
+				{Created: t0.Add(time.Minute), D1: ambidata.Just(10.0)},
+			},
+		},
+		{
+			name: "MinSumMid",
+			opt: Options{Align: AlignMid, Funcs: map[ambidata.Field]Func{
+				ambidata.FieldD1: Min,
+				ambidata.FieldD2: Sum,
+			}},
+			want: []ambidata.Data{
+				{Created: t0.Add(30 * time.Second), D1: ambidata.Just(1.0), D2: ambidata.Just(5.0), Loc: loc, Cmnt: "a", Hide: true},
+				{Created: t0.Add(90 * time.Second), D1: ambidata.Just(10.0)},
+			},
+		},
+		{
+			name: "End",
+			opt:  Options{Align: AlignEnd},
+			want: []ambidata.Data{
+				{Created: t0.Add(time.Minute), D1: ambidata.Just(2.0), D2: ambidata.Just(2.5), Loc: loc, Cmnt: "a", Hide: true},
+				{Created: t0.Add(2 * time.Minute), D1: ambidata.Just(10.0)},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		got := Reduce(in, tt.opt)
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("%s: mismatch (-want, +got):\n%s", tt.name, diff)
+		}
+	}
+}
+
+func TestReduceZeroCreated(t *testing.T) {
+	in := []ambidata.Data{
+		{D1: ambidata.Just(1.0)},
+		{Created: t0, D1: ambidata.Just(5.0)},
+		{D1: ambidata.Just(3.0)},
+	}
+	want := []ambidata.Data{
+		{Created: t0.Add(time.Minute), D1: ambidata.Just(5.0)},
+		{D1: ambidata.Just(2.0)},
+	}
+	if diff := cmp.Diff(want, Reduce(in, Options{Align: AlignEnd})); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestParseFunc(t *testing.T) {
+	for f := Mean; f <= Count; f++ {
+		got, err := ParseFunc(f.String())
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", f, err)
+		}
+		if got != f {
+			t.Errorf("%v: expected %v, got %v", f, f, got)
+		}
+	}
+	if _, err := ParseFunc("median"); err == nil {
+		t.Errorf("median: expected error, got nil")
+	}
+}
+
+func newServer(t *testing.T) *ambimock.Server {
+	srv := ambimock.New(t)
+	srv.AddChannel(&ambimock.Channel{Info: ambidata.ChannelInfo{Ch: "1"}, ReadKey: "rk", WriteKey: "wk"})
+	return srv
+}
+
+// waitData はチャネルのデータポイントが n 個以上になるまで待機します。
+func waitData(t *testing.T, srv *ambimock.Server, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(srv.Data("1")) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d data points", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReducer(t *testing.T) {
+	ctx := context.Background()
+	srv := newServer(t)
+	r := New(srv.Sender("1"))
+	r.Interval = time.Millisecond
+
+	for i, v := range []float64{1, 2, 3, 4} {
+		err := r.Add(ambidata.Data{Created: t0.Add(time.Duration(i) * 30 * time.Second), D1: ambidata.Just(v)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitData(t, srv, 1)
+	if diff := cmp.Diff([]ambidata.Data{
+		{Created: t0, D1: ambidata.Just(1.5)},
+	}, srv.Data("1")); diff != "" {
+		t.Errorf("Add: mismatch (-want, +got):\n%s", diff)
+	}
+
+	err := r.Add(ambidata.Data{Created: t0, D1: ambidata.Just(5.0)})
+	if !errors.Is(err, ErrLate) {
+		t.Errorf("late: expected ErrLate, got %v", err)
+	}
+
+	// Flush で送信したウィンドウには追加できない
+	err = r.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Add(ambidata.Data{Created: t0.Add(time.Minute + 50*time.Second), D1: ambidata.Just(5.0)})
+	if !errors.Is(err, ErrLate) {
+		t.Errorf("after Flush: expected ErrLate, got %v", err)
+	}
+
+	err = r.Close(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]ambidata.Data{
+		{Created: t0, D1: ambidata.Just(1.5)},
+		{Created: t0.Add(time.Minute), D1: ambidata.Just(3.5)},
+	}, srv.Data("1")); diff != "" {
+		t.Errorf("Close: mismatch (-want, +got):\n%s", diff)
+	}
+
+	err = r.Add(ambidata.Data{Created: t0.Add(time.Hour), D1: ambidata.Just(5.0)})
+	if !errors.Is(err, ErrClosed) {
+		t.Errorf("closed: expected ErrClosed, got %v", err)
+	}
+}
+
+func TestReducerBackfill(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := newServer(t)
+	block := make(chan struct{})
+	srv.Hook = func(r *http.Request) int {
+		<-block
+		return 0
+	}
+
+	r := New(srv.Sender("1"))
+	r.Interval = 20 * time.Millisecond
+
+	// 送信中も Add はブロックしない
+	var want []ambidata.Data
+	for i := range 5 {
+		created := t0.Add(time.Duration(i) * time.Minute)
+		want = append(want, ambidata.Data{Created: created, D1: ambidata.Just(float64(i))})
+		err := r.Add(ambidata.Data{Created: created, D1: ambidata.Just(float64(i))})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(block)
+
+	err := r.Close(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, srv.Data("1")); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+
+	// 送信は Interval 以上の間隔を空ける
+	var last time.Time
+	for _, req := range srv.Requests() {
+		if !last.IsZero() && req.Time.Sub(last) < r.Interval {
+			t.Errorf("interval: expected at least %v, got %v", r.Interval, req.Time.Sub(last))
+		}
+		last = req.Time
+	}
+}
+
+func TestReducerZeroCreated(t *testing.T) {
+	ctx := context.Background()
+	srv := newServer(t)
+	now := t0
+	r := New(srv.Sender("1"))
+	r.Interval = time.Millisecond
+	r.Align = AlignEnd
+	r.Now = func() time.Time { return now }
+
+	// 時刻がゼロ値のデータポイントは現在時刻のウィンドウに追加する
+	for i, v := range []float64{1, 3, 10} {
+		now = t0.Add(time.Duration(i) * 40 * time.Second)
+		err := r.Add(ambidata.Data{D1: ambidata.Just(v)})
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+	}
+	err := r.Close(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]ambidata.Data{
+		{Created: t0.Add(time.Minute), D1: ambidata.Just(2.0)},
+		{Created: t0.Add(2 * time.Minute), D1: ambidata.Just(10.0)},
+	}, srv.Data("1")); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestReducerRun(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := newServer(t)
+
+	var mu sync.Mutex
+	now := t0
+	r := New(srv.Sender("1"))
+	r.Window = 20 * time.Millisecond
+	r.Interval = time.Millisecond
+	r.Now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+
+	err := r.Add(ambidata.Data{Created: t0, D1: ambidata.Just(1.0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() { done <- r.Run(ctx) }()
+
+	// ウィンドウの終了時刻が経過するまでは送信されない
+	time.Sleep(50 * time.Millisecond)
+	if n := len(srv.Data("1")); n != 0 {
+		t.Errorf("before window end: expected 0 data points, got %d", n)
+	}
+
+	mu.Lock()
+	now = t0.Add(r.Window)
+	mu.Unlock()
+	waitData(t, srv, 1)
+	if diff := cmp.Diff([]ambidata.Data{
+		{Created: t0, D1: ambidata.Just(1.0)},
+	}, srv.Data("1")); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+
+	// Run で送信したウィンドウには追加できない
+	err = r.Add(ambidata.Data{Created: t0.Add(r.Window / 2), D1: ambidata.Just(2.0)})
+	if !errors.Is(err, ErrLate) {
+		t.Errorf("after Run: expected ErrLate, got %v", err)
+	}
+
+	err = r.Close(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(srv.Data("1")); n != 1 {
+		t.Errorf("Close: expected 1 data point, got %d", n)
+	}
+	err = <-done
+	if !errors.Is(err, ErrClosed) {
+		t.Errorf("Run: expected ErrClosed, got %v", err)
+	}
+}
@@ -0,0 +1,270 @@
+// Package report は、ユーザーが所有するチャネルの一覧を点検し、
+// 問題のあるチャネルをまとめたレポートを作成する機能を提供します。
+//
+// 以下の項目を検出します。
+//
+//   - データが一度も送信されていないチャネル ([KindNoData])
+//   - 最終送信日時が古いチャネル ([KindStale])
+//   - 値が送信されているのにデータ名が設定されていないデータ ([KindUnnamedField])
+//   - 位置情報が設定されていないチャネル ([KindNoLocation])
+//   - 一日あたりのデータ数が上限 ([ambidata.MaxDataPerDay]) に近いチャネル ([KindQuota])
+//
+// レポートは JSON、Markdown、テキストの表の形式で出力できます。
+package report
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+)
+
+const (
+	// DefaultStaleAfter は [Options.StaleAfter] のデフォルト値です。
+	DefaultStaleAfter = 24 * time.Hour
+
+	// DefaultQuotaRatio は [Options.QuotaRatio] のデフォルト値です。
+	DefaultQuotaRatio = 0.9
+)
+
+// Kind は検出された問題の種類です。
+type Kind string
+
+const (
+	KindNoData       Kind = "no-data"       // データが一度も送信されていない
+	KindStale        Kind = "stale"         // 最終送信日時が古い
+	KindUnnamedField Kind = "unnamed-field" // 値が送信されているデータにデータ名が設定されていない
+	KindNoLocation   Kind = "no-location"   // チャネルの位置情報が設定されていない
+	KindQuota        Kind = "quota"         // 一日あたりのデータ数が上限に近い
+)
+
+// Issue はチャネルで検出された問題です。
+type Issue struct {
+	Kind    Kind           `json:"kind"`
+	Field   ambidata.Field `json:"field,omitzero"` // KindUnnamedField の場合のデータ番号
+	Message string         `json:"message"`
+}
+
+// Channel はチャネルごとの点検結果です。
+type Channel struct {
+	Ch         string    `json:"ch"`
+	Name       string    `json:"name"`
+	LastPost   time.Time `json:"lastPost,omitzero"`
+	DataPerDay int       `json:"dataPerDay"`
+	Issues     []Issue   `json:"issues"`
+}
+
+// Report はチャネルの点検結果をまとめたレポートです。
+type Report struct {
+	Generated time.Time `json:"generated"`
+	Channels  []Channel `json:"channels"`
+}
+
+// Options はレポートの作成に関する設定です。
+// ゼロ値の Options 構造体は、デフォルトの設定を表す有効な構成となります。
+type Options struct {
+	// StaleAfter は最終送信日時からこの時間が経過したチャネルを [KindStale] とします。
+	// 0 以下の場合は、 [DefaultStaleAfter] が使用されます。
+	StaleAfter time.Duration
+
+	// QuotaRatio は一日あたりのデータ数が [ambidata.MaxDataPerDay] に対してこの割合以上の
+	// チャネルを [KindQuota] とします。
+	// 0 以下の場合は、 [DefaultQuotaRatio] が使用されます。
+	QuotaRatio float64
+
+	// IgnoreLocation が true の場合、 [KindNoLocation] を検出しません。
+	IgnoreLocation bool
+
+	// Now は現在時刻を返す関数です。
+	// nil の場合は、 [time.Now] が使用されます。
+	Now func() time.Time
+}
+
+// Generate は m のユーザーが所有する全てのチャネルを点検し、レポートを作成します。
+// opt が nil の場合は、デフォルトの設定が使用されます。
+func Generate(ctx context.Context, m *ambidata.Manager, opt *Options) (*Report, error) {
+	list, err := m.GetChannelList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]ambidata.ChannelInfo, len(list))
+	for i := range list {
+		infos[i] = list[i].ChannelInfo
+	}
+	return Check(infos, opt), nil
+}
+
+// Check はチャネル情報を点検し、レポートを作成します。
+// opt が nil の場合は、デフォルトの設定が使用されます。
+func Check(infos []ambidata.ChannelInfo, opt *Options) *Report {
+	if opt == nil {
+		opt = &Options{}
+	}
+	now := time.Now()
+	if opt.Now != nil {
+		now = opt.Now()
+	}
+	staleAfter := opt.StaleAfter
+	if staleAfter <= 0 {
+		staleAfter = DefaultStaleAfter
+	}
+	quotaRatio := opt.QuotaRatio
+	if quotaRatio <= 0 {
+		quotaRatio = DefaultQuotaRatio
+	}
+
+	r := &Report{Generated: now, Channels: []Channel{}}
+	for i := range infos {
+		info := &infos[i]
+		c := Channel{
+			Ch:         info.Ch,
+			Name:       info.ChName,
+			LastPost:   info.LastPost,
+			DataPerDay: info.DataPerDay,
+			Issues:     []Issue{},
+		}
+
+		if info.LastPost.IsZero() {
+			c.Issues = append(c.Issues, Issue{Kind: KindNoData, Message: "no data has been posted"})
+		} else if age := now.Sub(info.LastPost); age >= staleAfter {
+			c.Issues = append(c.Issues, Issue{
+				Kind:    KindStale,
+				Message: "last post was " + formatAge(age) + " ago",
+			})
+		}
+
+		for _, f := range ambidata.Fields {
+			if info.LastData.Field(f).OK && info.Field(f).Name == "" {
+				c.Issues = append(c.Issues, Issue{
+					Kind:    KindUnnamedField,
+					Field:   f,
+					Message: f.String() + " has data but no name",
+				})
+			}
+		}
+
+		if !opt.IgnoreLocation && !info.Loc.OK {
+			c.Issues = append(c.Issues, Issue{Kind: KindNoLocation, Message: "channel location is not set"})
+		}
+
+		if limit := quotaRatio * ambidata.MaxDataPerDay; float64(info.DataPerDay) >= limit {
+			c.Issues = append(c.Issues, Issue{
+				Kind:    KindQuota,
+				Message: fmt.Sprintf("%d data points per day (limit %d)", info.DataPerDay, ambidata.MaxDataPerDay),
+			})
+		}
+
+		r.Channels = append(r.Channels, c)
+	}
+
+	slices.SortStableFunc(r.Channels, func(a, b Channel) int {
+		return strings.Compare(a.Ch, b.Ch)
+	})
+	return r
+}
+
+// HasIssues はいずれかのチャネルで問題が検出された場合に true を返します。
+func (r *Report) HasIssues() bool {
+	for i := range r.Channels {
+		if len(r.Channels[i].Issues) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteJSON はレポートを JSON 形式で出力します。
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteMarkdown はレポートを Markdown 形式で出力します。
+func (r *Report) WriteMarkdown(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Channel report\n\nGenerated: %s\n\n", r.Generated.Format(time.RFC3339))
+	n := 0
+	for i := range r.Channels {
+		if len(r.Channels[i].Issues) > 0 {
+			n++
+		}
+	}
+	fmt.Fprintf(&b, "%d of %d channels have issues.\n\n", n, len(r.Channels))
+
+	b.WriteString("| Ch | Name | Last post | Data/day | Issues |\n")
+	b.WriteString("| --- | --- | --- | ---: | --- |\n")
+	for i := range r.Channels {
+		c := &r.Channels[i]
+		issues := make([]string, len(c.Issues))
+		for j, is := range c.Issues {
+			issues[j] = "**" + string(is.Kind) + "**: " + is.Message
+		}
+		fmt.Fprintf(&b, "| %s | %s | %s | %d | %s |\n",
+			escapeMarkdown(c.Ch),
+			escapeMarkdown(c.Name),
+			formatTime(c.LastPost),
+			c.DataPerDay,
+			strings.Join(issues, "<br>"),
+		)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteTable はレポートをテキストの表の形式で出力します。
+// 問題が複数あるチャネルは、問題ごとに1行を出力します。
+func (r *Report) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CH\tNAME\tLAST POST\tDATA/DAY\tISSUE")
+	for i := range r.Channels {
+		c := &r.Channels[i]
+		issues := make([]string, len(c.Issues))
+		for j, is := range c.Issues {
+			issues[j] = string(is.Kind) + ": " + is.Message
+		}
+		if len(issues) == 0 {
+			issues = []string{"ok"}
+		}
+		for j, is := range issues {
+			if j == 0 {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", c.Ch, c.Name, formatTime(c.LastPost), strconv.Itoa(c.DataPerDay), is)
+			} else {
+				fmt.Fprintf(tw, "\t\t\t\t%s\n", is)
+			}
+		}
+	}
+	return tw.Flush()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// formatAge は経過時間を "3d4h" のような形式で返します。
+func formatAge(d time.Duration) string {
+	days := int(d / (24 * time.Hour))
+	hours := int(d % (24 * time.Hour) / time.Hour)
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd%dh", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh%dm", hours, int(d%time.Hour/time.Minute))
+	default:
+		return d.Truncate(time.Second).String()
+	}
+}
+
+func escapeMarkdown(s string) string {
+	return strings.NewReplacer("|", `\|`, "\n", " ").Replace(s)
+}
@@ -0,0 +1,215 @@
+package report
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/internal/ambimock"
+	"github.com/google/go-cmp/cmp"
+)
+
+var now = time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+
+func TestCheck(t *testing.T) {
+	loc := ambidata.Just(ambidata.Location{Lat: 35, Lng: 139})
+	tests := []struct {
+		name string
+		info ambidata.ChannelInfo
+		opt  Options
+		want []Kind
+	}{
+		{
+			name: "ok",
+			info: ambidata.ChannelInfo{LastPost: now.Add(-time.Hour), DataPerDay: 100, Loc: loc},
+			want: []Kind{},
+		},
+		{
+			name: "no-data",
+			info: ambidata.ChannelInfo{Loc: loc},
+			want: []Kind{KindNoData},
+		},
+		{
+			name: "stale",
+			info: ambidata.ChannelInfo{LastPost: now.Add(-DefaultStaleAfter), Loc: loc},
+			want: []Kind{KindStale},
+		},
+		{
+			name: "stale-option",
+			info: ambidata.ChannelInfo{LastPost: now.Add(-time.Hour), Loc: loc},
+			opt:  Options{StaleAfter: time.Hour},
+			want: []Kind{KindStale},
+		},
+		{
+			name: "unnamed-field",
+			info: ambidata.ChannelInfo{
+				LastPost: now,
+				Loc:      loc,
+				D1:       ambidata.FieldInfo{Name: "temp"},
+				LastData: ambidata.LastData{Data: ambidata.Data{
+					D1: ambidata.Just(1.0),
+					D3: ambidata.Just(3.0),
+				}},
+			},
+			want: []Kind{KindUnnamedField},
+		},
+		{
+			name: "no-location",
+			info: ambidata.ChannelInfo{LastPost: now},
+			want: []Kind{KindNoLocation},
+		},
+		{
+			name: "no-location-ignored",
+			info: ambidata.ChannelInfo{LastPost: now},
+			opt:  Options{IgnoreLocation: true},
+			want: []Kind{},
+		},
+		{
+			name: "quota",
+			info: ambidata.ChannelInfo{LastPost: now, Loc: loc, DataPerDay: 2700},
+			want: []Kind{KindQuota},
+		},
+		{
+			name: "quota-below",
+			info: ambidata.ChannelInfo{LastPost: now, Loc: loc, DataPerDay: 2699},
+			want: []Kind{},
+		},
+		{
+			name: "quota-option",
+			info: ambidata.ChannelInfo{LastPost: now, Loc: loc, DataPerDay: 1500},
+			opt:  Options{QuotaRatio: 0.5},
+			want: []Kind{KindQuota},
+		},
+		{
+			name: "multiple",
+			info: ambidata.ChannelInfo{DataPerDay: 3000},
+			want: []Kind{KindNoData, KindNoLocation, KindQuota},
+		},
+	}
+
+	for _, tt := range tests {
+		tt.opt.Now = func() time.Time { return now }
+		r := Check([]ambidata.ChannelInfo{tt.info}, &tt.opt)
+		got := []Kind{}
+		for _, is := range r.Channels[0].Issues {
+			got = append(got, is.Kind)
+		}
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("%s: mismatch (-want, +got):\n%s", tt.name, diff)
+		}
+		if r.HasIssues() != (len(tt.want) > 0) {
+			t.Errorf("%s: HasIssues: expected %v, got %v", tt.name, len(tt.want) > 0, r.HasIssues())
+		}
+	}
+}
+
+func TestCheckUnnamedField(t *testing.T) {
+	info := ambidata.ChannelInfo{
+		LastPost: now,
+		LastData: ambidata.LastData{Data: ambidata.Data{D3: ambidata.Just(3.0)}},
+	}
+	r := Check([]ambidata.ChannelInfo{info}, &Options{IgnoreLocation: true, Now: func() time.Time { return now }})
+	want := []Issue{{Kind: KindUnnamedField, Field: ambidata.FieldD3, Message: "d3 has data but no name"}}
+	if diff := cmp.Diff(want, r.Channels[0].Issues); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	s := ambimock.New(t)
+	s.AddChannel(&ambimock.Channel{
+		Info:    ambidata.ChannelInfo{Ch: "2", ChName: "idle", Loc: ambidata.Just(ambidata.Location{Lat: 35, Lng: 139})},
+		UserKey: "uk",
+	})
+	s.AddChannel(&ambimock.Channel{
+		Info:    ambidata.ChannelInfo{Ch: "1", ChName: "room", D1: ambidata.FieldInfo{Name: "temp"}},
+		UserKey: "uk",
+		Data:    []ambidata.Data{{Created: now.Add(-time.Minute), D1: ambidata.Just(20.0)}},
+	})
+	s.AddChannel(&ambimock.Channel{
+		Info:    ambidata.ChannelInfo{Ch: "3"},
+		UserKey: "other",
+	})
+
+	r, err := Generate(context.Background(), s.Manager("uk"), &Options{Now: func() time.Time { return now }})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		Ch    string
+		Kinds []Kind
+	}
+	var got []result
+	for _, c := range r.Channels {
+		res := result{Ch: c.Ch, Kinds: []Kind{}}
+		for _, is := range c.Issues {
+			res.Kinds = append(res.Kinds, is.Kind)
+		}
+		got = append(got, res)
+	}
+	want := []result{
+		{Ch: "1", Kinds: []Kind{KindNoLocation}},
+		{Ch: "2", Kinds: []Kind{KindNoData}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+	if !r.Generated.Equal(now) {
+		t.Errorf("Generated: expected %v, got %v", now, r.Generated)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	r := Check([]ambidata.ChannelInfo{
+		{Ch: "1", ChName: "a|b", LastPost: now.Add(-50 * time.Hour), DataPerDay: 10},
+		{Ch: "2", ChName: "ok", LastPost: now, Loc: ambidata.Just(ambidata.Location{})},
+	}, &Options{Now: func() time.Time { return now }})
+
+	var b bytes.Buffer
+	err := r.WriteTable(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantTable := "" +
+		"CH  NAME  LAST POST             DATA/DAY  ISSUE\n" +
+		"1   a|b   2005-12-31T13:04:05Z  10        stale: last post was 2d2h ago\n" +
+		"                                          no-location: channel location is not set\n" +
+		"2   ok    2006-01-02T15:04:05Z  0         ok\n"
+	if diff := cmp.Diff(wantTable, b.String()); diff != "" {
+		t.Errorf("WriteTable: mismatch (-want, +got):\n%s", diff)
+	}
+
+	b.Reset()
+	err = r.WriteMarkdown(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"1 of 2 channels have issues.",
+		"| 1 | a\\|b | 2005-12-31T13:04:05Z | 10 | **stale**: last post was 2d2h ago<br>**no-location**: channel location is not set |",
+		"| 2 | ok | 2006-01-02T15:04:05Z | 0 |  |",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("WriteMarkdown: expected %q in output:\n%s", want, b.String())
+		}
+	}
+
+	b.Reset()
+	err = r.WriteJSON(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Report
+	err = json.Unmarshal(b.Bytes(), &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(r, &got); diff != "" {
+		t.Errorf("WriteJSON: mismatch (-want, +got):\n%s", diff)
+	}
+}
@@ -6,6 +6,15 @@ import (
 	"time"
 )
 
+// Ambient へのデータ送信に関する制限値。
+// 詳細は [諸元/制限] を参照ください。
+//
+// [諸元/制限]: https://ambidata.io/refs/spec/
+const (
+	MinSendInterval = 5 * time.Second // チャネルごとの送信間隔の最小値
+	MaxDataPerDay   = 3000            // 1チャネルあたり1日に登録できるデータポイントの最大数
+)
+
 // Sender は Ambient にデータを送信するクライアントです。
 type Sender struct {
 	Ch       string // チャネルID
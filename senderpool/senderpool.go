@@ -0,0 +1,256 @@
+// Package senderpool は、多数のチャネルへのデータ送信をまとめて管理する [Pool] を提供します。
+//
+// [Pool] は複数の goroutine から (チャネル, データポイント) の組を受け付け、
+// チャネルごとのキューに蓄積します。キューのデータポイントは追加された順序を保ったまま、
+// チャネルごとの送信間隔の制限を守りながら [ambidata.Sender.SendBulk] でまとめて送信されます。
+// 全てのチャネルを合わせた同時送信数は [Pool.Concurrency] で制限されます。
+// キューと送信の処理は、各種ブリッジと共通の internal/batch パッケージにより行います。
+//
+// 使用例:
+//
+//	p, err := config.Open("", "")
+//	// ...
+//	pool := &senderpool.Pool{Sender: p.Sender}
+//	defer pool.Close(context.Background())
+//	err = pool.Submit("room", ambidata.Data{D1: ambidata.Just(20.5)})
+package senderpool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/internal/batch"
+)
+
+const (
+	// DefaultMaxBatch は [Pool.MaxBatch] のデフォルト値です。
+	DefaultMaxBatch = batch.DefaultMaxBatch
+
+	// DefaultMaxPending は [Pool.MaxPending] のデフォルト値です。
+	DefaultMaxPending = batch.DefaultMaxPending
+
+	// DefaultConcurrency は [Pool.Concurrency] のデフォルト値です。
+	DefaultConcurrency = 4
+)
+
+var (
+	// ErrClosed は [Pool.Close] の後に [Pool.Submit] が呼び出された場合のエラーです。
+	ErrClosed = errors.New("senderpool: pool is closed")
+
+	// ErrQueueFull はチャネルのキューが満杯のため、データポイントを追加できなかった場合のエラーです。
+	ErrQueueFull = errors.New("senderpool: queue is full")
+)
+
+// SenderFunc はチャネル名から [ambidata.Sender] を作成する関数です。
+// [config.Profile.Sender] と互換性があります。
+//
+// [config.Profile.Sender]: https://pkg.go.dev/github.com/gcrtnst/ambidata/config#Profile.Sender
+type SenderFunc func(channel string) (*ambidata.Sender, error)
+
+// Item はチャネルとデータポイントの組です。
+type Item struct {
+	Channel string
+	Data    ambidata.Data
+}
+
+// Pool は多数のチャネルへのデータポイントの送信を管理します。
+// キューはチャネルIDごとに作成されるため、同じチャネルIDの複数のチャネル名は1つのキューを共有します。
+//
+// Pool のメソッドは複数の goroutine から同時に呼び出すことができます。
+// フィールドは最初の [Pool.Submit] の呼び出しより前に設定してください。
+type Pool struct {
+	// Sender はチャネル名から [ambidata.Sender] を作成する関数です。
+	// チャネルごとに、最初にそのチャネルのデータポイントが追加されたときに1回だけ呼び出されます。
+	Sender SenderFunc
+
+	// Interval は同一チャネルへの送信間隔です。
+	// 0 以下の場合は、 [ambidata.MinSendInterval] が使用されます。
+	Interval time.Duration
+
+	// MaxBatch は1回の送信に含める最大のデータポイント数です。
+	// 0 以下の場合は、 [DefaultMaxBatch] が使用されます。
+	MaxBatch int
+
+	// MaxPending はチャネルごとのキューに保持する最大のデータポイント数です。
+	// これを超える場合、 [Pool.Submit] は [ErrQueueFull] を返します。
+	// 0 以下の場合は、 [DefaultMaxPending] が使用されます。
+	MaxPending int
+
+	// Concurrency は全てのチャネルを合わせた同時送信数の上限です。
+	// 0 以下の場合は、 [DefaultConcurrency] が使用されます。
+	Concurrency int
+
+	// OnError は送信エラーが発生した場合に呼び出されます。
+	// 再試行しても解決しないエラーの場合、送信しようとしたデータポイントは破棄されます。
+	// nil の場合は、エラーは無視されます。
+	OnError func(channel string, err error)
+
+	mu      sync.Mutex
+	senders map[string]*ambidata.Sender // チャネル名をキーとする Sender
+	closed  bool
+	batcher *batch.Batcher
+
+	// names はチャネルIDをキーとする、最初に追加されたチャネル名です。
+	// OnError は mu をロックした状態で呼び出される場合があるため、別のロックで保護します。
+	namesMu sync.Mutex
+	names   map[string]string
+}
+
+// UnsentError は [Pool.Close] が全てのデータポイントを送信できなかった場合のエラーです。
+type UnsentError struct {
+	Err    error                      // 送信を打ち切った原因
+	Unsent map[string][]ambidata.Data // チャネル名をキーとする未送信のデータポイント
+}
+
+func (err *UnsentError) Error() string {
+	n := 0
+	for _, arr := range err.Unsent {
+		n += len(arr)
+	}
+	return fmt.Sprintf("senderpool: %s (%d data points unsent)", err.Err.Error(), n)
+}
+
+func (err *UnsentError) Unwrap() error {
+	return err.Err
+}
+
+// Submit はチャネル channel のキューにデータポイントを追加します。
+// データポイントは追加された順序で送信されます。
+//
+// キューに空きが無い場合は、データポイントを1つも追加せずに [ErrQueueFull] を返します。
+func (p *Pool) Submit(channel string, arr ...ambidata.Data) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	s, err := p.sender(channel)
+	if err != nil {
+		return err
+	}
+
+	// キューのデータポイントは送信により減るのみのため、p.mu のロック中に確認した空きは保たれる
+	if p.batcher.Pending(s.Ch)+len(arr) > p.maxPending() {
+		return fmt.Errorf("%w: channel %q", ErrQueueFull, channel)
+	}
+	return p.batcher.Add(s, arr...)
+}
+
+// SubmitItems は複数の (チャネル, データポイント) の組をキューに追加します。
+// エラーが発生した場合は、その組より前の組のみが追加された状態で、エラーを返します。
+func (p *Pool) SubmitItems(items ...Item) error {
+	for _, item := range items {
+		err := p.Submit(item.Channel, item.Data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pending はチャネル channel のキューにある未送信のデータポイント数を返します。
+func (p *Pool) Pending(channel string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s, ok := p.senders[channel]; ok {
+		return p.batcher.Pending(s.Ch)
+	}
+	return 0
+}
+
+// Close は新たなデータポイントの追加を停止し、キューに残っているデータポイントを送信します。
+// 全てのデータポイントの送信が完了するか、ctx が終了するまで待機します。
+// ctx が終了した場合は送信を打ち切り、未送信のデータポイントを含む [*UnsentError] を返します。
+func (p *Pool) Close(ctx context.Context) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	b := p.batcher
+	p.mu.Unlock()
+	if b == nil {
+		return nil
+	}
+
+	err := b.Close(ctx)
+	var ue *batch.UnsentError
+	if !errors.As(err, &ue) {
+		return err
+	}
+	unsent := make(map[string][]ambidata.Data, len(ue.Unsent))
+	for ch, arr := range ue.Unsent {
+		unsent[p.name(ch)] = arr
+	}
+	return &UnsentError{Err: ue.Err, Unsent: unsent}
+}
+
+// sender はチャネルの Sender を返します。 Sender が無い場合は作成します。
+// p.mu をロックした状態で呼び出してください。
+func (p *Pool) sender(channel string) (*ambidata.Sender, error) {
+	if s, ok := p.senders[channel]; ok {
+		return s, nil
+	}
+	if p.Sender == nil {
+		return nil, errors.New("senderpool: Pool.Sender is nil")
+	}
+
+	s, err := p.Sender(channel)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, fmt.Errorf("senderpool: channel %q: no sender", channel)
+	}
+	if p.batcher == nil {
+		concurrency := p.Concurrency
+		if concurrency <= 0 {
+			concurrency = DefaultConcurrency
+		}
+		p.senders = map[string]*ambidata.Sender{}
+		p.batcher = &batch.Batcher{
+			Interval:    p.Interval,
+			MaxBatch:    p.MaxBatch,
+			MaxPending:  p.maxPending(),
+			FIFO:        true,
+			Concurrency: concurrency,
+			OnError:     p.onError,
+		}
+	}
+	p.senders[channel] = s
+
+	p.namesMu.Lock()
+	defer p.namesMu.Unlock()
+	if p.names == nil {
+		p.names = map[string]string{}
+	}
+	if _, ok := p.names[s.Ch]; !ok {
+		p.names[s.Ch] = channel
+	}
+	return s, nil
+}
+
+// name はチャネルIDに対応するチャネル名を返します。
+func (p *Pool) name(ch string) string {
+	p.namesMu.Lock()
+	defer p.namesMu.Unlock()
+	return p.names[ch]
+}
+
+func (p *Pool) onError(ch string, err error) {
+	if p.OnError != nil {
+		p.OnError(p.name(ch), err)
+	}
+}
+
+func (p *Pool) maxPending() int {
+	if p.MaxPending <= 0 {
+		return DefaultMaxPending
+	}
+	return p.MaxPending
+}
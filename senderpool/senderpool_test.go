@@ -0,0 +1,271 @@
+package senderpool
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+	"github.com/gcrtnst/ambidata/internal/ambimock"
+	"github.com/google/go-cmp/cmp"
+)
+
+var t0 = time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+
+func newServer(t *testing.T, channels ...string) *ambimock.Server {
+	s := ambimock.New(t)
+	for _, ch := range channels {
+		s.AddChannel(&ambimock.Channel{Info: ambidata.ChannelInfo{Ch: ch}, ReadKey: "rk", WriteKey: "wk"})
+	}
+	return s
+}
+
+func senderFunc(s *ambimock.Server) SenderFunc {
+	return func(channel string) (*ambidata.Sender, error) {
+		return s.Sender(channel), nil
+	}
+}
+
+// sentValues は送信されたデータポイントの D1 の値を送信順に返します。
+func sentValues(t *testing.T, s *ambimock.Server, ch string) []float64 {
+	ret := []float64{}
+	for _, req := range s.Requests() {
+		if req.Method != http.MethodPost || req.Path != "/api/v2/channels/"+ch+"/dataarray" {
+			continue
+		}
+		var j struct {
+			Data []struct {
+				D1 float64 `json:"d1"`
+			} `json:"data"`
+		}
+		err := json.Unmarshal(req.Body, &j)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range j.Data {
+			ret = append(ret, d.D1)
+		}
+	}
+	return ret
+}
+
+func TestPoolOrder(t *testing.T) {
+	s := newServer(t, "1", "2")
+	p := &Pool{Sender: senderFunc(s), Interval: 20 * time.Millisecond}
+
+	want := []float64{}
+	for i := range 20 {
+		// 時刻の逆順に追加しても、追加した順に送信される
+		data := ambidata.Data{Created: t0.Add(-time.Duration(i) * time.Second), D1: ambidata.Just(float64(i))}
+		err := p.SubmitItems(Item{"1", data}, Item{"2", data})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, float64(i))
+		time.Sleep(time.Millisecond)
+	}
+
+	err := p.Close(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ch := range []string{"1", "2"} {
+		if diff := cmp.Diff(want, sentValues(t, s, ch)); diff != "" {
+			t.Errorf("channel %s: mismatch (-want, +got):\n%s", ch, diff)
+		}
+		if p.Pending(ch) != 0 {
+			t.Errorf("channel %s: expected no pending data, got %d", ch, p.Pending(ch))
+		}
+	}
+}
+
+func TestPoolCoalesce(t *testing.T) {
+	s := newServer(t, "1")
+	p := &Pool{Sender: senderFunc(s), Interval: time.Hour, MaxBatch: 3}
+
+	// 1回目の送信中に追加されたデータポイントは、2回目以降の送信にまとめられる
+	release := make(chan struct{})
+	var first atomic.Bool
+	s.Hook = func(r *http.Request) int {
+		if !first.Swap(true) {
+			<-release
+		}
+		return 0
+	}
+	for i := range 5 {
+		err := p.Submit("1", ambidata.Data{Created: t0.Add(time.Duration(i) * time.Second), D1: ambidata.Just(float64(i))})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := p.Close(ctx)
+	var unsent *UnsentError
+	if !errors.As(err, &unsent) {
+		t.Fatalf("expected *UnsentError, got %v", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// 送信間隔が1時間のため、1回しか送信されない
+	sent := sentValues(t, s, "1")
+	if len(sent) < 1 || len(sent) > 3 {
+		t.Fatalf("expected 1 to 3 data points to be sent, got %v", sent)
+	}
+	var rest []float64
+	for _, d := range unsent.Unsent["1"] {
+		rest = append(rest, d.D1.V)
+	}
+	if diff := cmp.Diff([]float64{0, 1, 2, 3, 4}, append(sent, rest...)); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestPoolConcurrency(t *testing.T) {
+	channels := make([]string, 10)
+	for i := range channels {
+		channels[i] = fmt.Sprint(i + 1)
+	}
+	s := newServer(t, channels...)
+	p := &Pool{Sender: senderFunc(s), Concurrency: 3}
+
+	var mu sync.Mutex
+	var inflight, peak int
+	s.Hook = func(r *http.Request) int {
+		mu.Lock()
+		inflight++
+		peak = max(peak, inflight)
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inflight--
+		mu.Unlock()
+		return 0
+	}
+
+	for _, ch := range channels {
+		err := p.Submit(ch, ambidata.Data{Created: t0, D1: ambidata.Just(1.0)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := p.Close(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peak != 3 {
+		t.Errorf("expected peak concurrency 3, got %d", peak)
+	}
+	for _, ch := range channels {
+		if n := len(s.Data(ch)); n != 1 {
+			t.Errorf("channel %s: expected 1 data point, got %d", ch, n)
+		}
+	}
+}
+
+func TestPoolRetry(t *testing.T) {
+	s := newServer(t, "1", "2")
+	var errs []error
+	var mu sync.Mutex
+	p := &Pool{
+		Sender:   senderFunc(s),
+		Interval: time.Millisecond,
+		OnError: func(ch string, err error) {
+			mu.Lock()
+			errs = append(errs, fmt.Errorf("%s: %w", ch, err))
+			mu.Unlock()
+		},
+	}
+
+	var failed atomic.Int32
+	s.Hook = func(r *http.Request) int {
+		switch r.URL.Path {
+		case "/api/v2/channels/1/dataarray":
+			if failed.Add(1) <= 2 {
+				return http.StatusServiceUnavailable
+			}
+		case "/api/v2/channels/2/dataarray":
+			return http.StatusBadRequest
+		}
+		return 0
+	}
+
+	p.Submit("1", ambidata.Data{Created: t0, D1: ambidata.Just(1.0)})
+	p.Submit("2", ambidata.Data{Created: t0, D1: ambidata.Just(1.0)})
+	err := p.Close(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(s.Data("1")); n != 1 {
+		t.Errorf("retryable error: expected 1 data point, got %d", n)
+	}
+	if n := len(errs); n != 3 {
+		t.Errorf("expected 3 errors, got %v", errs)
+	}
+}
+
+func TestPoolErrQueueFull(t *testing.T) {
+	s := newServer(t, "1")
+	p := &Pool{Sender: senderFunc(s), MaxPending: 2}
+	defer p.Close(context.Background())
+
+	err := p.Submit("1", ambidata.Data{Created: t0}, ambidata.Data{Created: t0}, ambidata.Data{Created: t0})
+	if !errors.Is(err, ErrQueueFull) {
+		t.Errorf("expected ErrQueueFull, got %v", err)
+	}
+	if n := p.Pending("1"); n != 0 {
+		t.Errorf("expected no pending data, got %d", n)
+	}
+}
+
+func TestPoolErrSender(t *testing.T) {
+	s := newServer(t)
+	errSender := errors.New("no such channel")
+	p := &Pool{Sender: func(string) (*ambidata.Sender, error) { return nil, errSender }}
+
+	err := p.Submit("1", ambidata.Data{Created: t0})
+	if !errors.Is(err, errSender) {
+		t.Errorf("expected errSender, got %v", err)
+	}
+	p.Sender = func(string) (*ambidata.Sender, error) { return nil, nil }
+	err = p.Submit("1", ambidata.Data{Created: t0})
+	if err == nil {
+		t.Error("nil sender: expected error, got nil")
+	}
+	p.Sender = nil
+	err = p.Submit("1", ambidata.Data{Created: t0})
+	if err == nil {
+		t.Error("nil Pool.Sender: expected error, got nil")
+	}
+	err = p.Close(context.Background())
+	if err != nil {
+		t.Error(err)
+	}
+	if n := len(s.Requests()); n != 0 {
+		t.Errorf("expected no request, got %d", n)
+	}
+}
+
+func TestPoolErrClosed(t *testing.T) {
+	s := newServer(t, "1")
+	p := &Pool{Sender: senderFunc(s)}
+	err := p.Close(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Submit("1", ambidata.Data{Created: t0})
+	if !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
@@ -1,5 +1,7 @@
 package ambidata
 
+import "math"
+
 // 状態表示チャートで使用する色。
 // データフィールドの値として送信することで、対応する色を状態表示チャートに表示できます。
 //
@@ -81,3 +83,145 @@ const (
 	StateColorDarkPurple3 // #20124d
 	StateColorDarkPink3   // #4c1130
 )
+
+// StateRule は値を状態表示チャートの色 (StateColor* 定数) に変換する規則を表すインターフェースです。
+//
+// StateColor は値 v に対応する色を返します。
+// 対応する色が存在しない場合、ok は false になります。
+type StateRule[T any] interface {
+	StateColor(v T) (color int, ok bool)
+}
+
+// StateValue は規則 r に従って v を状態表示チャートの色に変換し、
+// データフィールドにそのまま設定できる形で返します。
+// 対応する色が存在しない場合は、ゼロ値の [Maybe] を返します。
+func StateValue[T any](r StateRule[T], v T) Maybe[float64] {
+	c, ok := r.StateColor(v)
+	if !ok {
+		return Maybe[float64]{}
+	}
+	return Just(float64(c))
+}
+
+// SetState は規則 r に従って v を状態表示チャートの色に変換し、
+// d のデータフィールド f に設定します。
+// 対応する色が存在しない場合、フィールド f は値無しに設定されます。
+func SetState[T any](d *Data, f Field, r StateRule[T], v T) {
+	d.SetField(f, StateValue(r, v))
+}
+
+// StateRange は数値の範囲と状態表示チャートの色の対応を表す構造体です。
+// Min 以上 Max 未満の値が Color に対応します。
+type StateRange struct {
+	Min   Maybe[float64] // 下限 (この値を含む)。値が無い場合は下限無し。
+	Max   Maybe[float64] // 上限 (この値を含まない)。値が無い場合は上限無し。
+	Color int            // 状態表示チャートの色
+}
+
+// Contains は v が範囲に含まれる場合に true を返します。
+// NaN はどの範囲にも含まれません。
+func (r StateRange) Contains(v float64) bool {
+	if math.IsNaN(v) {
+		return false
+	}
+	if r.Min.OK && v < r.Min.V {
+		return false
+	}
+	if r.Max.OK && v >= r.Max.V {
+		return false
+	}
+	return true
+}
+
+// StateRanges は数値を範囲に基づいて状態表示チャートの色に変換する規則です。
+// 範囲は先頭から順に評価され、最初に v を含む範囲の色が使用されます。
+type StateRanges []StateRange
+
+// StateColor は [StateRule] を実装します。
+func (r StateRanges) StateColor(v float64) (int, bool) {
+	i := r.index(v)
+	if i < 0 {
+		return 0, false
+	}
+	return r[i].Color, true
+}
+
+func (r StateRanges) index(v float64) int {
+	for i := range r {
+		if r[i].Contains(v) {
+			return i
+		}
+	}
+	return -1
+}
+
+// StateEnum は列挙値を状態表示チャートの色に変換する規則です。
+// マップに存在しない値には対応する色がありません。
+type StateEnum[K comparable] map[K]int
+
+// StateColor は [StateRule] を実装します。
+func (e StateEnum[K]) StateColor(v K) (int, bool) {
+	c, ok := e[v]
+	return c, ok
+}
+
+// StateBool は真偽値を状態表示チャートの色に変換する規則です。
+type StateBool struct {
+	True  int // true に対応する色
+	False int // false に対応する色
+}
+
+// StateColor は [StateRule] を実装します。
+func (b StateBool) StateColor(v bool) (int, bool) {
+	if v {
+		return b.True, true
+	}
+	return b.False, true
+}
+
+// StateHysteresis はヒステリシス付きで数値を状態表示チャートの色に変換する規則です。
+//
+// 値が一度ある範囲に入ると、範囲の境界から Margin 以上離れるまでその範囲に留まります。
+// これにより、しきい値付近で値が揺らいだ場合に色が頻繁に切り替わることを防ぎます。
+//
+// StateHysteresis は直前の状態を保持するため、ポインタで使用してください。
+// 複数の goroutine から同時に使用することはできません。
+type StateHysteresis struct {
+	Ranges StateRanges // 範囲の定義
+	Margin float64     // 現在の範囲から抜けるために必要な、境界からの距離
+
+	cur  int
+	init bool
+}
+
+// StateColor は [StateRule] を実装します。
+func (h *StateHysteresis) StateColor(v float64) (int, bool) {
+	if math.IsNaN(v) {
+		return 0, false
+	}
+	if h.init && h.cur >= 0 && h.cur < len(h.Ranges) {
+		r := h.Ranges[h.cur]
+		if r.Min.OK {
+			r.Min.V -= h.Margin
+		}
+		if r.Max.OK {
+			r.Max.V += h.Margin
+		}
+		if r.Contains(v) {
+			return h.Ranges[h.cur].Color, true
+		}
+	}
+
+	h.cur = h.Ranges.index(v)
+	h.init = true
+	if h.cur < 0 {
+		return 0, false
+	}
+	return h.Ranges[h.cur].Color, true
+}
+
+// Reset は保持している直前の状態を破棄します。
+func (h *StateHysteresis) Reset() {
+	h.cur = 0
+	h.init = false
+}
@@ -0,0 +1,99 @@
+package ambidata
+
+import (
+	"math"
+	"testing"
+)
+
+func TestStateRanges(t *testing.T) {
+	r := StateRanges{
+		{Max: Just(0.0), Color: StateColorBlue},
+		{Min: Just(0.0), Max: Just(30.0), Color: StateColorGreen},
+		{Min: Just(30.0), Color: StateColorRed},
+	}
+
+	tt := []struct {
+		name string
+		in   float64
+		want Maybe[float64]
+	}{
+		{name: "Below", in: -5, want: Just(float64(StateColorBlue))},
+		{name: "LowerBound", in: 0, want: Just(float64(StateColorGreen))},
+		{name: "Middle", in: 15, want: Just(float64(StateColorGreen))},
+		{name: "UpperBound", in: 30, want: Just(float64(StateColorRed))},
+		{name: "NaN", in: math.NaN(), want: Maybe[float64]{}},
+	}
+
+	for _, tc := range tt {
+		got := StateValue[float64](r, tc.in)
+		if got != tc.want {
+			t.Errorf("%s: expected %#v, got %#v", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestStateRangesNoMatch(t *testing.T) {
+	r := StateRanges{{Min: Just(0.0), Max: Just(1.0), Color: StateColorGreen}}
+	if c, ok := r.StateColor(2); ok {
+		t.Errorf("expected not ok, got %d", c)
+	}
+}
+
+func TestStateEnum(t *testing.T) {
+	e := StateEnum[string]{"running": StateColorGreen, "stopped": StateColorRed}
+
+	var d Data
+	SetState[string](&d, FieldD3, e, "running")
+	if want := Just(float64(StateColorGreen)); d.D3 != want {
+		t.Errorf("running: expected %#v, got %#v", want, d.D3)
+	}
+
+	SetState[string](&d, FieldD3, e, "unknown")
+	if d.D3.OK {
+		t.Errorf("unknown: expected not ok, got %#v", d.D3)
+	}
+}
+
+func TestStateBool(t *testing.T) {
+	b := StateBool{True: StateColorGreen, False: StateColorDarkGrey1}
+	if got, _ := b.StateColor(true); got != StateColorGreen {
+		t.Errorf("true: expected %d, got %d", StateColorGreen, got)
+	}
+	if got, _ := b.StateColor(false); got != StateColorDarkGrey1 {
+		t.Errorf("false: expected %d, got %d", StateColorDarkGrey1, got)
+	}
+}
+
+func TestStateHysteresis(t *testing.T) {
+	h := &StateHysteresis{
+		Ranges: StateRanges{
+			{Max: Just(30.0), Color: StateColorGreen},
+			{Min: Just(30.0), Color: StateColorRed},
+		},
+		Margin: 2,
+	}
+
+	tt := []struct {
+		in   float64
+		want int
+	}{
+		{in: 25, want: StateColorGreen},
+		{in: 31, want: StateColorGreen}, // within margin
+		{in: 32.5, want: StateColorRed},
+		{in: 29, want: StateColorRed}, // within margin
+		{in: 28.5, want: StateColorRed},
+		{in: 27.9, want: StateColorGreen},
+	}
+
+	for i, tc := range tt {
+		got, ok := h.StateColor(tc.in)
+		if !ok || got != tc.want {
+			t.Errorf("%d: %v: expected %d, got %d (ok=%t)", i, tc.in, tc.want, got, ok)
+		}
+	}
+
+	h.Reset()
+	if got, _ := h.StateColor(31); got != StateColorRed {
+		t.Errorf("reset: expected %d, got %d", StateColorRed, got)
+	}
+}
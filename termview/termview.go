@@ -0,0 +1,352 @@
+// Package termview は、チャネルのデータを端末向けのテキストとして表示する機能を提供します。
+//
+// [WriteTable] はデータを列を揃えた表として、 [WriteSparklines] はフィールドごとの
+// Unicode スパークラインとして出力します。
+// [Render] は [ambidata.Fetcher] から最新のデータを取得し、両方をまとめて出力します。
+package termview
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gcrtnst/ambidata"
+)
+
+// DefaultTimeFormat は [Options.TimeFormat] のデフォルト値です。
+const DefaultTimeFormat = "2006-01-02 15:04:05"
+
+// Options は表示の設定を保持する構造体です。
+//
+// ゼロ値の Options 構造体は、デフォルトの設定を使用する有効な構成となります。
+type Options struct {
+	// Fields は表示するデータフィールドを指定します。
+	// nil の場合は、データ名が設定されているか値が存在するフィールドを全て表示します。
+	Fields []ambidata.Field
+
+	// Location は時刻を表示するタイムゾーンを指定します。
+	// nil の場合は、 [time.Local] が使用されます。
+	Location *time.Location
+
+	// TimeFormat は時刻の書式を [time.Time.Format] の形式で指定します。
+	// 空文字列の場合は、 [DefaultTimeFormat] が使用されます。
+	TimeFormat string
+
+	// Color が true の場合、フィールド名とスパークラインを ANSI エスケープシーケンスで色付けします。
+	// 色は [ambidata.FieldColor] を 256 色パレットで近似したものです。
+	Color bool
+
+	// SparkWidth はスパークラインの最大文字数を指定します。
+	// データ数がこれを超える場合、複数のデータポイントを平均して1文字にまとめます。
+	// 0 以下の場合は、データ数と同じ文字数になります。
+	SparkWidth int
+}
+
+// Render は f からチャネル情報と最新 n 件のデータを取得し、表とスパークラインを w に書き込みます。
+// opt が nil の場合は、デフォルトの設定が使用されます。
+func Render(ctx context.Context, w io.Writer, f *ambidata.Fetcher, n int, opt *Options) error {
+	info, err := f.GetChannel(ctx)
+	if err != nil {
+		return err
+	}
+	arr, err := f.FetchRange(ctx, n, 0)
+	if err != nil {
+		return err
+	}
+
+	err = WriteTable(w, &info, arr, opt)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, "\n"); err != nil {
+		return err
+	}
+	return WriteSparklines(w, &info, arr, opt)
+}
+
+// WriteTable はデータ arr を列を揃えた表として w に書き込みます。
+// 列見出しにはチャネル情報 info のデータ名が使用されます。
+// データは古いものから新しいものの順に並べて表示されます。
+// opt が nil の場合は、デフォルトの設定が使用されます。
+func WriteTable(w io.Writer, info *ambidata.ChannelInfo, arr []ambidata.Data, opt *Options) error {
+	opt = normalize(opt)
+	arr = sortData(arr)
+	fields := selectFields(info, arr, opt)
+
+	hasCmnt := slices.ContainsFunc(arr, func(d ambidata.Data) bool { return d.Cmnt != "" })
+
+	header := []string{"created"}
+	colors := []string{""}
+	right := []bool{false}
+	for _, f := range fields {
+		header = append(header, fieldName(info, f))
+		colors = append(colors, fieldEscape(info, f, opt))
+		right = append(right, true)
+	}
+	if hasCmnt {
+		header = append(header, "cmnt")
+		colors = append(colors, "")
+		right = append(right, false)
+	}
+
+	rows := [][]string{header}
+	for i := range arr {
+		row := []string{arr[i].Created.In(opt.Location).Format(opt.TimeFormat)}
+		for _, f := range fields {
+			row = append(row, formatValue(arr[i].Field(f)))
+		}
+		if hasCmnt {
+			row = append(row, arr[i].Cmnt)
+		}
+		rows = append(rows, row)
+	}
+
+	widths := make([]int, len(header))
+	for _, row := range rows {
+		for j, cell := range row {
+			widths[j] = max(widths[j], stringWidth(cell))
+		}
+	}
+
+	b := bufio.NewWriter(w)
+	for i, row := range rows {
+		line := &strings.Builder{}
+		for j, cell := range row {
+			if j > 0 {
+				line.WriteString("  ")
+			}
+			pad := strings.Repeat(" ", widths[j]-stringWidth(cell))
+			if i == 0 && colors[j] != "" {
+				cell = colors[j] + cell + ansiReset
+			}
+			if right[j] {
+				line.WriteString(pad + cell)
+			} else {
+				line.WriteString(cell + pad)
+			}
+		}
+		b.WriteString(strings.TrimRight(line.String(), " "))
+		b.WriteByte('\n')
+	}
+	return b.Flush()
+}
+
+// WriteSparklines はデータ arr をフィールドごとのスパークラインとして w に書き込みます。
+// 各行にはデータ名、スパークライン、最小値、最大値、最新値が表示されます。
+// opt が nil の場合は、デフォルトの設定が使用されます。
+func WriteSparklines(w io.Writer, info *ambidata.ChannelInfo, arr []ambidata.Data, opt *Options) error {
+	opt = normalize(opt)
+	arr = sortData(arr)
+	fields := selectFields(info, arr, opt)
+
+	names := make([]string, len(fields))
+	width := 0
+	for i, f := range fields {
+		names[i] = fieldName(info, f)
+		width = max(width, stringWidth(names[i]))
+	}
+
+	b := bufio.NewWriter(w)
+	for i, f := range fields {
+		vals := make([]ambidata.Maybe[float64], len(arr))
+		for j := range arr {
+			vals[j] = arr[j].Field(f)
+		}
+		spark := Sparkline(resample(vals, opt.SparkWidth))
+
+		esc := fieldEscape(info, f, opt)
+		pad := strings.Repeat(" ", width-stringWidth(names[i]))
+		if esc != "" {
+			fmt.Fprintf(b, "%s%s%s%s  %s%s%s", esc, names[i], ansiReset, pad, esc, spark, ansiReset)
+		} else {
+			fmt.Fprintf(b, "%s%s  %s", names[i], pad, spark)
+		}
+
+		lo, hi, last, ok := summary(vals)
+		if ok {
+			fmt.Fprintf(b, "  min=%s max=%s last=%s", formatFloat(lo), formatFloat(hi), formatFloat(last))
+		}
+		b.WriteByte('\n')
+	}
+	return b.Flush()
+}
+
+var sparkRunes = []rune("▁▂▃▄▅▆▇█")
+
+// Sparkline は値の列を Unicode のブロック文字によるスパークラインに変換します。
+// 値が無い要素は空白になります。
+func Sparkline(vals []ambidata.Maybe[float64]) string {
+	lo, hi, _, ok := summary(vals)
+
+	b := &strings.Builder{}
+	for _, v := range vals {
+		if !v.OK || !ok || math.IsNaN(v.V) || math.IsInf(v.V, 0) {
+			b.WriteByte(' ')
+			continue
+		}
+		i := len(sparkRunes) / 2
+		if hi > lo {
+			r := (v.V - lo) / (hi - lo)
+			if math.IsInf(hi-lo, 0) {
+				// 範囲の幅が float64 で表せない場合は、半分に縮めて比率を求める
+				r = (v.V/2 - lo/2) / (hi/2 - lo/2)
+			}
+			i = int(r * float64(len(sparkRunes)-1))
+			i = min(max(i, 0), len(sparkRunes)-1)
+		}
+		b.WriteRune(sparkRunes[i])
+	}
+	return b.String()
+}
+
+// resample は vals を最大 width 個の要素にまとめます。
+// まとめられた要素の値は、値が存在する要素の平均となります。
+func resample(vals []ambidata.Maybe[float64], width int) []ambidata.Maybe[float64] {
+	if width <= 0 || len(vals) <= width {
+		return vals
+	}
+
+	out := make([]ambidata.Maybe[float64], width)
+	for i := range out {
+		stt := i * len(vals) / width
+		end := (i + 1) * len(vals) / width
+		var sum float64
+		var n int
+		for _, v := range vals[stt:end] {
+			if v.OK {
+				sum += v.V
+				n++
+			}
+		}
+		if n > 0 {
+			out[i] = ambidata.Just(sum / float64(n))
+		}
+	}
+	return out
+}
+
+func summary(vals []ambidata.Maybe[float64]) (lo, hi, last float64, ok bool) {
+	for _, v := range vals {
+		if !v.OK || math.IsNaN(v.V) || math.IsInf(v.V, 0) {
+			continue
+		}
+		if !ok {
+			lo, hi = v.V, v.V
+			ok = true
+		}
+		lo = math.Min(lo, v.V)
+		hi = math.Max(hi, v.V)
+		last = v.V
+	}
+	return
+}
+
+func normalize(opt *Options) *Options {
+	var o Options
+	if opt != nil {
+		o = *opt
+	}
+	if o.Location == nil {
+		o.Location = time.Local
+	}
+	if o.TimeFormat == "" {
+		o.TimeFormat = DefaultTimeFormat
+	}
+	return &o
+}
+
+// sortData は arr を古いものから新しいものの順に並べ替えたコピーを返します。
+func sortData(arr []ambidata.Data) []ambidata.Data {
+	arr = slices.Clone(arr)
+	slices.SortStableFunc(arr, func(a, b ambidata.Data) int {
+		return a.Created.Compare(b.Created)
+	})
+	return arr
+}
+
+func selectFields(info *ambidata.ChannelInfo, arr []ambidata.Data, opt *Options) []ambidata.Field {
+	if opt.Fields != nil {
+		return opt.Fields
+	}
+
+	var fields []ambidata.Field
+	for _, f := range ambidata.Fields {
+		if info.Field(f).Name != "" || slices.ContainsFunc(arr, func(d ambidata.Data) bool { return d.Field(f).OK }) {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+func fieldName(info *ambidata.ChannelInfo, f ambidata.Field) string {
+	if name := info.Field(f).Name; name != "" {
+		return name
+	}
+	return f.String()
+}
+
+func formatValue(v ambidata.Maybe[float64]) string {
+	if !v.OK {
+		return "-"
+	}
+	return formatFloat(v.V)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+const ansiReset = "\x1b[0m"
+
+// fieldEscape はフィールドの色に対応する ANSI エスケープシーケンスを返します。
+// 色付けが無効な場合は空文字列を返します。
+func fieldEscape(info *ambidata.ChannelInfo, f ambidata.Field, opt *Options) string {
+	if !opt.Color {
+		return ""
+	}
+	rgba, ok := info.Field(f).Color.ToRGBA()
+	if !ok {
+		rgba, _ = ambidata.FieldColor(strconv.Itoa(int(f))).ToRGBA()
+	}
+	return "\x1b[38;5;" + strconv.Itoa(ansi256(rgba.R, rgba.G, rgba.B)) + "m"
+}
+
+// ansi256 は RGB 値を ANSI 256 色パレットの 6x6x6 カラーキューブの色番号に近似します。
+func ansi256(r, g, b uint8) int {
+	q := func(v uint8) int { return (int(v)*5 + 127) / 255 }
+	return 16 + 36*q(r) + 6*q(g) + q(b)
+}
+
+// stringWidth は端末上での文字列の表示幅を返します。
+// 東アジアの全角文字は幅2として数えます。
+func stringWidth(s string) int {
+	n := 0
+	for len(s) > 0 {
+		r, size := utf8.DecodeRuneInString(s)
+		s = s[size:]
+		if isWide(r) {
+			n += 2
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+func isWide(r rune) bool {
+	return (0x1100 <= r && r <= 0x115F) ||
+		(0x2E80 <= r && r <= 0xA4CF && r != 0x303F) ||
+		(0xAC00 <= r && r <= 0xD7A3) ||
+		(0xF900 <= r && r <= 0xFAFF) ||
+		(0xFE30 <= r && r <= 0xFE4F) ||
+		(0xFF00 <= r && r <= 0xFF60) ||
+		(0xFFE0 <= r && r <= 0xFFE6) ||
+		(0x20000 <= r && r <= 0x3FFFD)
+}
@@ -0,0 +1,160 @@
+package termview
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gcrtnst/ambidata"
+)
+
+var testInfo = ambidata.ChannelInfo{
+	D1: ambidata.FieldInfo{Name: "温度", Color: ambidata.FieldColorRed},
+	D3: ambidata.FieldInfo{Name: "humidity"},
+}
+
+func testData() []ambidata.Data {
+	base := time.Date(2006, 1, 2, 15, 0, 0, 0, time.UTC)
+	return []ambidata.Data{
+		{Created: base.Add(2 * time.Minute), D1: ambidata.Just(22.5), D3: ambidata.Just(40.0), Cmnt: "ok"},
+		{Created: base.Add(1 * time.Minute), D3: ambidata.Just(45.0)},
+		{Created: base, D1: ambidata.Just(20.0), D3: ambidata.Just(50.0)},
+	}
+}
+
+func TestWriteTable(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteTable(&buf, &testInfo, testData(), &Options{Location: time.UTC})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	want := "" +
+		"created              温度  humidity  cmnt\n" +
+		"2006-01-02 15:00:00    20        50\n" +
+		"2006-01-02 15:01:00     -        45\n" +
+		"2006-01-02 15:02:00  22.5        40  ok\n"
+	if got := buf.String(); got != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, got)
+	}
+}
+
+func TestWriteTableColor(t *testing.T) {
+	var buf bytes.Buffer
+	opt := &Options{Location: time.UTC, Fields: []ambidata.Field{ambidata.FieldD1}, Color: true}
+	err := WriteTable(&buf, &testInfo, testData(), opt)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// #DC3912 -> (4, 1, 0) -> 16 + 144 + 6 + 0
+	want := "\x1b[38;5;166m温度\x1b[0m"
+	if got := buf.String(); !strings.Contains(got, want) {
+		t.Errorf("expected to contain %#v, got %#v", want, got)
+	}
+}
+
+func TestWriteSparklines(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteSparklines(&buf, &testInfo, testData(), &Options{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	want := "" +
+		"温度      ▁ █  min=20 max=22.5 last=22.5\n" +
+		"humidity  █▄▁  min=40 max=50 last=40\n"
+	if got := buf.String(); got != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, got)
+	}
+}
+
+func TestSparkline(t *testing.T) {
+	tt := []struct {
+		name string
+		in   []ambidata.Maybe[float64]
+		want string
+	}{
+		{name: "Empty", in: nil, want: ""},
+		{name: "Flat", in: []ambidata.Maybe[float64]{ambidata.Just(1.0), ambidata.Just(1.0)}, want: "▅▅"},
+		{name: "Gap", in: []ambidata.Maybe[float64]{ambidata.Just(0.0), {}, ambidata.Just(7.0)}, want: "▁ █"},
+		{name: "Ramp", in: []ambidata.Maybe[float64]{ambidata.Just(0.0), ambidata.Just(1.0), ambidata.Just(2.0), ambidata.Just(3.0), ambidata.Just(4.0), ambidata.Just(5.0), ambidata.Just(6.0), ambidata.Just(7.0)}, want: "▁▂▃▄▅▆▇█"},
+		{name: "Huge", in: []ambidata.Maybe[float64]{ambidata.Just(-math.MaxFloat64), ambidata.Just(0.0), ambidata.Just(math.MaxFloat64)}, want: "▁▄█"},
+	}
+
+	for _, tc := range tt {
+		if got := Sparkline(tc.in); got != tc.want {
+			t.Errorf("%s: expected %#v, got %#v", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestResample(t *testing.T) {
+	in := []ambidata.Maybe[float64]{ambidata.Just(1.0), ambidata.Just(3.0), {}, {}, ambidata.Just(5.0), {}}
+	got := resample(in, 3)
+	want := []ambidata.Maybe[float64]{ambidata.Just(2.0), {}, ambidata.Just(5.0)}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("%d: expected %#v, got %#v", i, want[i], got[i])
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	const inCh = "83601"
+	const chBody = `{"ch":"83601","d1":{"name":"temp","color":"2"}}`
+	const dataBody = `[{"d1":2,"created":"2006-01-02T15:01:00.000Z"},{"d1":1,"created":"2006-01-02T15:00:00.000Z"}]`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var gotN string
+	mux := http.NewServeMux()
+	mux.Handle("/", http.NotFoundHandler())
+	mux.HandleFunc("GET /api/v2/channels/"+inCh+"/{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(chBody))
+	})
+	mux.HandleFunc("GET /api/v2/channels/"+inCh+"/data", func(w http.ResponseWriter, r *http.Request) {
+		gotN = r.URL.Query().Get("n")
+		w.Write([]byte(dataBody))
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+
+	f := &ambidata.Fetcher{
+		Ch:      inCh,
+		ReadKey: "74545caba2bfd44f",
+		Config: &ambidata.Config{
+			Scheme: srvURL.Scheme,
+			Host:   srvURL.Host,
+			Client: srv.Client(),
+		},
+	}
+
+	var buf bytes.Buffer
+	err := Render(ctx, &buf, f, 2, &Options{Location: time.UTC})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if gotN != "2" {
+		t.Errorf("request: n: expected %#v, got %#v", "2", gotN)
+	}
+
+	want := "" +
+		"created              temp\n" +
+		"2006-01-02 15:00:00     1\n" +
+		"2006-01-02 15:01:00     2\n" +
+		"\n" +
+		"temp  ▁█  min=1 max=2 last=2\n"
+	if got := buf.String(); got != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, got)
+	}
+}